@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"dscheirer.com/piclock/sevenseg_backpack"
+)
+
+// one step of an animation, either text or raw segment masks
+type animationFrame struct {
+	text       string
+	masks      []byte // one per digit, used when text is empty
+	duration   time.Duration
+	brightness int // -1 leaves it alone
+	blink      int // -1 leaves it alone
+}
+
+type animation struct {
+	name   string
+	frames []animationFrame
+	loop   bool
+}
+
+const sName string = "name"
+const sFrames string = "frames"
+const sLoop string = "loop"
+const sText string = "text"
+const sMasks string = "masks"
+const sBlinkRate string = "blink"
+
+// per-alarm options (see parseAlarmOptions) that pick an animation
+const optAnimation string = "anim"
+const optCountdown string = "countdown"
+
+const dAnimationFrame time.Duration = 100 * time.Millisecond
+
+// the built-ins, in the same format as the "animations" setting.  strobe
+// and dashes are what alarm mode always did, one segment per effects loop
+// and the alternating dashes.
+const builtinAnimations string = `[
+	{"name": "strobe", "loop": true, "frames": [
+		{"masks": ["0x01", "0x01", "0x01", "0x01"], "duration": "10ms"},
+		{"masks": ["0x02", "0x02", "0x02", "0x02"], "duration": "10ms"},
+		{"masks": ["0x04", "0x04", "0x04", "0x04"], "duration": "10ms"},
+		{"masks": ["0x08", "0x08", "0x08", "0x08"], "duration": "10ms"},
+		{"masks": ["0x10", "0x10", "0x10", "0x10"], "duration": "10ms"},
+		{"masks": ["0x20", "0x20", "0x20", "0x20"], "duration": "10ms"}
+	]},
+	{"name": "dashes", "loop": true, "frames": [
+		{"text": "_-_-", "duration": "1s"},
+		{"text": "-_-_", "duration": "1s"}
+	]},
+	{"name": "spinner", "loop": true, "frames": [
+		{"masks": ["0x01", "0x00", "0x00", "0x00"]},
+		{"masks": ["0x00", "0x01", "0x00", "0x00"]},
+		{"masks": ["0x00", "0x00", "0x01", "0x00"]},
+		{"masks": ["0x00", "0x00", "0x00", "0x01"]},
+		{"masks": ["0x00", "0x00", "0x00", "0x02"]},
+		{"masks": ["0x00", "0x00", "0x00", "0x04"]},
+		{"masks": ["0x00", "0x00", "0x00", "0x08"]},
+		{"masks": ["0x00", "0x00", "0x08", "0x00"]},
+		{"masks": ["0x00", "0x08", "0x00", "0x00"]},
+		{"masks": ["0x08", "0x00", "0x00", "0x00"]},
+		{"masks": ["0x10", "0x00", "0x00", "0x00"]},
+		{"masks": ["0x20", "0x00", "0x00", "0x00"]}
+	]},
+	{"name": "fill", "loop": true, "frames": [
+		{"text": "8   ", "duration": "250ms"},
+		{"text": "88  ", "duration": "250ms"},
+		{"text": "888 ", "duration": "250ms"},
+		{"text": "8888", "duration": "500ms", "brightness": 15},
+		{"text": "    ", "duration": "250ms"}
+	]},
+	{"name": "sweep", "loop": true, "frames": [
+		{"masks": ["0x30", "0x00", "0x00", "0x00"]},
+		{"masks": ["0x06", "0x00", "0x00", "0x00"]},
+		{"masks": ["0x00", "0x30", "0x00", "0x00"]},
+		{"masks": ["0x00", "0x06", "0x00", "0x00"]},
+		{"masks": ["0x00", "0x00", "0x30", "0x00"]},
+		{"masks": ["0x00", "0x00", "0x06", "0x00"]},
+		{"masks": ["0x00", "0x00", "0x00", "0x30"]},
+		{"masks": ["0x00", "0x00", "0x00", "0x06"]},
+		{"masks": ["0x00", "0x00", "0x00", "0x30"]},
+		{"masks": ["0x00", "0x00", "0x06", "0x00"]},
+		{"masks": ["0x00", "0x00", "0x30", "0x00"]},
+		{"masks": ["0x00", "0x06", "0x00", "0x00"]},
+		{"masks": ["0x00", "0x30", "0x00", "0x00"]},
+		{"masks": ["0x06", "0x00", "0x00", "0x00"]}
+	]}
+]`
+
+var animations = map[string]animation{}
+
+func init() {
+	var data interface{}
+	if err := json.Unmarshal([]byte(builtinAnimations), &data); err != nil {
+		panic(err)
+	}
+	builtins, err := toAnimations(data)
+	if err != nil {
+		panic(err)
+	}
+	for _, anim := range builtins {
+		animations[anim.name] = anim
+	}
+}
+
+func toAnimationFrame(result interface{}) (animationFrame, error) {
+	rt, ok := result.(map[string]interface{})
+	if !ok {
+		return animationFrame{}, fmt.Errorf("Could not convert type %T (%v)", result, result)
+	}
+	frame := animationFrame{duration: dAnimationFrame, brightness: -1, blink: -1}
+	var err error
+	if rt[sText] != nil {
+		if frame.text, err = toString(rt[sText]); err != nil {
+			return frame, err
+		}
+	} else if rt[sMasks] != nil {
+		if frame.masks, err = toUInt8Array(rt[sMasks]); err != nil {
+			return frame, err
+		}
+		if len(frame.masks) > 4 {
+			return frame, fmt.Errorf("Too many masks in frame: %v", frame.masks)
+		}
+	}
+	if rt[sDuration] != nil {
+		if frame.duration, err = toDuration(rt[sDuration]); err != nil {
+			return frame, err
+		}
+		if frame.duration <= 0 {
+			return frame, fmt.Errorf("Frame duration must be positive: %v", frame.duration)
+		}
+	}
+	if rt[sBrightness] != nil {
+		if frame.brightness, err = toInt(rt[sBrightness]); err != nil {
+			return frame, err
+		}
+	}
+	if rt[sBlinkRate] != nil {
+		if frame.blink, err = toInt(rt[sBlinkRate]); err != nil {
+			return frame, err
+		}
+	}
+	return frame, nil
+}
+
+func toAnimation(result interface{}) (animation, error) {
+	rt, ok := result.(map[string]interface{})
+	if !ok {
+		return animation{}, fmt.Errorf("Could not convert type %T (%v)", result, result)
+	}
+	name, err := toString(rt[sName])
+	if err != nil {
+		return animation{}, err
+	}
+	ret := animation{name: name}
+	if rt[sLoop] != nil {
+		if ret.loop, err = toBool(rt[sLoop]); err != nil {
+			return ret, err
+		}
+	}
+	frames, ok := rt[sFrames].([]interface{})
+	if !ok || len(frames) == 0 {
+		return ret, fmt.Errorf("Animation %s has no frames", name)
+	}
+	ret.frames = make([]animationFrame, len(frames))
+	for i := range frames {
+		if ret.frames[i], err = toAnimationFrame(frames[i]); err != nil {
+			return ret, err
+		}
+	}
+	return ret, nil
+}
+
+func toAnimations(result interface{}) ([]animation, error) {
+	switch rt := result.(type) {
+	case []animation:
+		return rt, nil
+	case []interface{}:
+		anims := make([]animation, len(rt))
+		for i := range rt {
+			var err error
+			anims[i], err = toAnimation(rt[i])
+			if err != nil {
+				return anims, err
+			}
+		}
+		return anims, nil
+	default:
+		return nil, fmt.Errorf("Could not convert type %T (%v)", rt, rt)
+	}
+}
+
+// findAnimation looks in the "animations" setting, then the built-ins
+func findAnimation(rt runtimeConfig, name string) (animation, bool) {
+	for _, anim := range rt.settings.GetAnimations(sAnimations) {
+		if anim.name == name {
+			return anim, true
+		}
+	}
+	anim, ok := animations[name]
+	return anim, ok
+}
+
+// alarmAnimation picks the animation for an alarm, the alarm's own
+// choice wins over the setting
+func alarmAnimation(rt runtimeConfig, alm *alarm) string {
+	if name := alm.option(optAnimation); name != "" {
+		return name
+	}
+	if name := rt.settings.GetString(sAlarmAnimation); name != "" {
+		return name
+	}
+	if rt.settings.GetBool(sStrobe) {
+		return "strobe"
+	}
+	return "dashes"
+}
+
+// countdownAnimation - empty means the usual numeric countdown
+func countdownAnimation(rt runtimeConfig, alm *alarm) string {
+	if name := alm.option(optCountdown); name != "" {
+		return name
+	}
+	return rt.settings.GetString(sCountdownAnimation)
+}
+
+// animationPlayer steps through an animation off rt.clock, drawing a
+// frame only when it changes
+type animationPlayer struct {
+	anim   animation
+	start  time.Time
+	total  time.Duration
+	frame  int  // last frame drawn, -1 before the first
+	bright bool // the last frame set the brightness
+	blink  bool // the last frame set the blink rate
+}
+
+func newAnimationPlayer(rt runtimeConfig, name string) *animationPlayer {
+	anim, ok := findAnimation(rt, name)
+	if !ok {
+		rt.logger.Printf("Unknown animation: %s", name)
+		anim = animations["dashes"]
+	}
+	rt.logger.Printf("Animation: %s", anim.name)
+	p := &animationPlayer{anim: anim, start: rt.clock.Now(), frame: -1}
+	for _, f := range anim.frames {
+		p.total += f.duration
+	}
+	return p
+}
+
+// frameAt returns the frame index for elapsed time, -1 when it is over
+func (p *animationPlayer) frameAt(elapsed time.Duration) int {
+	if elapsed >= p.total {
+		if !p.anim.loop {
+			return -1
+		}
+		elapsed %= p.total
+	}
+	for i, f := range p.anim.frames {
+		if elapsed < f.duration {
+			return i
+		}
+		elapsed -= f.duration
+	}
+	return len(p.anim.frames) - 1
+}
+
+// render draws the current frame, returns false once a non-looping
+// animation has finished
+func (p *animationPlayer) render(rt runtimeConfig) bool {
+	frame := p.frameAt(rt.clock.Now().Sub(p.start))
+	if frame < 0 {
+		return false
+	}
+	if frame == p.frame {
+		return true
+	}
+	p.frame = frame
+	f := p.anim.frames[frame]
+
+	// a frame without a brightness or blink rate has the usual one
+	if f.brightness >= 0 {
+		rt.display.SetBrightness(uint8(f.brightness))
+	} else if p.bright {
+		rt.display.SetBrightness(uint8(rt.settings.GetInt(sBrightness)))
+	}
+	if f.blink >= 0 {
+		rt.display.SetBlinkRate(uint8(f.blink))
+	} else if p.blink {
+		rt.display.SetBlinkRate(sevenseg_backpack.BLINK_OFF)
+	}
+	p.bright = f.brightness >= 0
+	p.blink = f.blink >= 0
+
+	if f.text != "" {
+		if err := rt.display.Print(f.text); err != nil {
+			rt.logger.Printf("Error: %s\n", err.Error())
+		}
+		return true
+	}
+
+	// build the whole frame before showing it
+	rt.display.RefreshOn(false)
+	rt.display.ClearDisplay()
+	for pos, mask := range f.masks {
+		for seg := 0; seg < 8; seg++ {
+			if mask&(1<<uint(seg)) != 0 {
+				rt.display.SegmentOn(byte(pos), byte(seg), true)
+			}
+		}
+	}
+	rt.display.RefreshOn(true)
+	return true
+}
+
+// stop puts back anything the animation changed
+func (p *animationPlayer) stop(rt runtimeConfig) {
+	rt.display.SetBrightness(uint8(rt.settings.GetInt(sBrightness)))
+	rt.display.SetBlinkRate(sevenseg_backpack.BLINK_OFF)
+}
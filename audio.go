@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// audio backends, the "audioBackend" setting
+const (
+	audioMpg123  = "mpg123"
+	audioAplay   = "aplay"
+	audioFfplay  = "ffplay"
+	audioCommand = "command"
+	audioWav     = "wav"
+)
+
+// replaced by {file} in a command template
+const audioFileArg = "{file}"
+
+// the players read a stream from stdin
+const audioStdin = "-"
+
+// how long the audio error stays on the display
+const dAudioError time.Duration = 10 * time.Second
+
+// the command templates for the named players, {volume} (0 - 100) and
+// {scale} (mpg123's 0 - 32768) carry the software volume.  aplay has no
+// volume so it needs the amixer control.
+var audioPlayers = map[string]string{
+	audioMpg123: "mpg123 -q -f {scale} {file}",
+	audioAplay:  "aplay -q {file}",
+	audioFfplay: "ffplay -nodisp -autoexit -loglevel error -volume {volume} {file}",
+}
+
+// audioBackend starts playing a file, it does not loop or wait
+type audioBackend interface {
+	start(rt runtimeConfig, fName string) (audioProcess, error)
+	// stream plays body (a radio stream) until it ends or is killed
+	stream(rt runtimeConfig, body io.ReadCloser) (audioProcess, error)
+}
+
+// audioProcess is one file playing
+type audioProcess interface {
+	// wait blocks until the file is done, or kill is called
+	wait() error
+	kill()
+	// pause and resume hold the audio while something is announced
+	pause()
+	resume()
+	// setGain changes the software volume (0 - 1) while it plays
+	setGain(gain float64)
+}
+
+// newAudioBackend builds the backend named in the settings
+func newAudioBackend(settings configSettings) (audioBackend, error) {
+	name := settings.GetString(sAudioBackend)
+	switch name {
+	case audioMpg123, audioAplay, audioFfplay:
+		return newCommandBackend(audioPlayers[name])
+	case audioCommand:
+		return newCommandBackend(settings.GetString(sAudioCommand))
+	case audioWav:
+		if settings.GetString(sAudioSink) == "" {
+			return nil, fmt.Errorf("The %s audio backend needs %s", audioWav, sAudioSink)
+		}
+		return &wavBackend{sink: settings.GetString(sAudioSink), decoder: settings.GetString(sAudioDecoder)}, nil
+	default:
+		return nil, fmt.Errorf("Unknown audio backend: %s", name)
+	}
+}
+
+// wavAudioBackend is the backend for WAV files, mpg123 only does MPEG
+// so aplay stands in for it
+func wavAudioBackend(settings configSettings) (audioBackend, error) {
+	if settings.GetString(sAudioBackend) == audioMpg123 {
+		return newCommandBackend(audioPlayers[audioAplay])
+	}
+	return newAudioBackend(settings)
+}
+
+// commandBackend runs an external player, args is the template split on spaces
+type commandBackend struct {
+	args []string
+}
+
+func newCommandBackend(template string) (*commandBackend, error) {
+	args := strings.Fields(template)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Empty audio command")
+	}
+	if !strings.Contains(template, audioFileArg) {
+		args = append(args, audioFileArg)
+	}
+	return &commandBackend{args: args}, nil
+}
+
+func (cb *commandBackend) command(fName string, tokens map[string]string) []string {
+	args := make([]string, len(cb.args))
+	for i, arg := range cb.args {
+		args[i] = strings.Replace(arg, audioFileArg, fName, -1)
+		for token, value := range tokens {
+			args[i] = strings.Replace(args[i], token, value, -1)
+		}
+	}
+	return args
+}
+
+func (cb *commandBackend) start(rt runtimeConfig, fName string) (audioProcess, error) {
+	return cb.run(rt, fName, nil)
+}
+
+func (cb *commandBackend) stream(rt runtimeConfig, body io.ReadCloser) (audioProcess, error) {
+	return cb.run(rt, audioStdin, body)
+}
+
+func (cb *commandBackend) run(rt runtimeConfig, fName string, stdin io.ReadCloser) (audioProcess, error) {
+	args := cb.command(fName, volumeArgs(rt))
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(path, args[1:]...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	rt.logger.Printf("Started %s", strings.Join(args, " "))
+	return &commandProcess{cmd: cmd, stdin: stdin}, nil
+}
+
+type commandProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.ReadCloser // the stream being played, if any
+	lock   sync.Mutex
+	killed bool
+}
+
+func (cp *commandProcess) wait() error {
+	err := cp.cmd.Wait()
+	if cp.stdin != nil {
+		cp.stdin.Close()
+	}
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	if cp.killed {
+		// we did that, not a failure
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", cp.cmd.Args[0], err.Error())
+	}
+	return nil
+}
+
+func (cp *commandProcess) kill() {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	cp.killed = true
+	cp.cmd.Process.Kill()
+}
+
+func (cp *commandProcess) pause() {
+	cp.cmd.Process.Signal(syscall.SIGSTOP)
+}
+
+func (cp *commandProcess) resume() {
+	cp.cmd.Process.Signal(syscall.SIGCONT)
+}
+
+// setGain does nothing, the volume went on the player's command line when
+// it started (see liveGain)
+func (cp *commandProcess) setGain(gain float64) {
+}
+
+// audioError - tell the effects thread the audio failed
+func audioError(err error) displayEffect {
+	return displayEffect{id: eAudioError, val: err.Error()}
+}
+
+// reportAudio records how the last play went, the error LED gets its
+// own blink so it is not confused with a config or network problem
+func reportAudio(rt runtimeConfig, err error) {
+	hadError := rt.status.getAudioError() != ""
+	if err == nil {
+		rt.status.setAudioError("")
+		if hadError {
+			rt.comms.leds <- ledOff(rt.settings.GetInt(sLEDErr))
+		}
+		return
+	}
+	rt.logger.Printf("Audio error: %s", err.Error())
+	rt.status.setAudioError(err.Error())
+	rt.comms.leds <- ledMessage(rt.settings.GetInt(sLEDErr), modeBlink10, 0)
+	rt.comms.effects <- audioError(err)
+}
+
+// playAudio plays one file, looping it "playRepeat" times when asked
+func playAudio(rt runtimeConfig, backend audioBackend, fName string, loop bool, stop chan bool, done chan bool) {
+	opts := playOptions{repeat: 1}
+	if loop {
+		opts.repeat = rt.settings.GetInt(sPlayRepeat)
+	}
+	playTracks(rt, backend, []string{fName}, opts, stop, done)
+}
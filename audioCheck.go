@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	wg.Add(1)
+}
+
+// where ALSA lists the sound cards, a var so the tests can swap it
+var soundCards = "/proc/asound/cards"
+
+// audio errors from the check start with this, so a good check only
+// clears what a bad one reported
+const audioCheckFailed = "Audio check"
+
+// hold the long button this long to hear a test sound
+const dTestSoundHold time.Duration = 3 * time.Second
+
+// how long the test sound plays
+const dTestSound time.Duration = 3 * time.Second
+
+// audioHealth - the result of the last check, for the status API
+type audioHealth struct {
+	Checked  time.Time `json:"checked"` // zero when it never ran
+	Problems []string  `json:"problems"`
+}
+
+// checkPlayer - is the program a command backend runs installed?
+func checkPlayer(backend audioBackend, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	cb, ok := backend.(*commandBackend)
+	if !ok {
+		return ""
+	}
+	if _, err := exec.LookPath(cb.args[0]); err != nil {
+		return fmt.Sprintf("Player %s not found", cb.args[0])
+	}
+	return ""
+}
+
+// checkSoundCard - is there a card to play on, the one in "audioDevice"
+// if it is set?
+func checkSoundCard(device string) string {
+	data, err := ioutil.ReadFile(soundCards)
+	if err != nil {
+		return fmt.Sprintf("No sound cards: %s", err.Error())
+	}
+	cards := string(data)
+	if strings.TrimSpace(cards) == "" || strings.Contains(cards, "no soundcards") {
+		return "No sound cards"
+	}
+	if device != "" && !strings.Contains(cards, device) {
+		return fmt.Sprintf("Sound card %s not found", device)
+	}
+	return ""
+}
+
+// checkTrack - is the track there, and does it have any audio in it?
+func checkTrack(rt runtimeConfig, name string) string {
+	fName, ok := findTrack(rt, name)
+	if !ok {
+		return fmt.Sprintf("Fallback track '%s' not found", name)
+	}
+	tags, err := readTags(fName)
+	if err != nil {
+		return fmt.Sprintf("Fallback track %s: %s", filepath.Base(fName), err.Error())
+	}
+	if tags.duration <= 0 {
+		return fmt.Sprintf("Fallback track %s does not decode", filepath.Base(fName))
+	}
+	return ""
+}
+
+// checkAudio looks for what would make an alarm silent: a missing player
+// or mixer, no sound card, nowhere to write the tones, or a fallback that
+// will not play
+func checkAudio(rt runtimeConfig) []string {
+	settings := rt.settings
+	problems := []string{}
+	add := func(problem string) {
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	backend, err := newAudioBackend(settings)
+	add(checkPlayer(backend, err))
+	if settings.GetString(sAudioBackend) == audioMpg123 {
+		// tones and speech go to aplay
+		add(checkPlayer(wavAudioBackend(settings)))
+	}
+	if _, ok := backend.(*commandBackend); ok {
+		add(checkSoundCard(settings.GetString(sAudioDevice)))
+	}
+	if wb, ok := backend.(*wavBackend); ok {
+		if _, err := os.Stat(filepath.Dir(wb.sink)); err != nil {
+			add(fmt.Sprintf("Audio sink: %s", err.Error()))
+		}
+	}
+	if settings.GetString(sVolumeControl) == volumeAmixer {
+		if _, err := exec.LookPath(volumeAmixer); err != nil {
+			add(fmt.Sprintf("Mixer %s not found", volumeAmixer))
+		}
+	}
+
+	// the tones are written out before they play
+	if f, err := ioutil.TempFile("", "piclock-check-*.wav"); err != nil {
+		add(fmt.Sprintf("Tones: %s", err.Error()))
+	} else {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if name := settings.GetString(sTonePattern); name != "" {
+		if _, ok := findTonePattern(rt, name); !ok {
+			add(fmt.Sprintf("Unknown tone pattern: %s", name))
+		}
+	}
+	if name := settings.GetString(sRadioFallback); name != "" {
+		add(checkTrack(rt, name))
+	}
+	return problems
+}
+
+// audioCheck runs the checks and reports a failure like any other audio
+// error, on the error LED and the display
+func audioCheck(rt runtimeConfig) audioHealth {
+	health := audioHealth{Checked: rt.clock.Now(), Problems: checkAudio(rt)}
+	rt.status.setAudioHealth(health)
+	if len(health.Problems) > 0 {
+		reportAudio(rt, fmt.Errorf("%s: %s", audioCheckFailed, strings.Join(health.Problems, "; ")))
+	} else if strings.HasPrefix(rt.status.getAudioError(), audioCheckFailed) {
+		reportAudio(rt, nil)
+	}
+	return health
+}
+
+func startAudioCheck(rt runtimeConfig) {
+	rt.logger = &ThreadLogger{name: "Audio check"}
+	go runAudioCheck(rt)
+}
+
+// runAudioCheck checks at startup and every "audioCheck" after that
+func runAudioCheck(rt runtimeConfig) {
+	defer wg.Done()
+	defer func() {
+		rt.logger.Println("Exiting runAudioCheck")
+	}()
+
+	for true {
+		select {
+		case <-rt.comms.quit:
+			rt.logger.Println("quit from runAudioCheck")
+			return
+		default:
+		}
+		if health := audioCheck(rt); len(health.Problems) == 0 {
+			rt.logger.Println("Audio check OK")
+		}
+		interval := rt.settings.GetDuration(sAudioCheck)
+		if interval <= 0 {
+			// just the once
+			<-rt.comms.quit
+			return
+		}
+		rt.clock.Sleep(interval)
+	}
+}
+
+// testSoundEffect - have the effects thread play the test sound
+func testSoundEffect() displayEffect {
+	return displayEffect{id: eTestSound, val: nil}
+}
+
+// testSound is a few seconds of the alarm tones, run by the effects
+// thread which calls step every loop
+type testSound struct {
+	stop chan bool // nil when quiet
+	ends time.Time
+	done chan bool
+}
+
+// start plays the test sound, false if it is already playing
+func (ts *testSound) start(rt runtimeConfig) bool {
+	if ts.stop != nil {
+		return false
+	}
+	pattern, ok := findTonePattern(rt, rt.settings.GetString(sTonePattern))
+	if !ok {
+		pattern = tonePatterns["beep-beep"]
+	}
+	rt.logger.Printf("Test sound %s", pattern.name)
+	ts.stop = make(chan bool, 1)
+	ts.done = make(chan bool, 1)
+	ts.ends = rt.clock.Now().Add(dTestSound)
+	rt.sounds.playIt(rt, pattern, ts.stop, ts.done)
+	return true
+}
+
+func (ts *testSound) step(rt runtimeConfig) {
+	if ts.stop != nil && !rt.clock.Now().Before(ts.ends) {
+		ts.cancel()
+	}
+}
+
+func (ts *testSound) cancel() {
+	if ts.stop == nil {
+		return
+	}
+	ts.stop <- true
+	ts.stop = nil
+}
+
+func (m *APIHandler) apiAudio(w http.ResponseWriter, r *http.Request) {
+	output, _ := json.Marshal(m.getAudioStatus())
+	w.Write(output)
+}
+
+// apiAudioCheck runs the checks now rather than waiting for the next one
+func (m *APIHandler) apiAudioCheck(w http.ResponseWriter, r *http.Request) {
+	audioCheck(m.rt)
+	m.apiAudio(w, r)
+}
+
+// apiAudioTest plays the test sound, like holding the long button
+func (m *APIHandler) apiAudioTest(w http.ResponseWriter, r *http.Request) {
+	m.rt.comms.effects <- testSoundEffect()
+	m.apiAudio(w, r)
+}
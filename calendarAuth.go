@@ -1,15 +1,22 @@
 package main
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
@@ -18,18 +25,204 @@ import (
 type gcalEvents struct {
 }
 
+// one entry in the "accounts" setting, a Google account the alarms are
+// read from
+type calendarAccount struct {
+	name     string
+	calendar string // "" -> the "calendar" setting
+	token    string // "" -> token-<name>.json next to the tokenPath
+}
+
+const sToken string = "token"
+
+// label - the account's name in logs and the status
+func (account calendarAccount) label() string {
+	if account.name == "" {
+		return "default"
+	}
+	return account.name
+}
+
+// the token file in secretPath when tokenPath is not set
+const defaultTokenFile string = "token.json"
+
+func toCalendarAccount(result interface{}) (calendarAccount, error) {
+	rt, ok := result.(map[string]interface{})
+	if !ok {
+		return calendarAccount{}, fmt.Errorf("Could not convert type %T (%v)", result, result)
+	}
+	name, err := toString(rt[sName])
+	if err != nil {
+		return calendarAccount{}, err
+	}
+	if name == "" {
+		return calendarAccount{}, fmt.Errorf("An account needs a name")
+	}
+	ret := calendarAccount{name: name}
+	// everything else is optional
+	if rt[sCalName] != nil {
+		if ret.calendar, err = toString(rt[sCalName]); err != nil {
+			return ret, err
+		}
+	}
+	if rt[sToken] != nil {
+		if ret.token, err = toString(rt[sToken]); err != nil {
+			return ret, err
+		}
+	}
+	return ret, nil
+}
+
+func toCalendarAccounts(result interface{}) ([]calendarAccount, error) {
+	switch rt := result.(type) {
+	case []calendarAccount:
+		return rt, nil
+	case []interface{}:
+		accounts := make([]calendarAccount, len(rt))
+		names := map[string]bool{}
+		for i := range rt {
+			var err error
+			accounts[i], err = toCalendarAccount(rt[i])
+			if err != nil {
+				return accounts, err
+			}
+			if names[accounts[i].name] {
+				return accounts, fmt.Errorf("Account %s is there twice", accounts[i].name)
+			}
+			names[accounts[i].name] = true
+		}
+		return accounts, nil
+	default:
+		return nil, fmt.Errorf("Could not convert type %T (%v)", rt, rt)
+	}
+}
+
+// calendarAccounts - the "accounts" setting, or the one account made of
+// the "calendar" and "tokenPath" settings when there are none
+func calendarAccounts(settings configSettings) []calendarAccount {
+	accounts := settings.GetCalendarAccounts(sAccounts)
+	if len(accounts) == 0 {
+		return []calendarAccount{{}}
+	}
+	return accounts
+}
+
+// accountCalendar - the calendar the account's alarms are in
+func accountCalendar(settings configSettings, account calendarAccount) string {
+	if account.calendar != "" {
+		return account.calendar
+	}
+	return settings.GetString(sCalName)
+}
+
+// tokenCacheFile - where the account's token is kept: its own "token",
+// then the "tokenPath" setting, then token.json in the secretPath.  a
+// named account without a token is token-<name>.json next to that.
+func tokenCacheFile(settings configSettings, account calendarAccount) string {
+	if account.token != "" {
+		return account.token
+	}
+	file := settings.GetString(sTokenPath)
+	if file == "" {
+		file = filepath.Join(settings.GetString(sSecrets), defaultTokenFile)
+	}
+	if account.name != "" {
+		file = filepath.Join(filepath.Dir(file), "token-"+account.name+".json")
+	}
+	return file
+}
+
+// legacyTokenFile - where the token was before it could be configured,
+// ~/.credentials/piclock.json of whoever ran piclock -oauth
+func legacyTokenFile() string {
+	usr, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(usr.HomeDir, ".credentials", "piclock.json")
+}
+
+// tokenKey - the key the tokens are encrypted with, nil when the
+// "tokenKey" setting is empty and they are plain JSON
+func tokenKey(settings configSettings) ([]byte, error) {
+	keyFile := settings.GetString(sTokenKey)
+	if keyFile == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return nil, fmt.Errorf("The token key %s is empty", keyFile)
+	}
+	// any length of key file makes an AES-256 key
+	key := sha256.Sum256([]byte(secret))
+	return key[:], nil
+}
+
+// sealedToken - a token file encrypted with the token key, AES-GCM with
+// the nonce in front
+type sealedToken struct {
+	Sealed []byte `json:"sealed"`
+}
+
+func sealToken(data []byte, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealedToken{Sealed: gcm.Seal(nonce, nonce, data, nil)})
+}
+
+func openToken(sealed []byte, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("The token is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
 // getClient uses a Context and Config to retrieve a Token
 // then generate a Client. It returns the generated Client.
-func getClient(ctx context.Context, config *oauth2.Config, prompt bool) (*http.Client, error) {
-	cacheFile, err := tokenCacheFile()
+func getClient(ctx context.Context, config *oauth2.Config, settings configSettings, account calendarAccount, prompt bool) (*http.Client, error) {
+	cacheFile := tokenCacheFile(settings, account)
+	key, err := tokenKey(settings)
 	if err != nil {
-		log.Printf("Unable to get path to cached credential file. %v", err)
+		return nil, err
+	}
+	tok, err := tokenFromFile(cacheFile, key)
+	if err != nil && account.name == "" {
+		// from before the tokenPath setting, move it
+		if legacy, lerr := tokenFromFile(legacyTokenFile(), nil); lerr == nil {
+			log.Printf("Moving the token from %s to %s", legacyTokenFile(), cacheFile)
+			tok, err = legacy, saveToken(cacheFile, legacy, key)
+		}
 	}
-	tok, err := tokenFromFile(cacheFile)
 	if err != nil {
 		if prompt {
-			tok = getTokenFromWeb(config)
-			saveToken(cacheFile, tok)
+			if tok, err = getTokenFromWeb(config); err != nil {
+				return nil, err
+			}
+			if err := saveToken(cacheFile, tok, key); err != nil {
+				log.Printf("Unable to cache oauth token: %v", err)
+			}
 		} else {
 			// run with -oauth to generate the token
 			return nil, err
@@ -40,7 +233,37 @@ func getClient(ctx context.Context, config *oauth2.Config, prompt bool) (*http.C
 		}
 	}
 
-	return config.Client(ctx, tok), nil
+	// the client refreshes the token as it needs to, keep the new one
+	src := &savingTokenSource{src: config.TokenSource(ctx, tok), file: cacheFile, key: key, last: tok.AccessToken}
+	return oauth2.NewClient(ctx, src), nil
+}
+
+// savingTokenSource writes a token to its file each time it is
+// refreshed, so a restart does not have to refresh it again (or find
+// the refresh token gone)
+type savingTokenSource struct {
+	src   oauth2.TokenSource
+	file  string
+	key   []byte
+	mutex sync.Mutex
+	last  string // the access token in the file
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if tok.AccessToken != s.last {
+		if err := saveToken(s.file, tok, s.key); err != nil {
+			log.Printf("Unable to save the refreshed token: %v", err)
+		} else {
+			s.last = tok.AccessToken
+		}
+	}
+	return tok, nil
 }
 
 func getAuthURL(config *oauth2.Config) string {
@@ -48,58 +271,59 @@ func getAuthURL(config *oauth2.Config) string {
 }
 
 // getTokenFromWeb uses Config to request a Token.
-// It returns the retrieved Token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
+// It returns the retrieved Token, or why there is none.
+func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
 	fmt.Printf("Go to the following link in your browser then type the "+
 		"authorization code: \n%v\n", getAuthURL(config))
 
 	var code string
 	if _, err := fmt.Scan(&code); err != nil {
-		log.Printf("Unable to read authorization code %v", err)
+		return nil, fmt.Errorf("Unable to read authorization code: %v", err)
 	}
 
 	tok, err := config.Exchange(oauth2.NoContext, code)
 	if err != nil {
-		log.Printf("Unable to retrieve token from web %v", err)
+		return nil, fmt.Errorf("Unable to retrieve token from web: %v", err)
 	}
-	return tok
+	return tok, nil
 }
 
-// tokenCacheFile generates credential file path/filename.
-// It returns the generated credential path/filename.
-func tokenCacheFile() (string, error) {
-	usr, err := user.Current()
-	if err != nil {
-		return "", err
-	}
-	tokenCacheDir := filepath.Join(usr.HomeDir, ".credentials")
-	os.MkdirAll(tokenCacheDir, 0700)
-	return filepath.Join(tokenCacheDir,
-		url.QueryEscape("piclock.json")), err
-}
-
-// tokenFromFile retrieves a Token from a given file path.
+// tokenFromFile retrieves a Token from a given file path, key decrypts
+// it (a plain token is read either way, and encrypted the next save).
 // It returns the retrieved Token and any read error encountered.
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.OpenFile(file, os.O_RDONLY, 0600)
+func tokenFromFile(file string, key []byte) (*oauth2.Token, error) {
+	data, err := ioutil.ReadFile(file)
 	if err != nil {
 		log.Printf("error opening credential file: %v", err)
 		return nil, errors.New("Could not use google calendar credentials, re-authenticate")
 	}
+	var sealed sealedToken
+	if err := json.Unmarshal(data, &sealed); err == nil && sealed.Sealed != nil {
+		if key == nil {
+			return nil, fmt.Errorf("%s is encrypted, set tokenKey", file)
+		}
+		if data, err = openToken(sealed.Sealed, key); err != nil {
+			return nil, fmt.Errorf("Could not decrypt %s: %s", file, err.Error())
+		}
+	}
 	t := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(t)
-	defer f.Close()
+	err = json.Unmarshal(data, t)
 	return t, err
 }
 
 // saveToken uses a file path to create a file and store the
-// token in it.
-func saveToken(file string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", file)
-	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+// token in it, encrypted when there is a key.
+func saveToken(file string, token *oauth2.Token, key []byte) error {
+	log.Printf("Saving credential file to: %s", file)
+	data, err := json.Marshal(token)
 	if err != nil {
-		log.Printf("Unable to cache oauth token: %v", err)
+		return err
+	}
+	if key != nil {
+		if data, err = sealToken(data, key); err != nil {
+			return err
+		}
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
+	os.MkdirAll(filepath.Dir(file), 0700)
+	return writeFileMode(file, data, 0600)
 }
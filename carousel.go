@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a carousel page produces the text to show while the clock is idle,
+// return false when there is nothing to show (e.g. no sensor)
+type carouselPage interface {
+	render(rt runtimeConfig) (string, bool)
+}
+
+// carouselPageFunc lets a plain function act as a carouselPage
+type carouselPageFunc func(rt runtimeConfig) (string, bool)
+
+func (f carouselPageFunc) render(rt runtimeConfig) (string, bool) {
+	return f(rt)
+}
+
+// one entry in the "carousel" setting
+type carouselPageConfig struct {
+	page     string
+	duration time.Duration // how long the page stays up
+	interval time.Duration // how often the page is shown
+	from     time.Duration // offset from midnight, start of the window
+	until    time.Duration // offset from midnight, end of the window (from == until -> all day)
+}
+
+const sPage string = "page"
+const sDuration string = "duration"
+const sInterval string = "interval"
+const sFrom string = "from"
+const sUntil string = "until"
+
+const dCarouselDuration time.Duration = 3 * time.Second
+const dCarouselInterval time.Duration = time.Minute
+
+var carouselDays = []string{"SUn", "Mon", "tUE", "WEd", "thU", "FrI", "SAt"}
+
+var carouselPages = map[string]carouselPage{}
+
+// registerCarouselPage makes a page available to the "carousel" setting
+func registerCarouselPage(name string, page carouselPage) {
+	carouselPages[name] = page
+}
+
+func init() {
+	registerCarouselPage("date", carouselPageFunc(dateCarouselPage))
+	registerCarouselPage("day", carouselPageFunc(dayCarouselPage))
+	registerCarouselPage("next", carouselPageFunc(nextAlarmCarouselPage))
+	registerCarouselPage("temp", carouselPageFunc(tempCarouselPage))
+	registerCarouselPage("seconds", carouselPageFunc(secondsCarouselPage))
+}
+
+func dateCarouselPage(rt runtimeConfig) (string, bool) {
+	return rt.clock.Now().Format("01.02"), true
+}
+
+func dayCarouselPage(rt runtimeConfig) (string, bool) {
+	return carouselDays[rt.clock.Now().Weekday()], true
+}
+
+func secondsCarouselPage(rt runtimeConfig) (string, bool) {
+	return fmt.Sprintf(":%02d", rt.clock.Now().Second()), true
+}
+
+func nextAlarmCarouselPage(rt runtimeConfig) (string, bool) {
+	alm := rt.status.getNextAlarm()
+	if alm == nil {
+		return "", false
+	}
+	diff := alm.When.Sub(rt.clock.Now())
+	if diff <= 0 {
+		return "", false
+	}
+	// A prefix so it does not look like the time of day
+	hours := int(diff.Hours())
+	switch {
+	case hours < 10:
+		return fmt.Sprintf("A%d:%02d", hours, int(diff.Minutes())%60), true
+	case hours < 100:
+		return fmt.Sprintf("A%dh", hours), true
+	default:
+		return fmt.Sprintf("A%dd", hours/24), true
+	}
+}
+
+func tempCarouselPage(rt runtimeConfig) (string, bool) {
+	celsius, err := readTempSensor(rt.settings.GetString(sTempSensor))
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%.1fC", celsius), true
+}
+
+// readTempSensor reads a 1-wire (DS18B20) w1_slave file, the path can be a glob
+func readTempSensor(path string) (float64, error) {
+	if path == "" {
+		return 0, fmt.Errorf("No temperature sensor configured")
+	}
+	files, err := filepath.Glob(path)
+	if err != nil {
+		return 0, err
+	}
+	if len(files) == 0 {
+		return 0, fmt.Errorf("No temperature sensor at %s", path)
+	}
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		return 0, err
+	}
+	// first line ends in YES if the CRC was good, second line ends in t=<millidegrees>
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) < 2 || !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+		return 0, fmt.Errorf("Bad sensor read: %s", string(data))
+	}
+	pos := strings.LastIndex(lines[1], "t=")
+	if pos < 0 {
+		return 0, fmt.Errorf("No temperature in: %s", lines[1])
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(lines[1][pos+2:]))
+	if err != nil {
+		return 0, err
+	}
+	return float64(milli) / 1000, nil
+}
+
+// carousel keeps track of which page is up and when each was last shown
+type carousel struct {
+	pages    []carouselPageConfig
+	lastShow []time.Time
+	current  int // index into pages, -1 when the clock is showing
+	start    time.Time
+}
+
+func newCarousel(rt runtimeConfig) *carousel {
+	pages := rt.settings.GetCarouselPages(sCarousel)
+	c := &carousel{
+		pages:    pages,
+		lastShow: make([]time.Time, len(pages)),
+		current:  -1,
+	}
+	// wait a full interval before the first showing
+	now := rt.clock.Now()
+	for i := range c.lastShow {
+		c.lastShow[i] = now
+	}
+	return c
+}
+
+func inWindow(page carouselPageConfig, now time.Time) bool {
+	return inTimeWindow(page.from, page.until, now)
+}
+
+// inTimeWindow - is now between the offsets from midnight? from == until
+// is all day
+func inTimeWindow(from time.Duration, until time.Duration, now time.Time) bool {
+	if from == until {
+		return true
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+	if from < until {
+		return offset >= from && offset < until
+	}
+	// the window wraps around midnight
+	return offset >= from || offset < until
+}
+
+func (c *carousel) nextPage(now time.Time) int {
+	for i, page := range c.pages {
+		if !inWindow(page, now) {
+			continue
+		}
+		if now.Sub(c.lastShow[i]) >= page.interval {
+			return i
+		}
+	}
+	return -1
+}
+
+// show puts the current carousel page on the display, returns false
+// when it is the clock's turn
+func (c *carousel) show(rt runtimeConfig) bool {
+	now := rt.clock.Now()
+	if c.current >= 0 && now.Sub(c.start) >= c.pages[c.current].duration {
+		c.current = -1
+	}
+	if c.current < 0 {
+		c.current = c.nextPage(now)
+		if c.current < 0 {
+			return false
+		}
+		c.start = now
+		c.lastShow[c.current] = now
+		rt.logger.Printf("Carousel page: %s", c.pages[c.current].page)
+	}
+
+	text, ok := carouselPages[c.pages[c.current].page].render(rt)
+	if !ok {
+		// nothing to show, try again next interval
+		c.current = -1
+		return false
+	}
+	err := rt.display.Print(text)
+	if err != nil {
+		rt.logger.Printf("Error: %s\n", err.Error())
+	}
+	return true
+}
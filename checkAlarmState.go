@@ -31,10 +31,10 @@ type rca struct {
 func (state *rca) showLoginInfo() time.Duration {
 	e := state.rt.comms.effects
 	// show a secret code and our IP address
-	e <- printRollingEffect("secret", dRollingPrint)
-	e <- printEffect(state.cfgError.secret, dPrintDuration)
-	e <- printEffect("IP:  ", dPrintDuration)
-	e <- printRollingEffect(GetOutboundIP().String(), dRollingPrint)
+	e <- prioritized(printRollingEffect("secret", dRollingPrint), prioHigh)
+	e <- prioritized(printEffect(state.cfgError.secret, dPrintDuration), prioHigh)
+	e <- prioritized(printEffect("IP:  ", dPrintDuration), prioHigh)
+	e <- prioritized(printRollingEffect(GetOutboundIP().String(), dRollingPrint), prioHigh)
 	return calcRolling("secret") + dPrintDuration + dPrintDuration + calcRolling(GetOutboundIP().String())
 }
 
@@ -136,6 +136,7 @@ func (state *rca) driveState(forceReport bool) {
 				state.reportNextAlarm(forceReport)
 			}
 		}
+		state.rt.status.setNextAlarm(state.nextAlarm)
 		state.invalid = false
 	}
 
@@ -175,6 +176,10 @@ func (state *rca) driveState(forceReport bool) {
 }
 
 func (state *rca) findNextAlarm() *alarm {
+	// a profile can turn the calendar off, e.g. on vacation
+	if !state.rt.settings.GetBool(sCalendarAlarms) {
+		return nil
+	}
 	// alarms come in sorted with soonest first
 	for index := 0; index < len(state.alarms); index++ {
 		if state.alarms[index].started {
@@ -201,8 +206,8 @@ func (state *rca) cancelNextAlarm() {
 }
 
 func (state *rca) startCancelPrompt() {
-	state.rt.comms.effects <- printCancelableRollingEffect(sCancel, dRollingPrint, state.cancelPrint)
-	state.rt.comms.effects <- printCancelableEffect(sYorN, 0, state.cancelPrint) // no duration is until cancelled
+	state.rt.comms.effects <- prioritized(printCancelableRollingEffect(sCancel, dRollingPrint, state.cancelPrint), prioHigh)
+	state.rt.comms.effects <- prioritized(printCancelableEffect(sYorN, 0, state.cancelPrint), prioHigh) // no duration is until cancelled
 	state.mode.mode = modeCancelStarted
 	// do the math: Y : n should be displayed for n secs, add time to print the rolling effect right before it
 	now := state.rt.clock.Now()
@@ -215,7 +220,7 @@ func (state *rca) startCancelPrompt() {
 func (state *rca) cancelPrompt() {
 	state.rt.logger.Println("Cancel next alarm")
 	// make sure to queue up the next print first
-	state.rt.comms.effects <- printRollingEffect("-- cancelled --", dRollingPrint)
+	state.rt.comms.effects <- prioritized(printRollingEffect("-- cancelled --", dRollingPrint), prioHigh)
 	state.cancelMessages()
 }
 
@@ -233,6 +238,11 @@ func (state *rca) reportNextAlarm(force bool) time.Duration {
 	alm := state.nextAlarm
 
 	var duration time.Duration = 0
+	// a newer report replaces one that is still waiting to be shown
+	batch := newPrintBatch()
+	report := func(e displayEffect) {
+		comms.effects <- deduped(e, "nextAL", batch)
+	}
 
 	if alm != nil {
 		// calculate days/hours/minutes
@@ -244,30 +254,30 @@ func (state *rca) reportNextAlarm(force bool) time.Duration {
 		diff = diff - time.Duration(hours)*time.Hour
 		// more than 7 days, print the date
 		if days > 7 {
-			comms.effects <- printRollingEffect(sNextAL, dRollingPrint)
+			report(printRollingEffect(sNextAL, dRollingPrint))
 			duration += calcRolling(sNextAL)
 			// date, then time
 			effect := alm.When.Format("01.02 2006")
-			comms.effects <- printRollingEffect(effect, dRollingPrint)
+			report(printRollingEffect(effect, dRollingPrint))
 			duration += calcRolling(effect)
-			comms.effects <- printEffect(sAt, dPrintDuration)
+			report(printEffect(sAt, dPrintDuration))
 			duration += dPrintDuration
-			comms.effects <- printEffect(alm.When.Format("15:04"), dPrintDuration)
+			report(printEffect(alm.When.Format("15:04"), dPrintDuration))
 			duration += dPrintDuration
 		} else {
-			comms.effects <- printRollingEffect(sNextALIn, dRollingPrint)
+			report(printRollingEffect(sNextALIn, dRollingPrint))
 			duration += calcRolling(sNextALIn)
 			if days > 0 {
-				comms.effects <- printEffect(fmt.Sprintf("%dd", days), dPrintDuration)
+				report(printEffect(fmt.Sprintf("%dd", days), dPrintDuration))
 				duration += dPrintDuration
 			}
-			comms.effects <- printEffect(fmt.Sprintf("%2d:%02d", hours, int(diff.Minutes())), dPrintDuration)
+			report(printEffect(fmt.Sprintf("%2d:%02d", hours, int(diff.Minutes())), dPrintDuration))
 			duration += dPrintDuration
 		}
 	} else {
 		// only print "none" when specifically asked?
 		// if force {
-		comms.effects <- printEffect("none", dPrintBriefDuration)
+		report(printEffect("none", dPrintBriefDuration))
 		duration += dPrintBriefDuration
 		// }
 	}
@@ -283,7 +293,7 @@ func (state *rca) compareAlarms(alm1 *alarm, alm2 *alarm) bool {
 		return false
 	}
 	return (alm1.ID == alm2.ID && alm1.When == alm2.When && alm1.Effect == alm2.Effect &&
-		alm1.Name == alm2.Name && alm1.Extra == alm2.Extra)
+		alm1.Name == alm2.Name && alm1.Extra == alm2.Extra && alm1.Options == alm2.Options)
 }
 
 func (state *rca) reset() {
@@ -39,6 +39,9 @@ func runCheckAlarms(rt runtimeConfig) {
 	comms := rt.comms
 	buttonPressActed := false
 	nextDoubleClick := time.Time{}
+	// a double click is acted on when it is let go, held for dSleepHold
+	// it sets the sleep timer (see runEffects) instead
+	doubleTapped := false
 
 	// generate a new FSM
 	state := newStateMachine(rt)
@@ -62,10 +65,15 @@ func runCheckAlarms(rt runtimeConfig) {
 			case msgDoubleButton:
 				// if there is a pending alarm ask to cancel
 				info := stateMsg.val.(buttonInfo)
-				if !info.pressed {
+				if info.pressed {
+					doubleTapped = info.duration < dSleepHold
+					continue
+				}
+				if !doubleTapped {
 					continue
 				}
-				if info.duration > 0 || rt.clock.Now().Sub(nextDoubleClick) < 0 {
+				doubleTapped = false
+				if rt.clock.Now().Sub(nextDoubleClick) < 0 {
 					rt.logger.Println("Ignoring duplicate doubleclick")
 					continue
 				}
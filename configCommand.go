@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// exit codes of "piclock config ...", reload.sh checks them before it
+// restarts the service
+const (
+	exitOK      = 0
+	exitInvalid = 1 // the settings have problems
+	exitUsage   = 2
+)
+
+const configUsage = "usage: piclock [-config file] [-host name] [-set key=value] config validate|dump|diff|migrate"
+
+// runConfigCommand runs "piclock config validate|dump|diff|migrate" and
+// returns the exit code.  validate lists every problem with where it is,
+// dump is every setting with its type and source, diff only the ones
+// that are not the default, migrate updates an old config file.
+func runConfigCommand(args cliArgs, env []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args.command) != 2 || args.command[0] != "config" {
+		fmt.Fprintln(stderr, configUsage)
+		return exitUsage
+	}
+	command := args.command[1]
+	if command != "validate" && command != "dump" && command != "diff" && command != "migrate" {
+		fmt.Fprintln(stderr, configUsage)
+		return exitUsage
+	}
+	if command == "migrate" {
+		changes, err := migrateConfigFile(args.configFile)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %s\n", err.Error())
+			return exitInvalid
+		}
+		for _, change := range changes {
+			fmt.Fprintln(stdout, change)
+		}
+		if len(changes) == 0 {
+			fmt.Fprintf(stdout, "%s is up to date\n", args.configFile)
+		}
+		return exitOK
+	}
+
+	s, problems := validateSettings(args.configFile, "", env, args.sets)
+	for _, problem := range problems {
+		fmt.Fprintf(stderr, "Error: %s\n", problem)
+	}
+	if !s.GetBool(sStrictSettings) {
+		// otherwise they are problems
+		for _, warning := range s.warnings {
+			fmt.Fprintf(stderr, "Warning: %s\n", warning)
+		}
+	}
+	if len(problems) > 0 {
+		return exitInvalid
+	}
+
+	switch command {
+	case "validate":
+		fmt.Fprintf(stdout, "%s is valid\n", args.configFile)
+	case "dump":
+		s.effectiveDoc(stdout)
+	case "diff":
+		for _, line := range s.settingsDiff() {
+			fmt.Fprintln(stdout, line)
+		}
+	}
+	return exitOK
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// updateSettingsFile only touches the changed keys: their values are
+// spliced into the file as it is, so the layout and comments of the rest
+// stay byte for byte.
+
+// fileMember - one top level key in a config file, the bytes from the
+// start of the key to the end of its value
+type fileMember struct {
+	key      string
+	start    int
+	keyEnd   int
+	valStart int
+	end      int
+	section  bool // TOML, a [key] or [[key]] table rather than key = value
+}
+
+func findMember(members []fileMember, key string) int {
+	for i := range members {
+		if members[i].key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func splice(data []byte, start int, end int, insert []byte) []byte {
+	out := make([]byte, 0, len(data)-(end-start)+len(insert))
+	out = append(out, data[:start]...)
+	out = append(out, insert...)
+	return append(out, data[end:]...)
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
+
+func skipSpace(data []byte, pos int) int {
+	for pos < len(data) && isSpace(data[pos]) {
+		pos++
+	}
+	return pos
+}
+
+// lineStart - where the line with pos on it starts
+func lineStart(data []byte, pos int) int {
+	return bytes.LastIndexByte(data[:pos], '\n') + 1
+}
+
+// nextLine - where the line after the one with pos on it starts
+func nextLine(data []byte, pos int) int {
+	if i := bytes.IndexByte(data[pos:], '\n'); i >= 0 {
+		return pos + i + 1
+	}
+	return len(data)
+}
+
+// jsonValueEnd - the end of the JSON value that starts at pos
+func jsonValueEnd(data []byte, pos int) (int, error) {
+	if pos >= len(data) {
+		return pos, fmt.Errorf("Unexpected end of JSON")
+	}
+	depth := 0
+	for i := pos; i < len(data); i++ {
+		switch data[i] {
+		case '"':
+			for i++; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(data) {
+				return i, fmt.Errorf("Unterminated string in JSON")
+			}
+			if depth == 0 {
+				return i + 1, nil
+			}
+		case '{', '[':
+			depth++
+		case '}', ']':
+			if depth == 0 {
+				return i, nil
+			}
+			depth--
+			if depth == 0 {
+				return i + 1, nil
+			}
+		case ',', ' ', '\t', '\r', '\n':
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return len(data), nil
+}
+
+// jsonMembers - the keys of the top level object, and where it opens
+func jsonMembers(data []byte) ([]fileMember, int, error) {
+	var check map[string]interface{}
+	if err := json.Unmarshal(data, &check); err != nil {
+		return nil, 0, err
+	}
+	open := skipSpace(data, 0)
+	members := []fileMember{}
+	pos := open + 1
+	for {
+		pos = skipSpace(data, pos)
+		if pos >= len(data) || data[pos] == '}' {
+			return members, open, nil
+		}
+		if data[pos] == ',' {
+			pos++
+			continue
+		}
+		m := fileMember{start: pos}
+		end, err := jsonValueEnd(data, pos)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := json.Unmarshal(data[pos:end], &m.key); err != nil {
+			return nil, 0, err
+		}
+		m.keyEnd = end
+		pos = skipSpace(data, end)
+		// the colon, the Unmarshal above says it is there
+		m.valStart = skipSpace(data, pos+1)
+		if m.end, err = jsonValueEnd(data, m.valStart); err != nil {
+			return nil, 0, err
+		}
+		members = append(members, m)
+		pos = m.end
+	}
+}
+
+// spliceJSON sets (or with nil removes) one key, a new one goes last
+// like the one before it
+func spliceJSON(data []byte, key string, value interface{}) ([]byte, error) {
+	members, open, err := jsonMembers(data)
+	if err != nil {
+		return nil, err
+	}
+	i := findMember(members, key)
+	if value == nil {
+		switch {
+		case i < 0:
+			return data, nil
+		case i < len(members)-1:
+			return splice(data, members[i].start, members[i+1].start, nil), nil
+		case i > 0:
+			return splice(data, members[i-1].end, members[i].end, nil), nil
+		default:
+			return splice(data, members[i].start, members[i].end, nil), nil
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(value); err != nil {
+		return nil, err
+	}
+	encoded := bytes.TrimSpace(buf.Bytes())
+	if i >= 0 {
+		return splice(data, members[i].valStart, members[i].end, encoded), nil
+	}
+
+	name, _ := json.Marshal(key)
+	if len(members) == 0 {
+		insert := append(append([]byte("\n  "), name...), ": "...)
+		insert = append(append(insert, encoded...), '\n')
+		rest := skipSpace(data, open+1)
+		return splice(data, open+1, rest, insert), nil
+	}
+	last := members[len(members)-1]
+	// the same indent and "key": or "key" : as the last one
+	insert := []byte(",")
+	if start := lineStart(data, last.start); len(bytes.TrimSpace(data[start:last.start])) == 0 {
+		insert = append(append(insert, '\n'), data[start:last.start]...)
+	} else {
+		insert = append(insert, ' ')
+	}
+	insert = append(append(insert, name...), data[last.keyEnd:last.valStart]...)
+	insert = append(insert, encoded...)
+	return splice(data, last.end, last.end, insert), nil
+}
+
+// trailingNotes - back off from end over blank and comment lines, they
+// go with whatever comes next
+func trailingNotes(data []byte, start int, end int) int {
+	for end > start {
+		prev := lineStart(data, end-1)
+		if prev < start {
+			break
+		}
+		line := bytes.TrimSpace(data[prev:end])
+		if len(line) > 0 && line[0] != '#' {
+			break
+		}
+		end = prev
+	}
+	return end
+}
+
+func unquoteKey(key string) string {
+	key = strings.TrimSpace(key)
+	if len(key) >= 2 && (key[0] == '"' || key[0] == '\'') && key[len(key)-1] == key[0] {
+		if key[0] == '"' {
+			if unquoted, err := strconv.Unquote(key); err == nil {
+				return unquoted
+			}
+		}
+		return key[1 : len(key)-1]
+	}
+	return key
+}
+
+// yamlMembers - the keys at the left margin, each runs to the next
+func yamlMembers(data []byte) []fileMember {
+	members := []fileMember{}
+	for pos := 0; pos < len(data); pos = nextLine(data, pos) {
+		line := data[pos:nextLine(data, pos)]
+		if len(line) == 0 || isSpace(line[0]) || line[0] == '#' || line[0] == '-' || line[0] == '.' {
+			continue
+		}
+		if len(members) > 0 {
+			last := &members[len(members)-1]
+			last.end = trailingNotes(data, last.start, pos)
+		}
+		colon := bytes.Index(line, []byte(":"))
+		if colon < 0 {
+			continue
+		}
+		members = append(members, fileMember{key: unquoteKey(string(line[:colon])), start: pos, end: len(data)})
+	}
+	if len(members) > 0 {
+		last := &members[len(members)-1]
+		last.end = trailingNotes(data, last.start, last.end)
+	}
+	return members
+}
+
+// spliceYAML sets (or with nil removes) one key, a new one goes at the end
+func spliceYAML(data []byte, key string, value interface{}) ([]byte, error) {
+	var check yaml.MapSlice
+	if err := yaml.Unmarshal(data, &check); err != nil {
+		return nil, err
+	}
+	members := yamlMembers(data)
+	i := findMember(members, key)
+	if value == nil {
+		if i < 0 {
+			return data, nil
+		}
+		return splice(data, members[i].start, members[i].end, nil), nil
+	}
+	encoded, err := yaml.Marshal(yaml.MapSlice{{Key: key, Value: fileValue(value)}})
+	if err != nil {
+		return nil, err
+	}
+	if i >= 0 {
+		return splice(data, members[i].start, members[i].end, encoded), nil
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	return append(data, encoded...), nil
+}
+
+// tomlValueEnd - the end of the line a TOML value that starts at pos ends
+// on, past arrays and strings that run over several lines
+func tomlValueEnd(data []byte, pos int) int {
+	depth := 0
+	for i := pos; i < len(data); i++ {
+		switch data[i] {
+		case '"', '\'':
+			quote := data[i : i+1]
+			if bytes.HasPrefix(data[i:], bytes.Repeat(quote, 3)) {
+				quote = bytes.Repeat(quote, 3)
+			}
+			i += len(quote)
+			for i < len(data) && !bytes.HasPrefix(data[i:], quote) {
+				if data[i] == '\\' && quote[0] == '"' {
+					i++
+				}
+				i++
+			}
+			i += len(quote) - 1
+		case '#':
+			i = nextLine(data, i) - 1
+			if depth == 0 {
+				return i + 1
+			}
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		case '\n':
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(data)
+}
+
+// tomlRoot - the top level key of a header or a dotted key
+func tomlRoot(key string) string {
+	key = strings.TrimSpace(key)
+	if len(key) > 0 && (key[0] == '"' || key[0] == '\'') {
+		if end := strings.IndexByte(key[1:], key[0]); end >= 0 {
+			return unquoteKey(key[:end+2])
+		}
+	}
+	if dot := strings.IndexByte(key, '.'); dot >= 0 {
+		key = key[:dot]
+	}
+	return strings.TrimSpace(key)
+}
+
+// tomlMembers - the key = value lines before the first table, and each
+// table, and where the first table starts
+func tomlMembers(data []byte) ([]fileMember, int) {
+	members := []fileMember{}
+	tables := len(data)
+	for pos := 0; pos < len(data); {
+		next := nextLine(data, pos)
+		line := bytes.TrimSpace(data[pos:next])
+		switch {
+		case len(line) == 0 || line[0] == '#':
+		case line[0] == '[':
+			name := strings.Trim(string(line), "[] \t")
+			if hash := strings.IndexByte(name, '#'); hash >= 0 {
+				name = strings.Trim(name[:hash], "[] \t")
+			}
+			if len(members) > 0 && members[len(members)-1].section {
+				last := &members[len(members)-1]
+				last.end = trailingNotes(data, last.start, pos)
+			}
+			if tables == len(data) {
+				tables = pos
+			}
+			members = append(members, fileMember{key: tomlRoot(name), start: pos, end: len(data), section: true})
+		case tables == len(data):
+			eq := bytes.IndexByte(data[pos:next], '=')
+			if eq < 0 {
+				break
+			}
+			next = tomlValueEnd(data, pos+eq+1)
+			members = append(members, fileMember{key: tomlRoot(string(data[pos : pos+eq])), start: pos, end: next})
+		}
+		pos = next
+	}
+	if len(members) > 0 && members[len(members)-1].section {
+		last := &members[len(members)-1]
+		last.end = trailingNotes(data, last.start, last.end)
+	}
+	return members, tables
+}
+
+// spliceTOML sets (or with nil removes) one key.  key = value goes
+// before the tables, a table after them.
+func spliceTOML(data []byte, key string, value interface{}) ([]byte, error) {
+	var check map[string]interface{}
+	if _, err := toml.Decode(string(data), &check); err != nil {
+		return nil, err
+	}
+	var encoded []byte
+	if value != nil {
+		var buf bytes.Buffer
+		enc := toml.NewEncoder(&buf)
+		enc.Indent = ""
+		if err := enc.Encode(map[string]interface{}{key: fileValue(value)}); err != nil {
+			return nil, err
+		}
+		encoded = bytes.TrimLeft(buf.Bytes(), "\n")
+	}
+	section := len(encoded) > 0 && encoded[0] == '['
+
+	// the first one of the same kind is replaced, the others go
+	members, _ := tomlMembers(data)
+	replace := -1
+	for i := len(members) - 1; i >= 0; i-- {
+		if members[i].key != key {
+			continue
+		}
+		if value != nil && members[i].section == section && (replace < 0 || i < replace) {
+			if replace >= 0 {
+				data = splice(data, members[replace].start, members[replace].end, nil)
+			}
+			replace = i
+			continue
+		}
+		data = splice(data, members[i].start, members[i].end, nil)
+	}
+	if value == nil {
+		return data, nil
+	}
+	if replace >= 0 {
+		return splice(data, members[replace].start, members[replace].end, encoded), nil
+	}
+
+	members, tables := tomlMembers(data)
+	if section {
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			data = append(data, '\n')
+		}
+		if len(data) > 0 {
+			data = append(data, '\n')
+		}
+		return append(data, encoded...), nil
+	}
+	at := 0
+	for _, m := range members {
+		if !m.section {
+			at = m.end
+		}
+	}
+	if at == 0 && tables < len(data) {
+		at = tables
+	}
+	if at > 0 && data[at-1] != '\n' {
+		encoded = append([]byte("\n"), encoded...)
+	}
+	return splice(data, at, at, encoded), nil
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	wg.Add(1)
+}
+
+// what the config server has, under the configServer URL
+const (
+	pullConfig = "config"
+	pullMusic  = "music"
+)
+
+// the files in configPullCache: the last good config and manifest, and
+// the ETags and versions they came with
+const pulledConfigFile string = "config.json"
+const pulledMusicFile string = "music.json"
+const pulledETagsFile string = "etags.json"
+const pulledVersionsFile string = "versions.json"
+
+// the server signs each version and body with the shared key,
+// "sha256=<hex hmac>".  the version only goes up, so an old body cannot
+// be sent again.
+const signatureHeader string = "X-Piclock-Signature"
+const versionHeader string = "X-Piclock-Version"
+
+// give up on a server that is this slow
+const dPullTimeout time.Duration = 30 * time.Second
+
+// more than a config (or a manifest) should ever be
+const maxPullSize int64 = 1 << 20
+
+// pullStatus - what the last pull did, for the API
+type pullStatus struct {
+	Server   string            `json:"server"`  // "" -> not pulling
+	Checked  time.Time         `json:"checked"` // zero -> never
+	Updated  time.Time         `json:"updated"` // when the config or manifest last changed
+	ETags    map[string]string `json:"etags"`
+	Versions map[string]int64  `json:"versions"`
+	Error    string            `json:"error"` // the last pull failed, the last good config is in use
+}
+
+// pullURL - where the server has what ("" is the server itself), {host}
+// in the configServer setting is this clock's name
+func pullURL(settings configSettings, what string) string {
+	server := settings.GetString(sConfigServer)
+	if server == "" {
+		return ""
+	}
+	if names := hostNames(); len(names) > 0 {
+		server = strings.Replace(server, "{host}", url.PathEscape(names[0]), -1)
+	}
+	if what == "" {
+		return server
+	}
+	return strings.TrimRight(server, "/") + "/" + what
+}
+
+// pulledFile - a file in the configPullCache, "" when it is not pulling
+func pulledFile(settings configSettings, name string) string {
+	if settings.GetString(sConfigServer) == "" {
+		return ""
+	}
+	return filepath.Join(settings.GetString(sConfigPullCache), name)
+}
+
+// serverKey - the shared key the server signs with
+func serverKey(settings configSettings) ([]byte, error) {
+	keyFile := settings.GetString(sConfigServerKey)
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		return nil, fmt.Errorf("The config server key %s is empty", keyFile)
+	}
+	return []byte(key), nil
+}
+
+// signBody - what the server puts in the X-Piclock-Signature header, the
+// HMAC of the version, a newline and the body
+func signBody(version int64, data []byte, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d\n", version)
+	mac.Write(data)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkSignature(version int64, data []byte, signature string, key []byte) error {
+	if signature == "" {
+		return fmt.Errorf("No %s", signatureHeader)
+	}
+	if !hmac.Equal([]byte(signature), []byte(signBody(version, data, key))) {
+		return fmt.Errorf("Bad %s", signatureHeader)
+	}
+	return nil
+}
+
+// serverProblems - what the config server sends cannot be trusted
+// without a key
+func serverProblems(s *configSettings) []string {
+	problems := []string{}
+	if s.GetString(sConfigServer) != "" && s.GetString(sConfigServerKey) == "" {
+		problems = append(problems, fmt.Sprintf("%s: %s needs a %s", s.source(sConfigServer), sConfigServer, sConfigServerKey))
+	}
+	return problems
+}
+
+// pulledSettings reads the last good config from the server.  it cannot
+// change the file only settings, they say where the server is and how to
+// trust it, and which commands run (see checkProfileSetting).
+func pulledSettings(fName string) (map[string]interface{}, []string, error) {
+	values, changes, err := overrideSettings(fName)
+	if err != nil {
+		return values, changes, err
+	}
+	for _, spec := range settingsSchema {
+		if _, ok := values[spec.key]; ok && spec.fileOnly {
+			return values, changes, fmt.Errorf("%s cannot come from the config server", spec.key)
+		}
+	}
+	return values, changes, nil
+}
+
+// fetchSigned gets what from the server, nil data when it has not
+// changed since etag.  what it sends must be newer than version, a server
+// that no longer has it is an error like any other.
+func fetchSigned(client *http.Client, address string, etag string, version int64, key []byte) ([]byte, string, int64, error) {
+	req, err := http.NewRequest("GET", address, nil)
+	if err != nil {
+		return nil, etag, version, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, etag, version, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, etag, version, nil
+	default:
+		return nil, etag, version, fmt.Errorf("GET %s: %s", address, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPullSize+1))
+	if err != nil {
+		return nil, etag, version, err
+	}
+	if int64(len(data)) > maxPullSize {
+		return nil, etag, version, fmt.Errorf("GET %s: more than %d bytes", address, maxPullSize)
+	}
+	sent, err := strconv.ParseInt(resp.Header.Get(versionHeader), 10, 64)
+	if err != nil {
+		return nil, etag, version, fmt.Errorf("GET %s: bad %s: %s", address, versionHeader, err.Error())
+	}
+	if err := checkSignature(sent, data, resp.Header.Get(signatureHeader), key); err != nil {
+		return nil, etag, version, fmt.Errorf("GET %s: %s", address, err.Error())
+	}
+	if sent <= version {
+		return nil, etag, version, fmt.Errorf("GET %s: version %d is not newer than %d", address, sent, version)
+	}
+	return data, resp.Header.Get("ETag"), sent, nil
+}
+
+// pulledCached - the last good one of what is in the configPullCache
+func pulledCached(settings configSettings, what string) bool {
+	name := map[string]string{pullConfig: pulledConfigFile, pullMusic: pulledMusicFile}[what]
+	_, err := os.Stat(pulledFile(settings, name))
+	return err == nil
+}
+
+func readPulledETags(settings configSettings) map[string]string {
+	etags := map[string]string{}
+	data, err := ioutil.ReadFile(pulledFile(settings, pulledETagsFile))
+	if err == nil {
+		json.Unmarshal(data, &etags)
+	}
+	// without the file its ETag would keep it from coming again
+	for what := range etags {
+		if !pulledCached(settings, what) {
+			delete(etags, what)
+		}
+	}
+	return etags
+}
+
+func readPulledVersions(settings configSettings) map[string]int64 {
+	versions := map[string]int64{}
+	data, err := ioutil.ReadFile(pulledFile(settings, pulledVersionsFile))
+	if err == nil {
+		json.Unmarshal(data, &versions)
+	}
+	// without the file any version will do
+	for what := range versions {
+		if !pulledCached(settings, what) {
+			delete(versions, what)
+		}
+	}
+	return versions
+}
+
+// applyPulledConfig makes data the last good config if the settings load
+// with it, and reloads them
+func applyPulledConfig(rt runtimeConfig, data []byte) error {
+	settingsWrite.Lock()
+	defer settingsWrite.Unlock()
+
+	fName := pulledFile(rt.settings, pulledConfigFile)
+	old, oldErr := ioutil.ReadFile(fName)
+	if err := os.MkdirAll(filepath.Dir(fName), 0755); err != nil {
+		return err
+	}
+	if err := writeFileMode(fName, data, 0600); err != nil {
+		return err
+	}
+	status := reloadSettings(rt)
+	if status.Error == "" {
+		return nil
+	}
+	// back to the last good one
+	if oldErr == nil {
+		writeFileMode(fName, old, 0600)
+	} else {
+		os.Remove(fName)
+	}
+	return fmt.Errorf("Not applied: %s", status.Error)
+}
+
+// applyPulledMusic keeps the manifest, and downloads what it lists
+func applyPulledMusic(rt runtimeConfig, data []byte) error {
+	var files []musicFile
+	if err := json.Unmarshal(data, &files); err != nil {
+		return err
+	}
+	fName := pulledFile(rt.settings, pulledMusicFile)
+	if err := os.MkdirAll(filepath.Dir(fName), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(fName, data); err != nil {
+		return err
+	}
+	rt.events.downloadMusicFiles(rt, rt.comms.effects)
+	return nil
+}
+
+// musicManifest - the manifest the music downloads from, the one pulled
+// from the config server when there is one
+func musicManifest(settings configSettings) string {
+	if fName := pulledFile(settings, pulledMusicFile); fName != "" {
+		if _, err := os.Stat(fName); err == nil {
+			return fName
+		}
+	}
+	return settings.GetString(sMusicURL)
+}
+
+// pullFromServer checks the config server for a new config and manifest.
+// anything that does not check out (or a server that is down) leaves the
+// last good one in use.
+func pullFromServer(rt runtimeConfig, client *http.Client) pullStatus {
+	status := rt.status.getPull()
+	status.Server = pullURL(rt.settings, "")
+	status.Checked = rt.clock.Now()
+	status.Error = ""
+	if status.Server == "" {
+		rt.status.setPull(status)
+		return status
+	}
+
+	fail := func(err error) pullStatus {
+		status.Error = err.Error()
+		rt.logger.Printf("Error: %s, keeping the last good config", status.Error)
+		rt.status.setPull(status)
+		return status
+	}
+	key, err := serverKey(rt.settings)
+	if err != nil {
+		return fail(err)
+	}
+
+	etags := readPulledETags(rt.settings)
+	versions := readPulledVersions(rt.settings)
+	apply := map[string]func(runtimeConfig, []byte) error{pullConfig: applyPulledConfig, pullMusic: applyPulledMusic}
+	for _, what := range []string{pullConfig, pullMusic} {
+		data, etag, version, err := fetchSigned(client, pullURL(rt.settings, what), etags[what], versions[what], key)
+		if err != nil {
+			return fail(err)
+		}
+		if data == nil {
+			continue
+		}
+		rt.logger.Printf("New %s from the config server (%s, version %d)", what, etag, version)
+		if err := apply[what](rt, data); err != nil {
+			return fail(fmt.Errorf("%s from the config server: %s", what, err.Error()))
+		}
+		etags[what] = etag
+		versions[what] = version
+		status.Updated = rt.clock.Now()
+		if out, err := json.Marshal(etags); err == nil {
+			writeFileAtomic(pulledFile(rt.settings, pulledETagsFile), out)
+		}
+		if out, err := json.Marshal(versions); err == nil {
+			writeFileAtomic(pulledFile(rt.settings, pulledVersionsFile), out)
+		}
+	}
+	status.ETags = etags
+	status.Versions = versions
+	rt.status.setPull(status)
+	return status
+}
+
+func startConfigPull(rt runtimeConfig) {
+	rt.logger = &ThreadLogger{name: "Config pull"}
+	go runConfigPull(rt)
+}
+
+// runConfigPull pulls from the config server every configPullTime, when
+// there is one
+func runConfigPull(rt runtimeConfig) {
+	defer wg.Done()
+	defer func() {
+		rt.logger.Println("Exiting runConfigPull")
+	}()
+
+	client := &http.Client{Timeout: dPullTimeout}
+	pullFromServer(rt, client)
+	for true {
+		select {
+		case <-rt.comms.quit:
+			rt.logger.Println("quit from runConfigPull")
+			return
+		case <-rt.clock.After(rt.settings.GetDuration(sConfigPullTime)):
+			pullFromServer(rt, client)
+		}
+	}
+}
+
+func (m *APIHandler) apiPull(w http.ResponseWriter, r *http.Request) {
+	output, _ := json.Marshal(m.rt.status.getPull())
+	w.Write(output)
+}
@@ -13,9 +13,21 @@ func init() {
 
 // TODO: figure this out
 type configResponse struct {
-	Response string  `json:"response"`
-	Error    string  `json:"error"`
-	Alarms   []alarm `json:"alarms"`
+	Response string            `json:"response"`
+	Error    string            `json:"error"`
+	Alarms   []alarm           `json:"alarms"`
+	Audio    audioStatus       `json:"audio"`
+	Volume   volumeStatus      `json:"volume"`
+	Music    downloadStatus    `json:"music"`
+	Reload   reloadStatus      `json:"reload"`
+	Profile  profileStatus     `json:"profile"`
+	Accounts map[string]string `json:"accounts"` // calendar account -> why its alarms are missing
+}
+
+type audioStatus struct {
+	Backend string      `json:"backend"`
+	Error   string      `json:"error"`
+	Health  audioHealth `json:"health"`
 }
 
 type configSvcMsg struct {
@@ -69,14 +81,34 @@ func (m *APIHandler) BasicAuth(next http.Handler) http.Handler {
 	})
 }
 
+func (m *APIHandler) getAudioStatus() audioStatus {
+	return audioStatus{
+		Backend: m.rt.settings.GetString(sAudioBackend),
+		Error:   m.rt.status.getAudioError(),
+		Health:  m.rt.status.getAudioHealth(),
+	}
+}
+
 func (m *APIHandler) getStatus() configResponse {
 	// run a getAlarmsFromService
 	alarms, err := getAlarmsFromService(m.rt)
+	status := configResponse{
+		Audio:    m.getAudioStatus(),
+		Volume:   m.getVolumeStatus(),
+		Music:    m.rt.status.getDownloads(),
+		Reload:   m.rt.status.getReload(),
+		Profile:  m.rt.status.getProfile(),
+		Accounts: m.rt.status.getAccountErrors(),
+	}
 	if err != nil {
-		return configResponse{Response: "BAD", Error: err.Error()}
+		status.Response = "BAD"
+		status.Error = err.Error()
+		return status
 	}
 	// return the alarms list too
-	return configResponse{Response: "OK", Alarms: alarms}
+	status.Response = "OK"
+	status.Alarms = alarms
+	return status
 }
 
 func writeAnswer(w http.ResponseWriter, cr configResponse) {
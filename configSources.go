@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// where a setting came from, in the order they are layered: each one
+// overrides the ones before it
+const (
+	sourceDefault = "default"
+	sourceEnv     = "env"
+	sourceCLI     = "-set"
+)
+
+// environment overrides are PICLOCK_ and the key in any case, e.g.
+// PICLOCK_CONFIGSERVICE=0 or PICLOCK_MAINBUTTON='{"pin": 5, "key": "a"}'
+const envPrefix = "PICLOCK_"
+
+// fileSettings reads a config file as JSON, YAML (.yaml, .yml) or TOML
+// (.toml) by its extension
+func fileSettings(fName string, data []byte) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	var err error
+	switch strings.ToLower(filepath.Ext(fName)) {
+	case ".yaml", ".yml":
+		var raw map[interface{}]interface{}
+		if err = yaml.Unmarshal(data, &raw); err == nil {
+			for k, v := range raw {
+				values[fmt.Sprint(k)] = plainValue(v)
+			}
+		}
+	case ".toml":
+		var raw map[string]interface{}
+		if _, err = toml.Decode(string(data), &raw); err == nil {
+			for k, v := range raw {
+				values[k] = plainValue(v)
+			}
+		}
+	default:
+		err = json.Unmarshal(data, &values)
+	}
+	return values, err
+}
+
+// plainValue makes YAML and TOML values look like they came from JSON,
+// which is what the to* converters expect
+func plainValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, item := range v {
+			m[fmt.Sprint(k)] = plainValue(item)
+		}
+		return m
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, item := range v {
+			m[k] = plainValue(item)
+		}
+		return m
+	case []map[string]interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = plainValue(item)
+		}
+		return items
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = plainValue(item)
+		}
+		return items
+	case int64:
+		return int(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return val
+}
+
+// plainSetting - a default the way a config file would have it
+func plainSetting(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Duration:
+		return v.String()
+	case uint8:
+		return int(v)
+	case buttonMap:
+		return map[string]interface{}{sPin: int(v.pinNum), sKey: v.key, sPullup: v.pullup}
+	case []carouselPageConfig, []animation, []tonePattern, []radioStation, []profileRule, []calendarAccount, []uint8:
+		// the defaults are all empty
+		return []interface{}{}
+	case settingsProfiles:
+		return map[string]interface{}{}
+	}
+	return value
+}
+
+// textValue - a value from the environment or the command line, text for
+// the simple settings and JSON for buttons and lists
+func textValue(key string, text string) interface{} {
+	spec, ok := findSetting(key)
+	if !ok {
+		return text
+	}
+	switch spec.def.(type) {
+	case bool, uint8, int, string, time.Duration:
+		return text
+	}
+	var val interface{}
+	if err := json.Unmarshal([]byte(text), &val); err != nil {
+		return text
+	}
+	return val
+}
+
+// envKey - the setting PICLOCK_CONFIGSERVICE is for, or the name
+// lowercased when there is none (the unknown key warning shows it)
+func envKey(name string) string {
+	name = strings.TrimPrefix(name, envPrefix)
+	for _, spec := range settingsSchema {
+		if strings.EqualFold(spec.key, name) {
+			return spec.key
+		}
+	}
+	return strings.ToLower(name)
+}
+
+// envSettings - the PICLOCK_ variables in env (os.Environ)
+func envSettings(env []string) map[string]interface{} {
+	values := map[string]interface{}{}
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, envPrefix) {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := envKey(parts[0])
+		values[key] = textValue(key, parts[1])
+	}
+	return values
+}
+
+// cliSettings - the -set key=value flags
+func cliSettings(sets []string) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	for _, set := range sets {
+		parts := strings.SplitN(set, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s is not key=value", set)
+		}
+		values[parts[0]] = textValue(parts[0], parts[1])
+	}
+	return values, nil
+}
+
+// loadSettings layers the defaults, the config file, this host's
+// overrides, the config server's, the environment and the command line,
+// and remembers where each setting came from
+func loadSettings(configFile string, env []string, sets []string) (*configSettings, error) {
+	return loadProfile(configFile, "", env, sets)
+}
+
+// loadProfile is loadSettings with a profile from the config file
+// between the file and the environment, "" is none
+func loadProfile(configFile string, profile string, env []string, sets []string) (*configSettings, error) {
+	s, problems := validateSettings(configFile, profile, env, sets)
+	if len(problems) > 0 {
+		return s, errors.New(strings.Join(problems, "; "))
+	}
+	return s, nil
+}
+
+// validateSettings is loadProfile, but goes on past a bad setting to
+// list every problem, each with the layer it is in
+func validateSettings(configFile string, profile string, env []string, sets []string) (*configSettings, []string) {
+	s := defaultSettings()
+	s.file = configFile
+	s.sets = sets
+
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return s, []string{fmt.Sprintf("Could not load conf file '%s': %s", configFile, err.Error())}
+	}
+
+	problems := []string{}
+	layer := func(values map[string]interface{}, err error, source string) {
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", source, err.Error()))
+			return
+		}
+		known := len(s.warnings)
+		for _, problem := range s.layerProblems(values, source) {
+			problems = append(problems, fmt.Sprintf("%s: %s", source, problem))
+		}
+		for i := known; i < len(s.warnings); i++ {
+			s.warnings[i] = fmt.Sprintf("%s: %s", source, s.warnings[i])
+		}
+	}
+	values, err := fileSettings(configFile, data)
+	if err == nil {
+		// an old file works, piclock config migrate updates it
+		var changes []string
+		changes, err = migrateSettings(values)
+		for _, change := range changes {
+			s.warnings = append(s.warnings, fmt.Sprintf("%s: %s", configFile, change))
+		}
+	}
+	layer(values, err, configFile)
+	if host := hostConfigFile(configFile, s.GetString(sHostConfigs)); host != "" {
+		values, changes, err := overrideSettings(host)
+		for _, change := range changes {
+			s.warnings = append(s.warnings, fmt.Sprintf("%s: %s", host, change))
+		}
+		layer(values, err, host)
+	}
+	if pulled := pulledFile(*s, pulledConfigFile); pulled != "" {
+		// nothing is there until the first pull works
+		if _, err := os.Stat(pulled); err == nil {
+			values, changes, err := pulledSettings(pulled)
+			for _, change := range changes {
+				s.warnings = append(s.warnings, fmt.Sprintf("%s: %s", pulled, change))
+			}
+			layer(values, err, pulled)
+		}
+	}
+	if profile != "" {
+		if overrides, ok := s.GetProfiles(sProfiles)[profile]; ok {
+			layer(overrides, nil, profileSource(profile))
+		} else {
+			s.warnings = append(s.warnings, fmt.Sprintf("No profile \"%s\", using the base settings", profile))
+		}
+	}
+	layer(envSettings(env), nil, sourceEnv)
+	values, err = cliSettings(sets)
+	layer(values, err, sourceCLI)
+	problems = append(problems, profileProblems(s)...)
+	problems = append(problems, serverProblems(s)...)
+	problems = append(problems, volumeProblems(s)...)
+	return s, problems
+}
+
+// the machine id, a name for the override file that survives a rename
+var machineIDFile = "/etc/machine-id"
+
+// configHost - the -host flag, "" is this machine
+var configHost string
+
+// the per-host override file is the first of these that is there
+var hostConfigExts = []string{".conf", ".json", ".yaml", ".yml", ".toml"}
+
+// hostNames - the names this machine's override file can have: the -host
+// flag, or the hostname (and its short form) then the machine id
+func hostNames() []string {
+	if configHost != "" {
+		return []string{configHost}
+	}
+	names := []string{}
+	if name, err := os.Hostname(); err == nil && name != "" {
+		names = append(names, name)
+		if short := strings.SplitN(name, ".", 2)[0]; short != name {
+			names = append(names, short)
+		}
+	}
+	if data, err := ioutil.ReadFile(machineIDFile); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			names = append(names, id)
+		}
+	}
+	return names
+}
+
+// hostConfigFile - this machine's override file in dir (relative to the
+// config file), "" when it has none
+func hostConfigFile(configFile string, dir string) string {
+	if dir == "" {
+		return ""
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(configFile), dir)
+	}
+	for _, name := range hostNames() {
+		for _, ext := range hostConfigExts {
+			fName := filepath.Join(dir, name+ext)
+			if info, err := os.Stat(fName); err == nil && !info.IsDir() {
+				return fName
+			}
+		}
+	}
+	return ""
+}
+
+// overrideSettings reads a host's override file (or the config from the
+// config server), migrated like the config file.  they came after
+// configVersion 1, so one without a configVersion is already current.
+func overrideSettings(fName string) (map[string]interface{}, []string, error) {
+	data, err := ioutil.ReadFile(fName)
+	if err != nil {
+		return nil, nil, err
+	}
+	values, err := fileSettings(fName, data)
+	if err != nil || values[sConfigVersion] == nil {
+		return values, nil, err
+	}
+	changes, err := migrateSettings(values)
+	return values, changes, err
+}
+
+// settingsFile - where the settings API writes, the host's override file
+// when it has one so the shared config file is left as it is
+func settingsFile(s configSettings) string {
+	if host := hostConfigFile(s.file, s.GetString(sHostConfigs)); host != "" {
+		return host
+	}
+	return s.file
+}
+
+// source - where a setting came from
+func (s *configSettings) source(key string) string {
+	if s.lock != nil {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+	}
+	if source, ok := s.sources[key]; ok {
+		return source
+	}
+	return sourceDefault
+}
+
+// effectiveDoc writes every setting in effect, its type and where it
+// came from, "config dump" and the -effective flag
+func (s *configSettings) effectiveDoc(w io.Writer) {
+	for _, spec := range settingsSchema {
+		fmt.Fprintf(w, "%s = %s (%s, %s)\n", spec.key, showSetting(s.get(spec.key)), spec.typeName(), s.source(spec.key))
+	}
+}
+
+// fileValue - whole numbers from JSON are float64, YAML and TOML would
+// write them as 7.0
+func fileValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case float64:
+		if v == math.Trunc(v) {
+			return int64(v)
+		}
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, item := range v {
+			m[k] = fileValue(item)
+		}
+		return m
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = fileValue(item)
+		}
+		return items
+	}
+	return val
+}
+
+// updateSettingsFile writes changes into the config file in its own
+// format, only the changed keys are touched (see configEdit.go), new ones
+// go at the end.  a nil change removes the key.
+func updateSettingsFile(fName string, changes map[string]interface{}) error {
+	data, err := ioutil.ReadFile(fName)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(changes))
+	for k := range changes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	update := spliceJSON
+	switch strings.ToLower(filepath.Ext(fName)) {
+	case ".yaml", ".yml":
+		update = spliceYAML
+	case ".toml":
+		update = spliceTOML
+	}
+	for _, k := range keys {
+		if data, err = update(data, k, changes[k]); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(fName, data)
+}
+
+// settingsDiff - the settings that are not their default, "config diff"
+// and the startup log
+func (s *configSettings) settingsDiff() []string {
+	lines := []string{}
+	for _, spec := range settingsSchema {
+		value := s.get(spec.key)
+		if reflect.DeepEqual(value, spec.def) {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s = %s (default %s, %s)", spec.key, showSetting(value), showSetting(spec.def), s.source(spec.key)))
+	}
+	return lines
+}
@@ -1,29 +1,27 @@
 package main
 
 import (
-	"container/list"
 	"fmt"
-	"math/rand"
 	"os"
-	"path/filepath"
 	"time"
 
 	"dscheirer.com/piclock/sevenseg_backpack"
 )
 
-const almDisplay1 string = "_-_-"
-const almDisplay2 string = "-_-_"
-
 type displayEffect struct {
 	id  int
 	val interface{}
 }
 
 type displayPrint struct {
-	s      string
-	d      time.Duration
-	cancel chan bool
-	id     int
+	s        string
+	d        time.Duration
+	cancel   chan bool
+	id       int
+	priority int
+	expires  time.Time // zero -> never
+	key      string    // dedupe key, see deduped()
+	batch    int
 }
 
 // one of the interface types for displayEffect
@@ -53,6 +51,12 @@ const (
 	eAlarmOn
 	eAlarmOff
 	eCountdown
+	eAudioError
+	eVolume
+	eAnnounce
+	eTestSound
+	eSleep
+	eSettings
 )
 
 func init() {
@@ -97,22 +101,22 @@ var globPrintID int = 0
 
 func printEffect(s string, d time.Duration) displayEffect {
 	globPrintID++
-	return displayEffect{id: ePrint, val: displayPrint{s: s, d: d, id: globPrintID}}
+	return displayEffect{id: ePrint, val: displayPrint{s: s, d: d, id: globPrintID, priority: prioNormal}}
 }
 
 func printCancelableEffect(s string, d time.Duration, cancel chan bool) displayEffect {
 	globPrintID++
-	return displayEffect{id: ePrint, val: displayPrint{s: s, d: d, cancel: cancel, id: globPrintID}}
+	return displayEffect{id: ePrint, val: displayPrint{s: s, d: d, cancel: cancel, id: globPrintID, priority: prioNormal}}
 }
 
 func printRollingEffect(s string, d time.Duration) displayEffect {
 	globPrintID++
-	return displayEffect{id: ePrintRolling, val: displayPrint{s: s, d: d, id: globPrintID}}
+	return displayEffect{id: ePrintRolling, val: displayPrint{s: s, d: d, id: globPrintID, priority: prioNormal}}
 }
 
 func printCancelableRollingEffect(s string, d time.Duration, cancel chan bool) displayEffect {
 	globPrintID++
-	return displayEffect{id: ePrintRolling, val: displayPrint{s: s, d: d, cancel: cancel, id: globPrintID}}
+	return displayEffect{id: ePrintRolling, val: displayPrint{s: s, d: d, cancel: cancel, id: globPrintID, priority: prioNormal}}
 }
 
 func showLoader(rt runtimeConfig) {
@@ -124,8 +128,8 @@ func showLoader(rt runtimeConfig) {
 	}
 	effects := rt.comms.effects
 
-	effects <- printRollingEffect(fmt.Sprintf("build... %s %s at", info.ModTime().Format("01.02"), info.ModTime().Format("2006")), dRollingPrint)
-	effects <- printEffect(info.ModTime().Format("15:04"), 1500*time.Millisecond)
+	effects <- prioritized(printRollingEffect(fmt.Sprintf("build... %s %s at", info.ModTime().Format("01.02"), info.ModTime().Format("2006")), dRollingPrint), prioLow)
+	effects <- prioritized(printEffect(info.ModTime().Format("15:04"), 1500*time.Millisecond), prioLow)
 	// also sleep for a few seconds
 	rt.clock.Sleep(3 * time.Second)
 }
@@ -208,106 +212,51 @@ func displayCountdown(rt runtimeConfig, alarm *alarm, dot bool) bool {
 
 func playAlarmEffect(rt runtimeConfig, alm *alarm, stop chan bool, done chan bool) {
 	musicPath := rt.settings.GetString(sMusicPath)
-	var musicFile string
-	playTones := false
+	var tracks []string
 
-	switch alm.Effect {
+	switch alarmEffect(rt, alm) {
 	case almMusic:
-		musicFile = musicPath + "/" + alm.Extra
-	case almFile:
-		musicFile = musicPath + "/" + alm.Extra
-	case almTones:
-		playTones = true
-	default:
-		// play a random mp3 in the cache
-		s1 := rand.NewSource(rt.clock.Now().UnixNano())
-		r1 := rand.New(s1)
-
-		files, err := filepath.Glob(musicPath + "/*")
-		if err != nil {
-			rt.logger.Println(err)
-			break
-		}
-		if len(files) > 0 {
-			musicFile = files[r1.Intn(len(files))]
-		} else {
-			playTones = true
+		// "music bowie" is matched against the library
+		if track, ok := findTrack(rt, alm.Extra); ok {
+			tracks = []string{track}
 		}
-	}
-
-	if !playTones {
+	case almFile:
+		musicFile := musicPath + "/" + alm.Extra
 		// make sure the file exists
 		fstat, err := os.Stat(musicFile)
-		if err != nil || fstat == nil || fstat.Size() == 0 {
-			playTones = true
+		if err == nil && fstat != nil && fstat.Size() > 0 {
+			tracks = []string{musicFile}
+		}
+	case almTones:
+	case almRadio:
+		streamURL, err := alarmStream(rt, alm)
+		if err == nil {
+			rt.sounds.playStream(rt, streamURL, alarmPlayOptions(rt, alm), func(stop chan bool, done chan bool) {
+				playRadioFallback(rt, alm, stop, done)
+			}, stop, done)
+			return
 		}
+		rt.logger.Printf("Error: %s", err.Error())
+		playRadioFallback(rt, alm, stop, done)
+		return
+	default:
+		// random and playlists
+		tracks = alarmTracks(rt, alm)
 	}
 
-	if playTones {
-		// the pi is not great at audio generation
-		musicFile = musicPath + "/tones"
+	if len(tracks) == 0 {
+		rt.sounds.playIt(rt, alarmTonePattern(rt, alm), stop, done)
+		return
 	}
 
-	rt.logger.Printf("Playing %s", musicFile)
-	rt.sounds.playMP3(rt, musicFile, true, stop, done)
+	rt.logger.Printf("Playing %v", tracks)
+	rt.sounds.playTracks(rt, tracks, alarmPlayOptions(rt, alm), stop, done)
 }
 
 func stopAlarmEffect(stop chan bool) {
 	stop <- true
 }
 
-func printDisplay(rt runtimeConfig, e displayPrint) {
-	rt.logger.Printf("Print: %s (%d)", e.s, e.d)
-	// either sleep the entire duration or chunk it out waiting for a cancel
-	if e.cancel == nil {
-		rt.display.Print(e.s)
-		rt.clock.Sleep(e.d)
-	} else {
-		start := rt.clock.Now()
-		printed := false
-		// delay printing until we checked the cancel
-		for true {
-			select {
-			case c := <-e.cancel:
-				rt.logger.Printf("Got print cancel: %v", c)
-				return
-			default:
-			}
-			if !printed {
-				rt.display.Print(e.s)
-				printed = true
-			}
-			// a zero duration is "until cancelled"
-			if e.d > 0 && rt.clock.Now().Sub(start) > e.d {
-				return
-			}
-			rt.clock.Sleep(dEffectSleep)
-		}
-	}
-}
-
-func printRolling(rt runtimeConfig, e displayPrint) {
-	rt.logger.Printf("Rolling print: %s (%d)", e.s, e.d)
-	// pre/postpend 4/8 spaces, then rotate trhough the string
-	// with e.d as the duration on each
-	toprint := "    " + e.s + "    "
-	for i := 0; i <= len(toprint)-4; i++ {
-		// always check for cancel first
-		select {
-		case c := <-e.cancel:
-			rt.logger.Printf("Got rolling print cancel: %v", c)
-			return
-		default:
-		}
-		_, err := rt.display.PrintOffset(toprint, i)
-		if err != nil {
-			rt.logger.Printf("Error: %s\n", err.Error())
-			return
-		}
-		rt.clock.Sleep(e.d)
-	}
-}
-
 func startEffects(rt runtimeConfig) {
 	rt.logger = &ThreadLogger{name: "Effects"}
 	go runEffects(rt)
@@ -337,19 +286,54 @@ func runEffects(rt runtimeConfig) {
 	rt.display.SetBrightness(uint8(settings.GetInt(sBrightness)))
 	// ready to rock
 	rt.display.DisplayOn(true)
+	// the volume between alarms
+	resetVolume := func() {
+		setVolumeLevel(rt, settings.GetInt(sVolume))
+	}
+	resetVolume()
+	// set while an alarm is ringing
+	var ramp *volumeRamp
 
 	mode := modeClock
 	var countdown *alarm
 	var errorID = 0
-	alarmSegment := 0
 	buttonDot := false
+	// how long the main button has been held, the time is said when it is
+	// let go so a profile hold does not say it too
+	mainHeld := time.Duration(0)
+	pages := newCarousel(rt)
+	// alarm and countdown animations, nil when not running
+	var player *animationPlayer
+	stopPlayer := func() {
+		if player != nil {
+			player.stop(rt)
+			player = nil
+		}
+	}
+
+	// speech, one announcement at a time
+	announcements := &announcer{}
+	// a few seconds of the alarm tones on demand
+	test := &testSound{}
+	// music to fall asleep to, it gives way to the alarms
+	sleep := &sleepTimer{}
 
 	// stopAlarm will be re-created
 	var stopAlarm chan bool = nil
 	done := make(chan bool, 20)
 
-	// TODO: put a keepReading around the channel reader?
-	printQueue := list.New()
+	// prints are rendered a frame per loop so we keep reading effects
+	printQueue := newPrintQueue()
+
+	playTestSound := func() {
+		if mode == modeAlarm || mode == modeCountdown {
+			rt.logger.Println("No test sound during an alarm")
+			return
+		}
+		if test.start(rt) {
+			printQueue.push(rt, printEffect("Snd", dTestSound))
+		}
+	}
 
 	for true {
 		var e displayEffect
@@ -363,6 +347,9 @@ func runEffects(rt runtimeConfig) {
 			// go back to normal clock mode
 			rt.logger.Printf("Got a done signal from playEffect: %v", d)
 			mode = modeClock
+			stopPlayer()
+			ramp = nil
+			resetVolume()
 			// tell checkAlarms that it's over?  it could use
 			// that information to figure out what to do with
 			// button presses
@@ -380,35 +367,64 @@ func runEffects(rt runtimeConfig) {
 					rt.display.DebugDump(v)
 				case eClock:
 					mode = modeClock
+					stopPlayer()
 				case eCountdown:
 					mode = modeCountdown
+					sleep.cancel(rt)
 					countdown, _ = toAlarm(e.val)
+					stopPlayer()
+					if name := countdownAnimation(rt, countdown); name != "" {
+						player = newAnimationPlayer(rt, name)
+					}
 					// also clear the print queue
-					rt.logger.Printf("Dumping print queue: %d", printQueue.Len())
-					printQueue = list.New()
+					printQueue.discardBelow(rt, prioCountdown)
 				case eAlarmError:
-					rt.display.Print("Err")
 					d, _ := toDuration(e.val)
-					rt.clock.Sleep(d)
+					printQueue.push(rt, prioritized(printEffect("Err", d), prioHigh))
+				case eAudioError:
+					v, _ := toString(e.val)
+					rt.logger.Printf("Audio failed: %s", v)
+					printQueue.push(rt, deduped(prioritized(printEffect("SndE", dAudioError), prioHigh), "audioError", 0))
+				case eVolume:
+					level, _ := toInt(e.val)
+					rt.logger.Printf("Volume: %d", level)
+					if ramp != nil {
+						ramp.set(rt, level)
+					} else {
+						rt.status.setVolumeTarget(level)
+						applyVolume(rt, level)
+					}
+				case eAnnounce:
+					text, _ := toString(e.val)
+					announcements.add(text)
+				case eTestSound:
+					playTestSound()
+				case eSleep:
+					d, _ := toDuration(e.val)
+					if mode == modeAlarm || mode == modeCountdown {
+						rt.logger.Println("No sleep timer during an alarm")
+						break
+					}
+					sleep.set(rt, d)
+				case eSettings:
+					// reloaded, pick up what was read once above
+					rt.logger.Println("Settings reloaded")
+					rt.display.DebugDump(settings.GetBool(sDebug))
+					rt.display.SetBrightness(uint8(settings.GetInt(sBrightness)))
+					pages = newCarousel(rt)
+					if mode == modeClock && ramp == nil && sleep.stop == nil {
+						resetVolume()
+					}
 				case eTerminate:
 					rt.logger.Println("terminate")
 					return
-				case ePrintRolling:
-					v, _ := toPrint(e.val)
-					// queue it for later?
-					if mode == modeCountdown {
-						rt.logger.Printf("Ignored print during countdown: %s", v.s)
-					} else {
-						printQueue.PushBack(e)
-						rt.logger.Printf("Queued rolling print: %s (%d)", v.s, v.d)
-					}
-				case ePrint:
+				case ePrint, ePrintRolling:
 					v, _ := toPrint(e.val)
-					// queue it for later?
-					if mode == modeCountdown {
+					// queue it for later? (alarm mode holds them until it is over)
+					if mode == modeCountdown && v.priority < prioCountdown {
 						rt.logger.Printf("Ignored print during countdown: %s", v.s)
 					} else {
-						printQueue.PushBack(e)
+						printQueue.push(rt, e)
 						rt.logger.Printf("Queued print: %s (%d)", v.s, v.d)
 					}
 				case eAlarmOn:
@@ -417,12 +433,23 @@ func runEffects(rt runtimeConfig) {
 					rt.logger.Printf(">>>>>>>>>>>>>>> ALARM <<<<<<<<<<<<<<<<<<")
 					rt.logger.Printf("%s %s %d", alm.Name, alm.When, alm.Effect)
 					rt.display.SetBlinkRate(sevenseg_backpack.BLINK_OFF)
+					printQueue.discardBelow(rt, prioAlarm)
+					stopPlayer()
+					test.cancel()
+					sleep.cancel(rt)
+					player = newAnimationPlayer(rt, alarmAnimation(rt, alm))
 					// if stopAlarm exists, close it
 					if stopAlarm != nil {
 						stopAlarmEffect(stopAlarm)
 						close(stopAlarm)
 					}
 					stopAlarm = make(chan bool, 1)
+					ramp = newVolumeRamp(rt, alm)
+					if settings.GetBool(sAnnounceAlarm) {
+						// start talking first so the alarm audio starts paused
+						announcements.add(alarmAnnouncement(rt, alm))
+						announcements.step(rt)
+					}
 					playAlarmEffect(rt, alm, stopAlarm, done)
 				case eAlarmOff:
 					mode = modeClock
@@ -433,12 +460,43 @@ func runEffects(rt runtimeConfig) {
 						rt.logger.Printf(">>>>>>>>>>>>>>> STOP ALARM <<<<<<<<<<<<<<<<<<")
 						stopAlarm = nil
 					}
+					stopPlayer()
+					if ramp != nil {
+						ramp = nil
+						resetVolume()
+					}
 					rt.display.SetBlinkRate(sevenseg_backpack.BLINK_OFF)
 				case eMainButton:
 					info, _ := toButtonInfo(e.val)
 					buttonDot = info.pressed
+					// a hold let go before the profile hold says the time and
+					// the next alarm
+					if info.pressed {
+						mainHeld = info.duration
+					} else {
+						if mainHeld >= dAnnounceHold && mainHeld < dProfileHold {
+							announcements.add(timeAnnouncement(rt) + " " + nextAlarmAnnouncement(rt))
+						}
+						mainHeld = 0
+					}
+					// and held longer moves to the next profile
+					if info.pressed && info.duration == dProfileHold && mode == modeClock {
+						rt.comms.profiles <- nextProfileMessage()
+					}
 				case eLongButton:
+					info, _ := toButtonInfo(e.val)
+					// a hold plays the test sound, a press reloads the alarms
+					if info.pressed && info.duration == dTestSoundHold {
+						playTestSound()
+					}
 				case eDoubleButton:
+					info, _ := toButtonInfo(e.val)
+					// each hold moves the sleep timer on, 15 -> 30 -> 60 -> off
+					if info.pressed && info.duration == dSleepHold && mode == modeClock {
+						d := sleep.next()
+						printQueue.push(rt, printEffect(sleepShow(d), dSleepShow))
+						sleep.set(rt, d)
+					}
 				default:
 					rt.logger.Printf("Unhandled %d\n", e.id)
 				}
@@ -447,25 +505,24 @@ func runEffects(rt runtimeConfig) {
 				keepReading = false
 			}
 		}
+		announcements.step(rt)
+		test.step(rt)
+		sleep.step(rt)
 
 		switch mode {
 		case modeClock:
-			if printQueue.Len() > 0 {
-				rt.logger.Printf("Print from queue (%d)", printQueue.Len())
-				e := printQueue.Front()
-				v := e.Value.(displayEffect)
-				switch v.id {
-				case ePrint:
-					printDisplay(rt, v.val.(displayPrint))
-				case ePrintRolling:
-					printRolling(rt, v.val.(displayPrint))
-				}
-				printQueue.Remove(e)
-			} else {
+			if !printQueue.render(rt) && !pages.show(rt) {
 				displayClock(rt, settings.GetBool(sBlink), buttonDot)
 			}
 		case modeCountdown:
-			if !displayCountdown(rt, countdown, buttonDot) {
+			if player != nil {
+				if countdown.When.After(rt.clock.Now()) {
+					player.render(rt)
+				} else {
+					mode = modeClock
+					stopPlayer()
+				}
+			} else if !displayCountdown(rt, countdown, buttonDot) {
 				mode = modeClock
 			}
 		case modeAlarmError:
@@ -474,21 +531,12 @@ func runEffects(rt runtimeConfig) {
 		case modeOutput:
 			// do nothing
 		case modeAlarm:
-			// do a strobing 0, light up segments 0 - 5
-			if settings.GetBool(sStrobe) == true {
-				rt.display.RefreshOn(false)
-				rt.display.ClearDisplay()
-				for i := 0; i < 4; i++ {
-					rt.display.SegmentOn(byte(i), byte(alarmSegment), true)
-				}
-				rt.display.RefreshOn(true)
-				alarmSegment = (alarmSegment + 1) % 6
-			} else {
-				if (rt.clock.Now().Second())%2 == 0 {
-					rt.display.Print(almDisplay1)
-				} else {
-					rt.display.Print(almDisplay2)
-				}
+			if ramp != nil {
+				ramp.step(rt)
+			}
+			if player != nil && !player.render(rt) {
+				// a one-shot animation finished, leave the last frame up
+				player = nil
 			}
 		default:
 			rt.logger.Printf("Unknown mode: '%d'\n", mode)
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const dDisplayStream time.Duration = 100 * time.Millisecond
+
+// what the virtual display page renders, digits are raw segment masks
+type displayState struct {
+	Digits     [4]uint8 `json:"digits"`
+	Colon      bool     `json:"colon"`
+	Blink      uint8    `json:"blink"`
+	Brightness uint8    `json:"brightness"`
+	On         bool     `json:"on"`
+	Inverted   bool     `json:"inverted"`
+	AlarmLED   bool     `json:"alarmLed"`
+	ErrorLED   bool     `json:"errorLed"`
+}
+
+func (m *APIHandler) getDisplayState() displayState {
+	snap := m.rt.display.Snapshot()
+	return displayState{
+		Digits:     snap.Digits,
+		Colon:      snap.Colon,
+		Blink:      snap.Blink,
+		Brightness: snap.Brightness,
+		On:         snap.On,
+		Inverted:   snap.Inverted,
+		AlarmLED:   m.rt.status.getLED(m.rt.settings.GetInt(sLEDAlm)),
+		ErrorLED:   m.rt.status.getLED(m.rt.settings.GetInt(sLEDErr)),
+	}
+}
+
+// apiDisplay streams the display state as server-sent events, one
+// event each time it changes
+func (m *APIHandler) apiDisplay(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		m.apiError(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	first := true
+	var last displayState
+	for {
+		cur := m.getDisplayState()
+		if first || cur != last {
+			data, _ := json.Marshal(cur)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+			last = cur
+			first = false
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-m.rt.clock.After(dDisplayStream):
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// download states, see downloadStatus
+const (
+	downloadIdle    = "idle"
+	downloadRunning = "running"
+	downloadDone    = "done"
+	downloadFailed  = "failed"
+)
+
+// what we saved last time, so changed entries are downloaded again and
+// dropped ones can be pruned.  hidden, so the library skips it.
+const downloadManifest string = ".manifest.json"
+
+// temp files are renamed into place once they check out
+const downloadPrefix string = ".download-"
+
+// downloadStatus - progress of the last run, for the status API
+type downloadStatus struct {
+	State    string    `json:"state"`
+	Total    int       `json:"total"`
+	Current  int       `json:"current"`  // up to date already
+	Fetched  int       `json:"fetched"`  // downloaded this run
+	Failed   []string  `json:"failed"`   // "name: error"
+	Pruned   []string  `json:"pruned"`   // removed, no longer listed
+	Error    string    `json:"error"`    // the manifest itself failed
+	Started  time.Time `json:"started"`  // zero when it never ran
+	Finished time.Time `json:"finished"` // zero while running
+}
+
+func newDownloadStatus() downloadStatus {
+	return downloadStatus{State: downloadIdle, Failed: []string{}, Pruned: []string{}}
+}
+
+// musicDownloader fetches the manifest's files into musicPath
+type musicDownloader struct {
+	rt     runtimeConfig
+	client *http.Client
+	dir    string
+	mutex  sync.Mutex
+	saved  map[string]musicFile // guarded by mutex
+}
+
+func newMusicDownloader(rt runtimeConfig) *musicDownloader {
+	return &musicDownloader{
+		rt:     rt,
+		client: &http.Client{Timeout: rt.settings.GetDuration(sMusicTimeout)},
+		dir:    rt.settings.GetString(sMusicPath),
+		saved:  map[string]musicFile{},
+	}
+}
+
+// retry calls f until it works, waiting longer each time
+func (md *musicDownloader) retry(what string, f func() error) error {
+	retries := md.rt.settings.GetInt(sMusicRetries)
+	delay := md.rt.settings.GetDuration(sMusicRetryDelay)
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = f(); err == nil || attempt >= retries {
+			return err
+		}
+		md.rt.logger.Printf("%s failed (%s), retrying in %v", what, err.Error(), delay)
+		md.rt.clock.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (md *musicDownloader) get(url string) (*http.Response, error) {
+	resp, err := md.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
+// fetchManifest reads the manifest at url, or in a file (the one pulled
+// from the config server)
+func (md *musicDownloader) fetchManifest(url string) ([]musicFile, error) {
+	var files []musicFile
+	err := md.retry("Manifest", func() error {
+		if !strings.Contains(url, "://") {
+			data, err := ioutil.ReadFile(url)
+			if err != nil {
+				return err
+			}
+			return json.Unmarshal(data, &files)
+		}
+		resp, err := md.get(url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, &files)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !goodMusicName(f.Name) {
+			return nil, fmt.Errorf("Bad file name in manifest: '%s'", f.Name)
+		}
+	}
+	return files, nil
+}
+
+// goodMusicName - is name a plain file in musicPath?  no directories and
+// nothing hidden (like the saved manifest)
+func goodMusicName(name string) bool {
+	return name != "" && name == filepath.Base(name) && !isHidden(name)
+}
+
+func (md *musicDownloader) loadSaved() {
+	data, err := ioutil.ReadFile(filepath.Join(md.dir, downloadManifest))
+	if err != nil {
+		return
+	}
+	var saved []musicFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		md.rt.logger.Printf("Ignoring %s: %s", downloadManifest, err.Error())
+		return
+	}
+	for _, f := range saved {
+		// prune removes these, so only the ones a manifest could have had
+		if !goodMusicName(f.Name) {
+			md.rt.logger.Printf("Ignoring '%s' in %s", f.Name, downloadManifest)
+			continue
+		}
+		md.saved[f.Name] = f
+	}
+}
+
+func (md *musicDownloader) writeSaved() error {
+	md.mutex.Lock()
+	saved := make([]musicFile, 0, len(md.saved))
+	for _, f := range md.saved {
+		saved = append(saved, f)
+	}
+	md.mutex.Unlock()
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Name < saved[j].Name })
+	data, _ := json.MarshalIndent(saved, "", "  ")
+	return writeFileAtomic(filepath.Join(md.dir, downloadManifest), data)
+}
+
+func (md *musicDownloader) setSaved(f musicFile) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+	md.saved[f.Name] = f
+}
+
+func fileSHA256(fName string) (string, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// current - is what we have the file the manifest lists?  files we did
+// not download (or lost track of) are checked by hash, or by size if
+// that is all there is, and kept if there is nothing to check.
+func (md *musicDownloader) current(f musicFile) bool {
+	info, err := os.Stat(filepath.Join(md.dir, f.Name))
+	if err != nil {
+		return false
+	}
+	md.mutex.Lock()
+	saved, ok := md.saved[f.Name]
+	md.mutex.Unlock()
+	if ok {
+		return saved == f
+	}
+	if f.SHA256 != "" {
+		sum, err := fileSHA256(filepath.Join(md.dir, f.Name))
+		if err != nil || !strings.EqualFold(sum, f.SHA256) {
+			return false
+		}
+	} else if f.Size > 0 && info.Size() != f.Size {
+		return false
+	}
+	md.setSaved(f)
+	return true
+}
+
+// download writes to a temp file and only renames it into place once
+// the size and hash check out
+func (md *musicDownloader) download(f musicFile) error {
+	resp, err := md.get(f.Path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	tmp, err := ioutil.TempFile(md.dir, downloadPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return fmt.Errorf("Empty download")
+	}
+	if f.Size > 0 && size != f.Size {
+		return fmt.Errorf("Size is %d, expected %d", size, f.Size)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); f.SHA256 != "" && !strings.EqualFold(sum, f.SHA256) {
+		return fmt.Errorf("SHA256 is %s, expected %s", sum, f.SHA256)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(md.dir, f.Name))
+}
+
+// cleanup removes temp files left by a run that did not finish
+func (md *musicDownloader) cleanup() {
+	leftovers, _ := filepath.Glob(filepath.Join(md.dir, downloadPrefix+"*"))
+	for _, fName := range leftovers {
+		os.Remove(fName)
+	}
+}
+
+// prune removes files we downloaded that are no longer listed, files
+// that were put there some other way are left alone
+func (md *musicDownloader) prune(files []musicFile) []string {
+	listed := map[string]bool{}
+	for _, f := range files {
+		listed[f.Name] = true
+	}
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+	pruned := []string{}
+	for name := range md.saved {
+		if listed[name] {
+			continue
+		}
+		err := os.Remove(filepath.Join(md.dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			md.rt.logger.Printf("Failed to prune %s: %s", name, err.Error())
+			continue
+		}
+		md.rt.logger.Printf("Pruned %s", name)
+		delete(md.saved, name)
+		pruned = append(pruned, name)
+	}
+	sort.Strings(pruned)
+	return pruned
+}
+
+// downloadMusic brings musicPath up to date with the manifest at
+// musicDownloads (or the one from the config server), a few files at a
+// time.  only one run at a time, a
+// call while one is going is a no-op.
+func downloadMusic(rt runtimeConfig) {
+	if !rt.status.beginDownloads(rt.clock.Now()) {
+		rt.logger.Println("Music download already running")
+		return
+	}
+	md := newMusicDownloader(rt)
+	state := downloadDone
+	defer func() {
+		rt.status.updateDownloads(func(ds *downloadStatus) {
+			ds.State = state
+			ds.Finished = rt.clock.Now()
+		})
+	}()
+
+	url := musicManifest(rt.settings)
+	rt.logger.Printf("Downloading list from %s", url)
+	files, err := md.fetchManifest(url)
+	if err != nil {
+		rt.logger.Printf("Error: %s", err.Error())
+		rt.status.updateDownloads(func(ds *downloadStatus) { ds.Error = err.Error() })
+		state = downloadFailed
+		return
+	}
+	rt.logger.Printf("Received a list of %d files", len(files))
+	rt.status.updateDownloads(func(ds *downloadStatus) { ds.Total = len(files) })
+
+	if err := os.MkdirAll(md.dir, 0755); err != nil {
+		rt.logger.Printf("Error: %s", err.Error())
+		rt.status.updateDownloads(func(ds *downloadStatus) { ds.Error = err.Error() })
+		state = downloadFailed
+		return
+	}
+	md.cleanup()
+	md.loadSaved()
+
+	parallel := rt.settings.GetInt(sMusicParallel)
+	if parallel < 1 {
+		parallel = 1
+	}
+	slots := make(chan bool, parallel)
+	var running sync.WaitGroup
+	for _, f := range files {
+		if md.current(f) {
+			rt.status.updateDownloads(func(ds *downloadStatus) { ds.Current++ })
+			continue
+		}
+		running.Add(1)
+		slots <- true
+		go func(f musicFile) {
+			defer running.Done()
+			defer func() { <-slots }()
+			rt.logger.Printf("Downloading %s [%s]", f.Name, f.Path)
+			err := md.retry(f.Name, func() error { return md.download(f) })
+			if err != nil {
+				rt.logger.Printf("Failed to download %s: %s", f.Name, err.Error())
+				rt.status.updateDownloads(func(ds *downloadStatus) {
+					ds.Failed = append(ds.Failed, fmt.Sprintf("%s: %s", f.Name, err.Error()))
+				})
+				return
+			}
+			rt.logger.Printf("Saved %s", f.Name)
+			md.setSaved(f)
+			rt.status.updateDownloads(func(ds *downloadStatus) { ds.Fetched++ })
+		}(f)
+	}
+	running.Wait()
+
+	if rt.settings.GetBool(sMusicPrune) {
+		pruned := md.prune(files)
+		rt.status.updateDownloads(func(ds *downloadStatus) { ds.Pruned = pruned })
+	}
+	if err := md.writeSaved(); err != nil {
+		rt.logger.Printf("Failed to write %s: %s", downloadManifest, err.Error())
+	}
+	refreshLibrary(md.dir, rt.logger)
+	if len(rt.status.getDownloads().Failed) > 0 {
+		state = downloadFailed
+	}
+}
@@ -1,11 +1,10 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
-	"os"
+	"sort"
 	"time"
 
 	"golang.org/x/net/context"
@@ -14,8 +13,50 @@ import (
 )
 
 func (ge *gcalEvents) fetch(rt runtimeConfig) (*calendar.Events, error) {
-	settings := rt.settings
-	srv, err := ge.getCalendarService(rt, false)
+	return fetchAccounts(rt, calendarAccounts(rt.settings), ge.fetchAccount)
+}
+
+// fetchAccounts - every account's alarms, soonest first.  an account
+// that fails is skipped (and kept in the status) so the others still
+// ring, it is only an error when they all fail.
+func fetchAccounts(rt runtimeConfig, accounts []calendarAccount, fetchAccount func(runtimeConfig, calendarAccount) (*calendar.Events, error)) (*calendar.Events, error) {
+	all := &calendar.Events{}
+	failed := map[string]string{}
+	var lastErr error
+	for _, account := range accounts {
+		events, err := fetchAccount(rt, account)
+		if err != nil {
+			rt.logger.Printf("Error: account %s: %s, skipping it", account.label(), err.Error())
+			failed[account.label()] = err.Error()
+			lastErr = err
+			continue
+		}
+		all.Items = append(all.Items, events.Items...)
+	}
+	rt.status.setAccountErrors(failed)
+	if len(failed) == len(accounts) {
+		return nil, lastErr
+	}
+	sort.SliceStable(all.Items, func(i, j int) bool {
+		return eventStart(all.Items[i]).Before(eventStart(all.Items[j]))
+	})
+	return all, nil
+}
+
+// eventStart - when an event starts, all-day events at midnight
+func eventStart(event *calendar.Event) time.Time {
+	if event.Start == nil {
+		return time.Time{}
+	}
+	if when, err := time.Parse(time.RFC3339, event.Start.DateTime); err == nil {
+		return when
+	}
+	when, _ := time.Parse("2006-01-02", event.Start.Date)
+	return when
+}
+
+func (ge *gcalEvents) fetchAccount(rt runtimeConfig, account calendarAccount) (*calendar.Events, error) {
+	srv, err := ge.getCalendarService(rt, account, false)
 
 	if err != nil {
 		rt.logger.Printf("Failed to get calendar service")
@@ -23,7 +64,7 @@ func (ge *gcalEvents) fetch(rt runtimeConfig) (*calendar.Events, error) {
 	}
 
 	// map the calendar to an ID
-	calName := settings.GetString(sCalName)
+	calName := accountCalendar(rt.settings, account)
 	var id string
 	{
 		rt.logger.Println("get calendar list")
@@ -61,7 +102,7 @@ func (ge *gcalEvents) fetch(rt runtimeConfig) (*calendar.Events, error) {
 	return events, nil
 }
 
-func (ge *gcalEvents) getCalendarService(rt runtimeConfig, prompt bool) (*calendar.Service, error) {
+func (ge *gcalEvents) getCalendarService(rt runtimeConfig, account calendarAccount, prompt bool) (*calendar.Service, error) {
 	ctx := context.Background()
 
 	b, err := ioutil.ReadFile(rt.settings.GetString(sSecrets) + "/client_secret.json")
@@ -71,13 +112,13 @@ func (ge *gcalEvents) getCalendarService(rt runtimeConfig, prompt bool) (*calend
 	}
 
 	// If modifying these scopes, delete your previously saved credentials
-	// at ~/.credentials/piclock.json
+	// (the tokenPath setting, and each account's token)
 	config, err := google.ConfigFromJSON(b, calendar.CalendarReadonlyScope)
 	if err != nil {
 		rt.logger.Printf("Unable to parse client secret file to config: %v", err)
 		return nil, err
 	}
-	client, err := getClient(ctx, config, prompt)
+	client, err := getClient(ctx, config, rt.settings, account, prompt)
 	if err != nil {
 		rt.logger.Printf("Unable to retrieve calendar Client %v", err)
 		return nil, err
@@ -98,64 +139,7 @@ func (ge *gcalEvents) downloadMusicFiles(rt runtimeConfig, cE chan displayEffect
 }
 
 func (ge *gcalEvents) downloadMusicFilesLater(rt runtimeConfig, cE chan displayEffect) {
-	// this is currently dumb, it just uses a list from musicDownloads
-	// and walks through it, downloading to the music dir
-	jsonPath := rt.settings.GetString(sMusicURL)
-	rt.logger.Printf("Downloading list from " + jsonPath)
-
-	results := make(chan []byte, 20)
-
-	go func() {
-		results <- OOBFetch(jsonPath)
-	}()
-
-	var files []musicFile
-	err := json.Unmarshal(<-results, &files)
-
-	if err != nil {
-		rt.logger.Printf("Error unmarshalling files: " + err.Error())
-		return
-	}
-
-	musicPath := rt.settings.GetString(sMusicPath)
-	rt.logger.Printf("Received a list of %d files", len(files))
-
-	mp3Files := make([]chan []byte, len(files))
-	savePaths := make([]string, len(files))
-
-	for i := len(files) - 1; i >= 0; i-- {
-		// do we already have that file cached
-		savePaths[i] = musicPath + "/" + files[i].Name
-		// rt.logger.Printf("Checking for " + savePath)
-		if _, err := os.Stat(savePaths[i]); os.IsNotExist(err) {
-			mp3Files[i] = make(chan []byte, 20)
-			go func(i int) {
-				rt.logger.Println(fmt.Sprintf("Downloading %s [%s]", files[i].Name, files[i].Path))
-				mp3Files[i] <- OOBFetch(files[i].Path)
-			}(i)
-		}
-	}
-
-	for i := len(files) - 1; i >= 0; i-- {
-		if mp3Files[i] == nil {
-			continue
-		}
-
-		// write the file
-		data := <-mp3Files[i]
-		if data == nil || len(data) == 0 {
-			rt.logger.Printf("Skipping nil data for %s", savePaths[i])
-			continue
-		}
-
-		rt.logger.Printf("Saving %s", savePaths[i])
-		err = ioutil.WriteFile(savePaths[i], data, 0644)
-		if err != nil {
-			// handle error
-			rt.logger.Println(fmt.Sprintf("Failed to write %s: %s", savePaths[i], err.Error()))
-			continue
-		}
-	}
+	downloadMusic(rt)
 }
 
 func (ge *gcalEvents) loadAlarms(rt runtimeConfig, loadID int, report bool) {
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"strings"
 	"time"
 )
 
@@ -16,8 +17,9 @@ type alarm struct {
 	When      time.Time
 	Effect    int
 	Extra     string
-	started   bool // set to true when we're checking alarms and it fired
-	countdown bool // set to true when we're checking alarms and we signaled countdown
+	Options   string // "key=value key2" from the summary's #tags, see option()
+	started   bool   // set to true when we're checking alarms and it fired
+	countdown bool   // set to true when we're checking alarms and we signaled countdown
 }
 
 type loadedPayload struct {
@@ -50,9 +52,14 @@ type almStateMsg struct {
 	val interface{}
 }
 
+// musicFile - an entry in the musicDownloads manifest, size, sha256 and
+// version are optional.  a change to any of them downloads it again.
 type musicFile struct {
-	Name string `json:"name"`
-	Path string `json:"path"`
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Size    int64  `json:"size,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+	Version string `json:"version,omitempty"`
 }
 
 const (
@@ -60,10 +67,60 @@ const (
 	almMusic
 	almRandom
 	almFile
+	almPlaylist
+	almRadio
 	// to pick randomly, provide a max
 	almMax
 )
 
+// the "defaultEffect" choices, what an alarm that names no effect plays
+const (
+	effectRandom = "random"
+	effectTones  = "tones"
+	effectRadio  = "radio"
+)
+
+// alarmEffect - what the alarm plays, the "defaultEffect" setting is
+// read when it goes off so a profile can change it
+func alarmEffect(rt runtimeConfig, alm *alarm) int {
+	if alm.Effect != almRandom {
+		return alm.Effect
+	}
+	switch rt.settings.GetString(sDefaultEffect) {
+	case effectTones:
+		return almTones
+	case effectRadio:
+		return almRadio
+	}
+	return almRandom
+}
+
+// parseAlarmOptions pulls "#key=value" (or a bare "#key") tags out of
+// an event summary, returning what is left and the tags without the #
+func parseAlarmOptions(summary string) (string, string) {
+	words := make([]string, 0)
+	options := make([]string, 0)
+	for _, word := range strings.Fields(summary) {
+		if len(word) < 2 || word[0] != '#' {
+			words = append(words, word)
+		} else {
+			options = append(options, word[1:])
+		}
+	}
+	return strings.Join(words, " "), strings.Join(options, " ")
+}
+
+// option returns the value of an alarm tag, "" if it is not set
+func (alm *alarm) option(key string) string {
+	for _, opt := range strings.Fields(alm.Options) {
+		kv := strings.SplitN(opt, "=", 2)
+		if kv[0] == key && len(kv) == 2 {
+			return kv[1]
+		}
+	}
+	return ""
+}
+
 func handledMessage(alm alarm) almStateMsg {
 	return almStateMsg{ID: msgHandled, val: alm}
 }
@@ -215,7 +272,7 @@ func runGetAlarms(rt runtimeConfig) {
 				case msgReload:
 					reload = true
 					forceReload = true
-					comms.effects <- printEffect("rLd", dPrintBriefDuration)
+					comms.effects <- deduped(printEffect("rLd", dPrintBriefDuration), "reload", 0)
 				case msgLoaded:
 					// decide if we display a message or not
 					// it's possible we launched a bunch of loadAlarms threads
@@ -225,7 +282,9 @@ func runGetAlarms(rt runtimeConfig) {
 					if loadedPayload.loadID == curReloadID {
 						// force reload -> show alarm count
 						if loadedPayload.report {
-							comms.effects <- printRollingEffect(fmt.Sprintf("found %d", len(loadedPayload.alarms)), dRollingPrint)
+							found := printRollingEffect(fmt.Sprintf("found %d", len(loadedPayload.alarms)), dRollingPrint)
+							found = expiring(prioritized(found, prioLow), rt.clock.Now().Add(dPrintExpiry))
+							comms.effects <- deduped(found, "found", 0)
 						}
 					} else {
 						rt.logger.Printf("Skipping old loadID %v", loadedPayload.loadID)
@@ -340,22 +399,10 @@ func getAlarmsFromService(rt runtimeConfig) ([]alarm, error) {
 				continue
 			}
 
-			alm := alarm{ID: i.Id, Name: i.Summary, When: when, started: false}
-
-			// look for hashtags (does not work ATM, the gAPI is broken I think)
-
-			// priority is arbitrary except for random (default)
-			if m, _ := regexp.MatchString("[Mm]usic .*", i.Summary); m {
-				alm.Effect = almMusic
-				alm.Extra = i.Summary[6:]
-			} else if m, _ := regexp.MatchString("[Ff]ile .*", i.Summary); m {
-				alm.Effect = almFile
-				alm.Extra = i.Summary[5:]
-			} else if m, _ := regexp.MatchString("[Tt]one.*", i.Summary); m {
-				alm.Effect = almTones // TODO: tone options?
-			} else {
-				alm.Effect = almRandom
-			}
+			// look for hashtags, e.g. "music bowie #anim=spinner"
+			summary, options := parseAlarmOptions(i.Summary)
+			alm := alarm{ID: i.Id, Name: summary, When: when, Options: options, started: false}
+			alm.Effect, alm.Extra = parseAlarmEffect(summary)
 
 			rt.logger.Printf("Alarm: %v", alm)
 			alarms = append(alarms, alm)
@@ -367,3 +414,32 @@ func getAlarmsFromService(rt runtimeConfig) ([]alarm, error) {
 
 	return alarms, nil
 }
+
+// alarmKeyword - does the summary start with keyword (a pattern, any
+// case)?  returns what follows it
+func alarmKeyword(summary string, keyword string) (string, bool) {
+	m := regexp.MustCompile(`^(?is)` + keyword + `(.*)$`).FindStringSubmatch(summary)
+	if m == nil {
+		return "", false
+	}
+	return strings.TrimSpace(m[1]), true
+}
+
+// parseAlarmEffect - what the alarm does and what with, from its summary.
+// priority is arbitrary except for random (default)
+func parseAlarmEffect(summary string) (int, string) {
+	if extra, ok := alarmKeyword(summary, `music\s`); ok {
+		return almMusic, extra
+	} else if extra, ok := alarmKeyword(summary, `file\s`); ok {
+		return almFile, extra
+	} else if extra, ok := alarmKeyword(summary, `playlist\s`); ok {
+		return almPlaylist, extra
+	} else if extra, ok := alarmKeyword(summary, `radio\b`); ok {
+		// "radio jazz", or just "radio #stream=..."
+		return almRadio, extra
+	} else if extra, ok := alarmKeyword(summary, `tones?\b`); ok {
+		// "tone siren" (or "tones siren") picks a pattern
+		return almTones, extra
+	}
+	return almRandom, ""
+}
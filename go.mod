@@ -3,6 +3,7 @@ module dscheirer.com/piclock
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v0.4.1
 	github.com/bobertlo/go-mpg123 v0.0.0-20181204193349-1720ab305de3
 	github.com/gordonklaus/portaudio v0.0.0-20180817120803-00e7307ccd93
 	github.com/gorilla/mux v1.7.4
@@ -15,5 +16,6 @@ require (
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	google.golang.org/api v0.17.0
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
+	gopkg.in/yaml.v2 v2.4.0
 	gotest.tools v2.2.0+incompatible
 )
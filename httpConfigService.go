@@ -15,24 +15,8 @@ type httpConfigService struct {
 
 func (h *httpConfigService) launch(handler *APIHandler, addr string) {
 	h.handler = handler
-	// start a web server that handles JSON and static content
-	r := mux.NewRouter()
-
-	// start a web server that handles JSON and static content
-	// auth middleware
-	r.Use(handler.BasicAuth)
-	// static server
-	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static")))).Methods("GET")
-	// api server
-	r.HandleFunc("/api/status", handler.apiStatus).Methods("GET")
-	r.HandleFunc("/api/secret", handler.apiSecret).Methods("POST")
-	r.HandleFunc("/api/oauth", handler.apiOauth).Methods("POST")
-	// r.HandleFunc("/api/{cmd}", handler.apiError)
-
-	// root handler
-	r.HandleFunc("/", handler.rootHandler)
 	// give the mux to http
-	http.Handle("/", r)
+	http.Handle("/", newRouter(handler))
 
 	srv := &http.Server{Addr: addr}
 
@@ -49,6 +33,40 @@ func (h *httpConfigService) launch(handler *APIHandler, addr string) {
 	}()
 }
 
+// newRouter - the web server that handles JSON and static content
+func newRouter(handler *APIHandler) *mux.Router {
+	r := mux.NewRouter()
+
+	// auth middleware, and anything that is not a GET needs the settingsToken
+	r.Use(handler.BasicAuth, handler.TokenAuth)
+	// static server
+	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static")))).Methods("GET")
+	// api server
+	r.HandleFunc("/api/status", handler.apiStatus).Methods("GET")
+	r.HandleFunc("/api/display", handler.apiDisplay).Methods("GET")
+	r.HandleFunc("/api/volume", handler.apiVolume).Methods("GET")
+	r.HandleFunc("/api/volume", handler.apiSetVolume).Methods("PUT")
+	r.HandleFunc("/api/music", handler.apiMusic).Methods("GET")
+	r.HandleFunc("/api/audio", handler.apiAudio).Methods("GET")
+	r.HandleFunc("/api/audio/check", handler.apiAudioCheck).Methods("POST")
+	r.HandleFunc("/api/audio/test", handler.apiAudioTest).Methods("POST")
+	r.HandleFunc("/api/sleep", handler.apiSleep).Methods("GET")
+	r.HandleFunc("/api/sleep", handler.apiSetSleep).Methods("PUT")
+	r.HandleFunc("/api/reload", handler.apiReload).Methods("POST")
+	r.HandleFunc("/api/settings", handler.apiSettings).Methods("GET")
+	r.HandleFunc("/api/settings", handler.apiPatchSettings).Methods("PATCH")
+	r.HandleFunc("/api/profile", handler.apiProfile).Methods("GET")
+	r.HandleFunc("/api/profile", handler.apiSetProfile).Methods("PUT")
+	r.HandleFunc("/api/pull", handler.apiPull).Methods("GET")
+	r.HandleFunc("/api/secret", handler.apiSecret).Methods("POST")
+	r.HandleFunc("/api/oauth", handler.apiOauth).Methods("POST")
+	// r.HandleFunc("/api/{cmd}", handler.apiError)
+
+	// root handler
+	r.HandleFunc("/", handler.rootHandler)
+	return r
+}
+
 func (h *httpConfigService) stop() {
 	h.srv.Shutdown(context.Background())
 }
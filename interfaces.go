@@ -3,13 +3,24 @@ package main
 import (
 	"time"
 
+	"dscheirer.com/piclock/sevenseg_backpack"
 	"github.com/stianeikeland/go-rpio"
 	"google.golang.org/api/calendar/v3"
 )
 
 type sounds interface {
-	playIt(rt runtimeConfig, sfreqs []string, timing []string, stop chan bool, done chan bool)
-	playMP3(rt runtimeConfig, fName string, loop bool, stop chan bool, done chan bool)
+	playIt(rt runtimeConfig, pattern tonePattern, stop chan bool, done chan bool)
+	playTracks(rt runtimeConfig, tracks []string, opts playOptions, stop chan bool, done chan bool)
+	playStream(rt runtimeConfig, url string, opts playOptions, fallback func(stop chan bool, done chan bool), stop chan bool, done chan bool)
+}
+
+type speaker interface {
+	// speak blocks until text has been said
+	speak(rt runtimeConfig, text string) error
+}
+
+type mixer interface {
+	setVolume(rt runtimeConfig, level int) error
 }
 
 type buttons interface {
@@ -31,6 +42,7 @@ type display interface {
 	RefreshOn(on bool) error
 	ClearDisplay()
 	SegmentOn(pos byte, seg byte, on bool) error
+	Snapshot() sevenseg_backpack.Snapshot
 }
 
 type led interface {
@@ -42,7 +54,7 @@ type led interface {
 
 type events interface {
 	fetch(rt runtimeConfig) (*calendar.Events, error)
-	getCalendarService(rt runtimeConfig, prompt bool) (*calendar.Service, error)
+	getCalendarService(rt runtimeConfig, account calendarAccount, prompt bool) (*calendar.Service, error)
 	loadAlarms(rt runtimeConfig, loadID int, report bool)
 	downloadMusicFiles(rt runtimeConfig, cE chan displayEffect)
 	generateSecret(rt runtimeConfig) string
@@ -59,6 +59,16 @@ func setLEDEffect(effect ledEffect) ledEffect {
 	return effect
 }
 
+// setLED drives the pin and mirrors the state for the virtual display
+func setLED(rt runtimeConfig, pin int, on bool) {
+	if on {
+		rt.led.on(pin)
+	} else {
+		rt.led.off(pin)
+	}
+	rt.status.setLED(pin, on)
+}
+
 func startLEDController(rt runtimeConfig) {
 	rt.logger = &ThreadLogger{name: "LEDs"}
 	go runLEDController(rt)
@@ -72,7 +82,7 @@ func runLEDController(rt runtimeConfig) {
 	defer func() {
 		rt.logger.Printf("Exiting runLEDController")
 		for _, v := range leds {
-			rt.led.off(v.pin)
+			setLED(rt, v.pin, false)
 		}
 	}()
 
@@ -120,10 +130,10 @@ func runLEDController(rt runtimeConfig) {
 			if v.curMode == modeUnset {
 				// transform broader categories of mode to on/off
 				if v.mode == modeOff {
-					rt.led.off(v.pin)
+					setLED(rt, v.pin, false)
 					v.curMode = modeOff
 				} else {
-					rt.led.on(v.pin)
+					setLED(rt, v.pin, true)
 					v.curMode = modeOn
 				}
 				v.lastUpdate = now
@@ -139,7 +149,7 @@ func runLEDController(rt runtimeConfig) {
 			// duration expired means turn it off
 			if v.duration > 0 && now.Sub(v.startTime) >= v.duration {
 				if v.curMode != modeOff {
-					rt.led.off(v.pin)
+					setLED(rt, v.pin, false)
 				}
 				// negative duration is expired
 				// TODO: remove from the map to make processing faster
@@ -177,14 +187,14 @@ func runLEDController(rt runtimeConfig) {
 
 			if v.curMode == modeOff {
 				if timeInState >= downTime*time.Millisecond {
-					rt.led.on(v.pin)
+					setLED(rt, v.pin, true)
 					v.curMode = modeOn
 					v.lastUpdate = now
 					leds[i] = v
 				}
 			} else {
 				if upTime < 1000 && timeInState >= upTime*time.Millisecond {
-					rt.led.off(v.pin)
+					setLED(rt, v.pin, false)
 					v.curMode = modeOff
 					v.lastUpdate = now
 					leds[i] = v
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode"
+)
+
+// libraryTrack - one playable file in musicPath and its tags
+type libraryTrack struct {
+	Path     string        `json:"path"` // relative to musicPath
+	Title    string        `json:"title"`
+	Artist   string        `json:"artist"`
+	Album    string        `json:"album"`
+	Seconds  float64       `json:"seconds"`
+	Duration time.Duration `json:"-"`
+}
+
+// tags are only re-read when a file changes
+type cachedTags struct {
+	modTime time.Time
+	size    int64
+	tags    trackTags
+}
+
+var tagCache = struct {
+	sync.Mutex
+	files map[string]cachedTags
+}{files: map[string]cachedTags{}}
+
+func cachedReadTags(path string, modTime time.Time, size int64) (trackTags, error) {
+	tagCache.Lock()
+	defer tagCache.Unlock()
+	if c, ok := tagCache.files[path]; ok && c.modTime.Equal(modTime) && c.size == size {
+		return c.tags, nil
+	}
+	tags, err := readTags(path)
+	if err != nil {
+		return tags, err
+	}
+	tagCache.files[path] = cachedTags{modTime: modTime, size: size, tags: tags}
+	return tags, nil
+}
+
+// scanLibrary indexes every track under dir (see libraryTracks), a file
+// with bad tags is still listed, just without them
+func scanLibrary(dir string, logger flogger) ([]libraryTrack, error) {
+	paths, err := libraryTracks(dir)
+	if err != nil {
+		return nil, err
+	}
+	tracks := make([]libraryTrack, 0, len(paths))
+	for _, path := range paths {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			rel = path
+		}
+		track := libraryTrack{Path: rel}
+		if info, err := os.Stat(path); err == nil {
+			tags, err := cachedReadTags(path, info.ModTime(), info.Size())
+			if err != nil {
+				logger.Printf("Tags for %s: %s", path, err.Error())
+			}
+			track.Title = tags.title
+			track.Artist = tags.artist
+			track.Album = tags.album
+			track.Duration = tags.duration
+			track.Seconds = tags.duration.Seconds()
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks, nil
+}
+
+// libraryIndex - the last scan of musicPath.  an alarm resolves its
+// tracks from here, walking the library and reading its tags would hold
+// up the effects thread.
+var libraryIndex = struct {
+	sync.Mutex
+	dir      string
+	tracks   []libraryTrack
+	scanning bool
+}{}
+
+// refreshLibrary rescans dir into the index, unless a scan is already
+// running.  it is called at startup, after the music downloads and each
+// time the index is used.
+func refreshLibrary(dir string, logger flogger) {
+	libraryIndex.Lock()
+	if libraryIndex.scanning {
+		libraryIndex.Unlock()
+		return
+	}
+	libraryIndex.scanning = true
+	libraryIndex.Unlock()
+
+	tracks, err := scanLibrary(dir, logger)
+	libraryIndex.Lock()
+	defer libraryIndex.Unlock()
+	libraryIndex.scanning = false
+	if err != nil {
+		logger.Printf("Error: %s", err.Error())
+		return
+	}
+	libraryIndex.dir = dir
+	libraryIndex.tracks = tracks
+}
+
+// indexedLibrary - the tracks in dir from the index, and a rescan in the
+// background for next time.  only a library that was never scanned (the
+// startup scan has not finished) is scanned while the caller waits.
+func indexedLibrary(dir string, logger flogger) ([]libraryTrack, error) {
+	libraryIndex.Lock()
+	tracks, ok := libraryIndex.tracks, libraryIndex.dir == dir
+	libraryIndex.Unlock()
+	if !ok {
+		tracks, err := scanLibrary(dir, logger)
+		if err != nil {
+			return nil, err
+		}
+		libraryIndex.Lock()
+		libraryIndex.dir = dir
+		libraryIndex.tracks = tracks
+		libraryIndex.Unlock()
+		return tracks, nil
+	}
+	go refreshLibrary(dir, logger)
+	return tracks, nil
+}
+
+// indexedTracks - the files under dir, musicPath or a directory in it, as
+// libraryTracks has them but from the index
+func indexedTracks(rt runtimeConfig, dir string) ([]string, error) {
+	musicPath := rt.settings.GetString(sMusicPath)
+	rel, err := filepath.Rel(musicPath, dir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return libraryTracks(dir)
+	}
+	tracks, err := indexedLibrary(musicPath, rt.logger)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, track := range tracks {
+		if rel == "." || strings.HasPrefix(track.Path, rel+string(filepath.Separator)) {
+			paths = append(paths, filepath.Join(musicPath, track.Path))
+		}
+	}
+	return paths, nil
+}
+
+// name is the file name without the extension
+func (track libraryTrack) name() string {
+	base := filepath.Base(track.Path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// words - lower case letters and digits, everything else splits
+func words(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func levenshtein(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// similarity is 1 for the same word down to 0 for nothing in common
+func similarity(a string, b string) float64 {
+	longest := len([]rune(a))
+	if l := len([]rune(b)); l > longest {
+		longest = l
+	}
+	if longest == 0 {
+		return 0
+	}
+	return 1 - float64(levenshtein(a, b))/float64(longest)
+}
+
+// how close a word has to be to count as a typo
+const matchSimilarity = 0.75
+
+// trackMatch - how well a track matches a query, and why
+type trackMatch struct {
+	track  libraryTrack
+	score  float64
+	reason string
+}
+
+// matchTrack scores one track: the whole query as the file name, title
+// or artist beats every query word in the tags and file name, which
+// beats every query word being close to one of them
+func matchTrack(track libraryTrack, query []string) trackMatch {
+	joined := strings.Join(query, " ")
+	fields := []struct {
+		kind  string
+		value string
+		score float64
+	}{
+		{"file name", track.name(), 100},
+		{"title", track.Title, 95},
+		{"artist", track.Artist, 90},
+		{"album", track.Album, 80},
+	}
+	for _, field := range fields {
+		if field.value != "" && strings.Join(words(field.value), " ") == joined {
+			return trackMatch{track: track, score: field.score, reason: fmt.Sprintf("%s \"%s\"", field.kind, field.value)}
+		}
+	}
+
+	all := make([]string, 0)
+	for _, field := range fields {
+		all = append(all, words(field.value)...)
+	}
+	if len(all) == 0 || len(query) == 0 {
+		return trackMatch{track: track}
+	}
+	described := fmt.Sprintf("\"%s\"", track.Path)
+	if track.Title != "" {
+		described = fmt.Sprintf("\"%s - %s\"", track.Artist, track.Title)
+	}
+
+	contained := 0
+	total := 0.0
+	for _, q := range query {
+		best := 0.0
+		for _, w := range all {
+			if strings.HasPrefix(w, q) {
+				best = 1
+				break
+			}
+			if s := similarity(q, w); s > best {
+				best = s
+			}
+		}
+		if best == 1 {
+			contained++
+		} else if best < matchSimilarity {
+			return trackMatch{track: track}
+		}
+		total += best
+	}
+	if contained == len(query) {
+		return trackMatch{track: track, score: 70, reason: fmt.Sprintf("words in %s", described)}
+	}
+	closeness := total / float64(len(query))
+	return trackMatch{track: track, score: 60 * closeness, reason: fmt.Sprintf("close to %s (%.2f)", described, closeness)}
+}
+
+// bestTracks - the highest scoring matches, ties in path order
+func bestTracks(tracks []libraryTrack, name string) []trackMatch {
+	query := words(name)
+	best := make([]trackMatch, 0)
+	for _, track := range tracks {
+		m := matchTrack(track, query)
+		switch {
+		case m.score <= 0:
+		case len(best) == 0 || m.score > best[0].score:
+			best = []trackMatch{m}
+		case m.score == best[0].score:
+			best = append(best, m)
+		}
+	}
+	sort.Slice(best, func(i, j int) bool { return best[i].track.Path < best[j].track.Path })
+	return best
+}
+
+// findTrack resolves "music <name>" against the library index, several
+// equally good matches (every track by an artist) are picked from at random
+func findTrack(rt runtimeConfig, name string) (string, bool) {
+	musicPath := rt.settings.GetString(sMusicPath)
+	tracks, err := indexedLibrary(musicPath, rt.logger)
+	if err != nil {
+		rt.logger.Printf("Error: %s", err.Error())
+		return "", false
+	}
+	best := bestTracks(tracks, name)
+	if len(best) == 0 {
+		rt.logger.Printf("No track in %s matches '%s'", musicPath, name)
+		return "", false
+	}
+	choice := best[0]
+	if len(best) > 1 {
+		choice = best[rand.New(rand.NewSource(rt.clock.Now().UnixNano())).Intn(len(best))]
+	}
+	rt.logger.Printf("Music '%s': %s, matched %s (1 of %d)", name, choice.track.Path, choice.reason, len(best))
+	return filepath.Join(musicPath, choice.track.Path), true
+}
+
+type musicResponse struct {
+	Path   string         `json:"path"`
+	Tracks []libraryTrack `json:"tracks"`
+	Match  *musicMatch    `json:"match,omitempty"`
+}
+
+type musicMatch struct {
+	Query  string   `json:"query"`
+	Tracks []string `json:"tracks"`
+	Reason string   `json:"reason"`
+}
+
+// apiMusic lists the library, ?match=<name> also shows what "music <name>"
+// would play
+func (m *APIHandler) apiMusic(w http.ResponseWriter, r *http.Request) {
+	musicPath := m.rt.settings.GetString(sMusicPath)
+	tracks, err := scanLibrary(musicPath, m.rt.logger)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := musicResponse{Path: musicPath, Tracks: tracks}
+	if query := r.URL.Query().Get("match"); query != "" {
+		resp.Match = &musicMatch{Query: query, Tracks: []string{}}
+		for _, match := range bestTracks(tracks, query) {
+			resp.Match.Tracks = append(resp.Match.Tracks, match.track.Path)
+			if resp.Match.Reason == "" {
+				resp.Match.Reason = match.reason
+			}
+		}
+	}
+	output, _ := json.Marshal(resp)
+	w.Write(output)
+}
+
+// listMusic is the -music flag, a table of the library
+func listMusic(settings configSettings, out io.Writer) error {
+	musicPath := settings.GetString(sMusicPath)
+	tracks, err := scanLibrary(musicPath, &ThreadLogger{name: "Music"})
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "PATH\tARTIST\tTITLE\tALBUM\tLENGTH\n")
+	for _, track := range tracks {
+		length := "-"
+		if track.Duration > 0 {
+			length = track.Duration.Round(time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", track.Path, track.Artist, track.Title, track.Album, length)
+	}
+	fmt.Fprintf(tw, "%d tracks in %s\n", len(tracks), musicPath)
+	return tw.Flush()
+}
@@ -33,6 +33,12 @@ func (ld *logDisplay) OpenDisplay(settings configSettings) error {
 	ld.auditErrors = []error{}
 	// open the display in simulated mode
 	ld.ssb, _ = sevenseg_backpack.Open(0, 0, true)
+	glyphs, err := displayGlyphs(settings)
+	if err != nil {
+		return err
+	}
+	ld.ssb.SetGlyphs(glyphs)
+	ld.ssb.SetInverted(settings.GetBool(sInverted))
 
 	return nil
 }
@@ -117,3 +123,10 @@ func (ld *logDisplay) SegmentOn(pos byte, seg byte, on bool) error {
 	}
 	return err
 }
+
+func (ld *logDisplay) Snapshot() sevenseg_backpack.Snapshot {
+	if ld.ssb == nil {
+		return sevenseg_backpack.Snapshot{}
+	}
+	return ld.ssb.Snapshot()
+}
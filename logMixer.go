@@ -0,0 +1,32 @@
+package main
+
+import (
+	"sync"
+)
+
+// logMixer records the levels it was asked for
+type logMixer struct {
+	lock   sync.Mutex
+	levels []int
+	fail   error // returned from setVolume when set
+}
+
+func (lm *logMixer) setVolume(rt runtimeConfig, level int) error {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	rt.logger.Printf("Set volume to %d", level)
+	lm.levels = append(lm.levels, level)
+	return lm.fail
+}
+
+func (lm *logMixer) getLevels() []int {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	return append([]int{}, lm.levels...)
+}
+
+func (lm *logMixer) setFail(err error) {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	lm.fail = err
+}
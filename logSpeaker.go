@@ -0,0 +1,29 @@
+package main
+
+import (
+	"sync"
+)
+
+// logSpeaker records what it was asked to say, and whether the audio was
+// paused while it said it
+type logSpeaker struct {
+	lock   sync.Mutex
+	said   []string
+	paused []bool
+	fail   error // returned from speak when set
+}
+
+func (ls *logSpeaker) speak(rt runtimeConfig, text string) error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	rt.logger.Printf("Say '%s'", text)
+	ls.said = append(ls.said, text)
+	ls.paused = append(ls.paused, rt.status.isPaused())
+	return ls.fail
+}
+
+func (ls *logSpeaker) getSaid() ([]string, []bool) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	return append([]string{}, ls.said...), append([]bool{}, ls.paused...)
+}
@@ -7,7 +7,8 @@ import (
 	"time"
 )
 
-// piclock -config={config file}
+// piclock -config={config file} [-host={name}]
+// piclock -config={config file} config validate|dump|diff|migrate
 
 var wg sync.WaitGroup
 
@@ -20,14 +21,19 @@ func confirmCalendarAuth(settings configSettings) {
 		settings: settings,
 		logger:   &ThreadLogger{name: "confirmCalendarAuth"},
 	}
-	_, err := events.getCalendarService(rt, true)
-	if err == nil {
+	// each account has its own token
+	for _, account := range calendarAccounts(settings) {
+		if account.name != "" {
+			log.Printf("Account %s", account.name)
+		}
+		_, err := events.getCalendarService(rt, account, true)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
 		// success!
 		log.Println("OAuth successful")
-		return
 	}
-
-	log.Println(err)
 }
 
 func main() {
@@ -40,8 +46,28 @@ func main() {
 		return
 	}
 
+	// or the settings reference?
+	if args.settings {
+		settingsDoc(os.Stdout)
+		return
+	}
+
+	// whose overrides?
+	configHost = args.host
+
+	// or checking the config?
+	if len(args.command) > 0 {
+		os.Exit(runConfigCommand(args, os.Environ(), os.Stdout, os.Stderr))
+	}
+
 	// read config information
-	settings := initSettings(args.configFile)
+	settings := initSettings(args.configFile, args.sets)
+
+	// or what they add up to?
+	if args.effective {
+		settings.effectiveDoc(os.Stdout)
+		return
+	}
 
 	// are we just generating the oauth token?
 	if args.oauth {
@@ -49,10 +75,22 @@ func main() {
 		return
 	}
 
+	// or listing the music library?
+	if args.music {
+		if err := listMusic(settings, os.Stdout); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+
 	// first try to set up the log (optional)
 	setupLogging(settings, true)
 
 	log.Printf("STARTUP : %d\n", os.Getpid())
+	// an old config file still loads, piclock config migrate updates it
+	if version, err := configFileVersion(args.configFile); err == nil && version < currentConfigVersion {
+		log.Printf("Warning: %s is %s %d, piclock config migrate updates it to %d", args.configFile, sConfigVersion, version, currentConfigVersion)
+	}
 	// build features
 	var build string
 	for _, f := range features {
@@ -60,10 +98,15 @@ func main() {
 	}
 	log.Println("Build tags: " + build)
 
-	// dump them (debugging)
-	log.Println("\n>>> settings <<<")
-	settings.Dump()
-	log.Println("\n>>> settings <<<")
+	if host := hostConfigFile(args.configFile, settings.GetString(sHostConfigs)); host != "" {
+		log.Printf("Host overrides: %s", host)
+	}
+
+	// what is not the default (piclock config dump has the rest)
+	log.Println("Settings:")
+	for _, line := range settings.settingsDiff() {
+		log.Println("  " + line)
+	}
 
 	/*
 		Main app
@@ -75,6 +118,9 @@ func main() {
 	// start the sigterm thread
 	startWaitSigterm(rt)
 
+	// index the music library before an alarm needs it
+	go refreshLibrary(settings.GetString(sMusicPath), &ThreadLogger{name: "Music"})
+
 	// start the effect threads so we can update the LEDs
 	startLEDController(rt)
 	startEffects(rt)
@@ -94,6 +140,8 @@ func main() {
 	// launch the non-time dependant threads
 	startNTPWatcher(rt)
 	startWatchButtons(rt)
+	startAudioCheck(rt)
+	startReloadSettings(rt)
 	// optional config service
 	if settings.GetInt(sConfigSvc) > 0 {
 		startConfigService(rt)
@@ -108,6 +156,10 @@ func main() {
 	// launch time-dependant threads
 	startGetAlarms(rt)
 	startCheckAlarms(rt)
+	startProfiles(rt)
+
+	// and keep up with the config server, if there is one
+	startConfigPull(rt)
 
 	wg.Wait()
 }
@@ -1,7 +1,464 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	"gotest.tools/assert/cmp"
+)
 
 func TestMain(m *testing.M) {
 	piTestMain(m)
 }
+
+func TestSettingsSchema(t *testing.T) {
+	good := []string{
+		`{"brightness": 15}`,
+		`{"brightness": 0, "volume": 100, "configService": 0}`,
+		`{"audioBackend": "wav", "playOrder": "shuffle", "tts": ""}`,
+		`{"ledErr": 27, "i2cDevice": "0x71", "musicTimeout": "1s"}`,
+	}
+	for _, data := range good {
+		assert.NilError(t, defaultSettings().settingsFromJSON([]byte(data)), data)
+	}
+
+	bad := map[string]string{
+		`{"brightness": 16}`:             "brightness must be 0 - 15: 16",
+		`{"volume": -1}`:                 "volume must be 0 - 100: -1",
+		`{"musicParallel": 0}`:           "musicParallel must be 1 - 16: 0",
+		`{"ledErr": 28}`:                 "ledErr must be at most 27: 28",
+		`{"i2cDevice": 300}`:             "i2cDevice: 300 is not a byte",
+		`{"alarmRefreshTime": "1s"}`:     "alarmRefreshTime must be at least 10s: 1s",
+		`{"audioBackend": "gramophone"}`: `audioBackend must be one of "mpg123", "aplay", "ffplay", "command", "wav": "gramophone"`,
+	}
+	for data, msg := range bad {
+		assert.Error(t, defaultSettings().settingsFromJSON([]byte(data)), msg)
+	}
+}
+
+func TestUnknownSettings(t *testing.T) {
+	s := defaultSettings()
+	assert.NilError(t, s.settingsFromJSON([]byte(`{"ledError": 5, "brightnes": 7, "frobnicate": true}`)))
+	assert.DeepEqual(t, s.warnings, []string{
+		`Unknown setting "brightnes", did you mean "brightness"?`,
+		`Unknown setting "frobnicate"`,
+		`Unknown setting "ledError", did you mean "ledErr"?`,
+	})
+	// the known keys still load
+	assert.Equal(t, s.GetInt(sBrightness), 3)
+	assert.Equal(t, s.GetInt(sLEDErr), 6)
+
+	s = defaultSettings()
+	err := s.settingsFromJSON([]byte(`{"strictSettings": true, "ledError": 5}`))
+	assert.Error(t, err, `Unknown setting "ledError", did you mean "ledErr"?`)
+
+	// the shipped configs have no typos, once the old keys are migrated
+	for _, fName := range []string{"piclock.rpi.conf", "piclock.vscode.conf", cfgFile} {
+		data, err := ioutil.ReadFile(fName)
+		assert.NilError(t, err)
+		values, err := fileSettings(fName, data)
+		assert.NilError(t, err, fName)
+		_, err = migrateSettings(values)
+		assert.NilError(t, err, fName)
+		s = defaultSettings()
+		assert.NilError(t, s.settingsFrom(values, fName), fName)
+		assert.DeepEqual(t, s.warnings, []string{})
+	}
+}
+
+func TestSettingsMismatch(t *testing.T) {
+	// a setting of the wrong type is logged and gives the default
+	s := defaultSettings()
+	s.settings[sBrightness] = "bright"
+	s.settings[sAlmRefresh] = 7
+	s.settings[sCalName] = nil
+	assert.Equal(t, s.GetInt(sBrightness), 3)
+	assert.Equal(t, s.GetDuration(sAlmRefresh), time.Minute)
+	assert.Equal(t, s.GetString(sCalName), "piclock")
+	assert.Equal(t, s.GetString("noSuchSetting"), "")
+}
+
+func TestSettingsDoc(t *testing.T) {
+	var doc bytes.Buffer
+	settingsDoc(&doc)
+	data, err := ioutil.ReadFile("SETTINGS.md")
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), doc.String(), "SETTINGS.md is stale, run piclock -settings > SETTINGS.md")
+}
+
+func TestSettingsFormats(t *testing.T) {
+	for _, fName := range []string{"./test/formats/piclock.json", "./test/formats/piclock.yaml", "./test/formats/piclock.toml"} {
+		s, err := loadSettings(fName, nil, nil)
+		assert.NilError(t, err, fName)
+		assert.DeepEqual(t, s.warnings, []string{})
+		assert.Equal(t, s.GetString(sCalName), "bedroom", fName)
+		assert.Equal(t, s.GetInt(sBrightness), 7, fName)
+		assert.Equal(t, s.GetByte(sI2CDev), byte(0x71), fName)
+		assert.Equal(t, s.GetDuration(sCountdown), 90*time.Second, fName)
+		assert.Equal(t, s.GetButtonMap(sMainBtn), buttonMap{pinNum: 5, key: "z", pullup: false}, fName)
+		stations := s.GetRadioStations(sStations)
+		assert.Equal(t, len(stations), 2, fName)
+		assert.Equal(t, stations[1].url, "https://example.com/news.m3u", fName)
+		assert.Equal(t, s.source(sBrightness), fName)
+		assert.Equal(t, s.source(sVolume), sourceDefault)
+	}
+
+	_, err := loadSettings("./test/formats/bad.yaml", nil, nil)
+	assert.ErrorContains(t, err, "./test/formats/bad.yaml: yaml:")
+	_, err = loadSettings("./test/formats/nope.toml", nil, nil)
+	assert.ErrorContains(t, err, "Could not load conf file './test/formats/nope.toml'")
+}
+
+func TestSettingsLayers(t *testing.T) {
+	env := []string{
+		"HOME=/root",
+		"PICLOCK_CONFIGSERVICE=0",
+		"PICLOCK_BRIGHTNESS=9",
+		"PICLOCK_MAINBUTTON={\"pin\": 6, \"key\": \"q\"}",
+		"PICLOCK_BLINKTIME=false",
+		"PICLOCK_FROBNICATE=1",
+	}
+	sets := []string{"brightness=11", "calendar=kitchen"}
+
+	// defaults < file < env < -set
+	s, err := loadSettings("./test/formats/piclock.yaml", env, sets)
+	assert.NilError(t, err)
+	assert.Equal(t, s.GetInt(sConfigSvc), 0)
+	assert.Equal(t, s.source(sConfigSvc), sourceEnv)
+	assert.Equal(t, s.GetInt(sBrightness), 11)
+	assert.Equal(t, s.source(sBrightness), sourceCLI)
+	assert.Equal(t, s.GetString(sCalName), "kitchen")
+	assert.Equal(t, s.GetButtonMap(sMainBtn), buttonMap{pinNum: 6, key: "q", pullup: true})
+	assert.Equal(t, s.GetBool(sBlink), false)
+	assert.Equal(t, s.GetDuration(sCountdown), 90*time.Second)
+	assert.Equal(t, s.source(sCountdown), "./test/formats/piclock.yaml")
+	assert.DeepEqual(t, s.warnings, []string{`env: Unknown setting "frobnicate"`})
+
+	_, err = loadSettings("./test/formats/piclock.yaml", []string{"PICLOCK_BRIGHTNESS=99"}, nil)
+	assert.Error(t, err, "env: brightness must be 0 - 15: 99")
+	_, err = loadSettings("./test/formats/piclock.yaml", nil, []string{"brightness"})
+	assert.Error(t, err, "-set: brightness is not key=value")
+	_, err = loadSettings("./test/formats/piclock.yaml", nil, []string{"strictSettings=true", "brightnes=3"})
+	assert.Error(t, err, `-set: Unknown setting "brightnes", did you mean "brightness"?`)
+}
+
+func TestEffectiveSettings(t *testing.T) {
+	s, err := loadSettings("./test/formats/piclock.toml", []string{"PICLOCK_VOLUME=50"}, []string{"sleepFade=1m"})
+	assert.NilError(t, err)
+	var out bytes.Buffer
+	s.effectiveDoc(&out)
+	lines := strings.Split(out.String(), "\n")
+	assert.Equal(t, len(lines), len(settingsSchema)+1)
+	assert.Assert(t, cmp.Contains(lines, `calendar = "bedroom" (string, ./test/formats/piclock.toml)`))
+	assert.Assert(t, cmp.Contains(lines, `volume = 50 (int, env)`))
+	assert.Assert(t, cmp.Contains(lines, `sleepFade = "1m0s" (duration, -set)`))
+	assert.Assert(t, cmp.Contains(lines, `mainButton = {"pin": 5, "key": "z", "pullup": false} (button, ./test/formats/piclock.toml)`))
+	assert.Assert(t, cmp.Contains(lines, `tones = [] (tones, default)`))
+}
+
+func TestUpdateSettingsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "piclock")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"piclock.json", "piclock.yaml", "piclock.toml"} {
+		data, err := ioutil.ReadFile(filepath.Join("test/formats", name))
+		assert.NilError(t, err)
+		fName := filepath.Join(dir, name)
+		assert.NilError(t, ioutil.WriteFile(fName, data, 0644))
+
+		changes := map[string]interface{}{sBrightness: 12.0, sVolumeRamp: "30s", sDblBtn: map[string]interface{}{"pin": 4.0, "key": "x"}}
+		assert.NilError(t, updateSettingsFile(fName, changes), name)
+		s, err := loadSettings(fName, nil, nil)
+		assert.NilError(t, err, name)
+		assert.Equal(t, s.GetInt(sBrightness), 12, name)
+		assert.Equal(t, s.GetDuration(sVolumeRamp), 30*time.Second, name)
+		assert.Equal(t, s.GetButtonMap(sDblBtn), buttonMap{pinNum: 4, key: "x", pullup: true}, name)
+		// and the rest is as it was
+		assert.Equal(t, s.GetString(sCalName), "bedroom", name)
+		assert.Equal(t, len(s.GetRadioStations(sStations)), 2, name)
+
+		// a second write of the same changes leaves it alone
+		data, _ = ioutil.ReadFile(fName)
+		assert.NilError(t, updateSettingsFile(fName, changes), name)
+		again, _ := ioutil.ReadFile(fName)
+		assert.Equal(t, string(again), string(data), name)
+	}
+
+	// the keys stay in order, and the comments stay
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "piclock.yaml"))
+	assert.Assert(t, strings.HasPrefix(string(data), "# the same settings as piclock.toml and piclock.json\ncalendar: bedroom\nbrightness: 12\n"), string(data))
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "piclock.toml"))
+	assert.Assert(t, strings.HasPrefix(string(data), "# the same settings as piclock.yaml and piclock.json\ncalendar = \"bedroom\"\nbrightness = 12\n"), string(data))
+	assert.Assert(t, strings.HasSuffix(string(data), "volumeRamp = \"30s\"\n\n[mainButton]\npin = 5\nkey = \"z\"\npullup = false\n\n[[stations]]\nname = \"jazz\"\nurl = \"http://example.com/jazz.mp3\"\n\n[[stations]]\nname = \"news\"\nurl = \"https://example.com/news.m3u\"\n\n[doubleButton]\nkey = \"x\"\npin = 4\n"), string(data))
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "piclock.json"))
+	assert.Assert(t, strings.HasPrefix(string(data), "{\n  \"calendar\": \"bedroom\",\n  \"brightness\": 12,\n"), string(data))
+
+	// and "key" : value stays that way
+	fName := filepath.Join(dir, "spaced.conf")
+	assert.NilError(t, ioutil.WriteFile(fName, []byte("{\n  \"calendar\" : \"piclock\",\n  \"strobe\" : false\n}\n"), 0644))
+	assert.NilError(t, updateSettingsFile(fName, map[string]interface{}{sStrobe: true}))
+	data, _ = ioutil.ReadFile(fName)
+	assert.Equal(t, string(data), "{\n  \"calendar\" : \"piclock\",\n  \"strobe\" : true\n}\n")
+
+	// only the changed line of the config the clock ships with changes
+	original, err := ioutil.ReadFile("piclock.rpi.conf")
+	assert.NilError(t, err)
+	fName = filepath.Join(dir, "piclock.rpi.conf")
+	assert.NilError(t, ioutil.WriteFile(fName, original, 0644))
+	assert.NilError(t, updateSettingsFile(fName, map[string]interface{}{sBrightness: 4.0}))
+	data, _ = ioutil.ReadFile(fName)
+	assert.Equal(t, string(data), strings.Replace(string(original), "\"brightness\": 15,", "\"brightness\": 4,", 1))
+	assert.NilError(t, updateSettingsFile(fName, map[string]interface{}{sBrightness: 15.0}))
+	data, _ = ioutil.ReadFile(fName)
+	assert.Equal(t, string(data), string(original))
+}
+
+func TestConfigCommand(t *testing.T) {
+	run := func(configFile string, env []string, sets []string, command ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := runConfigCommand(cliArgs{configFile: configFile, sets: sets, command: command}, env, &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, out, errs := run("./test/formats/piclock.yaml", nil, nil, "config", "validate")
+	assert.Equal(t, code, exitOK)
+	assert.Equal(t, out, "./test/formats/piclock.yaml is valid\n")
+	assert.Equal(t, errs, "")
+
+	// every problem, not just the first
+	code, out, errs = run("./test/formats/problems.json", []string{"PICLOCK_SLEEPFADE=soon"}, []string{"musicParallel=0"}, "config", "validate")
+	assert.Equal(t, code, exitInvalid)
+	assert.Equal(t, out, "")
+	assert.Equal(t, errs, `Error: ./test/formats/problems.json: brightness must be 0 - 15: 20
+Error: ./test/formats/problems.json: audioBackend must be one of "mpg123", "aplay", "ffplay", "command", "wav": "gramophone"
+Error: ./test/formats/problems.json: volume: strconv.ParseInt: parsing "loud": invalid syntax
+Error: env: sleepFade: time: invalid duration "soon"
+Error: -set: musicParallel must be 1 - 16: 0
+Warning: ./test/formats/problems.json: configVersion 1: ledError renamed ledErr
+`)
+
+	// unknown keys fail in strict mode, in a file that is up to date
+	code, _, errs = run("./test/formats/strict.json", nil, nil, "config", "validate")
+	assert.Equal(t, code, exitInvalid)
+	assert.Equal(t, errs, "Error: ./test/formats/strict.json: Unknown setting \"ledError\", did you mean \"ledErr\"?\n")
+
+	code, _, errs = run("./test/formats/nope.json", nil, nil, "config", "validate")
+	assert.Equal(t, code, exitInvalid)
+	assert.Equal(t, errs, "Error: Could not load conf file './test/formats/nope.json': open ./test/formats/nope.json: no such file or directory\n")
+
+	code, out, _ = run("./test/formats/piclock.toml", nil, []string{"volume=30"}, "config", "diff")
+	assert.Equal(t, code, exitOK)
+	assert.Equal(t, out, `calendar = "bedroom" (default "piclock", ./test/formats/piclock.toml)
+countdownTime = "1m30s" (default "1m0s", ./test/formats/piclock.toml)
+i2cDevice = 113 (default 112, ./test/formats/piclock.toml)
+brightness = 7 (default 3, ./test/formats/piclock.toml)
+mainButton = {"pin": 5, "key": "z", "pullup": false} (default {"pin": 25, "key": "a", "pullup": true}, ./test/formats/piclock.toml)
+audioBackend = "wav" (default "mpg123", ./test/formats/piclock.toml)
+volume = 30 (default 80, -set)
+stations = [{name:jazz url:http://example.com/jazz.mp3} {name:news url:https://example.com/news.m3u}] (default [], ./test/formats/piclock.toml)
+`)
+
+	code, out, _ = run("./test/formats/piclock.toml", nil, nil, "config", "dump")
+	assert.Equal(t, code, exitOK)
+	assert.Equal(t, strings.Count(out, "\n"), len(settingsSchema))
+	code, _, _ = run("./test/formats/problems.json", nil, nil, "config", "dump")
+	assert.Equal(t, code, exitInvalid)
+
+	code, _, errs = run("./test/formats/piclock.toml", nil, nil, "config", "check")
+	assert.Equal(t, code, exitUsage)
+	assert.Equal(t, errs, configUsage+"\n")
+	code, _, _ = run("./test/formats/piclock.toml", nil, nil, "config")
+	assert.Equal(t, code, exitUsage)
+	code, _, _ = run("./test/formats/piclock.toml", nil, nil, "music", "list")
+	assert.Equal(t, code, exitUsage)
+}
+
+// testMigrateValues - a fixture under test/migrate the way a config file
+// is read
+func testMigrateValues(t *testing.T, name string) map[string]interface{} {
+	fName := filepath.Join("test/migrate", name)
+	data, err := ioutil.ReadFile(fName)
+	assert.NilError(t, err)
+	values, err := fileSettings(fName, data)
+	assert.NilError(t, err)
+	return values
+}
+
+func TestMigrateRenames(t *testing.T) {
+	values := testMigrateValues(t, "v0.json")
+	changes := configMigrations[0].migrate(values)
+	assert.DeepEqual(t, changes, []string{"ledError renamed ledErr"})
+	assert.DeepEqual(t, values, testMigrateValues(t, "v1.json"))
+
+	// the new key wins
+	values = map[string]interface{}{"ledError": 5.0, sLEDErr: 7.0}
+	changes = configMigrations[0].migrate(values)
+	assert.DeepEqual(t, changes, []string{"ledError dropped, ledErr is set"})
+	assert.DeepEqual(t, values, map[string]interface{}{sLEDErr: 7.0})
+}
+
+func TestMigrateSettings(t *testing.T) {
+	// the whole chain, from the version in the file
+	values := testMigrateValues(t, "v0.json")
+	changes, err := migrateSettings(values)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes, []string{"configVersion 1: ledError renamed ledErr"})
+	want := testMigrateValues(t, "v1.json")
+	want[sConfigVersion] = currentConfigVersion
+	assert.DeepEqual(t, values, want)
+
+	// already current
+	changes, err = migrateSettings(want)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes, []string{})
+
+	_, err = migrateSettings(testMigrateValues(t, "newer.json"))
+	assert.Error(t, err, "configVersion 2 is newer than this piclock (1)")
+
+	// an old file loads as it is
+	s, err := loadSettings("test/migrate/v0.json", nil, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, s.GetByte(sLEDErr), byte(5))
+	assert.Equal(t, s.GetButtonMap(sDblBtn), buttonMap{pinNum: 6, key: "c", pullup: false})
+	assert.Equal(t, s.GetString(sButtons), sRPi)
+	assert.Equal(t, len(s.warnings), 1)
+
+	// startup only warns, the file is left as it is
+	version, err := configFileVersion("test/migrate/v0.json")
+	assert.NilError(t, err)
+	assert.Equal(t, version, 0)
+	version, err = configFileVersion(cfgFile)
+	assert.NilError(t, err)
+	assert.Equal(t, version, currentConfigVersion)
+}
+
+func TestMigrateConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "piclock")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"v0.json", "v0.yaml"} {
+		original, err := ioutil.ReadFile(filepath.Join("test/migrate", name))
+		assert.NilError(t, err)
+		fName := filepath.Join(dir, name)
+		assert.NilError(t, ioutil.WriteFile(fName, original, 0644))
+
+		changes, err := migrateConfigFile(fName)
+		assert.NilError(t, err, name)
+		assert.Equal(t, changes[len(changes)-1], "configVersion 0 -> 1, the old file is "+fName+".v0.bak")
+		backup, err := ioutil.ReadFile(fName + ".v0.bak")
+		assert.NilError(t, err, name)
+		assert.Equal(t, string(backup), string(original))
+
+		// no warnings, it is up to date
+		s, err := loadSettings(fName, nil, nil)
+		assert.NilError(t, err, name)
+		assert.DeepEqual(t, s.warnings, []string{})
+		assert.Equal(t, s.GetInt(sConfigVersion), currentConfigVersion)
+		assert.Equal(t, s.GetByte(sLEDErr), byte(5))
+		assert.Equal(t, s.GetInt(sBrightness), 4)
+
+		// and the second time has nothing to do
+		data, _ := ioutil.ReadFile(fName)
+		changes, err = migrateConfigFile(fName)
+		assert.NilError(t, err, name)
+		assert.DeepEqual(t, changes, []string{})
+		again, _ := ioutil.ReadFile(fName)
+		assert.Equal(t, string(again), string(data))
+	}
+
+	// the keys that were not migrated stay in their place
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "v0.yaml"))
+	assert.Assert(t, strings.HasPrefix(string(data), "calendar: piclock\nbrightness: 4\nledAlarm: 16\n"), string(data))
+	s, err := loadSettings(filepath.Join(dir, "v0.yaml"), nil, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, s.GetString(sButtons), sKeyboard)
+	assert.Equal(t, s.GetButtonMap(sLongBtn).key, "b")
+
+	_, err = migrateConfigFile("test/migrate/newer.json")
+	assert.Error(t, err, "configVersion 2 is newer than this piclock (1)")
+
+	var stdout, stderr bytes.Buffer
+	fName := filepath.Join(dir, "v0.json")
+	code := runConfigCommand(cliArgs{configFile: fName, command: []string{"config", "migrate"}}, nil, &stdout, &stderr)
+	assert.Equal(t, code, exitOK)
+	assert.Equal(t, stdout.String(), fName+" is up to date\n")
+}
+
+// testHostFile writes an override file for name next to the config file
+func testHostFile(t *testing.T, configFile string, name string, data string) string {
+	dir := filepath.Join(filepath.Dir(configFile), "hosts")
+	assert.NilError(t, os.MkdirAll(dir, 0755))
+	fName := filepath.Join(dir, name)
+	assert.NilError(t, ioutil.WriteFile(fName, []byte(data), 0644))
+	return fName
+}
+
+func TestHostConfig(t *testing.T) {
+	fName, cleanup := testConfigFile(t, map[string]interface{}{sCalName: "piclock", sBrightness: 3})
+	defer cleanup()
+	defer func(host string, id string) {
+		configHost, machineIDFile = host, id
+	}(configHost, machineIDFile)
+	machineIDFile = filepath.Join(filepath.Dir(fName), "machine-id")
+	assert.NilError(t, ioutil.WriteFile(machineIDFile, []byte("0f1e2d3c\n"), 0644))
+
+	// the base file alone
+	configHost = "kitchen"
+	s, err := loadSettings(fName, nil, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, s.GetString(sCalName), "piclock")
+
+	// defaults < file < host file < env < -set
+	kitchen := testHostFile(t, fName, "kitchen.json", `{"calendar": "kitchen", "brightness": 7, "ledErr": 4}`)
+	s, err = loadSettings(fName, []string{"PICLOCK_BRIGHTNESS=9"}, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, s.GetString(sCalName), "kitchen")
+	assert.Equal(t, s.source(sCalName), kitchen)
+	assert.Equal(t, s.GetByte(sLEDErr), byte(4))
+	assert.Equal(t, s.GetInt(sBrightness), 9)
+	assert.Equal(t, s.source(sBrightness), sourceEnv)
+	assert.Equal(t, settingsFile(*s), kitchen)
+
+	// the hostname, then the machine id
+	configHost = ""
+	hostname, _ := os.Hostname()
+	assert.Equal(t, hostNames()[0], hostname)
+	assert.Equal(t, hostNames()[len(hostNames())-1], "0f1e2d3c")
+	bedroom := testHostFile(t, fName, "0f1e2d3c.yaml", "calendar: bedroom\n")
+	s, err = loadSettings(fName, nil, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, s.GetString(sCalName), "bedroom")
+	assert.Equal(t, s.source(sCalName), bedroom)
+
+	// turned off
+	off, cleanup2 := testConfigFile(t, map[string]interface{}{sHostConfigs: ""})
+	defer cleanup2()
+	testHostFile(t, off, "0f1e2d3c.yaml", "calendar: bedroom\n")
+	s, err = loadSettings(off, nil, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, s.GetString(sCalName), "piclock")
+	assert.Equal(t, settingsFile(*s), off)
+
+	// an old one is migrated, a bad one is a problem with where it is
+	configHost = "hall"
+	hall := testHostFile(t, fName, "hall.conf", `{"configVersion": 0, "ledError": 6}`)
+	s, err = loadSettings(fName, nil, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, s.GetByte(sLEDErr), byte(6))
+	assert.DeepEqual(t, s.warnings, []string{hall + ": configVersion 1: ledError renamed ledErr"})
+	testHostFile(t, fName, "hall.conf", `{"brightness": 16}`)
+	_, err = loadSettings(fName, nil, nil)
+	assert.Error(t, err, hall+": brightness must be 0 - 15: 16")
+
+	var stdout, stderr bytes.Buffer
+	code := runConfigCommand(cliArgs{configFile: fName, command: []string{"config", "diff"}}, nil, &stdout, &stderr)
+	assert.Equal(t, code, exitInvalid)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+)
+
+// the layout of the config file this piclock writes, a file with an
+// older configVersion (or none, 0) is migrated up to it
+const currentConfigVersion = 1
+
+// configMigration - one step in the chain, it moves a config file from
+// version-1 to version and says what it changed
+type configMigration struct {
+	version int
+	desc    string
+	migrate func(values map[string]interface{}) []string
+}
+
+var configMigrations = []configMigration{
+	{version: 1, desc: "rename keys", migrate: migrateRenames},
+}
+
+// keys that have been renamed, old -> new
+var renamedSettings = map[string]string{
+	"ledError": sLEDErr,
+}
+
+// migrateRenames moves renamed keys, the new key wins when a file has both
+func migrateRenames(values map[string]interface{}) []string {
+	changes := []string{}
+	for _, old := range sortedKeys(renamedSettings) {
+		val, ok := values[old]
+		if !ok {
+			continue
+		}
+		key := renamedSettings[old]
+		delete(values, old)
+		if _, ok := values[key]; ok {
+			changes = append(changes, fmt.Sprintf("%s dropped, %s is set", old, key))
+			continue
+		}
+		values[key] = val
+		changes = append(changes, fmt.Sprintf("%s renamed %s", old, key))
+	}
+	return changes
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// configVersion - the version a config file says it is, 0 when it does not
+func configVersion(values map[string]interface{}) (int, error) {
+	if values[sConfigVersion] == nil {
+		return 0, nil
+	}
+	version, err := toInt(values[sConfigVersion])
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", sConfigVersion, err.Error())
+	}
+	if version > currentConfigVersion {
+		return version, fmt.Errorf("%s %d is newer than this piclock (%d)", sConfigVersion, version, currentConfigVersion)
+	}
+	return version, nil
+}
+
+// configFileVersion - the version a config file says it is
+func configFileVersion(fName string) (int, error) {
+	data, err := ioutil.ReadFile(fName)
+	if err != nil {
+		return 0, err
+	}
+	values, err := fileSettings(fName, data)
+	if err != nil {
+		return 0, err
+	}
+	return configVersion(values)
+}
+
+// migrateSettings runs the migrations after the file's version on
+// values, each change is "configVersion 1: ledError renamed ledErr"
+func migrateSettings(values map[string]interface{}) ([]string, error) {
+	version, err := configVersion(values)
+	if err != nil || version == currentConfigVersion {
+		return []string{}, err
+	}
+	changes := []string{}
+	for _, step := range configMigrations {
+		if step.version <= version {
+			continue
+		}
+		for _, change := range step.migrate(values) {
+			changes = append(changes, fmt.Sprintf("%s %d: %s", sConfigVersion, step.version, change))
+		}
+	}
+	values[sConfigVersion] = currentConfigVersion
+	return changes, nil
+}
+
+// migrateConfigFile brings a config file up to the current version: a
+// copy of the old one is kept as <file>.v<version>.bak, and the keys that
+// are not migrated stay as they were.  it returns what it changed.
+func migrateConfigFile(fName string) ([]string, error) {
+	data, err := ioutil.ReadFile(fName)
+	if err != nil {
+		return nil, err
+	}
+	values, err := fileSettings(fName, data)
+	if err != nil {
+		return nil, err
+	}
+	version, err := configVersion(values)
+	if err != nil || version == currentConfigVersion {
+		return []string{}, err
+	}
+
+	migrated := map[string]interface{}{}
+	for k, v := range values {
+		migrated[k] = v
+	}
+	changes, err := migrateSettings(migrated)
+	if err != nil {
+		return nil, err
+	}
+
+	// what to write, nil removes a key
+	update := map[string]interface{}{}
+	for k, v := range migrated {
+		if !reflect.DeepEqual(values[k], v) {
+			update[k] = v
+		}
+	}
+	for k := range values {
+		if _, ok := migrated[k]; !ok {
+			update[k] = nil
+		}
+	}
+
+	backup := fmt.Sprintf("%s.v%d.bak", fName, version)
+	if err := writeFileAtomic(backup, data); err != nil {
+		return nil, err
+	}
+	if err := updateSettingsFile(fName, update); err != nil {
+		return nil, err
+	}
+	changes = append(changes, fmt.Sprintf("%s %d -> %d, the old file is %s", sConfigVersion, version, currentConfigVersion, backup))
+	return changes, nil
+}
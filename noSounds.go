@@ -5,29 +5,40 @@ import (
 )
 
 type noSounds struct {
-	playFreqs  []string
-	playTiming []string
-	mp3        string
-	loopMp3    bool
-	playItCnt  int
-	playMP3Cnt int
-	done       chan bool
+	tones         tonePattern
+	tracks        []string
+	opts          playOptions
+	playItCnt     int
+	playTracksCnt int
+	stream        string
+	fallback      func(stop chan bool, done chan bool)
+	playStreamCnt int
+	done          chan bool
 }
 
-func (ns *noSounds) playIt(rt runtimeConfig, sfreqs []string, timing []string, stop chan bool, done chan bool) {
-	log.Println("STUB: playIt")
-	ns.playFreqs = sfreqs
-	ns.playTiming = timing
+func (ns *noSounds) playIt(rt runtimeConfig, pattern tonePattern, stop chan bool, done chan bool) {
+	log.Println("STUB: playIt " + pattern.name)
+	ns.tones = pattern
 	ns.done = done
 	// pretend we did this
 	ns.playItCnt++
 }
 
-func (ns *noSounds) playMP3(rt runtimeConfig, fName string, loop bool, stop chan bool, done chan bool) {
-	log.Println("STUB: playMP3 " + fName)
-	ns.mp3 = fName
-	ns.loopMp3 = loop
+func (ns *noSounds) playTracks(rt runtimeConfig, tracks []string, opts playOptions, stop chan bool, done chan bool) {
+	log.Printf("STUB: playTracks %v", tracks)
+	ns.tracks = tracks
+	ns.opts = opts
 	ns.done = done
 	// pretend we did this
-	ns.playMP3Cnt++
+	ns.playTracksCnt++
+}
+
+func (ns *noSounds) playStream(rt runtimeConfig, url string, opts playOptions, fallback func(stop chan bool, done chan bool), stop chan bool, done chan bool) {
+	log.Printf("STUB: playStream %s", url)
+	ns.stream = url
+	ns.opts = opts
+	ns.fallback = fallback
+	ns.done = done
+	// pretend we did this
+	ns.playStreamCnt++
 }
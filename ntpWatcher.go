@@ -32,7 +32,8 @@ func runNTPWatcher(rt runtimeConfig) {
 		// is our clock more than 5m off?
 		if diff > time.Minute*5 || diff < time.Minute*-5 {
 			// print a message, also error flag
-			rt.comms.effects <- printRollingEffect(sNeedSync, dRollingPrint)
+			needSync := expiring(printRollingEffect(sNeedSync, dRollingPrint), rt.clock.Now().Add(dNTPCheckBadSleep))
+			rt.comms.effects <- deduped(needSync, "needSync", 0)
 			rt.logger.Printf("NTP: %v  DIFF: %v", ipTime, diff)
 			rt.comms.leds <- ledMessage(rt.settings.GetInt(sLEDErr), modeBlink75, 0)
 			rt.badTime = true
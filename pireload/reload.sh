@@ -48,6 +48,12 @@ if [ "$NOW" != "Version $SHA" ] ; then
   su pi -c "git co -- versionInfo.go"
 fi
 
+# don't restart into a config that won't load
+su pi -c "./piclock -config=piclock.rpi.conf config validate" 2>&1 | logger
+if [ ${PIPESTATUS[0]} -ne 0 ] ; then
+  die "piclock.rpi.conf is not valid!"
+fi
+
 if [ "$NORESTART" == "" ] ; then
   systemctl daemon-reload
   systemctl restart piclock.service || die "failed to restart piclock"
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// play orders, the "playOrder" setting and #order option
+const (
+	orderSequential = "sequential"
+	orderShuffle    = "shuffle"
+)
+
+// per-alarm options (see parseAlarmOptions) for playlists
+const optPlaylist string = "playlist"
+const optOrder string = "order"
+const optRepeat string = "repeat"
+const optDuration string = "duration"
+
+// playOptions - how long a list of tracks goes on for
+type playOptions struct {
+	repeat   int           // times through the list
+	duration time.Duration // stop after this long, 0 -> just the repeats
+	tones    string        // the tone pattern played when no track will, "" -> none
+}
+
+func isPlaylist(fName string) bool {
+	switch strings.ToLower(filepath.Ext(fName)) {
+	case ".m3u", ".m3u8", ".pls":
+		return true
+	}
+	return false
+}
+
+// hidden files are the downloader's and the OS's business
+func isHidden(fName string) bool {
+	return strings.HasPrefix(filepath.Base(fName), ".")
+}
+
+// resolve a playlist entry, relative paths are from the playlist
+func playlistEntry(dir string, entry string) string {
+	if strings.Contains(entry, "://") || filepath.IsAbs(entry) {
+		return entry
+	}
+	return filepath.Join(dir, entry)
+}
+
+// parseM3U reads plain and extended M3U, comments and #EXT lines are skipped
+func parseM3U(data []byte, dir string) []string {
+	tracks := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tracks = append(tracks, playlistEntry(dir, line))
+	}
+	return tracks
+}
+
+// parsePLS reads the FileN= entries in N order
+func parsePLS(data []byte, dir string) []string {
+	entries := make(map[int]string)
+	numbers := make([]int, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(strings.ToLower(kv[0]), "file") {
+			continue
+		}
+		n, err := strconv.Atoi(kv[0][4:])
+		if err != nil {
+			continue
+		}
+		entries[n] = playlistEntry(dir, strings.TrimSpace(kv[1]))
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	tracks := make([]string, len(numbers))
+	for i, n := range numbers {
+		tracks[i] = entries[n]
+	}
+	return tracks
+}
+
+// libraryTracks is every playable file under dir
+func libraryTracks(dir string) ([]string, error) {
+	tracks := make([]string, 0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if isHidden(path) && path != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() && !isPlaylist(path) && info.Size() > 0 {
+			tracks = append(tracks, path)
+		}
+		return nil
+	})
+	return tracks, err
+}
+
+// loadPlaylist finds name in musicPath: "" is the whole library, then a
+// directory, then name.m3u/.m3u8/.pls
+func loadPlaylist(rt runtimeConfig, name string) ([]string, error) {
+	musicPath := rt.settings.GetString(sMusicPath)
+	if name == "" {
+		return indexedTracks(rt, musicPath)
+	}
+
+	path := filepath.Join(musicPath, name)
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return indexedTracks(rt, path)
+	}
+	for _, ext := range []string{"", ".m3u", ".m3u8", ".pls"} {
+		if !isPlaylist(path + ext) {
+			continue
+		}
+		data, err := ioutil.ReadFile(path + ext)
+		if err != nil {
+			continue
+		}
+		if strings.ToLower(filepath.Ext(path+ext)) == ".pls" {
+			return parsePLS(data, filepath.Dir(path+ext)), nil
+		}
+		return parseM3U(data, filepath.Dir(path+ext)), nil
+	}
+	return nil, fmt.Errorf("No playlist %s in %s", name, musicPath)
+}
+
+func shuffleTracks(rt runtimeConfig, tracks []string) []string {
+	r := rand.New(rand.NewSource(rt.clock.Now().UnixNano()))
+	shuffled := make([]string, len(tracks))
+	for i, j := range r.Perm(len(tracks)) {
+		shuffled[i] = tracks[j]
+	}
+	return shuffled
+}
+
+// alarmPlayOptions - the alarm's options win over the settings
+func alarmPlayOptions(rt runtimeConfig, alm *alarm) playOptions {
+	opts := playOptions{repeat: rt.settings.GetInt(sPlayRepeat), duration: rt.settings.GetDuration(sPlayDuration)}
+	if v := alm.option(optRepeat); v != "" {
+		if repeat, err := strconv.Atoi(v); err == nil && repeat > 0 {
+			opts.repeat = repeat
+		} else {
+			rt.logger.Printf("Bad alarm repeat: %s", v)
+		}
+	}
+	if v := alm.option(optDuration); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			opts.duration = d
+		} else {
+			rt.logger.Printf("Bad alarm duration: %s", v)
+		}
+	}
+	// a duration without a repeat count plays until the time is up
+	if alm.option(optDuration) != "" && alm.option(optRepeat) == "" && opts.duration > 0 {
+		opts.repeat = 0
+	}
+	// an alarm is never silent
+	opts.tones = alarmTonePattern(rt, alm).name
+	return opts
+}
+
+// alarmTracks - the playlist for a playlist or random alarm
+func alarmTracks(rt runtimeConfig, alm *alarm) []string {
+	name := alm.option(optPlaylist)
+	order := rt.settings.GetString(sPlayOrder)
+	switch alm.Effect {
+	case almPlaylist:
+		if name == "" {
+			name = alm.Extra
+		}
+	default:
+		// random is a shuffle of a playlist, the whole library by default
+		if name == "" {
+			name = rt.settings.GetString(sRandomPlaylist)
+		}
+		order = orderShuffle
+	}
+	if opt := alm.option(optOrder); opt != "" {
+		order = opt
+	}
+
+	tracks, err := loadPlaylist(rt, name)
+	if err != nil {
+		rt.logger.Printf("Error: %s", err.Error())
+		return nil
+	}
+	if order == orderShuffle {
+		tracks = shuffleTracks(rt, tracks)
+	}
+	rt.logger.Printf("Playlist '%s' (%s): %d tracks", name, order, len(tracks))
+	return tracks
+}
+
+// playTracks plays the list through backend opts.repeat times (0 plays
+// until opts.duration is up) or until opts.duration is up, starting each
+// track as soon as the last one ends.  done is signalled when it is over.
+// when nothing will play, opts.tones play instead.
+func playTracks(rt runtimeConfig, backend audioBackend, tracks []string, opts playOptions, stop chan bool, done chan bool) {
+	// when we exit the function, tell someone that we're done, unless the
+	// tones took over
+	tones := false
+	defer func() {
+		if !tones {
+			done <- true
+		}
+	}()
+	playTones := func() {
+		if pattern, ok := findTonePattern(rt, opts.tones); ok {
+			rt.logger.Printf("Nothing played, falling back to tones %s", pattern.name)
+			tones = true
+			rt.sounds.playIt(rt, pattern, stop, done)
+		}
+	}
+
+	if len(tracks) == 0 {
+		reportAudio(rt, fmt.Errorf("Nothing to play"))
+		playTones()
+		return
+	}
+
+	var deadline <-chan time.Time
+	if opts.duration > 0 {
+		deadline = rt.clock.After(opts.duration)
+	} else if opts.repeat <= 0 {
+		// never forever
+		opts.repeat = 1
+	}
+
+	for pass := 0; opts.repeat <= 0 || pass < opts.repeat; pass++ {
+		if pass > 0 {
+			rt.logger.Println("Replay")
+		}
+		// a bad track is skipped, a pass where nothing plays is the end
+		failures := 0
+		for _, track := range tracks {
+			proc, err := backend.start(rt, track)
+			if err != nil {
+				reportAudio(rt, err)
+				failures++
+				continue
+			}
+
+			rt.status.startPlaying(proc)
+			completed := make(chan error, 1)
+			go func() {
+				completed <- proc.wait()
+				rt.status.stopPlaying(proc)
+			}()
+
+			select {
+			case <-stop:
+				rt.logger.Println("Stopping playback")
+				proc.kill()
+				<-completed
+				return
+			case <-deadline:
+				rt.logger.Println("Play time is up")
+				proc.kill()
+				<-completed
+				return
+			case err := <-completed:
+				reportAudio(rt, err)
+				if err != nil {
+					failures++
+				}
+			}
+		}
+		if failures == len(tracks) {
+			playTones()
+			return
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// print priorities, higher goes first and interrupts lower.  countdown
+// and alarm are the display modes, anything below them is discarded
+// when they start
+const (
+	prioLow = iota
+	prioNormal
+	prioHigh
+	prioCountdown
+	prioAlarm
+)
+
+var globBatchID int = 0
+
+// newPrintBatch - an id to tie the parts of a multi-print message together
+func newPrintBatch() int {
+	globBatchID++
+	return globBatchID
+}
+
+func updatePrint(e displayEffect, update func(p *displayPrint)) displayEffect {
+	p, err := toPrint(e.val)
+	if err != nil {
+		return e
+	}
+	update(p)
+	e.val = *p
+	return e
+}
+
+// prioritized - the same print with a different priority
+func prioritized(e displayEffect, priority int) displayEffect {
+	return updatePrint(e, func(p *displayPrint) { p.priority = priority })
+}
+
+// expiring - drop the print if it has not been shown by t
+func expiring(e displayEffect, t time.Time) displayEffect {
+	return updatePrint(e, func(p *displayPrint) { p.expires = t })
+}
+
+// deduped - the print replaces anything queued with the same key from a
+// different batch.  a zero batch means the print stands alone.
+func deduped(e displayEffect, key string, batch int) displayEffect {
+	return updatePrint(e, func(p *displayPrint) {
+		p.key = key
+		p.batch = batch
+		if batch == 0 {
+			p.batch = newPrintBatch()
+		}
+	})
+}
+
+// printQueue holds prints waiting for the display and renders the
+// current one a frame at a time so the effects loop never blocks
+type printQueue struct {
+	items   []displayEffect
+	current *displayEffect
+	start   time.Time // when current went on the display
+	frame   int       // last rolling position shown, -1 before the first draw
+}
+
+func newPrintQueue() *printQueue {
+	return &printQueue{items: make([]displayEffect, 0)}
+}
+
+func (q *printQueue) len() int {
+	count := len(q.items)
+	if q.current != nil {
+		count++
+	}
+	return count
+}
+
+func (q *printQueue) push(rt runtimeConfig, e displayEffect) {
+	p := e.val.(displayPrint)
+
+	if p.key != "" {
+		kept := make([]displayEffect, 0, len(q.items))
+		for _, item := range q.items {
+			old := item.val.(displayPrint)
+			if old.key == p.key && old.batch != p.batch {
+				rt.logger.Printf("Replaced queued print: %s", old.s)
+				continue
+			}
+			kept = append(kept, item)
+		}
+		q.items = kept
+	}
+
+	// keep FIFO order within the same priority
+	q.insert(e, false)
+
+	// the preempted print goes back to the head of its priority, it keeps
+	// its expiry so a stale one is still dropped
+	if q.current != nil && q.current.val.(displayPrint).priority < p.priority {
+		rt.logger.Printf("Preempted print: %s", q.current.val.(displayPrint).s)
+		q.insert(*q.current, true)
+		q.current = nil
+	}
+}
+
+// insert puts e in priority order, ahead of its equals when first is set
+func (q *printQueue) insert(e displayEffect, first bool) {
+	priority := e.val.(displayPrint).priority
+	pos := sort.Search(len(q.items), func(i int) bool {
+		if first {
+			return q.items[i].val.(displayPrint).priority <= priority
+		}
+		return q.items[i].val.(displayPrint).priority < priority
+	})
+	q.items = append(q.items, displayEffect{})
+	copy(q.items[pos+1:], q.items[pos:])
+	q.items[pos] = e
+}
+
+// discardBelow drops everything (including what is on screen) below priority
+func (q *printQueue) discardBelow(rt runtimeConfig, priority int) {
+	kept := make([]displayEffect, 0, len(q.items))
+	for _, item := range q.items {
+		if item.val.(displayPrint).priority >= priority {
+			kept = append(kept, item)
+		}
+	}
+	if q.len() > 0 {
+		rt.logger.Printf("Dumping print queue: %d", q.len()-len(kept))
+	}
+	q.items = kept
+	if q.current != nil && q.current.val.(displayPrint).priority < priority {
+		q.current = nil
+	}
+}
+
+func printCancelled(rt runtimeConfig, p displayPrint) bool {
+	select {
+	case c := <-p.cancel:
+		rt.logger.Printf("Got print cancel: %v", c)
+		return true
+	default:
+		return false
+	}
+}
+
+// render draws the current print, moving on to the next one when it is
+// done.  returns false when there is nothing left to show.
+func (q *printQueue) render(rt runtimeConfig) bool {
+	now := rt.clock.Now()
+	for {
+		if q.current == nil {
+			if len(q.items) == 0 {
+				return false
+			}
+			e := q.items[0]
+			q.items = q.items[1:]
+			p := e.val.(displayPrint)
+			if !p.expires.IsZero() && now.After(p.expires) {
+				rt.logger.Printf("Expired print: %s", p.s)
+				continue
+			}
+			q.current = &e
+			q.start = now
+			q.frame = -1
+		}
+
+		if printCancelled(rt, q.current.val.(displayPrint)) || q.draw(rt, now) {
+			q.current = nil
+			continue
+		}
+		return true
+	}
+}
+
+// draw puts the current print on the display, returns true when it is done
+func (q *printQueue) draw(rt runtimeConfig, now time.Time) bool {
+	p := q.current.val.(displayPrint)
+	elapsed := now.Sub(q.start)
+
+	switch q.current.id {
+	case ePrintRolling:
+		// pre/postpend 4 spaces, then rotate through the string
+		// with p.d as the duration on each
+		toprint := "    " + p.s + "    "
+		step := p.d
+		if step <= 0 {
+			step = dRollingPrint
+		}
+		frame := int(elapsed / step)
+		if frame > len(toprint)-4 {
+			return true
+		}
+		if frame != q.frame {
+			if q.frame < 0 {
+				rt.logger.Printf("Rolling print: %s (%d)", p.s, p.d)
+			}
+			q.frame = frame
+			_, err := rt.display.PrintOffset(toprint, frame)
+			if err != nil {
+				rt.logger.Printf("Error: %s\n", err.Error())
+				return true
+			}
+		}
+		return false
+	default:
+		if q.frame < 0 {
+			rt.logger.Printf("Print: %s (%d)", p.s, p.d)
+			q.frame = 0
+			err := rt.display.Print(p.s)
+			if err != nil {
+				rt.logger.Printf("Error: %s\n", err.Error())
+			}
+			return false
+		}
+		// a zero duration with a cancel channel is "until cancelled"
+		if p.d == 0 && p.cancel != nil {
+			return false
+		}
+		return elapsed >= p.d
+	}
+}
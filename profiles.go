@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	wg.Add(1)
+}
+
+// settingsProfiles - the "profiles" setting, each name has the settings
+// it overrides the way the config file has them
+type settingsProfiles map[string]map[string]interface{}
+
+// one entry in the "profileSchedule" setting
+type profileRule struct {
+	profile string
+	days    []time.Weekday // none -> every day
+	from    time.Duration  // offset from midnight, start of the window
+	until   time.Duration  // offset from midnight, end of the window (from == until -> all day)
+}
+
+const sProfile string = "profile"
+const sDays string = "days"
+
+// how often the schedule is checked
+const dProfileCheck time.Duration = time.Minute
+
+// hold the main button this long to move to the next profile
+const dProfileHold time.Duration = 5 * time.Second
+
+// how long the profile's name stays on the display
+const dProfileShow time.Duration = 2 * time.Second
+
+// what the display shows for the base settings
+const baseProfile string = "base"
+
+// settings a profile cannot change, they choose the profile
+var profileSettings = []string{sProfiles, sProfileSchedule, sProfileState}
+
+// profileStatus - the profile in use, for the API, and what is kept in
+// the "profileState" file across restarts
+type profileStatus struct {
+	Active    string    `json:"active"`    // "" -> the base settings
+	Manual    bool      `json:"manual"`    // chosen by the button or the API, the schedule waits
+	Scheduled string    `json:"scheduled"` // what the schedule would pick
+	Since     time.Time `json:"since"`
+	Profiles  []string  `json:"profiles"`
+}
+
+// profileMsg - a change of profile for runProfiles
+type profileMsg struct {
+	name string // "" -> the base settings
+	next bool   // the one after the active profile
+	auto bool   // back to the schedule
+}
+
+func profileMessage(name string) profileMsg {
+	return profileMsg{name: name}
+}
+
+func nextProfileMessage() profileMsg {
+	return profileMsg{next: true}
+}
+
+func autoProfileMessage() profileMsg {
+	return profileMsg{auto: true}
+}
+
+func toProfiles(result interface{}) (settingsProfiles, error) {
+	switch rt := result.(type) {
+	case settingsProfiles:
+		return rt, nil
+	case map[string]interface{}:
+		profiles := settingsProfiles{}
+		for name, val := range rt {
+			values, ok := val.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Profile %s: could not convert type %T (%v)", name, val, val)
+			}
+			if name == "" {
+				return nil, fmt.Errorf("A profile needs a name")
+			}
+			for key, v := range values {
+				if err := checkProfileSetting(key, v); err != nil {
+					return nil, fmt.Errorf("Profile %s: %s", name, err.Error())
+				}
+			}
+			profiles[name] = values
+		}
+		return profiles, nil
+	default:
+		return nil, fmt.Errorf("Could not convert type %T (%v)", rt, rt)
+	}
+}
+
+// checkProfileSetting - can a profile set key to val?
+func checkProfileSetting(key string, val interface{}) error {
+	spec, ok := findSetting(key)
+	if !ok {
+		if suggestion := suggestSetting(key); suggestion != "" {
+			return fmt.Errorf("Unknown setting \"%s\", did you mean \"%s\"?", key, suggestion)
+		}
+		return fmt.Errorf("Unknown setting \"%s\"", key)
+	}
+	if spec.restart {
+		return fmt.Errorf("%s needs a restart, a profile cannot change it", key)
+	}
+	for _, k := range profileSettings {
+		if k == key {
+			return fmt.Errorf("%s cannot be in a profile", key)
+		}
+	}
+	if spec.fileOnly {
+		return fmt.Errorf("%s is only read from the config file, a profile cannot change it", key)
+	}
+	_, err := spec.parse(val)
+	return err
+}
+
+// toWeekday - "Mon", "monday" or "MON"
+func toWeekday(val interface{}) (time.Weekday, error) {
+	str, err := toString(val)
+	if err != nil {
+		return 0, err
+	}
+	if len(str) >= 3 {
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			if strings.EqualFold(str[:3], day.String()[:3]) {
+				return day, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("Unknown day: %s", str)
+}
+
+func toProfileRule(result interface{}) (profileRule, error) {
+	rt, ok := result.(map[string]interface{})
+	if !ok {
+		return profileRule{}, fmt.Errorf("Could not convert type %T (%v)", result, result)
+	}
+	name, err := toString(rt[sProfile])
+	if err != nil {
+		return profileRule{}, err
+	}
+	ret := profileRule{profile: name}
+	// everything else is optional
+	if rt[sDays] != nil {
+		days, ok := rt[sDays].([]interface{})
+		if !ok {
+			return ret, fmt.Errorf("Days of %s: could not convert type %T (%v)", name, rt[sDays], rt[sDays])
+		}
+		for _, d := range days {
+			day, err := toWeekday(d)
+			if err != nil {
+				return ret, err
+			}
+			ret.days = append(ret.days, day)
+		}
+	}
+	if rt[sFrom] != nil {
+		if ret.from, err = toTimeOfDay(rt[sFrom]); err != nil {
+			return ret, err
+		}
+	}
+	if rt[sUntil] != nil {
+		if ret.until, err = toTimeOfDay(rt[sUntil]); err != nil {
+			return ret, err
+		}
+	}
+	return ret, nil
+}
+
+func toProfileSchedule(result interface{}) ([]profileRule, error) {
+	switch rt := result.(type) {
+	case []profileRule:
+		return rt, nil
+	case []interface{}:
+		rules := make([]profileRule, len(rt))
+		for i := range rt {
+			var err error
+			rules[i], err = toProfileRule(rt[i])
+			if err != nil {
+				return rules, err
+			}
+		}
+		return rules, nil
+	default:
+		return nil, fmt.Errorf("Could not convert type %T (%v)", rt, rt)
+	}
+}
+
+// profileSource - where a profile's settings came from
+func profileSource(name string) string {
+	return sProfile + " " + name
+}
+
+// profileProblems - schedule rules for profiles that are not there
+func profileProblems(s *configSettings) []string {
+	problems := []string{}
+	profiles := s.GetProfiles(sProfiles)
+	for _, rule := range s.GetProfileSchedule(sProfileSchedule) {
+		if _, ok := profiles[rule.profile]; !ok {
+			problems = append(problems, fmt.Sprintf("%s: %s: no profile \"%s\"", s.source(sProfileSchedule), sProfileSchedule, rule.profile))
+		}
+	}
+	return problems
+}
+
+// matches - is the rule in effect at now?
+func (rule profileRule) matches(now time.Time) bool {
+	if len(rule.days) > 0 {
+		found := false
+		for _, day := range rule.days {
+			found = found || day == now.Weekday()
+		}
+		if !found {
+			return false
+		}
+	}
+	return inTimeWindow(rule.from, rule.until, now)
+}
+
+// scheduledProfile - the profile of the first rule that matches, "" (the
+// base settings) when none do
+func scheduledProfile(rt runtimeConfig) string {
+	now := rt.clock.Now()
+	for _, rule := range rt.settings.GetProfileSchedule(sProfileSchedule) {
+		if rule.matches(now) {
+			return rule.profile
+		}
+	}
+	return ""
+}
+
+// profileNames - the profiles in the config, sorted
+func profileNames(rt runtimeConfig) []string {
+	names := []string{}
+	for name := range rt.settings.GetProfiles(sProfiles) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func hasProfile(rt runtimeConfig, name string) bool {
+	_, ok := rt.settings.GetProfiles(sProfiles)[name]
+	return name == "" || ok
+}
+
+// nextProfile - the button goes base -> each profile -> base
+func nextProfile(rt runtimeConfig) string {
+	active := rt.status.getProfile().Active
+	names := profileNames(rt)
+	for i, name := range names {
+		if name == active {
+			if i+1 < len(names) {
+				return names[i+1]
+			}
+			return ""
+		}
+	}
+	if len(names) > 0 && active == "" {
+		return names[0]
+	}
+	return ""
+}
+
+// profileShow - the name on the display, rolled when it does not fit
+func profileShow(name string) displayEffect {
+	if name == "" {
+		name = baseProfile
+	}
+	if len(name) > 4 {
+		return printRollingEffect(name, dRollingPrint)
+	}
+	return printEffect(name, dProfileShow)
+}
+
+// readProfileState - the profile kept from before a restart
+func readProfileState(rt runtimeConfig) profileStatus {
+	state := profileStatus{}
+	fName := rt.settings.GetString(sProfileState)
+	if fName == "" {
+		return state
+	}
+	data, err := ioutil.ReadFile(fName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			rt.logger.Printf("Error: %s", err.Error())
+		}
+		return state
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		rt.logger.Printf("Error: %s: %s", fName, err.Error())
+		return profileStatus{}
+	}
+	return state
+}
+
+func writeProfileState(rt runtimeConfig, state profileStatus) {
+	fName := rt.settings.GetString(sProfileState)
+	if fName == "" {
+		return
+	}
+	data, _ := json.Marshal(state)
+	if err := writeFileAtomic(fName, data); err != nil {
+		rt.logger.Printf("Error: %s", err.Error())
+	}
+}
+
+// switchProfile makes name the active profile and reloads the settings
+// with it, a manual choice holds until the schedule is asked for again
+func switchProfile(rt runtimeConfig, name string, manual bool) profileStatus {
+	current := rt.status.getProfile()
+	next := profileStatus{Active: name, Manual: manual, Scheduled: scheduledProfile(rt), Since: current.Since, Profiles: profileNames(rt)}
+	if name != current.Active || next.Since.IsZero() {
+		next.Since = rt.clock.Now()
+	}
+	rt.status.setProfile(next)
+	if name != current.Active || manual != current.Manual {
+		writeProfileState(rt, next)
+	}
+	if name != current.Active {
+		rt.logger.Printf("Profile: %s (manual %t)", name, manual)
+		reloadSettings(rt)
+	}
+	return next
+}
+
+// checkProfile follows the schedule, unless the profile was picked by
+// hand (and is still in the config)
+func checkProfile(rt runtimeConfig) profileStatus {
+	current := rt.status.getProfile()
+	if current.Manual && hasProfile(rt, current.Active) {
+		return switchProfile(rt, current.Active, true)
+	}
+	return switchProfile(rt, scheduledProfile(rt), false)
+}
+
+func profileRequest(rt runtimeConfig, msg profileMsg) profileStatus {
+	switch {
+	case msg.auto:
+		return switchProfile(rt, scheduledProfile(rt), false)
+	case msg.next:
+		status := switchProfile(rt, nextProfile(rt), true)
+		rt.comms.effects <- profileShow(status.Active)
+		return status
+	default:
+		return switchProfile(rt, msg.name, true)
+	}
+}
+
+func startProfiles(rt runtimeConfig) {
+	rt.logger = &ThreadLogger{name: "Profiles"}
+	go runProfiles(rt)
+}
+
+// runProfiles switches profiles on the schedule, and when the button or
+// the API asks
+func runProfiles(rt runtimeConfig) {
+	defer wg.Done()
+	defer func() {
+		rt.logger.Println("Exiting runProfiles")
+	}()
+
+	// pick up where we were before a restart
+	saved := readProfileState(rt)
+	if saved.Manual && hasProfile(rt, saved.Active) {
+		switchProfile(rt, saved.Active, true)
+	} else {
+		checkProfile(rt)
+	}
+
+	for true {
+		select {
+		case <-rt.comms.quit:
+			rt.logger.Println("quit from runProfiles")
+			return
+		case msg := <-rt.comms.profiles:
+			profileRequest(rt, msg)
+		case <-rt.clock.After(dProfileCheck):
+			checkProfile(rt)
+		}
+	}
+}
+
+func (m *APIHandler) apiProfile(w http.ResponseWriter, r *http.Request) {
+	output, _ := json.Marshal(m.rt.status.getProfile())
+	w.Write(output)
+}
+
+// apiSetProfile takes {"profile": "weekend"}, "" is the base settings, or
+// {"auto": true} to go back to the schedule
+func (m *APIHandler) apiSetProfile(w http.ResponseWriter, r *http.Request) {
+	var req map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status := profileStatus{Scheduled: scheduledProfile(m.rt), Since: m.rt.clock.Now(), Profiles: profileNames(m.rt)}
+	if auto, _ := req["auto"].(bool); auto {
+		m.rt.comms.profiles <- autoProfileMessage()
+		status.Active = status.Scheduled
+	} else {
+		name, err := toString(req[sProfile])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !hasProfile(m.rt, name) {
+			http.Error(w, fmt.Sprintf("Unknown profile: %s", name), http.StatusBadRequest)
+			return
+		}
+		m.rt.comms.profiles <- profileMessage(name)
+		status.Active, status.Manual = name, true
+	}
+	output, _ := json.Marshal(status)
+	w.Write(output)
+}
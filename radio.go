@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// a named stream in the "stations" setting
+type radioStation struct {
+	name string
+	url  string
+}
+
+const sURL string = "url"
+
+// per-alarm options (see parseAlarmOptions) for radio alarms
+const optStream string = "stream"
+const optStation string = "station"
+const optFallback string = "fallback"
+
+// station playlists are small, anything bigger is not one
+const maxStationPlaylist = 64 * 1024
+
+func toRadioStation(result interface{}) (radioStation, error) {
+	rt, ok := result.(map[string]interface{})
+	if !ok {
+		return radioStation{}, fmt.Errorf("Could not convert type %T (%v)", result, result)
+	}
+	name, err := toString(rt[sName])
+	if err != nil {
+		return radioStation{}, err
+	}
+	streamURL, err := toString(rt[sURL])
+	if err != nil {
+		return radioStation{}, err
+	}
+	if u, err := url.Parse(streamURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return radioStation{}, fmt.Errorf("Station %s needs an http(s) url: %s", name, streamURL)
+	}
+	return radioStation{name: name, url: streamURL}, nil
+}
+
+func toRadioStations(result interface{}) ([]radioStation, error) {
+	switch rt := result.(type) {
+	case []radioStation:
+		return rt, nil
+	case []interface{}:
+		stations := make([]radioStation, len(rt))
+		for i := range rt {
+			var err error
+			stations[i], err = toRadioStation(rt[i])
+			if err != nil {
+				return stations, err
+			}
+		}
+		return stations, nil
+	default:
+		return nil, fmt.Errorf("Could not convert type %T (%v)", rt, rt)
+	}
+}
+
+// alarmStream picks the url for a radio alarm: the #stream option, then
+// a #station or "radio <station>" from the "stations" setting, a url
+// works in place of a station name
+func alarmStream(rt runtimeConfig, alm *alarm) (string, error) {
+	if stream := alm.option(optStream); stream != "" {
+		return stream, nil
+	}
+	name := alm.option(optStation)
+	if name == "" {
+		name = alm.Extra
+	}
+	if strings.Contains(name, "://") {
+		return name, nil
+	}
+	stations := rt.settings.GetRadioStations(sStations)
+	// no station at all, e.g. the "defaultEffect", is the first one
+	if name == "" && len(stations) > 0 {
+		return stations[0].url, nil
+	}
+	for _, station := range stations {
+		if strings.EqualFold(station.name, name) {
+			return station.url, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown station: '%s'", name)
+}
+
+// playRadioFallback is what a radio alarm plays instead: the #fallback
+// option or "radioFallback" track, or the alarm's tones
+func playRadioFallback(rt runtimeConfig, alm *alarm, stop chan bool, done chan bool) {
+	name := alm.option(optFallback)
+	if name == "" {
+		name = rt.settings.GetString(sRadioFallback)
+	}
+	if name != "" {
+		if track, ok := findTrack(rt, name); ok {
+			rt.logger.Printf("Radio fallback %s", track)
+			rt.sounds.playTracks(rt, []string{track}, alarmPlayOptions(rt, alm), stop, done)
+			return
+		}
+	}
+	rt.logger.Println("Radio fallback to tones")
+	rt.sounds.playIt(rt, alarmTonePattern(rt, alm), stop, done)
+}
+
+// idleConn fails a read that waits longer than timeout, a stream that
+// stalls is as good as dropped
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+// streamClient gives up on a connection, the response or a read after
+// timeout.  the network runs on real time, not rt.clock.
+func streamClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return &idleConn{Conn: conn, timeout: timeout}, nil
+			},
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+		},
+	}
+}
+
+func isStationPlaylist(streamURL string, contentType string) bool {
+	if u, err := url.Parse(streamURL); err == nil && isPlaylist(u.Path) {
+		return true
+	}
+	return strings.Contains(contentType, "mpegurl") || strings.Contains(contentType, "scpls")
+}
+
+// openStream connects to the stream, following one .m3u/.pls station
+// playlist to the first stream in it
+func openStream(client *http.Client, streamURL string, follow bool) (io.ReadCloser, error) {
+	resp, err := client.Get(streamURL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", streamURL, resp.Status)
+	}
+	contentType := strings.ToLower(resp.Header.Get("Content-Type"))
+	if strings.HasPrefix(contentType, "text/html") {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s is not a stream: %s", streamURL, contentType)
+	}
+	if !isStationPlaylist(streamURL, contentType) {
+		return resp.Body, nil
+	}
+
+	defer resp.Body.Close()
+	if !follow {
+		return nil, fmt.Errorf("%s is a playlist of playlists", streamURL)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxStationPlaylist))
+	if err != nil {
+		return nil, err
+	}
+	entries := parseM3U(data, "")
+	if strings.Contains(contentType, "scpls") || strings.HasSuffix(strings.ToLower(streamURL), ".pls") {
+		entries = parsePLS(data, "")
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry, "://") {
+			return openStream(client, entry, false)
+		}
+	}
+	return nil, fmt.Errorf("No stream in %s", streamURL)
+}
+
+// playStream plays the stream until stop or opts.duration is up (a stream
+// has no end, so there is nothing to repeat).  when it will not start, or
+// it ends or stalls before then, fallback takes over (with stop and done)
+// so the alarm is never silent.
+func playStream(rt runtimeConfig, backend audioBackend, streamURL string, opts playOptions, fallback func(stop chan bool, done chan bool), stop chan bool, done chan bool) {
+	timeout := rt.settings.GetDuration(sRadioTimeout)
+	body, err := openStream(streamClient(timeout), streamURL, true)
+	if err != nil {
+		reportAudio(rt, fmt.Errorf("Stream failed: %s", err.Error()))
+		fallback(stop, done)
+		return
+	}
+	proc, err := backend.stream(rt, body)
+	if err != nil {
+		body.Close()
+		reportAudio(rt, err)
+		fallback(stop, done)
+		return
+	}
+	rt.logger.Printf("Streaming %s", streamURL)
+	reportAudio(rt, nil)
+
+	var deadline <-chan time.Time
+	if opts.duration > 0 {
+		deadline = rt.clock.After(opts.duration)
+	}
+
+	rt.status.startPlaying(proc)
+	completed := make(chan error, 1)
+	go func() {
+		completed <- proc.wait()
+		rt.status.stopPlaying(proc)
+	}()
+
+	select {
+	case <-stop:
+		rt.logger.Println("Stopping stream")
+		proc.kill()
+		<-completed
+		done <- true
+	case <-deadline:
+		rt.logger.Println("Play time is up")
+		proc.kill()
+		<-completed
+		done <- true
+	case err := <-completed:
+		if err == nil {
+			err = fmt.Errorf("ended")
+		}
+		reportAudio(rt, fmt.Errorf("Stream dropped: %s", err.Error()))
+		fallback(stop, done)
+	}
+}
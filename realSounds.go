@@ -2,10 +2,6 @@
 
 package main
 
-import (
-	"os/exec"
-)
-
 func init() {
 	features = append(features, "audio")
 }
@@ -15,58 +11,45 @@ const sampleRate = 44100
 type realSounds struct {
 }
 
-func (rs *realSounds) playIt(rt runtimeConfig, sfreqs []string, timing []string, stop chan bool, done chan bool) {
-	// TODO: make this work without pulseaudio
-	rt.logger.Printf("playIt is not really implemented")
-}
-
-func (rs *realSounds) playMP3(rt runtimeConfig, fName string, loop bool, stop chan bool, done chan bool) {
-	go rs.playMP3Later(rt, fName, loop, stop, done)
+func (rs *realSounds) playIt(rt runtimeConfig, pattern tonePattern, stop chan bool, done chan bool) {
+	go rs.playItLater(rt, pattern, stop, done)
 }
 
-func (rs *realSounds) playMP3Later(rt runtimeConfig, fName string, loop bool, stop chan bool, done chan bool) {
-	// when we exit the function, tell someone that we're done
-	defer func() {
+func (rs *realSounds) playItLater(rt runtimeConfig, pattern tonePattern, stop chan bool, done chan bool) {
+	backend, err := wavAudioBackend(rt.settings)
+	if err != nil {
+		reportAudio(rt, err)
 		done <- true
-	}()
-
-	// TODO: make just the launch part of the interface impl, move the loop
-	//   logic somewhere else so we can test it
+		return
+	}
+	playTonePattern(rt, backend, pattern, stop, done)
+}
 
-	// just run mpg123 or the pi fails to play
-	cmd := exec.Command("mpg123", fName)
-	completed := make(chan error, 1)
-	// TODO: make configurable?
-	replayMax := 5
+func (rs *realSounds) playTracks(rt runtimeConfig, tracks []string, opts playOptions, stop chan bool, done chan bool) {
+	go rs.playTracksLater(rt, tracks, opts, stop, done)
+}
 
-	go func() {
-		completed <- cmd.Run()
-	}()
+func (rs *realSounds) playTracksLater(rt runtimeConfig, tracks []string, opts playOptions, stop chan bool, done chan bool) {
+	// the backend can change with the settings, so look it up each time
+	backend, err := newAudioBackend(rt.settings)
+	if err != nil {
+		reportAudio(rt, err)
+		done <- true
+		return
+	}
+	playTracks(rt, backend, tracks, opts, stop, done)
+}
 
-	stopPlayback := false
+func (rs *realSounds) playStream(rt runtimeConfig, url string, opts playOptions, fallback func(stop chan bool, done chan bool), stop chan bool, done chan bool) {
+	go rs.playStreamLater(rt, url, opts, fallback, stop, done)
+}
 
-	for {
-		rt.clock.Sleep(dAlarmSleep)
-		select {
-		case <-stop:
-			stopPlayback = true
-		case done := <-completed:
-			rt.logger.Printf("%v", done)
-			if !loop || replayMax < 0 {
-				return
-			}
-			replayMax--
-			rt.logger.Println("Replay")
-			cmd = exec.Command("mpg123", fName)
-			go func() {
-				completed <- cmd.Run()
-			}()
-		default:
-		}
-		if stopPlayback {
-			rt.logger.Println("Stopping playback")
-			cmd.Process.Kill()
-			return
-		}
+func (rs *realSounds) playStreamLater(rt runtimeConfig, url string, opts playOptions, fallback func(stop chan bool, done chan bool), stop chan bool, done chan bool) {
+	backend, err := newAudioBackend(rt.settings)
+	if err != nil {
+		reportAudio(rt, err)
+		fallback(stop, done)
+		return
 	}
+	playStream(rt, backend, url, opts, fallback, stop, done)
 }
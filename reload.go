@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+func init() {
+	wg.Add(1)
+}
+
+// how often the config file is checked for changes
+const dReloadPoll time.Duration = 2 * time.Second
+
+// reloadStatus - what the last reload did, for the API
+type reloadStatus struct {
+	Time     time.Time `json:"time"` // zero -> never reloaded
+	Changed  []string  `json:"changed"`
+	Restart  []string  `json:"restart"` // changed, but not until a restart
+	Warnings []string  `json:"warnings"`
+	Error    string    `json:"error"`
+}
+
+// settings that the alarms thread has to reload the calendar for
+var alarmSettings = []string{sCalName, sSecrets, sTokenPath, sTokenKey, sAccounts, sAlarms, sCalendarAlarms}
+
+func isAlarmSetting(key string) bool {
+	for _, k := range alarmSettings {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadSettings reads the config file (and the active profile, the
+// environment and -set flags on top) again and applies what changed.  a file that does not
+// parse changes nothing, and settings that are only read at startup keep
+// their old value and are reported as needing a restart.
+func reloadSettings(rt runtimeConfig) reloadStatus {
+	status := reloadStatus{Time: rt.clock.Now(), Changed: []string{}, Restart: []string{}, Warnings: []string{}}
+
+	fresh, err := loadProfile(rt.settings.file, rt.status.getProfile().Active, os.Environ(), rt.settings.sets)
+	if err != nil {
+		status.Error = err.Error()
+		rt.logger.Printf("Error: reload of '%s' failed, keeping the settings: %s", rt.settings.file, status.Error)
+		rt.status.setReload(status)
+		return status
+	}
+	status.Warnings = append(status.Warnings, fresh.warnings...)
+
+	for _, spec := range settingsSchema {
+		value := fresh.settings[spec.key]
+		if reflect.DeepEqual(rt.settings.get(spec.key), value) {
+			continue
+		}
+		if spec.restart {
+			rt.logger.Printf("%s: restart required", spec.key)
+			status.Restart = append(status.Restart, spec.key)
+			continue
+		}
+		rt.logger.Printf("%s: %v", spec.key, value)
+		status.Changed = append(status.Changed, spec.key)
+	}
+	rt.settings.apply(fresh, status.Changed)
+	rt.status.setReload(status)
+	if len(status.Changed) == 0 {
+		return status
+	}
+
+	// most threads read the settings as they go, these hold on to some
+	rt.comms.effects <- settingsEffect()
+	for _, key := range status.Changed {
+		if isAlarmSetting(key) {
+			rt.comms.getAlarms <- reloadMessage()
+			break
+		}
+	}
+	return status
+}
+
+// settingsEffect - have the effects thread pick up reloaded settings
+func settingsEffect() displayEffect {
+	return displayEffect{id: eSettings, val: nil}
+}
+
+func startReloadSettings(rt runtimeConfig) {
+	rt.logger = &ThreadLogger{name: "Reload settings"}
+	go runReloadSettings(rt)
+}
+
+// runReloadSettings reloads on SIGHUP, and when the config file (or the
+// host's override file) changes
+func runReloadSettings(rt runtimeConfig) {
+	defer wg.Done()
+	defer func() {
+		rt.logger.Println("Exiting runReloadSettings")
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	modified := configModified(rt)
+	for true {
+		select {
+		case <-rt.comms.quit:
+			rt.logger.Println("quit from runReloadSettings")
+			return
+		case <-hup:
+			rt.logger.Println("SIGHUP")
+			reloadSettings(rt)
+			modified = configModified(rt)
+		case <-rt.clock.After(dReloadPoll):
+			if latest := configModified(rt); !latest.Equal(modified) {
+				rt.logger.Printf("'%s' changed", rt.settings.file)
+				modified = latest
+				reloadSettings(rt)
+			}
+		}
+	}
+}
+
+// configModified - when the config file, or the host's override file, was
+// last written, zero when they are missing (an editor can remove one
+// while saving)
+func configModified(rt runtimeConfig) time.Time {
+	var modified time.Time
+	for _, fName := range []string{rt.settings.file, hostConfigFile(rt.settings.file, rt.settings.GetString(sHostConfigs))} {
+		if fName == "" {
+			continue
+		}
+		if info, err := os.Stat(fName); err == nil && info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified
+}
+
+func (m *APIHandler) apiReload(w http.ResponseWriter, r *http.Request) {
+	status := reloadSettings(m.rt)
+	if status.Error != "" {
+		http.Error(w, fmt.Sprintf("Reload failed: %s", status.Error), http.StatusBadRequest)
+		return
+	}
+	output, _ := json.Marshal(status)
+	w.Write(output)
+}
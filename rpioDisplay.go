@@ -12,9 +12,18 @@ func (ss *rpioDisplay) OpenDisplay(settings configSettings) error {
 		settings.GetByte(sI2CDev),
 		settings.GetInt(sI2CBus),
 		false)
+	if err != nil {
+		return err
+	}
+	glyphs, err := displayGlyphs(settings)
+	if err != nil {
+		return err
+	}
+	ss.ssb.SetGlyphs(glyphs)
+	ss.ssb.SetInverted(settings.GetBool(sInverted))
 	// by default, turn it on?
 	ss.DisplayOn(true)
-	return err
+	return nil
 }
 
 func (ss *rpioDisplay) DebugDump(on bool) {
@@ -46,9 +55,16 @@ func (ss *rpioDisplay) RefreshOn(on bool) error {
 }
 
 func (ss *rpioDisplay) ClearDisplay() {
-	ss.ClearDisplay()
+	ss.ssb.ClearDisplay()
 }
 
 func (ss *rpioDisplay) SegmentOn(pos byte, seg byte, on bool) error {
-	return ss.SegmentOn(pos, seg, on)
+	return ss.ssb.SegmentOn(pos, seg, on)
+}
+
+func (ss *rpioDisplay) Snapshot() sevenseg_backpack.Snapshot {
+	if ss.ssb == nil {
+		return sevenseg_backpack.Snapshot{}
+	}
+	return ss.ssb.Snapshot()
 }
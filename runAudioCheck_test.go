@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+/* things that runAudioCheck does:
+
+checks the player, sound card, tones and fallback at startup
+checks again every audioCheck
+reports problems on the error LED, the display and the status API
+clears what it reported when the problem goes away
+
+*/
+
+func testSoundCards(fName string) func() {
+	old := soundCards
+	soundCards = fName
+	return func() { soundCards = old }
+}
+
+func TestCheckAudio(t *testing.T) {
+	defer testSoundCards("./test/audio/cards")()
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+
+	tests := []struct {
+		settings map[string]interface{}
+		problems []string
+	}{
+		{map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink}, []string{}},
+		{map[string]interface{}{sAudioBackend: audioWav, sAudioSink: "./test/nope/sink.wav"}, []string{"Audio sink: stat test/nope: no such file or directory"}},
+		{map[string]interface{}{sAudioBackend: audioCommand, sAudioCommand: "true {file}"}, []string{}},
+		{map[string]interface{}{sAudioBackend: audioCommand, sAudioCommand: "true {file}", sAudioDevice: "Headphones"}, []string{}},
+		{map[string]interface{}{sAudioBackend: audioCommand, sAudioCommand: "true {file}", sAudioDevice: "sndrpihifiberry"}, []string{"Sound card sndrpihifiberry not found"}},
+		{map[string]interface{}{sAudioBackend: audioCommand, sAudioCommand: "nosuchplayer {file}"}, []string{"Player nosuchplayer not found"}},
+		{map[string]interface{}{sAudioBackend: audioCommand, sAudioCommand: ""}, []string{"Empty audio command"}},
+		{map[string]interface{}{sAudioBackend: "gramophone"}, []string{"Unknown audio backend: gramophone"}},
+		{map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink, sTonePattern: "klaxon"}, []string{"Unknown tone pattern: klaxon"}},
+		{map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink, sMusicPath: "./test/tags", sRadioFallback: "easy"}, []string{}},
+		{map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink, sMusicPath: "./test/tags", sRadioFallback: "zzz"}, []string{"Fallback track 'zzz' not found"}},
+		{map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink, sMusicPath: "./test/audio", sRadioFallback: "silent"}, []string{"Fallback track silent.mp3 does not decode"}},
+	}
+	for _, test := range tests {
+		rt, _, _ := testRuntimeWith(test.settings)
+		assert.DeepEqual(t, checkAudio(rt), test.problems)
+	}
+
+	rt, _, _ := testRuntimeWith(map[string]interface{}{sAudioBackend: audioCommand, sAudioCommand: "true {file}"})
+	defer testSoundCards("./test/audio/nocards")()
+	assert.DeepEqual(t, checkAudio(rt), []string{"No sound cards"})
+	soundCards = "./test/nope"
+	assert.DeepEqual(t, checkAudio(rt), []string{"No sound cards: open ./test/nope: no such file or directory"})
+}
+
+func TestAudioCheckReports(t *testing.T) {
+	rt, clock, comms := testRuntimeWith(map[string]interface{}{
+		sAudioBackend: audioCommand,
+		sAudioCommand: "nosuchplayer {file}",
+		sAudioCheck:   time.Hour,
+	})
+	defer testSoundCards("./test/audio/cards")()
+
+	go runAudioCheck(rt)
+	clock.BlockUntil(1)
+
+	// a bad check blinks the error LED and shows on the display
+	leds := ledReadAll(comms.leds)
+	assert.Equal(t, len(leds), 1)
+	assert.Equal(t, leds[0].mode, modeBlink10)
+	es := effectReadAll(comms.effects)
+	assert.Equal(t, len(es), 1)
+	assert.Equal(t, es[0].id, eAudioError)
+	assert.Equal(t, rt.status.getAudioError(), "Audio check: Player nosuchplayer not found")
+	health := rt.status.getAudioHealth()
+	assert.Equal(t, health.Checked, clock.Now())
+	assert.DeepEqual(t, health.Problems, []string{"Player nosuchplayer not found"})
+
+	// fixed by the next check
+	rt.settings.settings[sAudioCommand] = "true {file}"
+	clock.Advance(time.Hour)
+	clock.BlockUntil(1)
+	leds = ledReadAll(comms.leds)
+	assert.Equal(t, len(leds), 1)
+	assert.Equal(t, leds[0].mode, modeOff)
+	assert.Equal(t, rt.status.getAudioError(), "")
+	assert.DeepEqual(t, rt.status.getAudioHealth().Problems, []string{})
+
+	// a good check leaves errors from playing alone
+	rt.status.setAudioError("mpg123: exit status 1")
+	clock.Advance(time.Hour)
+	clock.BlockUntil(1)
+	assert.Equal(t, rt.status.getAudioError(), "mpg123: exit status 1")
+
+	testQuit(rt)
+}
+
+func TestAPIAudio(t *testing.T) {
+	defer testSoundCards("./test/audio/cards")()
+	rt, _, comms := testRuntimeWith(map[string]interface{}{sAudioBackend: audioCommand, sAudioCommand: "nosuchplayer {file}"})
+	handler := NewHandler(rt)
+
+	w := httptest.NewRecorder()
+	handler.apiAudio(w, httptest.NewRequest("GET", "/api/audio", nil))
+	var status audioStatus
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, status.Backend, audioCommand)
+	assert.Assert(t, status.Health.Checked.IsZero())
+	assert.DeepEqual(t, status.Health.Problems, []string{})
+
+	w = httptest.NewRecorder()
+	handler.apiAudioCheck(w, httptest.NewRequest("POST", "/api/audio/check", nil))
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, status.Error, "Audio check: Player nosuchplayer not found")
+	assert.DeepEqual(t, status.Health.Problems, []string{"Player nosuchplayer not found"})
+	effectReadAll(comms.effects)
+
+	w = httptest.NewRecorder()
+	handler.apiAudioTest(w, httptest.NewRequest("POST", "/api/audio/test", nil))
+	assert.Equal(t, w.Code, 200)
+	es := effectReadAll(comms.effects)
+	assert.Equal(t, len(es), 1)
+	assert.Equal(t, es[0].id, eTestSound)
+}
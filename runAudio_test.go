@@ -0,0 +1,885 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+const testBeep string = "./test/audio/beep.wav"
+
+// the beep is half a second of 8kHz mono 16 bit
+const dTestBeep time.Duration = 500 * time.Millisecond
+
+func testAudioSink(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "piclock")
+	assert.NilError(t, err)
+	return filepath.Join(dir, "sink.wav"), func() { os.RemoveAll(dir) }
+}
+
+func TestAudioWavLoop(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink})
+	backend, err := newAudioBackend(rt.settings)
+	assert.NilError(t, err)
+
+	stop := make(chan bool, 1)
+	done := make(chan bool, 1)
+	go playAudio(rt, backend, testBeep, true, stop, done)
+
+	// once through, then the replays
+	repeat := rt.settings.GetInt(sPlayRepeat)
+	for i := 0; i < repeat; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(dTestBeep)
+	}
+	<-done
+
+	beep, _ := readWav(testBeep)
+	played, err := readWav(sink)
+	assert.NilError(t, err)
+	assert.Equal(t, played.format, beep.format)
+	assert.Equal(t, len(played.pcm), repeat*len(beep.pcm))
+	assert.Equal(t, played.format.duration(len(played.pcm)), time.Duration(repeat)*dTestBeep)
+	assert.Equal(t, rt.status.getAudioError(), "")
+}
+
+func TestAudioWavStop(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink})
+	backend, _ := newAudioBackend(rt.settings)
+
+	stop := make(chan bool, 1)
+	done := make(chan bool, 1)
+	go playAudio(rt, backend, testBeep, true, stop, done)
+
+	clock.BlockUntil(1)
+	clock.Advance(200 * time.Millisecond)
+	stop <- true
+	<-done
+
+	played, err := readWav(sink)
+	assert.NilError(t, err)
+	assert.Equal(t, played.format.duration(len(played.pcm)), 200*time.Millisecond)
+}
+
+func TestAudioFailures(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	rt, clock, comms := testRuntimeWith(map[string]interface{}{sAudioBackend: audioCommand, sAudioCommand: "false"})
+	backend, err := newAudioBackend(rt.settings)
+	assert.NilError(t, err)
+
+	// non-zero exit
+	stop := make(chan bool, 1)
+	done := make(chan bool, 1)
+	playAudio(rt, backend, testBeep, true, stop, done)
+	<-done
+	assert.Assert(t, rt.status.getAudioError() != "")
+	led, _ := ledRead(t, comms.leds)
+	assert.Equal(t, led, ledMessage(rt.settings.GetInt(sLEDErr), modeBlink10, 0))
+	e, _ := effectRead(t, comms.effects)
+	assert.Equal(t, e.id, eAudioError)
+
+	// missing binary
+	backend, _ = newCommandBackend("no-such-player-piclock {file}")
+	playAudio(rt, backend, testBeep, false, stop, done)
+	<-done
+	assert.Assert(t, strings.Contains(rt.status.getAudioError(), "no-such-player-piclock"))
+
+	// a good play clears it and the LED
+	ledReadAll(comms.leds)
+	go playAudio(rt, &wavBackend{sink: sink}, testBeep, false, stop, done)
+	clock.BlockUntil(1)
+	clock.Advance(dTestBeep)
+	<-done
+	assert.Equal(t, rt.status.getAudioError(), "")
+	led, _ = ledRead(t, comms.leds)
+	assert.Equal(t, led, ledOff(rt.settings.GetInt(sLEDErr)))
+}
+
+func TestAudioBackends(t *testing.T) {
+	cb, err := newCommandBackend("mpv --no-video")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, cb.command("a b.mp3", nil), []string{"mpv", "--no-video", "a b.mp3"})
+
+	rt, _, _ := testRuntime()
+	rt.status.setVolume(50)
+	cb, _ = newCommandBackend(audioPlayers[audioFfplay])
+	assert.DeepEqual(t, cb.command("x.wav", volumeArgs(rt)), []string{"ffplay", "-nodisp", "-autoexit", "-loglevel", "error", "-volume", "50", "x.wav"})
+	cb, _ = newCommandBackend(audioPlayers[audioMpg123])
+	assert.DeepEqual(t, cb.command("x.mp3", volumeArgs(rt)), []string{"mpg123", "-q", "-f", "16384", "x.mp3"})
+
+	_, err = newCommandBackend("  ")
+	assert.ErrorContains(t, err, "Empty")
+
+	rt, _, _ = testRuntimeWith(map[string]interface{}{sAudioBackend: "gramophone"})
+	_, err = newAudioBackend(rt.settings)
+	assert.ErrorContains(t, err, "Unknown audio backend")
+
+	rt, _, _ = testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav})
+	_, err = newAudioBackend(rt.settings)
+	assert.ErrorContains(t, err, sAudioSink)
+}
+
+func TestAudioWavDecoder(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink, sAudioDecoder: "sh ./test/audio/decode.sh {file}"})
+	rt.status.setVolume(volumeMax)
+	backend, _ := newAudioBackend(rt.settings)
+
+	// an MP3 goes through the decoder, which has it as the beep
+	proc, err := backend.start(rt, filepath.Join(testTags, "getup.mp3"))
+	assert.NilError(t, err)
+	completed := make(chan error, 1)
+	go func() { completed <- proc.wait() }()
+	beep, _ := readWav(testBeep)
+	clock.Advance(beep.format.duration(len(beep.pcm)))
+	assert.NilError(t, <-completed)
+	played, err := readWav(sink)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, played.pcm, beep.pcm)
+
+	// without one only WAV files play
+	rt, _, _ = testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink, sAudioDecoder: ""})
+	backend, _ = newAudioBackend(rt.settings)
+	_, err = backend.start(rt, filepath.Join(testTags, "getup.mp3"))
+	assert.ErrorContains(t, err, "Not a WAV file")
+	rt, _, _ = testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink, sAudioDecoder: "false {file}"})
+	backend, _ = newAudioBackend(rt.settings)
+	_, err = backend.start(rt, filepath.Join(testTags, "getup.mp3"))
+	assert.ErrorContains(t, err, "false: exit status 1")
+}
+
+func toneSample(wav *wavData, t time.Duration) int16 {
+	pos := wav.format.bytesIn(t)
+	return int16(binary.LittleEndian.Uint16(wav.pcm[pos:]))
+}
+
+func TestRenderTones(t *testing.T) {
+	wav := renderTones(tonePatterns["beep-beep"])
+	assert.Equal(t, wav.format, wavFormat{channels: 1, sampleRate: toneSampleRate, bitsPerSample: 16})
+	assert.Equal(t, wav.format.duration(len(wav.pcm)), time.Second)
+
+	// the attack starts from nothing, the middle of a square beep is at volume
+	assert.Equal(t, toneSample(wav, 0), int16(0))
+	peak := toneSample(wav, 50*time.Millisecond)
+	if peak < 0 {
+		peak = -peak
+	}
+	assert.Equal(t, peak, int16(16383))
+	// the gaps are silent
+	for _, at := range []time.Duration{150 * time.Millisecond, 500 * time.Millisecond, 999 * time.Millisecond} {
+		assert.Equal(t, toneSample(wav, at), int16(0))
+	}
+
+	// repeats and the loop
+	pattern := tonePatterns["siren"]
+	pattern.repeat = 3
+	wav = renderTones(pattern)
+	assert.Equal(t, wav.format.duration(len(wav.pcm)), 3*time.Second)
+	wav = renderToneLoop(pattern, 10*time.Second)
+	assert.Equal(t, wav.format.duration(len(wav.pcm)), 12*time.Second)
+
+	// and it survives the trip through a file
+	parsed, err := parseWav(wav.encode())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, parsed.pcm, wav.pcm)
+}
+
+func TestTonePatternSettings(t *testing.T) {
+	s := defaultSettings()
+	err := s.settingsFromJSON([]byte(`{"tonePattern": "wake", "tones": [
+		{"name": "wake", "repeat": 2, "steps": [
+			{"freq": 880, "duration": "200ms", "wave": "square", "volume": 0.25},
+			{"duration": "300ms"}
+		]}
+	]}`))
+	assert.NilError(t, err)
+	patterns := s.GetTonePatterns(sTones)
+	assert.Equal(t, len(patterns), 1)
+	assert.Equal(t, patterns[0].repeat, 2)
+	assert.Equal(t, patterns[0].steps[0].volume, 0.25)
+	assert.Equal(t, renderTones(patterns[0]).format.duration(len(renderTones(patterns[0]).pcm)), time.Second)
+
+	for _, bad := range []string{
+		`{"tones": [{"name": "x", "steps": []}]}`,
+		`{"tones": [{"name": "x", "steps": [{"freq": 440}]}]}`,
+		`{"tones": [{"name": "x", "steps": [{"freq": 440, "duration": "1s", "wave": "saw"}]}]}`,
+		`{"tones": [{"name": "x", "steps": [{"freq": 440, "duration": "1s", "volume": 2}]}]}`,
+		`{"tones": [{"name": "x", "repeat": 0, "steps": [{"freq": 440, "duration": "1s"}]}]}`,
+	} {
+		assert.Assert(t, defaultSettings().settingsFromJSON([]byte(bad)) != nil, bad)
+	}
+}
+
+func TestAlarmTonePattern(t *testing.T) {
+	rt, _, _ := testRuntime()
+
+	alm := alarm{Effect: almTones}
+	assert.Equal(t, alarmTonePattern(rt, &alm).name, "beep-beep")
+	alm.Extra = "siren"
+	assert.Equal(t, alarmTonePattern(rt, &alm).name, "siren")
+	alm.Options = "tone=rising"
+	assert.Equal(t, alarmTonePattern(rt, &alm).name, "rising")
+	alm.Options = "tone=kazoo"
+	assert.Equal(t, alarmTonePattern(rt, &alm).name, "beep-beep")
+
+	// music that falls back to tones does not use the extra
+	alm = alarm{Effect: almMusic, Extra: "siren"}
+	assert.Equal(t, alarmTonePattern(rt, &alm).name, "beep-beep")
+}
+
+func TestPlayTonePattern(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink})
+	backend, _ := wavAudioBackend(rt.settings)
+	rt.status.setVolume(volumeMax)
+
+	stop := make(chan bool, 1)
+	done := make(chan bool, 1)
+	go playTonePattern(rt, backend, tonePatterns["rising"], stop, done)
+
+	clock.BlockUntil(1)
+	clock.Advance(1750 * time.Millisecond)
+	stop <- true
+	<-done
+
+	played, err := readWav(sink)
+	assert.NilError(t, err)
+	expected := renderTones(tonePatterns["rising"])
+	assert.DeepEqual(t, played.pcm, expected.pcm[:expected.format.bytesIn(1750*time.Millisecond)])
+}
+
+func TestPlayTonePatternName(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink})
+	backend, _ := wavAudioBackend(rt.settings)
+
+	// a pattern name from the settings is not a path
+	pattern := tonePatterns["rising"]
+	pattern.name = "../no/such/dir/rising"
+	stop := make(chan bool, 1)
+	done := make(chan bool, 1)
+	go playTonePattern(rt, backend, pattern, stop, done)
+
+	clock.BlockUntil(1)
+	stop <- true
+	<-done
+	assert.Equal(t, rt.status.getAudioError(), "")
+}
+
+const testLibrary string = "./test/library"
+
+func TestLoadPlaylist(t *testing.T) {
+	rt, _, _ := testRuntimeWith(map[string]interface{}{sMusicPath: testLibrary})
+	lib := func(names ...string) []string {
+		paths := make([]string, len(names))
+		for i, name := range names {
+			paths[i] = filepath.Join(testLibrary, name)
+		}
+		return paths
+	}
+
+	// the whole library skips playlists and hidden files
+	tracks, err := loadPlaylist(rt, "")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tracks, lib("a.wav", "b.wav", "morning/c.wav", "morning/d.wav"))
+
+	tracks, err = loadPlaylist(rt, "morning")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tracks, lib("morning/c.wav", "morning/d.wav"))
+
+	tracks, err = loadPlaylist(rt, "wake")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tracks, lib("b.wav", "morning/c.wav"))
+
+	tracks, err = loadPlaylist(rt, "evening.pls")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tracks, lib("morning/d.wav", "a.wav"))
+
+	_, err = loadPlaylist(rt, "nope")
+	assert.ErrorContains(t, err, "No playlist nope")
+
+	assert.DeepEqual(t, parseM3U([]byte("http://radio/stream\n/abs/song.mp3\n"), "dir"), []string{"http://radio/stream", "/abs/song.mp3"})
+}
+
+func TestAlarmPlayOptions(t *testing.T) {
+	rt, _, _ := testRuntimeWith(map[string]interface{}{sMusicPath: testLibrary})
+
+	alm := alarm{Effect: almPlaylist, Extra: "wake"}
+	assert.Equal(t, alarmPlayOptions(rt, &alm), playOptions{repeat: rt.settings.GetInt(sPlayRepeat), tones: "beep-beep"})
+	alm.Options = "repeat=2"
+	assert.Equal(t, alarmPlayOptions(rt, &alm), playOptions{repeat: 2, tones: "beep-beep"})
+	alm.Options = "duration=10m"
+	assert.Equal(t, alarmPlayOptions(rt, &alm), playOptions{repeat: 0, duration: 10 * time.Minute, tones: "beep-beep"})
+	alm.Options = "repeat=3 duration=10m"
+	assert.Equal(t, alarmPlayOptions(rt, &alm), playOptions{repeat: 3, duration: 10 * time.Minute, tones: "beep-beep"})
+	alm.Options = "tone=siren"
+	assert.Equal(t, alarmPlayOptions(rt, &alm).tones, "siren")
+
+	// sequential playlists, shuffled random
+	assert.DeepEqual(t, alarmTracks(rt, &alarm{Effect: almPlaylist, Extra: "wake"}),
+		[]string{filepath.Join(testLibrary, "b.wav"), filepath.Join(testLibrary, "morning/c.wav")})
+	tracks := alarmTracks(rt, &alarm{Effect: almRandom, Options: "playlist=morning"})
+	assert.Equal(t, len(tracks), 2)
+	assert.Assert(t, strings.Contains(strings.Join(tracks, " "), "morning/c.wav"))
+	assert.Equal(t, len(alarmTracks(rt, &alarm{Effect: almRandom})), 4)
+	assert.Equal(t, len(alarmTracks(rt, &alarm{Effect: almPlaylist, Extra: "nope"})), 0)
+}
+
+func TestPlayTracksDuration(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink})
+	rt.status.setVolume(volumeMax)
+	backend, _ := newAudioBackend(rt.settings)
+
+	tracks := []string{filepath.Join(testLibrary, "a.wav"), filepath.Join(testLibrary, "b.wav")}
+	stop := make(chan bool, 1)
+	done := make(chan bool, 1)
+	go playTracks(rt, backend, tracks, playOptions{duration: 250 * time.Millisecond}, stop, done)
+
+	// the deadline and a track, then the next track straight away
+	for _, step := range []time.Duration{100 * time.Millisecond, 100 * time.Millisecond, 50 * time.Millisecond} {
+		clock.BlockUntil(2)
+		clock.Advance(step)
+	}
+	<-done
+
+	a, _ := readWav(tracks[0])
+	b, _ := readWav(tracks[1])
+	played, err := readWav(sink)
+	assert.NilError(t, err)
+	expected := append(append(append([]byte{}, a.pcm...), b.pcm...), a.pcm[:a.format.bytesIn(50*time.Millisecond)]...)
+	assert.DeepEqual(t, played.pcm, expected)
+}
+
+func TestPlayTracksSkipsBad(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink})
+	rt.status.setVolume(volumeMax)
+	backend, _ := newAudioBackend(rt.settings)
+
+	tracks := []string{filepath.Join(testLibrary, "missing.wav"), filepath.Join(testLibrary, "a.wav")}
+	stop := make(chan bool, 1)
+	done := make(chan bool, 1)
+	go playTracks(rt, backend, tracks, playOptions{repeat: 2}, stop, done)
+	for i := 0; i < 2; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(100 * time.Millisecond)
+	}
+	<-done
+
+	played, err := readWav(sink)
+	assert.NilError(t, err)
+	assert.Equal(t, played.format.duration(len(played.pcm)), 200*time.Millisecond)
+}
+
+func TestPlayTracksFallsBackToTones(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	rt, _, _ := testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink})
+	s := rt.sounds.(*noSounds)
+	backend, _ := newAudioBackend(rt.settings)
+	stop := make(chan bool, 1)
+	done := make(chan bool, 1)
+
+	// nothing plays, the tones take over and signal done themselves
+	missing := []string{filepath.Join(testLibrary, "missing.wav"), filepath.Join(testLibrary, "gone.wav")}
+	playTracks(rt, backend, missing, playOptions{repeat: 1, tones: "siren"}, stop, done)
+	assert.Equal(t, s.playItCnt, 1)
+	assert.Equal(t, s.tones.name, "siren")
+	assert.Equal(t, s.done, done)
+	assert.Equal(t, len(done), 0)
+
+	playTracks(rt, backend, nil, playOptions{repeat: 1, tones: "rising"}, stop, done)
+	assert.Equal(t, s.playItCnt, 2)
+	assert.Equal(t, s.tones.name, "rising")
+	assert.Equal(t, len(done), 0)
+
+	// without tones it is just over
+	playTracks(rt, backend, missing, playOptions{repeat: 1}, stop, done)
+	assert.Equal(t, s.playItCnt, 2)
+	assert.Equal(t, <-done, true)
+}
+
+func TestAudioWavGain(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink, sVolumeControl: volumeSoftware})
+	rt.mixer = newMixer(rt.settings)
+	rt.status.setVolume(volumeMax)
+	backend, _ := newAudioBackend(rt.settings)
+
+	// turned down part way through, the rest is heard at half
+	track := filepath.Join(testLibrary, "a.wav")
+	proc, err := backend.start(rt, track)
+	assert.NilError(t, err)
+	rt.status.startPlaying(proc)
+	completed := make(chan error, 1)
+	go func() { completed <- proc.wait() }()
+	clock.Advance(40 * time.Millisecond)
+	applyVolume(rt, volumeMax/2)
+	clock.Advance(60 * time.Millisecond)
+	assert.NilError(t, <-completed)
+	rt.status.stopPlaying(proc)
+
+	a, _ := readWav(track)
+	split := a.format.bytesIn(40 * time.Millisecond)
+	expected := append(append([]byte{}, a.pcm[:split]...), (&wavData{format: a.format, pcm: a.pcm[split:]}).scaled(0.5).pcm...)
+	played, err := readWav(sink)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, played.pcm, expected)
+
+	// a command player cannot follow a ramp
+	fName, cleanup2 := testConfigFile(t, map[string]interface{}{sVolumeControl: volumeSoftware, sAudioBackend: audioMpg123, sVolumeRamp: "10s"})
+	defer cleanup2()
+	_, err = loadSettings(fName, nil, nil)
+	assert.ErrorContains(t, err, "volumeRamp needs volumeControl amixer (or the wav backend)")
+	_, err = loadSettings(fName, nil, []string{"audioBackend=wav", "audioSink=" + sink})
+	assert.NilError(t, err)
+}
+
+const testTags string = "./test/tags"
+
+func TestReadTags(t *testing.T) {
+	frames := func(n int) time.Duration {
+		// 417 byte frames at 128kbps
+		return time.Duration(n*417*8) * time.Second / 128000
+	}
+	for fName, expected := range map[string]trackTags{
+		"starman.mp3":    {title: "Starman", artist: "David Bowie", album: "Ziggy Stardust", duration: frames(10)},
+		"02 oddity.mp3":  {title: "Space Oddity", artist: "David Bowie", duration: 315 * time.Second},
+		"getup.mp3":      {title: "Gotta Get Up", artist: "Harry Nilsson", album: "Nilsson Schmilsson", duration: frames(20)},
+		"morning.ogg":    {title: "Morning Has Broken", artist: "Cat Stevens", album: "Teaser and the Firecat", duration: 10 * time.Second},
+		"easy.flac":      {title: "Easy Street", artist: "The Collapsable Hearts Club", duration: 3 * time.Second},
+		"plain.wav":      {duration: dTestBeep},
+		"../music/pizza": {},
+	} {
+		tags, err := readTags(filepath.Join(testTags, fName))
+		assert.NilError(t, err, fName)
+		assert.Equal(t, tags, expected, fName)
+	}
+}
+
+func TestTagSizes(t *testing.T) {
+	// sizes of 2GB and more are cut short, not turned negative
+	huge := []byte{0xff, 0xff, 0xff, 0xff}
+	comment := append(append([]byte{}, huge...), "vendor"...)
+	assert.Error(t, vorbisComments(comment, &trackTags{}), "Short comment header")
+	comment = append([]byte{0, 0, 0, 0, 1, 0, 0, 0}, huge...)
+	assert.Error(t, vorbisComments(append(comment, "TITLE=x"...), &trackTags{}), "Short comment")
+
+	frame := append([]byte("ID3\x03\x00\x00\x00\x00\x01\x00TIT2"), huge...)
+	frame = append(frame, make([]byte, 100)...)
+	tags, _ := id3v2(frame)
+	assert.Equal(t, tags, trackTags{})
+	extended := append([]byte("ID3\x03\x00\x40\x00\x00\x01\x00"), huge...)
+	extended = append(extended, make([]byte, 100)...)
+	tags, _ = id3v2(extended)
+	assert.Equal(t, tags, trackTags{})
+}
+
+func TestMatchTracks(t *testing.T) {
+	tracks, err := scanLibrary(testTags, &ThreadLogger{name: "test"})
+	assert.NilError(t, err)
+	assert.Equal(t, len(tracks), 6)
+	assert.Equal(t, tracks[0].Path, "02 oddity.mp3")
+	assert.Equal(t, tracks[0].Seconds, 315.0)
+
+	matches := func(query string) []string {
+		paths := make([]string, 0)
+		for _, m := range bestTracks(tracks, query) {
+			paths = append(paths, m.track.Path)
+		}
+		return paths
+	}
+	// file name, title, artist and album
+	assert.DeepEqual(t, matches("plain"), []string{"plain.wav"})
+	assert.DeepEqual(t, matches("02 Oddity"), []string{"02 oddity.mp3"})
+	assert.DeepEqual(t, matches("space oddity"), []string{"02 oddity.mp3"})
+	assert.DeepEqual(t, matches("Cat Stevens"), []string{"morning.ogg"})
+	assert.DeepEqual(t, matches("nilsson schmilsson"), []string{"getup.mp3"})
+	// words, every Bowie track is as good as the other
+	assert.DeepEqual(t, matches("bowie"), []string{"02 oddity.mp3", "starman.mp3"})
+	assert.DeepEqual(t, matches("bowie star"), []string{"starman.mp3"})
+	// typos
+	assert.DeepEqual(t, matches("collapsible hearts"), []string{"easy.flac"})
+	assert.DeepEqual(t, matches("nilson"), []string{"getup.mp3"})
+	assert.DeepEqual(t, matches("metallica"), []string{})
+	assert.DeepEqual(t, matches(""), []string{})
+
+	m := bestTracks(tracks, "space oddity")[0]
+	assert.Equal(t, m.reason, `title "Space Oddity"`)
+	m = bestTracks(tracks, "nilson")[0]
+	assert.Equal(t, m.reason, `close to "Harry Nilsson - Gotta Get Up" (0.86)`)
+}
+
+func TestFindTrack(t *testing.T) {
+	rt, _, _ := testRuntimeWith(map[string]interface{}{sMusicPath: testTags})
+
+	track, ok := findTrack(rt, "morning has broken")
+	assert.Assert(t, ok)
+	assert.Equal(t, track, filepath.Join(testTags, "morning.ogg"))
+
+	track, ok = findTrack(rt, "bowie")
+	assert.Assert(t, ok)
+	assert.Assert(t, strings.Contains(track, ".mp3"), track)
+
+	_, ok = findTrack(rt, "metallica")
+	assert.Assert(t, !ok)
+}
+
+func TestLibraryIndex(t *testing.T) {
+	dir, cleanup := testMusicDir(t)
+	defer cleanup()
+	copyTrack := func(name string) {
+		data, err := ioutil.ReadFile(filepath.Join(testTags, name))
+		assert.NilError(t, err)
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, name), data, 0644))
+	}
+	indexed := func() int {
+		libraryIndex.Lock()
+		defer libraryIndex.Unlock()
+		if libraryIndex.dir != dir {
+			return -1
+		}
+		return len(libraryIndex.tracks)
+	}
+	copyTrack("plain.wav")
+	rt, _, _ := testRuntimeWith(map[string]interface{}{sMusicPath: dir})
+	refreshLibrary(dir, rt.logger)
+	assert.Equal(t, indexed(), 1)
+
+	// an alarm uses the index it has, and it catches up for the next one
+	copyTrack("starman.mp3")
+	_, ok := findTrack(rt, "starman")
+	assert.Assert(t, !ok)
+	for i := 0; i < 100 && indexed() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	track, ok := findTrack(rt, "starman")
+	assert.Assert(t, ok)
+	assert.Equal(t, track, filepath.Join(dir, "starman.mp3"))
+	tracks, err := loadPlaylist(rt, "")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tracks, []string{filepath.Join(dir, "plain.wav"), filepath.Join(dir, "starman.mp3")})
+}
+
+// testRadio is a stand-in station: /stream sends the beep as a WAV
+// stream then holds on (or hangs up with drop), /station.m3u points at
+// /stream
+type testRadio struct {
+	beep   *wavData
+	drop   bool
+	sent   chan bool
+	closed chan bool
+}
+
+func newTestRadio(t *testing.T, drop bool) (*testRadio, *httptest.Server) {
+	beep, err := readWav(testBeep)
+	assert.NilError(t, err)
+	radio := &testRadio{beep: beep, drop: drop, sent: make(chan bool, 1), closed: make(chan bool, 1)}
+	srv := httptest.NewServer(radio)
+	return radio, srv
+}
+
+func (tr *testRadio) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/station.m3u":
+		w.Header().Set("Content-Type", "audio/x-mpegurl")
+		fmt.Fprintf(w, "#EXTM3U\n#EXTINF:-1,Test FM\nhttp://%s/stream\n", r.Host)
+	case "/garbage":
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Write([]byte("this is not audio"))
+	case "/html":
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html>Sorry</html>"))
+	case "/stream":
+		w.Header().Set("Content-Type", "audio/wav")
+		writeWavHeader(w, tr.beep.format, 0)
+		w.Write(tr.beep.pcm)
+		w.(http.Flusher).Flush()
+		tr.sent <- true
+		if tr.drop {
+			return
+		}
+		<-r.Context().Done()
+		tr.closed <- true
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// testFallback stands in for the local track, it reports that it ran
+// and finishes the alarm
+func testFallback(called chan bool) func(stop chan bool, done chan bool) {
+	return func(stop chan bool, done chan bool) {
+		called <- true
+		done <- true
+	}
+}
+
+func TestPlayStream(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	rt, _, _ := testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink})
+	rt.status.setVolume(volumeMax)
+	backend, _ := newAudioBackend(rt.settings)
+	radio, srv := newTestRadio(t, false)
+	defer srv.Close()
+
+	for _, path := range []string{"/stream", "/station.m3u"} {
+		os.Remove(sink)
+		stop := make(chan bool, 1)
+		done := make(chan bool, 1)
+		fallback := make(chan bool, 1)
+		go playStream(rt, backend, srv.URL+path, playOptions{}, testFallback(fallback), stop, done)
+
+		// it keeps playing until it is stopped
+		<-radio.sent
+		for i := 0; i < 100; i++ {
+			if played, err := readWav(sink); err == nil && len(played.pcm) == len(radio.beep.pcm) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		stop <- true
+		<-done
+		<-radio.closed
+		assert.Equal(t, len(fallback), 0, path)
+
+		played, err := readWav(sink)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, played.pcm, radio.beep.pcm)
+		assert.Equal(t, rt.status.getAudioError(), "")
+	}
+}
+
+func TestPlayStreamDuration(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink})
+	backend, _ := newAudioBackend(rt.settings)
+	radio, srv := newTestRadio(t, false)
+	defer srv.Close()
+
+	// the stream never ends, the play time does
+	stop := make(chan bool, 1)
+	done := make(chan bool, 1)
+	fallback := make(chan bool, 1)
+	go playStream(rt, backend, srv.URL+"/stream", playOptions{duration: time.Minute}, testFallback(fallback), stop, done)
+	<-radio.sent
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	<-done
+	<-radio.closed
+	assert.Equal(t, len(fallback), 0)
+	assert.Equal(t, rt.status.getAudioError(), "")
+}
+
+func TestPlayStreamDrop(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	rt, _, _ := testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink})
+	backend, _ := newAudioBackend(rt.settings)
+	_, srv := newTestRadio(t, true)
+	defer srv.Close()
+
+	stop := make(chan bool, 1)
+	done := make(chan bool, 1)
+	fallback := make(chan bool, 1)
+	go playStream(rt, backend, srv.URL+"/stream", playOptions{}, testFallback(fallback), stop, done)
+	<-done
+	assert.Equal(t, len(fallback), 1)
+	assert.Equal(t, rt.status.getAudioError(), "Stream dropped: ended")
+}
+
+func TestPlayStreamStall(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	rt, _, _ := testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink, sRadioTimeout: 100 * time.Millisecond})
+	backend, _ := newAudioBackend(rt.settings)
+	_, srv := newTestRadio(t, false)
+	defer srv.Close()
+
+	stop := make(chan bool, 1)
+	done := make(chan bool, 1)
+	fallback := make(chan bool, 1)
+	go playStream(rt, backend, srv.URL+"/stream", playOptions{}, testFallback(fallback), stop, done)
+	<-done
+	assert.Equal(t, len(fallback), 1)
+	assert.Assert(t, strings.HasPrefix(rt.status.getAudioError(), "Stream dropped: "), rt.status.getAudioError())
+}
+
+func TestPlayStreamFailures(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	rt, _, _ := testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink, sRadioTimeout: 100 * time.Millisecond})
+	backend, _ := newAudioBackend(rt.settings)
+	_, srv := newTestRadio(t, false)
+	defer srv.Close()
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	for path, expected := range map[string]string{
+		srv.URL + "/nope":    "404 Not Found",
+		srv.URL + "/html":    "is not a stream",
+		srv.URL + "/garbage": "Not a WAV stream",
+		gone.URL + "/stream": "connection refused",
+	} {
+		stop := make(chan bool, 1)
+		done := make(chan bool, 1)
+		fallback := make(chan bool, 1)
+		go playStream(rt, backend, path, playOptions{}, testFallback(fallback), stop, done)
+		<-done
+		assert.Equal(t, len(fallback), 1, path)
+		assert.Assert(t, strings.Contains(rt.status.getAudioError(), expected), rt.status.getAudioError())
+	}
+}
+
+func TestAlarmStream(t *testing.T) {
+	var stations interface{}
+	assert.NilError(t, json.Unmarshal([]byte(`[{"name": "Jazz", "url": "http://radio.example/jazz"}]`), &stations))
+	parsed, err := toRadioStations(stations)
+	assert.NilError(t, err)
+	rt, _, _ := testRuntimeWith(map[string]interface{}{sStations: parsed})
+
+	for _, test := range []struct {
+		alm      alarm
+		expected string
+	}{
+		{alarm{Effect: almRadio, Extra: "jazz"}, "http://radio.example/jazz"},
+		{alarm{Effect: almRadio, Options: "station=Jazz"}, "http://radio.example/jazz"},
+		{alarm{Effect: almRadio, Extra: "http://radio.example/rock"}, "http://radio.example/rock"},
+		{alarm{Effect: almRadio, Extra: "jazz", Options: "stream=http://radio.example/x?a=b"}, "http://radio.example/x?a=b"},
+	} {
+		streamURL, err := alarmStream(rt, &test.alm)
+		assert.NilError(t, err)
+		assert.Equal(t, streamURL, test.expected)
+	}
+	_, err = alarmStream(rt, &alarm{Effect: almRadio, Extra: "polka"})
+	assert.Error(t, err, "Unknown station: 'polka'")
+
+	assert.NilError(t, json.Unmarshal([]byte(`[{"name": "Bad", "url": "ftp://radio.example/jazz"}]`), &stations))
+	_, err = toRadioStations(stations)
+	assert.Error(t, err, "Station Bad needs an http(s) url: ftp://radio.example/jazz")
+}
+
+func TestAudioWavPause(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink})
+	rt.status.setVolume(volumeMax)
+	backend, _ := newAudioBackend(rt.settings)
+	beep, _ := readWav(testBeep)
+
+	// paused for a while in the middle, it still plays once through
+	stop := make(chan bool, 1)
+	done := make(chan bool, 1)
+	go playTracks(rt, backend, []string{testBeep}, playOptions{repeat: 1}, stop, done)
+	clock.BlockUntil(1)
+	clock.Advance(100 * time.Millisecond)
+	rt.status.pausePlaying(true)
+	clock.Advance(time.Second)
+	rt.status.pausePlaying(false)
+	clock.BlockUntil(1)
+	clock.Advance(dTestBeep - 100*time.Millisecond)
+	<-done
+	played, err := readWav(sink)
+	assert.NilError(t, err)
+	assert.Equal(t, len(played.pcm), len(beep.pcm))
+
+	// stopped while paused, only what played before the pause
+	os.Remove(sink)
+	go playTracks(rt, backend, []string{testBeep}, playOptions{repeat: 1}, stop, done)
+	clock.BlockUntil(1)
+	clock.Advance(100 * time.Millisecond)
+	rt.status.pausePlaying(true)
+	clock.Advance(time.Second)
+	stop <- true
+	<-done
+	played, err = readWav(sink)
+	assert.NilError(t, err)
+	assert.Equal(t, played.format.duration(len(played.pcm)), 100*time.Millisecond)
+
+	// anything that starts during a pause starts paused
+	os.Remove(sink)
+	go playTracks(rt, backend, []string{testBeep}, playOptions{repeat: 1}, stop, done)
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	rt.status.pausePlaying(false)
+	clock.BlockUntil(1)
+	clock.Advance(dTestBeep)
+	<-done
+	played, _ = readWav(sink)
+	assert.Equal(t, len(played.pcm), len(beep.pcm))
+}
+
+func TestSpokenTime(t *testing.T) {
+	now := time.Date(2020, 01, 26, 9, 15, 0, 0, time.UTC)
+	assert.Equal(t, spokenTime(now, now.Add(time.Hour)), "10:15 AM")
+	assert.Equal(t, spokenTime(now, time.Date(2020, 01, 27, 7, 0, 0, 0, time.UTC)), "7:00 AM tomorrow")
+	assert.Equal(t, spokenTime(now, time.Date(2020, 01, 29, 19, 30, 0, 0, time.UTC)), "7:30 PM Wednesday")
+	assert.Equal(t, spokenTime(now, time.Date(2020, 02, 14, 6, 0, 0, 0, time.UTC)), "6:00 AM, February 14")
+}
+
+func TestCommandSpeaker(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sAudioBackend: audioWav, sAudioSink: sink, sTTS: ttsCommand})
+	rt.status.setVolume(volumeMax)
+
+	// speaks by itself, the text is one argument
+	rt.settings.settings[sTTSCommand] = "true"
+	speaker, err := newSpeaker(rt.settings)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, speaker.(*commandSpeaker).args, []string{"true", ttsTextArg})
+	assert.NilError(t, speaker.speak(rt, "It's 9:15 AM."))
+
+	rt.settings.settings[sTTSCommand] = "false {text}"
+	speaker, _ = newSpeaker(rt.settings)
+	assert.ErrorContains(t, speaker.speak(rt, "hello"), "false: exit status 1")
+
+	// writes a WAV that is then played
+	rt.settings.settings[sTTSCommand] = "./test/tts/say.sh {file} {text}"
+	speaker, _ = newSpeaker(rt.settings)
+	spoken := make(chan error, 1)
+	go func() {
+		spoken <- speaker.speak(rt, "It's 9:15 AM.")
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(dTestBeep)
+	assert.NilError(t, <-spoken)
+	beep, _ := readWav(testBeep)
+	played, err := readWav(sink)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, played.pcm, beep.pcm)
+
+	for name, expected := range map[string]string{ttsNone: "*main.noSpeaker", ttsEspeak: "*main.commandSpeaker", ttsPico: "*main.commandSpeaker"} {
+		rt.settings.settings[sTTS] = name
+		speaker, err := newSpeaker(rt.settings)
+		assert.NilError(t, err)
+		assert.Equal(t, fmt.Sprintf("%T", speaker), expected)
+	}
+	rt.settings.settings[sTTS] = "shouty"
+	_, err = newSpeaker(rt.settings)
+	assert.Error(t, err, "Unknown tts: shouty")
+}
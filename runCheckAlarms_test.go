@@ -88,6 +88,31 @@ func TestCheckAlarmsMixed(t *testing.T) {
 	testQuit(rt)
 }
 
+func TestCheckAlarmsCalendarOff(t *testing.T) {
+	rt, clock, comms := testRuntimeWith(map[string]interface{}{sCalendarAlarms: false})
+	events := rt.events.(*testEvents)
+
+	go runCheckAlarms(rt)
+	clock.BlockUntil(1)
+	ledReadAll(rt.comms.leds)
+
+	// alarms to come, but a profile turned the calendar off
+	events.oldAlarms = 3
+	alarms, _ := getAlarmsFromService(rt)
+	comms.chkAlarms <- alarmsLoadedMsg(1, alarms, true)
+
+	// wait for a cycle
+	testBlockDuration(clock, dAlarmSleep, dAlarmSleep)
+
+	// should have messaged an off to the led controller
+	le, _ := ledRead(t, rt.comms.leds)
+	assert.Equal(t, le.pin, rt.settings.GetInt(sLEDAlm))
+	assert.Equal(t, le.mode, modeOff)
+	assert.Assert(t, rt.status.getNextAlarm() == nil)
+	// done
+	testQuit(rt)
+}
+
 func TestCheckAlarmsCountdown(t *testing.T) {
 	rt, clock, comms := testRuntime()
 
@@ -490,11 +515,12 @@ func TestCheckAlarmsDoubleClick(t *testing.T) {
 	// wait for a cycle to complete startup loop
 	clock.BlockUntil(1)
 
-	// the double click event comes in on another message
-	// the duration is longs than the checker, so make sure
-	// that we only get 1 effect message
+	// the double click event comes in on another message, it is
+	// acted on at the release.  clicks come faster than the prints
+	// take, so make sure that we only get 1 effect message
 	testBlockDurationCB(clock, dAlarmSleep, time.Second, func(cnt int) {
-		comms.chkAlarms <- doubleButtonAlmMsg(true, time.Duration(cnt-1)*dAlarmSleep)
+		comms.chkAlarms <- doubleButtonAlmMsg(true, 0)
+		comms.chkAlarms <- doubleButtonAlmMsg(false, 0)
 	})
 
 	// should be a bunch of prints
@@ -525,6 +551,27 @@ func TestCheckAlarmsDoubleClick(t *testing.T) {
 	testQuit(rt)
 }
 
+func TestCheckAlarmsSleepHold(t *testing.T) {
+	rt, clock, comms := testRuntime()
+	events := rt.events.(*testEvents)
+	events.oldAlarms = 3
+	alarms, _ := getAlarmsFromService(rt)
+	comms.chkAlarms <- alarmsLoadedMsg(1, alarms, true)
+
+	go runCheckAlarms(rt)
+	clock.BlockUntil(1)
+	effectReadAll(comms.effects)
+
+	// held for the sleep timer, it is not a double click
+	comms.chkAlarms <- doubleButtonAlmMsg(true, 0)
+	comms.chkAlarms <- doubleButtonAlmMsg(true, dSleepHold)
+	comms.chkAlarms <- doubleButtonAlmMsg(false, 0)
+	testBlockDuration(clock, dAlarmSleep, time.Second)
+	assert.Equal(t, len(effectReadAll(comms.effects)), 0)
+
+	testQuit(rt)
+}
+
 func TestCheckAlarmsDoubleClickPendingThenCacnel(t *testing.T) {
 	rt, clock, comms := testRuntime()
 	events := rt.events.(*testEvents)
@@ -542,6 +589,7 @@ func TestCheckAlarmsDoubleClickPendingThenCacnel(t *testing.T) {
 
 	// the double click event comes in on another message
 	comms.chkAlarms <- doubleButtonAlmMsg(true, 0)
+	comms.chkAlarms <- doubleButtonAlmMsg(false, 0)
 	testBlockDuration(clock, dAlarmSleep, dAlarmSleep)
 
 	// should have sent cancel prompt
@@ -602,6 +650,7 @@ func TestCheckAlarmsDoubleClickPendingNoCancel(t *testing.T) {
 
 	// the double click event comes in on another message
 	comms.chkAlarms <- doubleButtonAlmMsg(true, 0)
+	comms.chkAlarms <- doubleButtonAlmMsg(false, 0)
 	testBlockDuration(clock, dAlarmSleep, dAlarmSleep)
 
 	// should have sent cancel prompt
@@ -763,8 +812,6 @@ func TestCheckAlarmsConfigError(t *testing.T) {
 	// send a config error and then a double click into checkAlarms
 	comms.chkAlarms <- configErrorMsg(true, secret)
 	comms.chkAlarms <- doubleButtonAlmMsg(true, 0)
-	comms.chkAlarms <- doubleButtonAlmMsg(true, time.Second)
-	comms.chkAlarms <- doubleButtonAlmMsg(true, 2*time.Second)
 	comms.chkAlarms <- doubleButtonAlmMsg(false, 0)
 	// wait to process
 	testBlockDuration(clock, dAlarmSleep, 5*dAlarmSleep)
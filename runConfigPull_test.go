@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jonboulle/clockwork"
+	"gotest.tools/assert"
+)
+
+/* things that runConfigPull does:
+
+pulls the config and music manifest from the config server
+sends the ETag it has, and leaves things be on a 304
+checks the signature and that the version is newer, and that the
+settings load, before it uses them
+keeps the last good config when the server is down, and across restarts
+
+*/
+
+// testConfigServer serves a signed config and manifest for each host,
+// the ETag is the body's signature
+type testConfigServer struct {
+	mutex    sync.Mutex
+	key      []byte
+	bodies   map[string]string // path -> body
+	versions map[string]int64  // path -> version
+	version  int64             // the last one handed out
+	badSign  bool
+	down     bool
+	gets     []string // path and If-None-Match
+}
+
+func (cs *testConfigServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.gets = append(cs.gets, r.URL.Path+" "+r.Header.Get("If-None-Match"))
+	body, ok := cs.bodies[r.URL.Path]
+	switch {
+	case cs.down:
+		http.Error(w, "down", http.StatusBadGateway)
+	case !ok:
+		http.NotFound(w, r)
+	default:
+		version := cs.versions[r.URL.Path]
+		etag := `"` + signBody(version, []byte(body), cs.key)[7:19] + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set(versionHeader, strconv.FormatInt(version, 10))
+		if cs.badSign {
+			w.Header().Set(signatureHeader, signBody(version, []byte(body), []byte("not the key")))
+		} else {
+			w.Header().Set(signatureHeader, signBody(version, []byte(body), cs.key))
+		}
+		w.Write([]byte(body))
+	}
+}
+
+// set publishes body at the next version
+func (cs *testConfigServer) set(path string, body string) {
+	cs.mutex.Lock()
+	cs.version++
+	version := cs.version
+	cs.mutex.Unlock()
+	cs.setVersion(path, body, version)
+}
+
+// setVersion publishes body at any version, an old one is a replay
+func (cs *testConfigServer) setVersion(path string, body string, version int64) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.bodies[path] = body
+	cs.versions[path] = version
+}
+
+func (cs *testConfigServer) remove(path string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	delete(cs.bodies, path)
+}
+
+func (cs *testConfigServer) requests() []string {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	gets := cs.gets
+	cs.gets = nil
+	return gets
+}
+
+// testPullConfig - a config file (with changes) that pulls from a
+// stand-in server for the kitchen, with the key and the cache in their own
+// directory
+func testPullConfig(t *testing.T, changes map[string]interface{}) (runtimeConfig, *testConfigServer, *httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "piclock")
+	assert.NilError(t, err)
+	keyFile := filepath.Join(dir, "fleet.key")
+	assert.NilError(t, ioutil.WriteFile(keyFile, []byte("fleet secret\n"), 0600))
+	cs := &testConfigServer{key: []byte("fleet secret"), bodies: map[string]string{}, versions: map[string]int64{}}
+	srv := httptest.NewServer(cs)
+
+	pull := map[string]interface{}{
+		sConfigServer:    srv.URL + "/clocks/{host}",
+		sConfigServerKey: keyFile,
+		sConfigPullCache: filepath.Join(dir, "pulled"),
+	}
+	for k, v := range changes {
+		pull[k] = v
+	}
+	fName, cleanup := testConfigFile(t, pull)
+	host := configHost
+	configHost = "kitchen"
+	rt, _, _ := testRuntimeWith(nil)
+	rt.settings = initSettings(fName, nil)
+	return rt, cs, srv, func() {
+		configHost = host
+		srv.Close()
+		cleanup()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestConfigPull(t *testing.T) {
+	rt, cs, srv, cleanup := testPullConfig(t, nil)
+	defer cleanup()
+	client := srv.Client()
+	cs.set("/clocks/kitchen/config", `{"brightness": 7, "calendar": "kitchen"}`)
+	cs.set("/clocks/kitchen/music", `[{"name": "easy", "path": "http://example.com/easy.mp3"}]`)
+	cached := filepath.Join(rt.settings.GetString(sConfigPullCache), pulledConfigFile)
+
+	status := pullFromServer(rt, client)
+	assert.Equal(t, status.Error, "")
+	assert.Equal(t, status.Server, srv.URL+"/clocks/kitchen")
+	assert.Equal(t, rt.settings.GetInt(sBrightness), 7)
+	assert.Equal(t, rt.settings.source(sBrightness), cached)
+	assert.Equal(t, rt.settings.GetString(sCalName), "kitchen")
+	assert.Equal(t, len(status.ETags), 2)
+	assert.DeepEqual(t, status.Versions, map[string]int64{pullConfig: 1, pullMusic: 2})
+	assert.Equal(t, musicManifest(rt.settings), filepath.Join(rt.settings.GetString(sConfigPullCache), pulledMusicFile))
+	assert.DeepEqual(t, cs.requests(), []string{"/clocks/kitchen/config ", "/clocks/kitchen/music "})
+	effectReadAll(rt.comms.effects)
+
+	// nothing new, the ETags say so
+	status = pullFromServer(rt, client)
+	assert.Equal(t, status.Error, "")
+	assert.DeepEqual(t, cs.requests(), []string{
+		"/clocks/kitchen/config " + status.ETags[pullConfig],
+		"/clocks/kitchen/music " + status.ETags[pullMusic],
+	})
+	assert.Equal(t, len(rt.comms.effects), 0)
+
+	// none of these are used, the last good config stays
+	bad := []struct {
+		body    string
+		badSign bool
+		down    bool
+		want    string
+	}{
+		{`{"brightness": 2}`, true, false, "Bad X-Piclock-Signature"},
+		{`{"brightness": 2}`, false, true, "502 Bad Gateway"},
+		{"", false, false, "404 Not Found"},
+		{`{"brightness": 16}`, false, false, "brightness must be 0 - 15: 16"},
+		{`{"configServer": ""}`, false, false, "configServer cannot come from the config server"},
+		{`{"audioCommand": "rm -rf ~"}`, false, false, "audioCommand cannot come from the config server"},
+		{`{"settingsToken": "/tmp/mine"}`, false, false, "settingsToken cannot come from the config server"},
+		{`{"brightness": `, false, false, "config from the config server"},
+	}
+	for _, b := range bad {
+		if b.body == "" {
+			cs.remove("/clocks/kitchen/config")
+		} else {
+			cs.set("/clocks/kitchen/config", b.body)
+		}
+		cs.mutex.Lock()
+		cs.badSign, cs.down = b.badSign, b.down
+		cs.mutex.Unlock()
+		status = pullFromServer(rt, client)
+		assert.Assert(t, strings.Contains(status.Error, b.want), "%s: %s", b.body, status.Error)
+		assert.Equal(t, rt.settings.GetInt(sBrightness), 7, b.body)
+		data, _ := ioutil.ReadFile(cached)
+		assert.Equal(t, string(data), `{"brightness": 7, "calendar": "kitchen"}`, b.body)
+	}
+
+	// an old config, signed and all, is not sent again
+	cs.setVersion("/clocks/kitchen/config", `{"brightness": 2}`, 1)
+	status = pullFromServer(rt, client)
+	assert.Assert(t, strings.Contains(status.Error, "version 1 is not newer than 1"), status.Error)
+	assert.Equal(t, rt.settings.GetInt(sBrightness), 7)
+
+	// and across a restart, without the server
+	srv.Close()
+	s, err := loadSettings(rt.settings.file, nil, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, s.GetInt(sBrightness), 7)
+	status = pullFromServer(rt, client)
+	assert.Assert(t, status.Error != "")
+	assert.Equal(t, rt.settings.GetInt(sBrightness), 7)
+}
+
+func TestConfigPullSettings(t *testing.T) {
+	rt, _, _, cleanup := testPullConfig(t, nil)
+	defer cleanup()
+
+	_, err := loadSettings(rt.settings.file, nil, []string{"configServerKey="})
+	assert.ErrorContains(t, err, "configServer needs a configServerKey")
+
+	// the server cannot say where it is
+	cache := rt.settings.GetString(sConfigPullCache)
+	assert.NilError(t, os.MkdirAll(cache, 0755))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(cache, pulledConfigFile), []byte(`{"configServerKey": "/tmp/mine"}`), 0600))
+	_, err = loadSettings(rt.settings.file, nil, nil)
+	assert.ErrorContains(t, err, "configServerKey cannot come from the config server")
+
+	// and is ignored when it is turned off
+	off, cleanup2 := testConfigFile(t, map[string]interface{}{sConfigPullCache: cache})
+	defer cleanup2()
+	s, err := loadSettings(off, nil, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, musicManifest(*s), s.GetString(sMusicURL))
+}
+
+func TestRunConfigPull(t *testing.T) {
+	rt, cs, srv, cleanup := testPullConfig(t, nil)
+	defer cleanup()
+	clock := rt.clock.(clockwork.FakeClock)
+	cs.set("/clocks/kitchen/config", `{"brightness": 7}`)
+	cs.set("/clocks/kitchen/music", `[]`)
+
+	go runConfigPull(rt)
+	clock.BlockUntil(1)
+	assert.Equal(t, rt.settings.GetInt(sBrightness), 7)
+	assert.Equal(t, rt.status.getPull().Error, "")
+	assert.Equal(t, len(cs.requests()), 2)
+
+	// every configPullTime
+	cs.set("/clocks/kitchen/config", `{"brightness": 5}`)
+	clock.Advance(rt.settings.GetDuration(sConfigPullTime))
+	clock.BlockUntil(1)
+	assert.Equal(t, rt.settings.GetInt(sBrightness), 5)
+	assert.Equal(t, len(cs.requests()), 2)
+
+	handler := NewHandler(rt)
+	w := httptest.NewRecorder()
+	handler.apiPull(w, httptest.NewRequest("GET", "/api/pull", nil))
+	var status pullStatus
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, status.Server, srv.URL+"/clocks/kitchen")
+	assert.Equal(t, status.Updated, clock.Now())
+
+	rt.comms.quit <- struct{}{}
+}
+
+func TestDownloadPulledManifest(t *testing.T) {
+	ms, msrv := newTestMusicServer()
+	defer msrv.Close()
+	dir, cleanup := testMusicDir(t)
+	defer cleanup()
+	rt, cs, srv, cleanup2 := testPullConfig(t, map[string]interface{}{sMusicPath: dir, sMusicRetries: 0})
+	defer cleanup2()
+
+	// the manifest comes from the config server, the files from wherever it says
+	a := ms.add(msrv, "a.mp3", "aaaa", "")
+	manifest, _ := json.Marshal([]musicFile{a})
+	cs.set("/clocks/kitchen/config", `{}`)
+	cs.set("/clocks/kitchen/music", string(manifest))
+	assert.Equal(t, pullFromServer(rt, srv.Client()).Error, "")
+	downloadMusic(rt)
+	assert.DeepEqual(t, testDirFiles(t, dir), []string{".manifest.json", "a.mp3"})
+	assert.Equal(t, ms.getCount("/music.json"), 0)
+}
@@ -1,7 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"gotest.tools/assert"
 )
@@ -34,6 +43,19 @@ func TestAPIStatusGood(t *testing.T) {
 	assert.Equal(t, status.Response, "OK")
 	assert.Equal(t, status.Error, "")
 	assert.Equal(t, len(status.Alarms), 5)
+	assert.Equal(t, status.Audio.Backend, audioMpg123)
+	assert.Equal(t, status.Audio.Error, "")
+
+	rt.status.setAudioError("mpg123: exit status 1")
+	status = testHandler.handler.getStatus()
+	assert.Equal(t, status.Audio.Error, "mpg123: exit status 1")
+
+	assert.Equal(t, status.Music.State, downloadIdle)
+	rt.status.beginDownloads(clock.Now())
+	rt.status.updateDownloads(func(ds *downloadStatus) { ds.Total = 4 })
+	status = testHandler.handler.getStatus()
+	assert.Equal(t, status.Music.State, downloadRunning)
+	assert.Equal(t, status.Music.Total, 4)
 
 	testQuit(rt)
 }
@@ -61,3 +83,338 @@ func TestAPIOauth(t *testing.T) {
 	// might need to make an OAuth mocker?
 	// assert.Assert(t, false)
 }
+
+func TestAPIDisplayStream(t *testing.T) {
+	rt, clock, _ := testRuntime()
+	handler := NewHandler(rt)
+
+	rt.display.OpenDisplay(rt.settings)
+	rt.display.DisplayOn(true)
+	rt.display.Print("12:34")
+	rt.status.setLED(rt.settings.GetInt(sLEDAlm), true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", "/api/display", nil)
+	w := httptest.NewRecorder()
+	done := make(chan bool)
+	go func() {
+		handler.apiDisplay(w, req.WithContext(ctx))
+		done <- true
+	}()
+
+	// first event is the current state
+	clock.BlockUntil(1)
+	// nothing changed, no new event
+	clock.Advance(dDisplayStream)
+	clock.BlockUntil(1)
+	// change the display
+	rt.display.Print("bEEF")
+	clock.Advance(dDisplayStream)
+	clock.BlockUntil(1)
+	cancel()
+	<-done
+
+	assert.Equal(t, w.Header().Get("Content-Type"), "text/event-stream")
+	events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, events[0], `data: {"digits":[6,91,79,102],"colon":true,"blink":0,"brightness":15,"on":true,"inverted":false,"alarmLed":true,"errorLed":false}`)
+	assert.Equal(t, events[1], `data: {"digits":[124,121,121,113],"colon":false,"blink":0,"brightness":15,"on":true,"inverted":false,"alarmLed":true,"errorLed":false}`)
+}
+
+func TestAPIVolume(t *testing.T) {
+	rt, _, comms := testRuntime()
+	handler := NewHandler(rt)
+	rt.status.setVolume(70)
+	rt.status.setVolumeTarget(70)
+
+	w := httptest.NewRecorder()
+	handler.apiVolume(w, httptest.NewRequest("GET", "/api/volume", nil))
+	assert.Equal(t, w.Body.String(), `{"level":70,"target":70,"control":"software"}`)
+
+	w = httptest.NewRecorder()
+	handler.apiSetVolume(w, httptest.NewRequest("PUT", "/api/volume", strings.NewReader(`{"level": 35}`)))
+	assert.Equal(t, w.Code, 200)
+	e, _ := effectRead(t, comms.effects)
+	assert.Equal(t, e, volumeEffect(35))
+
+	for _, bad := range []string{`{"level": 101}`, `{"level": -1}`, `{"level": "loud"}`, `nope`} {
+		w = httptest.NewRecorder()
+		handler.apiSetVolume(w, httptest.NewRequest("PUT", "/api/volume", strings.NewReader(bad)))
+		assert.Equal(t, w.Code, 400, bad)
+	}
+	assert.Equal(t, len(effectReadAll(comms.effects)), 0)
+}
+
+func TestAPISleep(t *testing.T) {
+	rt, clock, comms := testRuntime()
+	handler := NewHandler(rt)
+
+	w := httptest.NewRecorder()
+	handler.apiSleep(w, httptest.NewRequest("GET", "/api/sleep", nil))
+	assert.Equal(t, w.Body.String(), `{"active":false,"minutes":0,"ends":"0001-01-01T00:00:00Z","tracks":0}`)
+
+	w = httptest.NewRecorder()
+	handler.apiSetSleep(w, httptest.NewRequest("PUT", "/api/sleep", strings.NewReader(`{"minutes": 45}`)))
+	assert.Equal(t, w.Code, 200)
+	var sleep sleepStatus
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &sleep))
+	assert.Equal(t, sleep.Active, true)
+	assert.Assert(t, sleep.Ends.Equal(clock.Now().Add(45*time.Minute)))
+	e, _ := effectRead(t, comms.effects)
+	assert.Equal(t, e, sleepEffect(45*time.Minute))
+
+	w = httptest.NewRecorder()
+	handler.apiSetSleep(w, httptest.NewRequest("PUT", "/api/sleep", strings.NewReader(`{"minutes": 0}`)))
+	assert.Equal(t, w.Code, 200)
+	e, _ = effectRead(t, comms.effects)
+	assert.Equal(t, e, sleepEffect(0))
+
+	for _, bad := range []string{`{"minutes": 721}`, `{"minutes": -5}`, `{"minutes": "soon"}`, `nope`} {
+		w = httptest.NewRecorder()
+		handler.apiSetSleep(w, httptest.NewRequest("PUT", "/api/sleep", strings.NewReader(bad)))
+		assert.Equal(t, w.Code, 400, bad)
+	}
+	assert.Equal(t, len(effectReadAll(comms.effects)), 0)
+}
+
+func TestAPIMusic(t *testing.T) {
+	rt, _, _ := testRuntimeWith(map[string]interface{}{sMusicPath: "./test/tags"})
+	handler := NewHandler(rt)
+
+	w := httptest.NewRecorder()
+	handler.apiMusic(w, httptest.NewRequest("GET", "/api/music", nil))
+	assert.Equal(t, w.Code, 200)
+	var resp musicResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, resp.Path, "./test/tags")
+	assert.Equal(t, len(resp.Tracks), 6)
+	assert.Equal(t, resp.Tracks[3], libraryTrack{Path: "morning.ogg", Title: "Morning Has Broken", Artist: "Cat Stevens", Album: "Teaser and the Firecat", Seconds: 10})
+	assert.Assert(t, resp.Match == nil)
+
+	w = httptest.NewRecorder()
+	handler.apiMusic(w, httptest.NewRequest("GET", "/api/music?match=David+Bowie", nil))
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.DeepEqual(t, *resp.Match, musicMatch{Query: "David Bowie", Tracks: []string{"02 oddity.mp3", "starman.mp3"}, Reason: `artist "David Bowie"`})
+
+	rt, _, _ = testRuntimeWith(map[string]interface{}{sMusicPath: "./test/nope"})
+	handler = NewHandler(rt)
+	w = httptest.NewRecorder()
+	handler.apiMusic(w, httptest.NewRequest("GET", "/api/music", nil))
+	assert.Equal(t, w.Code, 500)
+}
+
+func TestAPISettings(t *testing.T) {
+	fName, cleanup := testConfigFile(t, map[string]interface{}{sBrightness: 5})
+	defer cleanup()
+	rt, _, _ := testRuntimeWith(nil)
+	rt.settings = initSettings(fName, []string{"volume=30"})
+	handler := NewHandler(rt)
+
+	w := httptest.NewRecorder()
+	handler.apiSettings(w, httptest.NewRequest("GET", "/api/settings", nil))
+	var infos []settingInfo
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &infos))
+	assert.Equal(t, len(infos), len(settingsSchema))
+	found := map[string]settingInfo{}
+	for _, info := range infos {
+		found[info.Key] = info
+	}
+	assert.DeepEqual(t, found[sBrightness], settingInfo{Key: sBrightness, Type: "int", Value: 5.0, Default: 3.0, Source: fName, Reload: "live", Allowed: "0 - 15", Description: "Display brightness"})
+	assert.Equal(t, found[sVolume].Value, "30")
+	assert.Equal(t, found[sVolume].Source, sourceCLI)
+	assert.Equal(t, found[sCountdown].Value, "120s")
+	assert.Equal(t, found[sAlmRefresh].Default, "1m0s")
+	assert.DeepEqual(t, found[sMainBtn].Value, map[string]interface{}{"pin": 25.0, "key": "a"})
+	assert.Equal(t, found[sI2CBus].Reload, "restart")
+	assert.Equal(t, found[sAudioCommand].FileOnly, true)
+}
+
+// testSettingsToken - a settingsToken file, the token PATCH needs
+func testSettingsToken(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "piclock")
+	assert.NilError(t, err)
+	fName := filepath.Join(dir, "settings.token")
+	assert.NilError(t, ioutil.WriteFile(fName, []byte("let me in\n"), 0600))
+	return fName, func() { os.RemoveAll(dir) }
+}
+
+func TestAPIPatchSettings(t *testing.T) {
+	sink, cleanup := testAudioSink(t)
+	defer cleanup()
+	audit := sink + ".log"
+	token, cleanup3 := testSettingsToken(t)
+	defer cleanup3()
+	fName, cleanup2 := testConfigFile(t, map[string]interface{}{sSettingsAudit: audit, sSettingsToken: token})
+	defer cleanup2()
+	rt, _, comms := testRuntimeWith(nil)
+	rt.settings = initSettings(fName, []string{"volume=30"})
+	handler := NewHandler(rt)
+	patchWith := func(token string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PATCH", "/api/settings", strings.NewReader(body))
+		r.RemoteAddr = "192.168.1.5:5123"
+		if token != "" {
+			r.Header.Set(settingsTokenHeader, token)
+		}
+		handler.TokenAuth(http.HandlerFunc(handler.apiPatchSettings)).ServeHTTP(w, r)
+		return w
+	}
+	patch := func(body string) *httptest.ResponseRecorder {
+		return patchWith("let me in", body)
+	}
+	original, err := ioutil.ReadFile(fName)
+	assert.NilError(t, err)
+
+	// only with the token, and never commands, paths or credentials
+	assert.Equal(t, patchWith("", `{"brightness": 9}`).Code, 403)
+	assert.Equal(t, patchWith("let me out", `{"brightness": 9}`).Code, 403)
+	w := patch(`{"audioCommand": "rm -rf ~", "settingsAudit": "/etc/passwd", "tokenKey": "/tmp/key"}`)
+	assert.Equal(t, w.Code, 400)
+	assert.Equal(t, w.Body.String(), "audioCommand can only be changed in the config file; settingsAudit can only be changed in the config file; tokenKey can only be changed in the config file\n")
+	w = patch(`{"profiles": {"evil": {"audioCommand": "rm -rf ~"}}}`)
+	assert.Equal(t, w.Code, 400)
+	assert.Assert(t, strings.Contains(w.Body.String(), "audioCommand is only read from the config file"), w.Body.String())
+
+	// nothing is written unless all of it is good
+	w = patch(`{"brightness": 16, "ledError": 5, "calendar": "kitchen", "blinkTime": null}`)
+	assert.Equal(t, w.Code, 400)
+	assert.Equal(t, w.Body.String(), "Unknown setting \"ledError\", did you mean \"ledErr\"?; blinkTime: no value; brightness must be 0 - 15: 16\n")
+	assert.Equal(t, patch(`{}`).Code, 400)
+	assert.Equal(t, patch(`[1]`).Code, 400)
+	data, _ := ioutil.ReadFile(fName)
+	assert.Equal(t, string(data), string(original))
+
+	w = patch(`{"brightness": 9, "countdownTime": "45s", "i2cBus": 2, "volume": 70}`)
+	assert.Equal(t, w.Code, 200)
+	var change settingsChange
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &change))
+	assert.DeepEqual(t, change, settingsChange{
+		Changed:    []string{sCountdown, sBrightness},
+		Restart:    []string{sI2CBus},
+		Overridden: []string{sVolume},
+	})
+	assert.Equal(t, rt.settings.GetInt(sBrightness), 9)
+	assert.Equal(t, rt.settings.GetDuration(sCountdown), 45*time.Second)
+	assert.Equal(t, rt.settings.GetInt(sVolume), 30)
+	es := effectReadAll(comms.effects)
+	assert.Equal(t, len(es), 1)
+	assert.Equal(t, es[0].id, eSettings)
+
+	// written in place, a new key at the end
+	s, err := loadSettings(fName, nil, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, s.GetInt(sBrightness), 9)
+	assert.Equal(t, s.GetByte(sI2CBus), byte(2))
+	assert.Equal(t, s.GetInt(sVolume), 70)
+	data, _ = ioutil.ReadFile(fName)
+	assert.Assert(t, strings.HasPrefix(string(data), "{\n  \"alarmPath\": \"./test/alarms\",\n"), string(data))
+	assert.Assert(t, strings.HasSuffix(string(data), "  \"volume\": 70\n}\n"), string(data))
+
+	audits, err := ioutil.ReadFile(audit)
+	assert.NilError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(audits)), "\n")
+	assert.DeepEqual(t, lines, []string{
+		"2020-01-26T00:00:00Z 192.168.1.5:5123 brightness 3 -> 9",
+		`2020-01-26T00:00:00Z 192.168.1.5:5123 countdownTime "120s" -> "45s"`,
+		"2020-01-26T00:00:00Z 192.168.1.5:5123 i2cBus 1 -> 2",
+		`2020-01-26T00:00:00Z 192.168.1.5:5123 volume "30" -> 70`,
+	})
+}
+
+func TestAPIPatchHostSettings(t *testing.T) {
+	token, cleanup2 := testSettingsToken(t)
+	defer cleanup2()
+	fName, cleanup := testConfigFile(t, map[string]interface{}{sSettingsToken: token})
+	defer cleanup()
+	defer func(host string) { configHost = host }(configHost)
+	configHost = "kitchen"
+	kitchen := testHostFile(t, fName, "kitchen.json", "{\n  \"calendar\": \"kitchen\"\n}\n")
+	rt, _, _ := testRuntimeWith(nil)
+	rt.settings = initSettings(fName, nil)
+	handler := NewHandler(rt)
+	original, err := ioutil.ReadFile(fName)
+	assert.NilError(t, err)
+
+	// the shared file is left alone
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PATCH", "/api/settings", strings.NewReader(`{"brightness": 9}`))
+	r.Header.Set(settingsTokenHeader, "let me in")
+	handler.apiPatchSettings(w, r)
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, rt.settings.GetInt(sBrightness), 9)
+	assert.Equal(t, rt.settings.source(sBrightness), kitchen)
+	data, _ := ioutil.ReadFile(fName)
+	assert.Equal(t, string(data), string(original))
+	data, _ = ioutil.ReadFile(kitchen)
+	assert.Equal(t, string(data), "{\n  \"calendar\": \"kitchen\",\n  \"brightness\": 9\n}\n")
+}
+
+func TestAPIPatchProfileSettings(t *testing.T) {
+	token, cleanup2 := testSettingsToken(t)
+	defer cleanup2()
+	fName, cleanup := testConfigFile(t, map[string]interface{}{
+		sSettingsToken: token,
+		sProfiles:      map[string]interface{}{"night": map[string]interface{}{sBrightness: 1}},
+	})
+	defer cleanup()
+	rt, _, _ := testRuntimeWith(nil)
+	rt.settings = initSettings(fName, nil)
+	rt.status.setProfile(profileStatus{Active: "night"})
+	handler := NewHandler(rt)
+
+	// written, but the profile still wins
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PATCH", "/api/settings", strings.NewReader(`{"brightness": 9, "countdownTime": "45s"}`))
+	r.Header.Set(settingsTokenHeader, "let me in")
+	handler.apiPatchSettings(w, r)
+	assert.Equal(t, w.Code, 200)
+	var change settingsChange
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &change))
+	assert.DeepEqual(t, change.Overridden, []string{sBrightness})
+	assert.Equal(t, rt.settings.source(sBrightness), profileSource("night"))
+	assert.Equal(t, rt.settings.GetInt(sBrightness), 1)
+}
+
+func TestAPITokenAuth(t *testing.T) {
+	token, cleanup2 := testSettingsToken(t)
+	defer cleanup2()
+	fName, cleanup := testConfigFile(t, map[string]interface{}{sSettingsToken: token})
+	defer cleanup()
+	rt, _, comms := testRuntimeWith(nil)
+	rt.settings = initSettings(fName, nil)
+	handler := NewHandler(rt)
+	router := newRouter(&handler)
+	send := func(method string, path string, body string, token string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.SetBasicAuth(handler.getUser(), handler.getSecret())
+		if token != "" {
+			r.Header.Set(settingsTokenHeader, token)
+		}
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// everything that changes something needs the token
+	for _, call := range [][]string{
+		{"PUT", "/api/volume", `{"level": 35}`},
+		{"POST", "/api/audio/check", ``},
+		{"POST", "/api/audio/test", ``},
+		{"PUT", "/api/sleep", `{"minutes": 45}`},
+		{"POST", "/api/reload", ``},
+		{"PATCH", "/api/settings", `{"brightness": 9}`},
+		{"PUT", "/api/profile", `{"profile": "night"}`},
+		{"POST", "/api/secret", ``},
+	} {
+		assert.Equal(t, send(call[0], call[1], call[2], ""), 403, call[1])
+		assert.Equal(t, send(call[0], call[1], call[2], "let me out"), 403, call[1])
+	}
+	assert.Equal(t, len(effectReadAll(comms.effects)), 0)
+	assert.Equal(t, rt.settings.GetInt(sBrightness), 3)
+
+	// reading does not, changing does with it
+	assert.Equal(t, send("GET", "/api/volume", "", ""), 200)
+	assert.Equal(t, send("PUT", "/api/volume", `{"level": 35}`, "let me in"), 200)
+	e, _ := effectRead(t, comms.effects)
+	assert.Equal(t, e, volumeEffect(35))
+}
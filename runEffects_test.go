@@ -1,12 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"testing"
 	"time"
 
 	"dscheirer.com/piclock/sevenseg_backpack"
 
+	"github.com/jonboulle/clockwork"
 	"gotest.tools/assert"
 )
 
@@ -110,7 +112,7 @@ func TestClockModeCountdown(t *testing.T) {
 
 	// make sure the alarm effect did not fire
 	s := rt.sounds.(*noSounds)
-	assert.Equal(t, s.playMP3Cnt, 0)
+	assert.Equal(t, s.playTracksCnt, 0)
 	assert.Equal(t, s.playItCnt, 0)
 	assert.Equal(t, len(ld.auditErrors), 0)
 
@@ -188,14 +190,14 @@ func TestClockModeAlarmOn(t *testing.T) {
 
 	// now wait
 	testBlockDuration(clock, dEffectSleep, dEffectSleep)
-	assert.Equal(t, ld.curDisplay, almDisplay1)
+	assert.Equal(t, ld.curDisplay, "_-_-")
 	// wait for the other one
 	testBlockDuration(clock, dEffectSleep, 3*time.Second)
-	assert.Equal(t, ld.curDisplay, almDisplay2)
+	assert.Equal(t, ld.curDisplay, "-_-_")
 
 	// make sure the alarm effect did fire
 	s := rt.sounds.(*noSounds)
-	assert.Equal(t, s.playMP3Cnt, 1)
+	assert.Equal(t, s.playTracksCnt, 1)
 	assert.Equal(t, s.playItCnt, 0)
 
 	// cancel alarm
@@ -239,7 +241,7 @@ func TestClockModeAlarmOver(t *testing.T) {
 	assert.Equal(t, ld.curDisplay, "_-_-")
 	// make sure the alarm effect did fire
 	s := rt.sounds.(*noSounds)
-	assert.Equal(t, s.playMP3Cnt, 1)
+	assert.Equal(t, s.playTracksCnt, 1)
 	assert.Equal(t, s.playItCnt, 0)
 
 	// signal the play completed
@@ -260,8 +262,9 @@ func TestClockModeAlarmOver(t *testing.T) {
 	assert.Equal(t, ld.curDisplay, "_-_-")
 	// make sure the alarm effect did fire
 	s = rt.sounds.(*noSounds)
-	assert.Equal(t, s.playMP3Cnt, 2)
-	assert.Equal(t, s.playItCnt, 0)
+	assert.Equal(t, s.playTracksCnt, 1)
+	assert.Equal(t, s.playItCnt, 1)
+	assert.Equal(t, s.tones.name, rt.settings.GetString(sTonePattern))
 
 	// signal the play completed
 	ns = rt.sounds.(*noSounds)
@@ -326,7 +329,7 @@ func TestPrintDoesNotOverrideAlarm(t *testing.T) {
 
 	// make sure the alarm effect did fire
 	s := rt.sounds.(*noSounds)
-	assert.Equal(t, s.playMP3Cnt, 1)
+	assert.Equal(t, s.playTracksCnt, 1)
 	assert.Equal(t, s.playItCnt, 0)
 
 	// now tell it to print stuff (this is what checkAlarms will do)
@@ -386,13 +389,17 @@ func TestBadPrint(t *testing.T) {
 	ld := rt.display.(*logDisplay)
 
 	// print something with a character that is impossible
-	comms.effects <- printEffect("pizz", 0)
+	comms.effects <- printEffect("piz~", time.Second)
 
 	go runEffects(rt)
 
 	testBlockDuration(clock, dEffectSleep, dEffectSleep)
 
-	assert.Equal(t, len(ld.auditErrors), 1)
+	// the unknown character gets the fallback glyph, the rest still prints
+	assert.Equal(t, len(ld.auditErrors), 0)
+	snap := ld.Snapshot()
+	assert.Equal(t, snap.Digits[2], byte(0x5B))
+	assert.Equal(t, snap.Digits[3], byte(sevenseg_backpack.DefaultFallback))
 }
 
 func TestPrintRolling(t *testing.T) {
@@ -561,3 +568,705 @@ func TestPrintMultipleCancel(t *testing.T) {
 
 	assert.Equal(t, len(ld.auditErrors), 0)
 }
+
+func TestCarousel(t *testing.T) {
+	pages, _ := toCarouselPages([]interface{}{
+		map[string]interface{}{"page": "date", "duration": "2s", "interval": "10s"},
+		map[string]interface{}{"page": "seconds", "duration": "1s", "interval": "10s"},
+		map[string]interface{}{"page": "temp", "interval": "10s"},
+	})
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{
+		sCarousel:   pages,
+		sTempSensor: "./test/w1/w1_*",
+	})
+	ld := rt.display.(*logDisplay)
+
+	clock.Advance(9*time.Hour + 15*time.Minute)
+	go runEffects(rt)
+
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, ld.curDisplay, " 9:15")
+
+	// first page after an interval, the rest follow in order
+	testBlockDuration(clock, dEffectSleep, 10*time.Second)
+	assert.Equal(t, ld.curDisplay, "01.26")
+	testBlockDuration(clock, dEffectSleep, 2*time.Second)
+	assert.Equal(t, ld.curDisplay, ":12")
+	testBlockDuration(clock, dEffectSleep, time.Second)
+	assert.Equal(t, ld.curDisplay, "23.1C")
+	testBlockDuration(clock, dEffectSleep, dCarouselDuration)
+	assert.Equal(t, ld.curDisplay, " 9:15")
+	assert.Equal(t, len(ld.auditErrors), 0)
+
+	testQuit(rt)
+}
+
+func TestCarouselWindow(t *testing.T) {
+	pages, _ := toCarouselPages([]interface{}{
+		map[string]interface{}{"page": "day", "interval": "1m", "from": "06:00", "until": "09:00"},
+		map[string]interface{}{"page": "next", "interval": "1m", "from": "22:00", "until": "10:00"},
+	})
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sCarousel: pages})
+	ld := rt.display.(*logDisplay)
+
+	clock.Advance(9*time.Hour + 15*time.Minute)
+	rt.status.setNextAlarm(&alarm{When: clock.Now().Add(2*time.Hour + 5*time.Minute)})
+	go runEffects(rt)
+	clock.BlockUntil(1)
+
+	// the day is out of its window, the next alarm is not
+	testBlockDuration(clock, dEffectSleep, time.Minute)
+	assert.Equal(t, ld.curDisplay, "A2:04")
+	testBlockDuration(clock, dEffectSleep, dCarouselDuration)
+	assert.Equal(t, ld.curDisplay, " 9:16")
+
+	// no next alarm, no page
+	rt.status.setNextAlarm(nil)
+	testBlockDuration(clock, dEffectSleep, time.Minute)
+	assert.Equal(t, ld.curDisplay, " 9:17")
+	assert.Equal(t, len(ld.auditErrors), 0)
+
+	testQuit(rt)
+}
+
+func TestCarouselBadPage(t *testing.T) {
+	_, err := toCarouselPages([]interface{}{map[string]interface{}{"page": "weather"}})
+	assert.Error(t, err, "Unknown carousel page: weather")
+	_, err = toCarouselPages([]interface{}{map[string]interface{}{"page": "date", "interval": "0s"}})
+	assert.Error(t, err, "Carousel interval must be longer than the duration: 0s <= 3s")
+	_, err = toCarouselPages([]interface{}{map[string]interface{}{"page": "date", "duration": "0s"}})
+	assert.Error(t, err, "Carousel duration must be positive: 0s")
+	_, err = toCarouselPages([]interface{}{map[string]interface{}{"page": "date", "duration": "-1s"}})
+	assert.Error(t, err, "Carousel duration must be positive: -1s")
+	_, err = toCarouselPages([]interface{}{map[string]interface{}{"page": "date", "duration": "10s", "interval": "10s"}})
+	assert.Error(t, err, "Carousel interval must be longer than the duration: 10s <= 10s")
+	_, err = toCarouselPages([]interface{}{map[string]interface{}{"page": "date", "duration": "2m"}})
+	assert.Error(t, err, "Carousel interval must be longer than the duration: 1m0s <= 2m0s")
+}
+
+func TestCarouselStarvation(t *testing.T) {
+	pages, err := toCarouselPages([]interface{}{
+		map[string]interface{}{"page": "date", "duration": "2s", "interval": "3s"},
+	})
+	assert.NilError(t, err)
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sCarousel: pages})
+	ld := rt.display.(*logDisplay)
+
+	clock.Advance(9*time.Hour + 15*time.Minute)
+	go runEffects(rt)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, ld.curDisplay, " 9:15")
+
+	// the shortest interval still leaves the clock a turn every time
+	shown := []string{ld.curDisplay}
+	for i := 0; i < int(30*time.Second/dEffectSleep); i++ {
+		testBlockDuration(clock, dEffectSleep, dEffectSleep)
+		if ld.curDisplay != shown[len(shown)-1] {
+			shown = append(shown, ld.curDisplay)
+		}
+	}
+	assert.Assert(t, len(shown) > 10, shown)
+	for i := range shown {
+		if i%2 == 0 {
+			assert.Equal(t, shown[i], " 9:15", shown)
+		} else {
+			assert.Equal(t, shown[i], "01.26", shown)
+		}
+	}
+	assert.Equal(t, len(ld.auditErrors), 0)
+
+	testQuit(rt)
+}
+
+func TestPrintPriority(t *testing.T) {
+	rt, clock, comms := testRuntime()
+	ld := rt.display.(*logDisplay)
+
+	comms.effects <- prioritized(printEffect("1111", time.Second), prioLow)
+	comms.effects <- printEffect("2222", time.Second)
+	comms.effects <- prioritized(printEffect("3333", time.Second), prioHigh)
+
+	go runEffects(rt)
+
+	testBlockDuration(clock, dEffectSleep, 3*time.Second+dEffectSleep)
+	assert.DeepEqual(t, ld.audit, []string{"3333", "2222", "1111", " 0:00"})
+	assert.Equal(t, len(ld.auditErrors), 0)
+}
+
+func TestPrintPreempt(t *testing.T) {
+	rt, clock, comms := testRuntime()
+	ld := rt.display.(*logDisplay)
+
+	comms.effects <- printEffect("1111", 5*time.Second)
+
+	go runEffects(rt)
+
+	testBlockDuration(clock, dEffectSleep, time.Second)
+	assert.Equal(t, ld.curDisplay, "1111")
+
+	// a higher priority print goes up right away, the lower one waits
+	// behind it and is shown again
+	comms.effects <- prioritized(printEffect("2222", time.Second), prioHigh)
+	comms.effects <- printEffect("5555", time.Second)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, ld.curDisplay, "2222")
+	testBlockDuration(clock, dEffectSleep, time.Second)
+	assert.Equal(t, ld.curDisplay, "1111")
+	testBlockDuration(clock, dEffectSleep, 5*time.Second)
+	assert.Equal(t, ld.curDisplay, "5555")
+	testBlockDuration(clock, dEffectSleep, time.Second)
+	assert.Equal(t, ld.curDisplay, " 0:00")
+
+	// same priority waits its turn
+	comms.effects <- printEffect("3333", time.Second)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	comms.effects <- printEffect("4444", time.Second)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, ld.curDisplay, "3333")
+	testBlockDuration(clock, dEffectSleep, time.Second)
+	assert.Equal(t, ld.curDisplay, "4444")
+	assert.Equal(t, len(ld.auditErrors), 0)
+}
+
+func TestPrintPreemptExpires(t *testing.T) {
+	rt, clock, comms := testRuntime()
+	ld := rt.display.(*logDisplay)
+
+	// preempted past its expiry, it is not shown again
+	comms.effects <- expiring(printEffect("1111", 5*time.Second), clock.Now().Add(2*time.Second))
+
+	go runEffects(rt)
+
+	testBlockDuration(clock, dEffectSleep, time.Second)
+	assert.Equal(t, ld.curDisplay, "1111")
+	comms.effects <- prioritized(printEffect("2222", 2*time.Second), prioHigh)
+	testBlockDuration(clock, dEffectSleep, 2*time.Second+dEffectSleep)
+	assert.DeepEqual(t, ld.audit, []string{"1111", "2222", " 0:00"})
+	assert.Equal(t, len(ld.auditErrors), 0)
+}
+
+func TestPrintDedupeAndExpire(t *testing.T) {
+	rt, clock, comms := testRuntime()
+	ld := rt.display.(*logDisplay)
+
+	// the second report replaces the first, both parts of it survive
+	batch := newPrintBatch()
+	comms.effects <- deduped(printEffect("1111", time.Second), "report", batch)
+	comms.effects <- deduped(printEffect("2222", time.Second), "report", batch)
+	batch = newPrintBatch()
+	comms.effects <- deduped(printEffect("3333", time.Second), "report", batch)
+	comms.effects <- deduped(printEffect("4444", time.Second), "report", batch)
+	// already expired
+	comms.effects <- expiring(printEffect("5555", time.Second), clock.Now().Add(-time.Second))
+
+	go runEffects(rt)
+
+	testBlockDuration(clock, dEffectSleep, 2*time.Second+dEffectSleep)
+	assert.DeepEqual(t, ld.audit, []string{"3333", "4444", " 0:00"})
+	assert.Equal(t, len(ld.auditErrors), 0)
+}
+
+func TestCountdownPreemptsPrint(t *testing.T) {
+	rt, clock, comms := testRuntime()
+	ld := rt.display.(*logDisplay)
+
+	clock.Advance(9*time.Hour + 15*time.Minute)
+	comms.effects <- printRollingEffect("found 5", dRollingPrint)
+	comms.effects <- printEffect("9999", 5*time.Second)
+
+	go runEffects(rt)
+
+	testBlockDuration(clock, dEffectSleep, dRollingPrint+dEffectSleep)
+	assert.Equal(t, ld.curDisplay, "   f")
+
+	// the countdown does not wait for the prints to finish
+	alm := alarm{ID: "xoxoxo", Name: "test alarm", When: clock.Now().Add(time.Minute), Effect: almMusic, Extra: "pizza"}
+	comms.effects <- setCountdownMode(alm)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, ld.curDisplay, "59.9")
+
+	// the error no longer blocks, the alarm shows right away
+	comms.effects <- alarmError(5 * time.Second)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	comms.effects <- setAlarmMode(alm)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, ld.curDisplay, "_-_-")
+
+	s := rt.sounds.(*noSounds)
+	assert.Equal(t, s.playTracksCnt, 1)
+	assert.Equal(t, len(ld.auditErrors), 0)
+}
+
+func TestAlarmAnimationByName(t *testing.T) {
+	rt, clock, _ := testRuntime()
+	ld := rt.display.(*logDisplay)
+
+	clock.Advance(9*time.Hour + 15*time.Minute)
+	go runEffects(rt)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, ld.curDisplay, " 9:15")
+
+	alm := alarm{ID: "xoxoxo", Name: "test alarm", When: clock.Now(), Effect: almMusic, Options: "anim=fill"}
+	rt.comms.effects <- setAlarmMode(alm)
+
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, ld.curDisplay, "8   ")
+	testBlockDuration(clock, dEffectSleep, 250*time.Millisecond)
+	assert.Equal(t, ld.curDisplay, "88  ")
+	testBlockDuration(clock, dEffectSleep, 500*time.Millisecond)
+	assert.Equal(t, ld.curDisplay, "8888")
+	assert.Equal(t, ld.brightness, uint8(15))
+
+	// the next frame has no brightness, it is back to the usual one
+	testBlockDuration(clock, dEffectSleep, 500*time.Millisecond)
+	assert.Equal(t, ld.curDisplay, "    ")
+	assert.Equal(t, ld.brightness, uint8(rt.settings.GetInt(sBrightness)))
+	testBlockDuration(clock, dEffectSleep, 500*time.Millisecond)
+	assert.Equal(t, ld.curDisplay, "88  ")
+	assert.Equal(t, ld.brightness, uint8(rt.settings.GetInt(sBrightness)))
+
+	// cancelling puts the brightness back
+	rt.comms.effects <- cancelAlarmMode()
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, ld.curDisplay, " 9:15")
+	assert.Equal(t, ld.brightness, uint8(rt.settings.GetInt(sBrightness)))
+	assert.Equal(t, len(ld.auditErrors), 0)
+
+	testQuit(rt)
+}
+
+func TestAlarmAnimationStrobe(t *testing.T) {
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sStrobe: true})
+	ld := rt.display.(*logDisplay)
+
+	clock.Advance(9*time.Hour + 15*time.Minute)
+	go runEffects(rt)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+
+	rt.comms.effects <- setAlarmMode(alarm{ID: "xoxoxo", Name: "test alarm", When: clock.Now(), Effect: almMusic})
+
+	// one segment lit on every digit, moving each effects loop
+	for seg := 0; seg < 7; seg++ {
+		testBlockDuration(clock, dEffectSleep, dEffectSleep)
+		mask := byte(1 << uint(seg%6))
+		assert.Equal(t, ld.Snapshot().Digits, [4]byte{mask, mask, mask, mask})
+	}
+
+	rt.comms.effects <- cancelAlarmMode()
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, ld.curDisplay, " 9:15")
+	assert.Equal(t, len(ld.auditErrors), 0)
+
+	testQuit(rt)
+}
+
+func TestCountdownAnimation(t *testing.T) {
+	var data interface{}
+	json.Unmarshal([]byte(`[{"name": "hurry", "frames": [{"text": "Up", "blink": 1}]}]`), &data)
+	anims, err := toAnimations(data)
+	assert.NilError(t, err)
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sAnimations: anims, sCountdownAnimation: "hurry"})
+	ld := rt.display.(*logDisplay)
+
+	clock.Advance(9*time.Hour + 15*time.Minute)
+	go runEffects(rt)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+
+	rt.comms.effects <- setCountdownMode(alarm{ID: "xoxoxo", Name: "test alarm", When: clock.Now().Add(5 * time.Second), Effect: almMusic})
+
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, ld.curDisplay, "Up")
+	assert.Equal(t, ld.blinkRate, uint8(sevenseg_backpack.BLINK_2HZ))
+
+	// a one-shot animation stays on its last frame until the countdown is over
+	testBlockDuration(clock, dEffectSleep, 2*time.Second)
+	assert.Equal(t, ld.curDisplay, "Up")
+
+	testBlockDuration(clock, dEffectSleep, 3*time.Second)
+	assert.Equal(t, ld.curDisplay, " 9:15")
+	assert.Equal(t, ld.blinkRate, uint8(sevenseg_backpack.BLINK_OFF))
+	assert.Equal(t, len(ld.auditErrors), 0)
+
+	testQuit(rt)
+}
+
+func TestBadAnimation(t *testing.T) {
+	var data interface{}
+	json.Unmarshal([]byte(`[{"name": "empty", "frames": []}]`), &data)
+	_, err := toAnimations(data)
+	assert.ErrorContains(t, err, "no frames")
+
+	json.Unmarshal([]byte(`[{"name": "neg", "frames": [{"text": "8", "duration": "-1s"}]}]`), &data)
+	_, err = toAnimations(data)
+	assert.ErrorContains(t, err, "positive")
+}
+
+func TestAudioErrorDisplay(t *testing.T) {
+	rt, clock, _ := testRuntime()
+	ld := rt.display.(*logDisplay)
+
+	clock.Advance(9*time.Hour + 15*time.Minute)
+	go runEffects(rt)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+
+	rt.comms.effects <- audioError(fmt.Errorf("mpg123: exit status 1"))
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, ld.curDisplay, "SndE")
+
+	testBlockDuration(clock, dEffectSleep, dAudioError)
+	assert.Equal(t, ld.curDisplay, " 9:15")
+	assert.Equal(t, len(ld.auditErrors), 0)
+
+	testQuit(rt)
+}
+
+func TestAlarmVolumeRamp(t *testing.T) {
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sVolume: 80, sVolumeStart: 20, sVolumeRamp: 10 * time.Second, sVolumeControl: volumeAmixer})
+	lm := rt.mixer.(*logMixer)
+
+	clock.Advance(9*time.Hour + 15*time.Minute)
+	go runEffects(rt)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.DeepEqual(t, lm.getLevels(), []int{80})
+
+	rt.comms.effects <- setAlarmMode(alarm{ID: "xoxoxo", Name: "test alarm", When: clock.Now(), Effect: almMusic})
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, rt.status.getVolume(), 20)
+	assert.Equal(t, rt.status.getVolumeTarget(), 80)
+
+	testBlockDuration(clock, dEffectSleep, 5*time.Second)
+	assert.Equal(t, rt.status.getVolume(), 50)
+	testBlockDuration(clock, dEffectSleep, 5*time.Second)
+	assert.Equal(t, rt.status.getVolume(), 80)
+	// one mixer call per level, not per loop
+	assert.Equal(t, len(lm.getLevels()), 1+61)
+
+	// turned down while ringing
+	rt.comms.effects <- volumeEffect(30)
+	testBlockDuration(clock, dEffectSleep, time.Second)
+	assert.Equal(t, rt.status.getVolume(), 30)
+	assert.Equal(t, rt.status.getVolumeTarget(), 30)
+
+	// and back to the default when it is over
+	rt.comms.effects <- cancelAlarmMode()
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, rt.status.getVolume(), 80)
+
+	testQuit(rt)
+}
+
+func TestAlarmVolumeOption(t *testing.T) {
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sVolume: 80, sVolumeControl: volumeAmixer})
+	lm := rt.mixer.(*logMixer)
+
+	clock.Advance(9*time.Hour + 15*time.Minute)
+	go runEffects(rt)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+
+	rt.comms.effects <- setAlarmMode(alarm{ID: "xoxoxo", Name: "test alarm", When: clock.Now(), Effect: almMusic, Options: "volume=40 ramp=2s"})
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, rt.status.getVolume(), rt.settings.GetInt(sVolumeStart))
+	testBlockDuration(clock, dEffectSleep, 2*time.Second)
+	assert.Equal(t, rt.status.getVolume(), 40)
+
+	// a failing mixer is an audio error, and is not retried every loop
+	lm.setFail(fmt.Errorf("no mixer"))
+	rt.comms.effects <- volumeEffect(60)
+	testBlockDuration(clock, dEffectSleep, time.Second)
+	assert.Equal(t, rt.status.getAudioError(), "no mixer")
+	assert.Equal(t, lm.getLevels()[len(lm.getLevels())-1], 60)
+
+	testQuit(rt)
+}
+
+func TestPlaylistAlarm(t *testing.T) {
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sMusicPath: "./test/library"})
+	s := rt.sounds.(*noSounds)
+
+	clock.Advance(9*time.Hour + 15*time.Minute)
+	go runEffects(rt)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+
+	rt.comms.effects <- setAlarmMode(alarm{ID: "xoxoxo", Name: "playlist wake", When: clock.Now(), Effect: almPlaylist, Extra: "wake", Options: "repeat=2"})
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, s.playTracksCnt, 1)
+	assert.DeepEqual(t, s.tracks, []string{"test/library/b.wav", "test/library/morning/c.wav"})
+	assert.Equal(t, s.opts, playOptions{repeat: 2, tones: "beep-beep"})
+
+	// an empty playlist falls back to tones
+	rt.comms.effects <- setAlarmMode(alarm{ID: "xoxoxo", Name: "playlist nope", When: clock.Now(), Effect: almPlaylist, Extra: "nope"})
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, s.playTracksCnt, 1)
+	assert.Equal(t, s.playItCnt, 1)
+
+	testQuit(rt)
+}
+
+func TestMusicAlarm(t *testing.T) {
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{sMusicPath: "./test/tags"})
+	s := rt.sounds.(*noSounds)
+
+	clock.Advance(9*time.Hour + 15*time.Minute)
+	go runEffects(rt)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+
+	// matched on the tags, not the file name
+	rt.comms.effects <- setAlarmMode(alarm{ID: "xoxoxo", Name: "music starmen", When: clock.Now(), Effect: almMusic, Extra: "starmen"})
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, s.playTracksCnt, 1)
+	assert.DeepEqual(t, s.tracks, []string{"test/tags/starman.mp3"})
+
+	// nothing close falls back to tones
+	rt.comms.effects <- setAlarmMode(alarm{ID: "xoxoxo", Name: "music metallica", When: clock.Now(), Effect: almMusic, Extra: "metallica"})
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, s.playTracksCnt, 1)
+	assert.Equal(t, s.playItCnt, 1)
+
+	testQuit(rt)
+}
+
+func TestRadioAlarm(t *testing.T) {
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{
+		sMusicPath:     "./test/tags",
+		sStations:      []radioStation{{name: "jazz", url: "http://radio.example/jazz"}},
+		sRadioFallback: "starman",
+	})
+	s := rt.sounds.(*noSounds)
+
+	clock.Advance(9*time.Hour + 15*time.Minute)
+	go runEffects(rt)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+
+	rt.comms.effects <- setAlarmMode(alarm{ID: "xoxoxo", Name: "radio jazz", When: clock.Now(), Effect: almRadio, Extra: "jazz", Options: "duration=10m"})
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, s.playStreamCnt, 1)
+	assert.Equal(t, s.stream, "http://radio.example/jazz")
+	assert.Equal(t, s.opts.duration, 10*time.Minute)
+
+	// the stream failing plays the fallback track with the same channels
+	s.fallback(nil, s.done)
+	assert.Equal(t, s.playTracksCnt, 1)
+	assert.DeepEqual(t, s.tracks, []string{"test/tags/starman.mp3"})
+
+	// an unknown station goes straight to the fallback, no fallback track
+	// is tones
+	rt.comms.effects <- setAlarmMode(alarm{ID: "xoxoxo", Name: "radio polka", When: clock.Now(), Effect: almRadio, Extra: "polka", Options: "fallback=metallica"})
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, s.playStreamCnt, 1)
+	assert.Equal(t, s.playTracksCnt, 1)
+	assert.Equal(t, s.playItCnt, 1)
+
+	testQuit(rt)
+}
+
+// testSaid waits for the speech goroutine to have said n things, then lets
+// the effects loop see it is done
+func testSaid(t *testing.T, clock clockwork.FakeClock, ls *logSpeaker, n int) ([]string, []bool) {
+	for i := 0; i < 100; i++ {
+		if said, _ := ls.getSaid(); len(said) >= n {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	testBlockDuration(clock, dEffectSleep, 2*dEffectSleep)
+	return ls.getSaid()
+}
+
+func TestAnnounceHold(t *testing.T) {
+	rt, clock, comms := testRuntime()
+	ls := rt.speaker.(*logSpeaker)
+
+	clock.Advance(9*time.Hour + 15*time.Minute)
+	next := alarm{ID: "wake", Name: "Wake up", When: clock.Now().Add(22 * time.Hour)}
+	rt.status.setNextAlarm(&next)
+	go runEffects(rt)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+
+	// a one second hold says nothing, two or more speak when let go
+	comms.effects <- mainButtonEffect(true, 0)
+	comms.effects <- mainButtonEffect(true, time.Second)
+	comms.effects <- mainButtonEffect(false, 0)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	comms.effects <- mainButtonEffect(true, 0)
+	comms.effects <- mainButtonEffect(true, time.Second)
+	comms.effects <- mainButtonEffect(true, dAnnounceHold)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	said, _ := ls.getSaid()
+	assert.Equal(t, len(said), 0)
+	comms.effects <- mainButtonEffect(true, 3*time.Second)
+	comms.effects <- mainButtonEffect(false, 0)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	said, paused := testSaid(t, clock, ls, 1)
+	assert.DeepEqual(t, said, []string{"It's 9:15 AM. Next alarm, Wake up, at 7:15 AM tomorrow."})
+	assert.DeepEqual(t, paused, []bool{true})
+	assert.Assert(t, !rt.status.isPaused())
+
+	rt.status.setNextAlarm(nil)
+	comms.effects <- mainButtonEffect(true, dAnnounceHold)
+	comms.effects <- mainButtonEffect(false, 0)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	said, _ = testSaid(t, clock, ls, 2)
+	assert.Equal(t, said[1], "It's 9:15 AM. No alarms.")
+
+	testQuit(rt)
+}
+
+func TestAnnounceAlarm(t *testing.T) {
+	rt, clock, comms := testRuntimeWith(map[string]interface{}{sAnnounceAlarm: true})
+	ls := rt.speaker.(*logSpeaker)
+	ls.fail = fmt.Errorf("espeak-ng: exit status 1")
+
+	clock.Advance(9*time.Hour + 15*time.Minute)
+	go runEffects(rt)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+
+	comms.effects <- setAlarmMode(alarm{ID: "xoxoxo", Name: "Time to go!", When: clock.Now(), Effect: almTones})
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+
+	said, paused := testSaid(t, clock, ls, 1)
+	assert.DeepEqual(t, said, []string{"It's 9:15 AM. Time to go."})
+	assert.DeepEqual(t, paused, []bool{true})
+	assert.Equal(t, rt.sounds.(*noSounds).playItCnt, 1)
+	// the alarm carries on after a failure to speak
+	assert.Assert(t, !rt.status.isPaused())
+	assert.Equal(t, rt.status.getAudioError(), "espeak-ng: exit status 1")
+
+	testQuit(rt)
+}
+
+func TestTestSound(t *testing.T) {
+	rt, clock, comms := testRuntime()
+	s := rt.sounds.(*noSounds)
+
+	go runEffects(rt)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+
+	// a long button press reloads, a hold plays the test sound once
+	comms.effects <- longButtonEffect(true, 0)
+	comms.effects <- longButtonEffect(true, time.Second)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, s.playItCnt, 0)
+	comms.effects <- longButtonEffect(true, dTestSoundHold)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, s.playItCnt, 1)
+	assert.Equal(t, s.tones.name, "beep-beep")
+
+	// not again while it is playing
+	comms.effects <- testSoundEffect()
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, s.playItCnt, 1)
+
+	// the API can ask for it once it is over
+	testBlockDuration(clock, dEffectSleep, dTestSound+dEffectSleep)
+	comms.effects <- testSoundEffect()
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, s.playItCnt, 2)
+
+	// an alarm cuts it off, and there is none during the alarm
+	comms.effects <- setAlarmMode(alarm{ID: "xoxoxo", Name: "Wake up", When: clock.Now(), Effect: almTones})
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, s.playItCnt, 3)
+	comms.effects <- testSoundEffect()
+	testBlockDuration(clock, dEffectSleep, dTestSound)
+	assert.Equal(t, s.playItCnt, 3)
+
+	testQuit(rt)
+}
+
+func TestSleepTimer(t *testing.T) {
+	rt, clock, comms := testRuntimeWith(map[string]interface{}{sMusicPath: testLibrary, sSleepTrack: "wake", sVolume: 80, sSleepVolume: 40})
+	s := rt.sounds.(*noSounds)
+
+	go runEffects(rt)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+
+	// a double click is not a hold
+	comms.effects <- doubleButtonEffect(true, 0)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, s.playTracksCnt, 0)
+
+	// the first hold starts the music at the sleep volume
+	comms.effects <- doubleButtonEffect(true, dSleepHold)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, s.playTracksCnt, 1)
+	assert.DeepEqual(t, s.tracks, []string{"test/library/b.wav", "test/library/morning/c.wav"})
+	assert.Equal(t, rt.status.getVolume(), 40)
+	sleep := rt.status.getSleep()
+	assert.Equal(t, sleep.Active, true)
+	assert.Equal(t, sleep.Minutes, 15)
+	assert.Equal(t, sleep.Tracks, 2)
+	assert.Equal(t, sleep.Ends, clock.Now().Add(15*time.Minute))
+
+	// the next ones move it on without restarting the music, then off
+	for _, minutes := range []int{30, 60} {
+		comms.effects <- doubleButtonEffect(true, dSleepHold)
+		testBlockDuration(clock, dEffectSleep, dEffectSleep)
+		assert.Equal(t, rt.status.getSleep().Minutes, minutes)
+	}
+	assert.Equal(t, s.playTracksCnt, 1)
+	comms.effects <- doubleButtonEffect(true, dSleepHold)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, rt.status.getSleep().Active, false)
+	assert.Equal(t, rt.status.getVolume(), 80)
+	assert.Equal(t, len(comms.effects), 0)
+
+	testQuit(rt)
+}
+
+func TestSleepTimerFade(t *testing.T) {
+	rt, clock, comms := testRuntimeWith(map[string]interface{}{sMusicPath: testLibrary, sSleepFade: time.Minute, sVolume: 80, sSleepVolume: 40})
+	s := rt.sounds.(*noSounds)
+
+	go runEffects(rt)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+
+	// the whole library, shuffled
+	comms.effects <- sleepEffect(2 * time.Minute)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, len(s.tracks), 4)
+	assert.Equal(t, rt.status.getVolume(), 40)
+
+	// down over the last minute
+	testBlockDuration(clock, time.Second, time.Minute)
+	assert.Equal(t, rt.status.getVolume(), 40)
+	testBlockDuration(clock, time.Second, 30*time.Second)
+	assert.Assert(t, rt.status.getVolume() <= 21 && rt.status.getVolume() >= 19, rt.status.getVolume())
+	testBlockDuration(clock, time.Second, 30*time.Second)
+	assert.Equal(t, rt.status.getSleep().Active, false)
+	assert.Equal(t, rt.status.getVolume(), 80)
+
+	// music that runs out ends it too
+	comms.effects <- sleepEffect(time.Hour)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, s.playTracksCnt, 2)
+	s.done <- true
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, rt.status.getSleep().Active, false)
+
+	testQuit(rt)
+}
+
+func TestSleepTimerAlarm(t *testing.T) {
+	rt, clock, comms := testRuntimeWith(map[string]interface{}{sMusicPath: testLibrary, sVolume: 80, sSleepVolume: 40})
+	s := rt.sounds.(*noSounds)
+
+	go runEffects(rt)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+
+	comms.effects <- sleepEffect(time.Hour)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, rt.status.getSleep().Active, true)
+
+	// the countdown to an alarm stops it, and it will not start again
+	comms.effects <- setCountdownMode(alarm{ID: "xoxoxo", Name: "Wake up", When: clock.Now().Add(time.Minute), Effect: almTones})
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, rt.status.getSleep().Active, false)
+	assert.Equal(t, rt.status.getVolume(), 80)
+	comms.effects <- sleepEffect(time.Hour)
+	comms.effects <- doubleButtonEffect(true, dSleepHold)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, rt.status.getSleep().Active, false)
+	assert.Equal(t, s.playTracksCnt, 1)
+
+	testQuit(rt)
+}
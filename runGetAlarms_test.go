@@ -1,9 +1,23 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/calendar/v3"
 	"gotest.tools/assert"
 )
 
@@ -178,3 +192,491 @@ func TestCalendarLoadOldEvents(t *testing.T) {
 	// done
 	testQuit(rt)
 }
+
+func TestAlarmOptions(t *testing.T) {
+	summary, options := parseAlarmOptions("music #anim=spinner bowie # #countdown=fill #loud")
+	assert.Equal(t, summary, "music bowie #")
+	assert.Equal(t, options, "anim=spinner countdown=fill loud")
+
+	alm := alarm{Options: options}
+	assert.Equal(t, alm.option(optAnimation), "spinner")
+	assert.Equal(t, alm.option(optCountdown), "fill")
+	assert.Equal(t, alm.option("loud"), "")
+	assert.Equal(t, alm.option("missing"), "")
+}
+
+func TestAlarmEffect(t *testing.T) {
+	for _, test := range []struct {
+		summary string
+		effect  int
+		extra   string
+	}{
+		{"music bowie", almMusic, "bowie"},
+		{"file  starman.mp3", almFile, "starman.mp3"},
+		{"Music Bowie", almMusic, "Bowie"},
+		{"Play music now", almRandom, ""},
+		{"musical chairs", almRandom, ""},
+		{"profile photo", almRandom, ""},
+		{"playlist morning", almPlaylist, "morning"},
+		{"Playlist morning", almPlaylist, "morning"},
+		{"Make a playlist for the party", almRandom, ""},
+		{"playlists are fun", almRandom, ""},
+		{"radio jazz", almRadio, "jazz"},
+		{"radio", almRadio, ""},
+		{"Radio jazz", almRadio, "jazz"},
+		{"Radiohead concert", almRandom, ""},
+		{"Call radio station", almRandom, ""},
+		{"tone siren", almTones, "siren"},
+		{"tones siren", almTones, "siren"},
+		{"tone", almTones, ""},
+		{"Tones rising", almTones, "rising"},
+		{"Stone Roses", almRandom, ""},
+		{"toner order", almRandom, ""},
+		{"wake up", almRandom, ""},
+	} {
+		effect, extra := parseAlarmEffect(test.summary)
+		assert.Equal(t, effect, test.effect, test.summary)
+		assert.Equal(t, extra, test.extra, test.summary)
+	}
+}
+
+// testMusicServer serves a manifest and files, failing each path the
+// given number of times first
+type testMusicServer struct {
+	mutex    sync.Mutex
+	files    map[string][]byte
+	manifest []musicFile
+	failures map[string]int
+	gets     map[string]int
+	inFlight int
+	maxSeen  int
+	delay    time.Duration
+}
+
+func newTestMusicServer() (*testMusicServer, *httptest.Server) {
+	ms := &testMusicServer{files: map[string][]byte{}, failures: map[string]int{}, gets: map[string]int{}}
+	return ms, httptest.NewServer(ms)
+}
+
+func (ms *testMusicServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ms.mutex.Lock()
+	ms.gets[r.URL.Path]++
+	ms.inFlight++
+	if ms.inFlight > ms.maxSeen {
+		ms.maxSeen = ms.inFlight
+	}
+	fail := ms.failures[r.URL.Path] > 0
+	if fail {
+		ms.failures[r.URL.Path]--
+	}
+	manifest, _ := json.Marshal(ms.manifest)
+	data, ok := ms.files[r.URL.Path]
+	delay := ms.delay
+	ms.mutex.Unlock()
+	defer func() {
+		ms.mutex.Lock()
+		ms.inFlight--
+		ms.mutex.Unlock()
+	}()
+
+	time.Sleep(delay)
+	switch {
+	case fail:
+		http.Error(w, "try again", http.StatusInternalServerError)
+	case r.URL.Path == "/music.json":
+		w.Write(manifest)
+	case ok:
+		w.Write(data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (ms *testMusicServer) add(srv *httptest.Server, name string, data string, version string) musicFile {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.files["/"+name] = []byte(data)
+	sum := sha256.Sum256([]byte(data))
+	return musicFile{Name: name, Path: srv.URL + "/" + name, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:]), Version: version}
+}
+
+func (ms *testMusicServer) setManifest(files ...musicFile) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.manifest = files
+}
+
+func (ms *testMusicServer) getCount(path string) int {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.gets[path]
+}
+
+func testMusicDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "piclock")
+	assert.NilError(t, err)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func testDirFiles(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	assert.NilError(t, err)
+	names := []string{}
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+func TestDownloadMusic(t *testing.T) {
+	ms, srv := newTestMusicServer()
+	defer srv.Close()
+	dir, cleanup := testMusicDir(t)
+	defer cleanup()
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "mine.mp3"), []byte("mine"), 0644))
+
+	rt, _, _ := testRuntimeWith(map[string]interface{}{
+		sMusicURL:     srv.URL + "/music.json",
+		sMusicPath:    dir,
+		sMusicRetries: 0,
+	})
+	a := ms.add(srv, "a.mp3", "aaaa", "")
+	b := ms.add(srv, "b.mp3", "bbbbbb", "1")
+	bad := ms.add(srv, "c.mp3", "cccc", "")
+	bad.SHA256 = strings.Repeat("0", 64)
+	ms.setManifest(a, b, bad)
+
+	assert.Equal(t, rt.status.getDownloads().State, downloadIdle)
+	downloadMusic(rt)
+
+	// the bad one is never put in place
+	assert.DeepEqual(t, testDirFiles(t, dir), []string{".manifest.json", "a.mp3", "b.mp3", "mine.mp3"})
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "b.mp3"))
+	assert.Equal(t, string(data), "bbbbbb")
+	ds := rt.status.getDownloads()
+	assert.Equal(t, ds.State, downloadFailed)
+	assert.Equal(t, ds.Total, 3)
+	assert.Equal(t, ds.Fetched, 2)
+	assert.Equal(t, ds.Current, 0)
+	assert.Equal(t, len(ds.Failed), 1)
+	assert.Assert(t, strings.HasPrefix(ds.Failed[0], "c.mp3: SHA256 is "), ds.Failed[0])
+
+	// the second time through only the bad one is fetched
+	ms.setManifest(a, b)
+	downloadMusic(rt)
+	ds = rt.status.getDownloads()
+	assert.Equal(t, ds.State, downloadDone)
+	assert.Equal(t, ds.Current, 2)
+	assert.Equal(t, ds.Fetched, 0)
+	assert.Equal(t, ms.getCount("/a.mp3"), 1)
+	assert.Equal(t, ms.getCount("/b.mp3"), 1)
+
+	// a new version replaces the file, a dropped one is pruned but a
+	// file we did not download is left alone
+	rt.settings.settings[sMusicPrune] = true
+	b = ms.add(srv, "b.mp3", "BBBB", "2")
+	ms.setManifest(b)
+	downloadMusic(rt)
+	ds = rt.status.getDownloads()
+	assert.Equal(t, ds.State, downloadDone)
+	assert.Equal(t, ds.Fetched, 1)
+	assert.DeepEqual(t, ds.Pruned, []string{"a.mp3"})
+	assert.DeepEqual(t, testDirFiles(t, dir), []string{".manifest.json", "b.mp3", "mine.mp3"})
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "b.mp3"))
+	assert.Equal(t, string(data), "BBBB")
+
+	// a file that was already there is kept when it checks out
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "d.mp3"), []byte("dd"), 0644))
+	d := ms.add(srv, "d.mp3", "dd", "")
+	ms.setManifest(b, d)
+	downloadMusic(rt)
+	assert.Equal(t, rt.status.getDownloads().Current, 2)
+	assert.Equal(t, ms.getCount("/d.mp3"), 0)
+}
+
+func TestDownloadPruneSaved(t *testing.T) {
+	ms, srv := newTestMusicServer()
+	defer srv.Close()
+	parent, cleanup := testMusicDir(t)
+	defer cleanup()
+	dir := filepath.Join(parent, "music")
+	assert.NilError(t, os.Mkdir(dir, 0755))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(parent, "victim.mp3"), []byte("mine"), 0644))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, ".hidden"), []byte("mine"), 0644))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, downloadManifest), []byte(`[
+  {"name": "../victim.mp3", "path": "x", "size": 4},
+  {"name": ".hidden", "path": "x", "size": 4},
+  {"name": "a.mp3", "path": "x", "size": 4}
+]`), 0644))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "a.mp3"), []byte("aaaa"), 0644))
+
+	rt, _, _ := testRuntimeWith(map[string]interface{}{
+		sMusicURL:     srv.URL + "/music.json",
+		sMusicPath:    dir,
+		sMusicRetries: 0,
+		sMusicPrune:   true,
+	})
+	ms.setManifest(ms.add(srv, "b.mp3", "bbbbbb", ""))
+	downloadMusic(rt)
+
+	// a saved manifest that was tampered with cannot prune outside musicPath
+	ds := rt.status.getDownloads()
+	assert.Equal(t, ds.State, downloadDone)
+	assert.DeepEqual(t, ds.Pruned, []string{"a.mp3"})
+	assert.DeepEqual(t, testDirFiles(t, parent), []string{"music", "victim.mp3"})
+	assert.DeepEqual(t, testDirFiles(t, dir), []string{".hidden", ".manifest.json", "b.mp3"})
+}
+
+func TestDownloadMusicRetry(t *testing.T) {
+	ms, srv := newTestMusicServer()
+	defer srv.Close()
+	dir, cleanup := testMusicDir(t)
+	defer cleanup()
+
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{
+		sMusicURL:        srv.URL + "/music.json",
+		sMusicPath:       dir,
+		sMusicRetries:    3,
+		sMusicRetryDelay: time.Second,
+	})
+	ms.setManifest(ms.add(srv, "a.mp3", "aaaa", ""))
+	ms.failures["/a.mp3"] = 2
+
+	done := make(chan bool)
+	go func() {
+		downloadMusic(rt)
+		done <- true
+	}()
+	// backing off
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	clock.BlockUntil(1)
+	clock.Advance(2 * time.Second)
+	<-done
+
+	ds := rt.status.getDownloads()
+	assert.Equal(t, ds.State, downloadDone)
+	assert.Equal(t, ds.Fetched, 1)
+	assert.Equal(t, ms.getCount("/a.mp3"), 3)
+	assert.DeepEqual(t, testDirFiles(t, dir), []string{".manifest.json", "a.mp3"})
+}
+
+func TestDownloadMusicFailures(t *testing.T) {
+	ms, srv := newTestMusicServer()
+	defer srv.Close()
+	dir, cleanup := testMusicDir(t)
+	defer cleanup()
+
+	rt, _, _ := testRuntimeWith(map[string]interface{}{
+		sMusicURL:     srv.URL + "/nope.json",
+		sMusicPath:    dir,
+		sMusicRetries: 0,
+	})
+	downloadMusic(rt)
+	ds := rt.status.getDownloads()
+	assert.Equal(t, ds.State, downloadFailed)
+	assert.Assert(t, strings.Contains(ds.Error, "404"), ds.Error)
+
+	// names can not escape musicPath
+	rt.settings.settings[sMusicURL] = srv.URL + "/music.json"
+	ms.setManifest(musicFile{Name: "../escape.mp3", Path: srv.URL + "/escape.mp3"})
+	downloadMusic(rt)
+	assert.Equal(t, rt.status.getDownloads().Error, "Bad file name in manifest: '../escape.mp3'")
+
+	// a short download
+	a := ms.add(srv, "a.mp3", "aaaa", "")
+	a.Size = 10
+	a.SHA256 = ""
+	ms.setManifest(a)
+	downloadMusic(rt)
+	assert.DeepEqual(t, rt.status.getDownloads().Failed, []string{"a.mp3: Size is 4, expected 10"})
+	assert.DeepEqual(t, testDirFiles(t, dir), []string{".manifest.json"})
+}
+
+func TestDownloadMusicParallel(t *testing.T) {
+	ms, srv := newTestMusicServer()
+	defer srv.Close()
+	dir, cleanup := testMusicDir(t)
+	defer cleanup()
+
+	rt, _, _ := testRuntimeWith(map[string]interface{}{
+		sMusicURL:      srv.URL + "/music.json",
+		sMusicPath:     dir,
+		sMusicParallel: 2,
+	})
+	files := []musicFile{}
+	for i := 0; i < 6; i++ {
+		files = append(files, ms.add(srv, fmt.Sprintf("%d.mp3", i), "data", ""))
+	}
+	ms.setManifest(files...)
+	ms.delay = 20 * time.Millisecond
+
+	downloadMusic(rt)
+	assert.Equal(t, rt.status.getDownloads().Fetched, 6)
+	assert.Equal(t, ms.maxSeen, 2)
+}
+
+func TestTokenCacheFile(t *testing.T) {
+	rt, _, _ := testRuntimeWith(map[string]interface{}{sSecrets: "/etc/piclock"})
+	assert.Equal(t, tokenCacheFile(rt.settings, calendarAccount{}), "/etc/piclock/token.json")
+	assert.Equal(t, tokenCacheFile(rt.settings, calendarAccount{name: "work"}), "/etc/piclock/token-work.json")
+	assert.Equal(t, tokenCacheFile(rt.settings, calendarAccount{name: "work", token: "/tmp/w.json"}), "/tmp/w.json")
+	assert.Equal(t, len(calendarAccounts(rt.settings)), 1)
+	assert.Equal(t, accountCalendar(rt.settings, calendarAccount{}), "piclock")
+
+	rt, _, _ = testRuntimeWith(map[string]interface{}{sTokenPath: "/var/lib/piclock/google.json"})
+	assert.Equal(t, tokenCacheFile(rt.settings, calendarAccount{}), "/var/lib/piclock/google.json")
+	assert.Equal(t, tokenCacheFile(rt.settings, calendarAccount{name: "home"}), "/var/lib/piclock/token-home.json")
+
+	s, err := loadSettings(cfgFile, nil, []string{`accounts=[{"name": "home"}, {"name": "work", "calendar": "shifts"}]`})
+	assert.NilError(t, err)
+	accounts := calendarAccounts(*s)
+	assert.Equal(t, len(accounts), 2)
+	assert.Equal(t, accountCalendar(*s, accounts[0]), "piclock")
+	assert.Equal(t, accountCalendar(*s, accounts[1]), "shifts")
+
+	for _, bad := range []string{`accounts=[{"calendar": "x"}]`, `accounts=[{"name": "a"}, {"name": "a"}]`, `accounts={"name": "a"}`} {
+		_, err = loadSettings(cfgFile, nil, []string{bad})
+		assert.Assert(t, err != nil, bad)
+	}
+}
+
+func TestTokenEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "piclock")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "token.key")
+	assert.NilError(t, ioutil.WriteFile(keyFile, []byte("correct horse battery staple\n"), 0600))
+	rt, _, _ := testRuntimeWith(map[string]interface{}{sTokenKey: keyFile})
+	key, err := tokenKey(rt.settings)
+	assert.NilError(t, err)
+
+	fName := filepath.Join(dir, "token.json")
+	tok := &oauth2.Token{AccessToken: "access-1", RefreshToken: "refresh-1", TokenType: "Bearer"}
+	assert.NilError(t, saveToken(fName, tok, key))
+	info, err := os.Stat(fName)
+	assert.NilError(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0600))
+	data, _ := ioutil.ReadFile(fName)
+	assert.Assert(t, !strings.Contains(string(data), "refresh-1"))
+
+	read, err := tokenFromFile(fName, key)
+	assert.NilError(t, err)
+	assert.Equal(t, read.RefreshToken, "refresh-1")
+
+	// no key, or the wrong one
+	_, err = tokenFromFile(fName, nil)
+	assert.ErrorContains(t, err, "is encrypted, set tokenKey")
+	wrong := sha256.Sum256([]byte("nope"))
+	_, err = tokenFromFile(fName, wrong[:])
+	assert.ErrorContains(t, err, "Could not decrypt")
+
+	// a plain token still reads with a key
+	assert.NilError(t, saveToken(fName, tok, nil))
+	read, err = tokenFromFile(fName, key)
+	assert.NilError(t, err)
+	assert.Equal(t, read.AccessToken, "access-1")
+
+	assert.NilError(t, ioutil.WriteFile(keyFile, []byte("\n"), 0600))
+	_, err = tokenKey(rt.settings)
+	assert.ErrorContains(t, err, "is empty")
+}
+
+func TestTokenRefreshSaved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "piclock")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	fName := filepath.Join(dir, "token.json")
+	rt, _, _ := testRuntimeWith(map[string]interface{}{sTokenPath: fName})
+
+	// a stand-in for google, the token endpoint and an API call
+	refreshes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			refreshes++
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token": "access-%d", "token_type": "Bearer", "expires_in": 3600}`, refreshes+1)
+			return
+		}
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+	config := &oauth2.Config{ClientID: "piclock", Endpoint: oauth2.Endpoint{TokenURL: server.URL + "/token"}}
+
+	expired := &oauth2.Token{AccessToken: "access-1", RefreshToken: "refresh-1", TokenType: "Bearer", Expiry: time.Now().Add(-time.Hour)}
+	assert.NilError(t, saveToken(fName, expired, nil))
+
+	client, err := getClient(context.Background(), config, rt.settings, calendarAccount{}, false)
+	assert.NilError(t, err)
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL + "/calendar")
+		assert.NilError(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, string(body), "Bearer access-2")
+	}
+	assert.Equal(t, refreshes, 1)
+
+	// the new token is in the file, with the refresh token kept
+	saved, err := tokenFromFile(fName, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, saved.AccessToken, "access-2")
+	assert.Equal(t, saved.RefreshToken, "refresh-1")
+
+	// no token and no prompt is an error, -oauth makes one
+	_, err = getClient(context.Background(), config, rt.settings, calendarAccount{name: "work"}, false)
+	assert.ErrorContains(t, err, "re-authenticate")
+
+	// and -oauth without a code is an error too, not a nil token
+	empty := filepath.Join(dir, "stdin")
+	assert.NilError(t, ioutil.WriteFile(empty, nil, 0600))
+	stdin, err := os.Open(empty)
+	assert.NilError(t, err)
+	defer stdin.Close()
+	defer func(saved *os.File) { os.Stdin = saved }(os.Stdin)
+	os.Stdin = stdin
+	_, err = getClient(context.Background(), config, rt.settings, calendarAccount{name: "work"}, true)
+	assert.ErrorContains(t, err, "Unable to read authorization code")
+}
+
+func TestEventStart(t *testing.T) {
+	events := []*calendar.Event{
+		{Id: "b", Start: &calendar.EventDateTime{DateTime: "2020-01-26T09:00:00-08:00"}},
+		{Id: "a", Start: &calendar.EventDateTime{DateTime: "2020-01-26T10:00:00Z"}},
+		{Id: "c", Start: &calendar.EventDateTime{Date: "2020-01-27"}},
+	}
+	assert.Assert(t, eventStart(events[1]).Before(eventStart(events[0])))
+	assert.Assert(t, eventStart(events[0]).Before(eventStart(events[2])))
+}
+
+func TestFetchAccountsSkipsFailed(t *testing.T) {
+	rt, _, _ := testRuntime()
+	accounts := []calendarAccount{{}, {name: "work"}, {name: "home"}}
+	fetchOne := func(rt runtimeConfig, account calendarAccount) (*calendar.Events, error) {
+		switch account.name {
+		case "work":
+			return nil, fmt.Errorf("token expired")
+		case "home":
+			return &calendar.Events{Items: []*calendar.Event{
+				{Id: "h", Start: &calendar.EventDateTime{DateTime: "2020-01-26T07:00:00Z"}}}}, nil
+		}
+		return &calendar.Events{Items: []*calendar.Event{
+			{Id: "d", Start: &calendar.EventDateTime{DateTime: "2020-01-26T09:00:00Z"}}}}, nil
+	}
+
+	events, err := fetchAccounts(rt, accounts, fetchOne)
+	assert.NilError(t, err)
+	assert.Equal(t, len(events.Items), 2)
+	assert.Equal(t, events.Items[0].Id, "h")
+	assert.Equal(t, events.Items[1].Id, "d")
+	assert.DeepEqual(t, rt.status.getAccountErrors(), map[string]string{"work": "token expired"})
+
+	// all of them failing is still an error
+	_, err = fetchAccounts(rt, accounts[1:2], fetchOne)
+	assert.ErrorContains(t, err, "token expired")
+
+	// and a good fetch clears the report
+	_, err = fetchAccounts(rt, accounts[:1], fetchOne)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, rt.status.getAccountErrors(), map[string]string{})
+}
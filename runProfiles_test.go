@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"gotest.tools/assert"
+)
+
+/* things that runProfiles does:
+
+follows the profileSchedule, the first rule that matches wins
+the main button held moves to the next profile, and shows it
+a profile picked by hand holds until the schedule is asked for
+keeps the profile across restarts
+
+*/
+
+// testProfileConfig - a weekend profile on the schedule and a vacation
+// one by hand, the state file is in its own directory
+func testProfileConfig(t *testing.T) (runtimeConfig, func()) {
+	dir, err := ioutil.TempDir("", "piclock")
+	assert.NilError(t, err)
+	fName, cleanup := testConfigFile(t, map[string]interface{}{
+		sProfiles: map[string]interface{}{
+			"weekend":  map[string]interface{}{sBrightness: 1, sCountdown: "2m"},
+			"vacation": map[string]interface{}{sCalendarAlarms: false, sDefaultEffect: effectTones},
+		},
+		sProfileSchedule: []interface{}{
+			map[string]interface{}{sProfile: "weekend", sDays: []interface{}{"Sat", "sunday"}},
+		},
+		sProfileState: filepath.Join(dir, "profile.json"),
+	})
+	rt, _, _ := testRuntimeWith(nil)
+	rt.settings = initSettings(fName, nil)
+	return rt, func() {
+		cleanup()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestProfileSettings(t *testing.T) {
+	rt, cleanup := testProfileConfig(t)
+	defer cleanup()
+
+	assert.DeepEqual(t, profileNames(rt), []string{"vacation", "weekend"})
+	rules := rt.settings.GetProfileSchedule(sProfileSchedule)
+	assert.Equal(t, len(rules), 1)
+	assert.DeepEqual(t, rules[0].days, []time.Weekday{time.Saturday, time.Sunday})
+
+	// the profile goes on top of the file, under the environment
+	s, err := loadProfile(rt.settings.file, "weekend", []string{"PICLOCK_COUNTDOWNTIME=3m"}, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, s.GetInt(sBrightness), 1)
+	assert.Equal(t, s.source(sBrightness), "profile weekend")
+	assert.Equal(t, s.GetDuration(sCountdown), 3*time.Minute)
+	assert.Equal(t, s.source(sCountdown), sourceEnv)
+
+	s, err = loadProfile(rt.settings.file, "gone", nil, nil)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, s.warnings, []string{`No profile "gone", using the base settings`})
+
+	bad := []struct {
+		set  string
+		want string
+	}{
+		{`profiles={"a": {"display": false}}`, "display needs a restart"},
+		{`profiles={"a": {"brightnes": 2}}`, `Unknown setting "brightnes", did you mean "brightness"?`},
+		{`profiles={"a": {"brightness": 16}}`, "brightness must be 0 - 15: 16"},
+		{`profiles={"a": {"profileState": ""}}`, "profileState cannot be in a profile"},
+		{`profiles={"a": 1}`, "Profile a: could not convert"},
+		{`profileSchedule=[{"profile": "weekend", "days": ["Someday"]}]`, "Unknown day: Someday"},
+		{`profileSchedule=[{"profile": "holiday"}]`, `-set: profileSchedule: no profile "holiday"`},
+	}
+	for _, b := range bad {
+		_, err = loadSettings(rt.settings.file, nil, []string{b.set})
+		assert.ErrorContains(t, err, b.want, b.set)
+	}
+}
+
+func TestScheduledProfile(t *testing.T) {
+	rt, clock, _ := testRuntimeWith(map[string]interface{}{
+		sProfileSchedule: []profileRule{
+			{profile: "night", from: 22 * time.Hour, until: 7 * time.Hour},
+			{profile: "weekend", days: []time.Weekday{time.Saturday, time.Sunday}},
+			{profile: "work", days: []time.Weekday{time.Monday}, from: 9 * time.Hour, until: 17 * time.Hour},
+		},
+	})
+
+	// Sunday midnight, night comes first
+	assert.Equal(t, scheduledProfile(rt), "night")
+	clock.Advance(12 * time.Hour)
+	assert.Equal(t, scheduledProfile(rt), "weekend")
+	// Monday
+	clock.Advance(12 * time.Hour)
+	assert.Equal(t, scheduledProfile(rt), "night")
+	clock.Advance(8 * time.Hour)
+	assert.Equal(t, scheduledProfile(rt), "")
+	clock.Advance(2 * time.Hour)
+	assert.Equal(t, scheduledProfile(rt), "work")
+}
+
+func TestRunProfiles(t *testing.T) {
+	rt, cleanup := testProfileConfig(t)
+	defer cleanup()
+	clock := rt.clock.(clockwork.FakeClock)
+	comms := rt.comms
+
+	// a Sunday, the weekend profile
+	go runProfiles(rt)
+	clock.BlockUntil(1)
+	status := rt.status.getProfile()
+	assert.Equal(t, status.Active, "weekend")
+	assert.Equal(t, status.Manual, false)
+	assert.Equal(t, rt.settings.GetInt(sBrightness), 1)
+	assert.Equal(t, rt.settings.GetDuration(sCountdown), 2*time.Minute)
+	es := effectReadAll(comms.effects)
+	assert.Equal(t, len(es), 1)
+	assert.Equal(t, es[0].id, eSettings)
+
+	// Monday, the base settings
+	clock.Advance(24 * time.Hour)
+	clock.BlockUntil(1)
+	assert.Equal(t, rt.status.getProfile().Active, "")
+	assert.Equal(t, rt.settings.GetInt(sBrightness), testSettings.GetInt(sBrightness))
+
+	// the button goes to the first profile, and shows it
+	effectReadAll(comms.effects)
+	comms.profiles <- nextProfileMessage()
+	clock.BlockUntil(2)
+	status = rt.status.getProfile()
+	assert.Equal(t, status.Active, "vacation")
+	assert.Equal(t, status.Manual, true)
+	assert.Equal(t, rt.settings.GetBool(sCalendarAlarms), false)
+	es = effectReadAll(comms.effects)
+	assert.Equal(t, len(es), 2)
+	v, _ := toPrint(es[1].val)
+	assert.Equal(t, v.s, "vacation")
+	assert.Equal(t, alarmEffect(rt, &alarm{Effect: almRandom}), almTones)
+
+	// it holds past the schedule, and is kept
+	clock.Advance(5 * 24 * time.Hour)
+	clock.BlockUntil(1)
+	assert.Equal(t, rt.status.getProfile().Active, "vacation")
+	assert.Equal(t, rt.status.getProfile().Scheduled, "weekend")
+	saved := readProfileState(rt)
+	assert.Equal(t, saved.Active, "vacation")
+	assert.Equal(t, saved.Manual, true)
+
+	comms.profiles <- autoProfileMessage()
+	clock.BlockUntil(2)
+	assert.Equal(t, rt.status.getProfile().Active, "weekend")
+	assert.Equal(t, readProfileState(rt).Manual, false)
+
+	comms.quit <- struct{}{}
+}
+
+func TestProfileRestart(t *testing.T) {
+	rt, cleanup := testProfileConfig(t)
+	defer cleanup()
+	writeProfileState(rt, profileStatus{Active: "vacation", Manual: true})
+
+	// picked by hand before the restart, the schedule waits
+	go runProfiles(rt)
+	rt.clock.(clockwork.FakeClock).BlockUntil(1)
+	assert.Equal(t, rt.status.getProfile().Active, "vacation")
+	assert.Equal(t, rt.settings.GetBool(sCalendarAlarms), false)
+	rt.comms.quit <- struct{}{}
+}
+
+func TestNextProfile(t *testing.T) {
+	rt, cleanup := testProfileConfig(t)
+	defer cleanup()
+
+	// base -> each profile -> base
+	for _, want := range []string{"vacation", "weekend", "", "vacation"} {
+		assert.Equal(t, profileRequest(rt, nextProfileMessage()).Active, want)
+		e, _ := effectRead(t, rt.comms.effects)
+		assert.Equal(t, e.id, eSettings)
+		e, _ = effectRead(t, rt.comms.effects)
+		v, _ := toPrint(e.val)
+		if want == "" {
+			want = baseProfile
+		}
+		assert.Equal(t, v.s, want)
+		// a long name rolls by at the usual pace
+		if len(want) > 4 {
+			assert.Equal(t, e.id, ePrintRolling)
+			assert.Equal(t, v.d, dRollingPrint)
+		}
+		effectReadAll(rt.comms.effects)
+	}
+}
+
+func TestAPIProfile(t *testing.T) {
+	rt, cleanup := testProfileConfig(t)
+	defer cleanup()
+	handler := NewHandler(rt)
+
+	w := httptest.NewRecorder()
+	handler.apiSetProfile(w, httptest.NewRequest("PUT", "/api/profile", strings.NewReader(`{"profile": "vacation"}`)))
+	assert.Equal(t, w.Code, 200)
+	var status profileStatus
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, status.Active, "vacation")
+	assert.Equal(t, status.Manual, true)
+	assert.Equal(t, status.Scheduled, "weekend")
+	assert.Equal(t, <-rt.comms.profiles, profileMessage("vacation"))
+
+	w = httptest.NewRecorder()
+	handler.apiSetProfile(w, httptest.NewRequest("PUT", "/api/profile", strings.NewReader(`{"auto": true}`)))
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, <-rt.comms.profiles, autoProfileMessage())
+
+	for _, bad := range []string{`{"profile": "holiday"}`, `{"profile": 5}`, `{}`, `nope`} {
+		w = httptest.NewRecorder()
+		handler.apiSetProfile(w, httptest.NewRequest("PUT", "/api/profile", strings.NewReader(bad)))
+		assert.Equal(t, w.Code, 400, bad)
+	}
+	assert.Equal(t, len(rt.comms.profiles), 0)
+
+	profileRequest(rt, profileMessage("weekend"))
+	w = httptest.NewRecorder()
+	handler.apiProfile(w, httptest.NewRequest("GET", "/api/profile", nil))
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, status.Active, "weekend")
+	assert.DeepEqual(t, status.Profiles, []string{"vacation", "weekend"})
+}
+
+func TestProfileHold(t *testing.T) {
+	rt, clock, comms := testRuntime()
+
+	go runEffects(rt)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+
+	// only the fifth second of a hold asks for the next profile
+	for d := time.Duration(0); d <= dProfileHold+time.Second; d += time.Second {
+		comms.effects <- mainButtonEffect(true, d)
+	}
+	comms.effects <- mainButtonEffect(false, 0)
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	assert.Equal(t, len(comms.profiles), 1)
+	assert.Equal(t, <-comms.profiles, nextProfileMessage())
+	// and it does not say the time on the way
+	testBlockDuration(clock, dEffectSleep, dEffectSleep)
+	said, _ := rt.speaker.(*logSpeaker).getSaid()
+	assert.Equal(t, len(said), 0)
+
+	testQuit(rt)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+/* things that runReloadSettings does:
+
+reloads the config file on SIGHUP, or when it changes
+applies what changed to every thread's settings
+leaves settings read at startup alone, "restart required"
+keeps the settings when the file is bad
+
+*/
+
+// testConfigFile writes test/config.conf with changes, the reloads read it
+func testConfigFile(t *testing.T, changes map[string]interface{}) (string, func()) {
+	data, err := ioutil.ReadFile(cfgFile)
+	assert.NilError(t, err)
+	var conf map[string]interface{}
+	assert.NilError(t, json.Unmarshal(data, &conf))
+	for k, v := range changes {
+		conf[k] = v
+	}
+	data, err = json.MarshalIndent(conf, "", "  ")
+	assert.NilError(t, err)
+	data = append(data, '\n')
+
+	dir, err := ioutil.TempDir("", "piclock")
+	assert.NilError(t, err)
+	fName := filepath.Join(dir, "piclock.conf")
+	assert.NilError(t, ioutil.WriteFile(fName, data, 0644))
+	return fName, func() { os.RemoveAll(dir) }
+}
+
+func TestReloadSettings(t *testing.T) {
+	fName, cleanup := testConfigFile(t, nil)
+	defer cleanup()
+	rt, _, comms := testRuntimeWith(nil)
+	rt.settings = initSettings(fName, nil)
+	// another thread's copy
+	other := rt.settings
+
+	// nothing changed
+	status := reloadSettings(rt)
+	assert.Equal(t, status.Error, "")
+	assert.DeepEqual(t, status.Changed, []string{})
+	assert.Equal(t, len(effectReadAll(comms.effects)), 0)
+
+	changed, cleanup2 := testConfigFile(t, map[string]interface{}{sBrightness: 9, sCalName: "bedroom", sI2CBus: 2, "ledError": 5})
+	defer cleanup2()
+	rt.settings.file = changed
+	status = reloadSettings(rt)
+	assert.Equal(t, status.Error, "")
+	assert.DeepEqual(t, status.Changed, []string{sCalName, sBrightness})
+	assert.DeepEqual(t, status.Restart, []string{sI2CBus})
+	assert.DeepEqual(t, status.Warnings, []string{changed + `: Unknown setting "ledError", did you mean "ledErr"?`})
+	assert.DeepEqual(t, rt.status.getReload(), status)
+
+	assert.Equal(t, other.GetInt(sBrightness), 9)
+	assert.Equal(t, other.GetString(sCalName), "bedroom")
+	assert.Equal(t, other.GetByte(sI2CBus), byte(1))
+
+	// the effects thread re-reads, and the calendar changed
+	es := effectReadAll(comms.effects)
+	assert.Equal(t, len(es), 1)
+	assert.Equal(t, es[0].id, eSettings)
+	msg, _ := almStateRead(t, comms.getAlarms)
+	assert.Equal(t, msg.ID, msgReload)
+
+	// a bad file changes nothing
+	bad, cleanup3 := testConfigFile(t, map[string]interface{}{sBrightness: 99})
+	defer cleanup3()
+	rt.settings.file = bad
+	status = reloadSettings(rt)
+	assert.Equal(t, status.Error, bad+": brightness must be 0 - 15: 99")
+	assert.Equal(t, other.GetInt(sBrightness), 9)
+	assert.Equal(t, len(effectReadAll(comms.effects)), 0)
+
+	rt.settings.file = "./test/nope.conf"
+	status = reloadSettings(rt)
+	assert.Equal(t, status.Error, "Could not load conf file './test/nope.conf': open ./test/nope.conf: no such file or directory")
+}
+
+func TestReloadOnChange(t *testing.T) {
+	fName, cleanup := testConfigFile(t, nil)
+	defer cleanup()
+	rt, clock, comms := testRuntimeWith(nil)
+	rt.settings = initSettings(fName, nil)
+
+	go runReloadSettings(rt)
+	clock.BlockUntil(1)
+
+	// the same file, nothing to do
+	clock.Advance(dReloadPoll)
+	clock.BlockUntil(1)
+	assert.Assert(t, rt.status.getReload().Time.IsZero())
+
+	data, err := ioutil.ReadFile(fName)
+	assert.NilError(t, err)
+	var conf map[string]interface{}
+	assert.NilError(t, json.Unmarshal(data, &conf))
+	conf[sCountdown] = "30s"
+	data, _ = json.Marshal(conf)
+	assert.NilError(t, ioutil.WriteFile(fName, data, 0644))
+	later := time.Now().Add(time.Minute)
+	assert.NilError(t, os.Chtimes(fName, later, later))
+
+	clock.Advance(dReloadPoll)
+	clock.BlockUntil(1)
+	assert.DeepEqual(t, rt.status.getReload().Changed, []string{sCountdown})
+	assert.Equal(t, rt.settings.GetDuration(sCountdown), 30*time.Second)
+	es := effectReadAll(comms.effects)
+	assert.Equal(t, len(es), 1)
+	assert.Equal(t, es[0].id, eSettings)
+
+	comms.quit <- struct{}{}
+}
+
+func TestAPIReload(t *testing.T) {
+	fName, cleanup := testConfigFile(t, nil)
+	defer cleanup()
+	changed, cleanup2 := testConfigFile(t, map[string]interface{}{sConfigSvc: 8181})
+	defer cleanup2()
+	rt, _, _ := testRuntimeWith(nil)
+	rt.settings = initSettings(fName, nil)
+	rt.settings.file = changed
+	handler := NewHandler(rt)
+
+	w := httptest.NewRecorder()
+	handler.apiReload(w, httptest.NewRequest("POST", "/api/reload", nil))
+	assert.Equal(t, w.Code, 200)
+	var status reloadStatus
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.DeepEqual(t, status.Restart, []string{sConfigSvc})
+
+	handler.rt.settings.file = "./test/nope.conf"
+	w = httptest.NewRecorder()
+	handler.apiReload(w, httptest.NewRequest("POST", "/api/reload", nil))
+	assert.Equal(t, w.Code, 400)
+}
+
+func TestReloadOnHostChange(t *testing.T) {
+	fName, cleanup := testConfigFile(t, nil)
+	defer cleanup()
+	defer func(host string) { configHost = host }(configHost)
+	configHost = "kitchen"
+	rt, clock, comms := testRuntimeWith(nil)
+	rt.settings = initSettings(fName, nil)
+
+	go runReloadSettings(rt)
+	clock.BlockUntil(1)
+
+	// a new override file is a change too
+	kitchen := testHostFile(t, fName, "kitchen.json", `{"countdownTime": "30s"}`)
+	later := time.Now().Add(time.Minute)
+	assert.NilError(t, os.Chtimes(kitchen, later, later))
+
+	clock.Advance(dReloadPoll)
+	clock.BlockUntil(1)
+	assert.DeepEqual(t, rt.status.getReload().Changed, []string{sCountdown})
+	assert.Equal(t, rt.settings.GetDuration(sCountdown), 30*time.Second)
+	assert.Equal(t, rt.settings.source(sCountdown), kitchen)
+	effectReadAll(comms.effects)
+
+	comms.quit <- struct{}{}
+}
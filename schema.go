@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"dscheirer.com/piclock/sevenseg_backpack"
+)
+
+// settingSpec - one key in the config file.  the type of def is the type
+// of the setting, min and max (of the same type) limit numbers and
+// durations, choices limit strings.
+type settingSpec struct {
+	key      string
+	def      interface{}
+	min      interface{} // nil -> no lower limit
+	max      interface{} // nil -> no upper limit
+	choices  []string
+	restart  bool // read once at startup, a reload cannot change it
+	fileOnly bool // a command, path or credential, the settings API and profiles cannot change it
+	desc     string
+}
+
+// onPi - the default on the clock itself, and everywhere else
+func onPi(pi interface{}, other interface{}) interface{} {
+	if runtime.GOARCH == "arm" {
+		return pi
+	}
+	return other
+}
+
+var noDuration = time.Duration(0)
+
+// settingsSchema is every key the config file can have, in the order
+// the reference lists them (see settingsDoc)
+var settingsSchema = []settingSpec{
+	// alarms
+	{key: sCalName, def: "piclock", desc: "Google calendar the alarms come from"},
+	{key: sSecrets, def: "/etc/default/piclock", fileOnly: true, desc: "Directory of the calendar credentials (client_secret.json)"},
+	{key: sTokenPath, def: "", fileOnly: true, desc: "The calendar token, empty -> token.json in the secretPath"},
+	{key: sTokenKey, def: "", fileOnly: true, desc: "Key file the tokens are encrypted with, empty -> plain JSON"},
+	{key: sAccounts, def: []calendarAccount{}, fileOnly: true, desc: "Google accounts to read alarms from, each {\"name\", \"calendar\", \"token\"}, none -> calendar and tokenPath"},
+	{key: sAlarms, def: "/etc/default/piclock/alarms", fileOnly: true, desc: "Directory the alarms are cached in"},
+	{key: sAlmRefresh, def: time.Minute, min: 10 * time.Second, desc: "How often the calendar is read"},
+	{key: sCountdown, def: time.Minute, min: noDuration, desc: "Count down this long before an alarm"},
+	{key: sIPTime, def: "http://worldtimeapi.org/api/ip", desc: "Where the clock is checked against"},
+	{key: sCalendarAlarms, def: true, desc: "Ring the calendar's alarms, false ignores them"},
+
+	// display
+	{key: sDisplay, def: onPi(true, false), restart: true, desc: "Drive the LED backpack, false logs the display"},
+	{key: sI2CBus, def: byte(0), restart: true, desc: "I2C bus of the backpack"},
+	{key: sI2CDev, def: byte(0x70), restart: true, desc: "I2C address of the backpack"},
+	{key: sBrightness, def: 3, min: 0, max: 15, desc: "Display brightness"},
+	{key: sInverted, def: false, restart: true, desc: "The display is mounted upside down"},
+	{key: sBlink, def: true, desc: "Blink the colon every second"},
+	{key: sStrobe, def: true, desc: "Strobe the display for an alarm, false shows dashes"},
+	{key: sSkipLoader, def: false, desc: "Skip the build date at startup"},
+	{key: sDebug, def: false, desc: "Log every display update"},
+	{key: sGlyphFile, def: "", restart: true, fileOnly: true, desc: "Extra or replacement glyphs"},
+	{key: sGlyphFallback, def: byte(sevenseg_backpack.DefaultFallback), restart: true, desc: "Segments shown for a character with no glyph"},
+	{key: sCarousel, def: []carouselPageConfig{}, desc: "Pages shown between the clock, none -> just the clock"},
+	{key: sTempSensor, def: "/sys/bus/w1/devices/28-*/w1_slave", fileOnly: true, desc: "1-wire sensor for the temperature page"},
+	{key: sAnimations, def: []animation{}, desc: "Extra or replacement animations"},
+	{key: sAlarmAnimation, def: "", desc: "Animation while an alarm rings, empty -> strobe or dashes"},
+	{key: sCountdownAnimation, def: "", desc: "Animation for the countdown, empty -> the seconds"},
+
+	// buttons and LEDs
+	{key: sButtons, def: onPi(sRPi, sKeyboard), restart: true, desc: "Where button presses come from, \"rpi\" or \"keys\", anything else -> none"},
+	{key: sMainBtn, def: buttonMap{pinNum: 25, key: "a", pullup: true}, restart: true, desc: "Stops an alarm, hold for the time and next alarm, 5s for the next profile"},
+	{key: sLongBtn, def: buttonMap{pinNum: 26, key: "b", pullup: true}, restart: true, desc: "Reloads the alarms, hold for a test sound"},
+	{key: sDblBtn, def: buttonMap{pinNum: 27, key: "c", pullup: true}, restart: true, desc: "Shows or cancels the next alarm, hold for the sleep timer"},
+	{key: sLEDErr, def: byte(6), max: byte(27), restart: true, desc: "GPIO pin of the error LED"},
+	{key: sLEDAlm, def: byte(16), max: byte(27), restart: true, desc: "GPIO pin of the alarm LED"},
+
+	// config service
+	{key: sConfigSvc, def: 8080, min: 0, max: 65535, restart: true, desc: "Port of the config service, 0 -> no service"},
+	{key: sLog, def: "/var/log/piclock.log", restart: true, fileOnly: true, desc: "Log file"},
+
+	// music
+	{key: sMusicURL, def: "http://localhost/pimusic/music.json", fileOnly: true, desc: "Manifest of the music to download"},
+	{key: sMusicPath, def: "/etc/default/piclock/music", fileOnly: true, desc: "Directory of the music library"},
+	{key: sMusicParallel, def: 2, min: 1, max: 16, desc: "Downloads at once"},
+	{key: sMusicRetries, def: 3, min: 0, max: 10, desc: "Retries of a failed download"},
+	{key: sMusicRetryDelay, def: 5 * time.Second, min: noDuration, desc: "Wait before the first retry, it doubles each retry"},
+	{key: sMusicTimeout, def: 5 * time.Minute, min: time.Second, desc: "Longest one download can take"},
+	{key: sMusicPrune, def: false, desc: "Remove downloads dropped from the manifest"},
+
+	// audio
+	{key: sAudio, def: true, restart: true, desc: "Play sounds, false only logs them"},
+	{key: sAudioBackend, def: audioMpg123, choices: []string{audioMpg123, audioAplay, audioFfplay, audioCommand, audioWav}, desc: "What plays the audio"},
+	{key: sAudioCommand, def: "", fileOnly: true, desc: "Player for \"command\", e.g. \"mpv --no-video {file}\""},
+	{key: sAudioSink, def: "", fileOnly: true, desc: "For \"wav\", where the played audio is written"},
+	{key: sAudioDecoder, def: "ffmpeg -loglevel error -i {file} -f wav -", fileOnly: true, desc: "For \"wav\", writes a file that is not a WAV (MP3, OGG, FLAC) to stdout as one, empty -> WAV files only"},
+	{key: sAudioDevice, def: "", desc: "The ALSA card the audio check looks for, empty -> any"},
+	{key: sAudioCheck, def: time.Hour, min: noDuration, desc: "Between audio checks, 0 -> only at startup"},
+	{key: sTones, def: []tonePattern{}, desc: "Extra or replacement tone patterns"},
+	{key: sTonePattern, def: "beep-beep", desc: "Tones for alarms that do not pick any"},
+	{key: sDefaultEffect, def: effectRandom, choices: []string{effectRandom, effectTones, effectRadio}, desc: "What an alarm that names no effect plays, \"radio\" -> the first station"},
+	{key: sVolumeControl, def: onPi(volumeAmixer, volumeSoftware), choices: []string{volumeAmixer, volumeSoftware}, restart: true, desc: "How the volume is set"},
+	{key: sMixerControl, def: "PCM", desc: "The amixer control"},
+	{key: sVolume, def: 80, min: 0, max: volumeMax, desc: "Volume in percent"},
+	{key: sVolumeStart, def: 20, min: 0, max: volumeMax, desc: "Where a volume ramp starts"},
+	{key: sVolumeRamp, def: noDuration, min: noDuration, desc: "Ramp an alarm's volume up over this long, with software volume only the wav backend can"},
+	{key: sPlayRepeat, def: 6, min: 0, max: 100, desc: "Times through an alarm's tracks"},
+	{key: sPlayDuration, def: noDuration, min: noDuration, desc: "Stop an alarm's tracks after this long, 0 -> just the repeats"},
+	{key: sPlayOrder, def: orderSequential, choices: []string{orderSequential, orderShuffle}, desc: "Order of playlist alarms, random alarms shuffle"},
+	{key: sRandomPlaylist, def: "", desc: "Playlist for random alarms, empty -> the whole library"},
+	{key: sStations, def: []radioStation{}, desc: "Named streams for radio alarms"},
+	{key: sRadioTimeout, def: 10 * time.Second, min: time.Second, desc: "Give up on a stream that stalls this long"},
+	{key: sRadioFallback, def: "", desc: "Track for when a stream fails, empty -> tones"},
+	{key: sTTS, def: ttsNone, choices: []string{ttsNone, ttsEspeak, ttsPico, ttsCommand}, restart: true, desc: "Text to speech, empty -> none"},
+	{key: sTTSCommand, def: "", restart: true, fileOnly: true, desc: "For \"command\", e.g. \"flite -t {text}\""},
+	{key: sAnnounceAlarm, def: false, desc: "Say the time and the alarm's name when it goes off"},
+	{key: sSleepTrack, def: "", desc: "Playlist, directory or track for the sleep timer, empty -> the library"},
+	{key: sSleepVolume, def: 40, min: 0, max: volumeMax, desc: "Volume of the sleep timer"},
+	{key: sSleepFade, def: 5 * time.Minute, min: noDuration, desc: "Fade out over the end of the sleep timer"},
+
+	// profiles
+	{key: sProfiles, def: settingsProfiles{}, desc: "Named sets of live settings that override the rest of the file"},
+	{key: sProfileSchedule, def: []profileRule{}, desc: "When each profile is used, the first rule that matches wins, none -> the base settings"},
+	{key: sProfileState, def: "/etc/default/piclock/profile.json", fileOnly: true, desc: "Where the active profile is kept across restarts, empty -> not kept"},
+
+	// the config file itself
+	{key: sConfigVersion, def: currentConfigVersion, min: 0, max: currentConfigVersion, desc: "Layout of the config file, an older one still loads and piclock config migrate updates it"},
+	{key: sHostConfigs, def: "hosts", fileOnly: true, desc: "Directory of per-host overrides (<hostname>.conf or <machine-id>.conf) relative to the config file, read from the config file only, empty -> none"},
+	{key: sConfigServer, def: "", fileOnly: true, desc: "Where to pull this clock's config (<url>/config) and music manifest (<url>/music) from, {host} is the hostname, empty -> not pulled"},
+	{key: sConfigServerKey, def: "", fileOnly: true, desc: "File with the key the config server signs with (HMAC-SHA256)"},
+	{key: sConfigPullTime, def: 5 * time.Minute, min: 10 * time.Second, desc: "How often the config server is checked"},
+	{key: sConfigPullCache, def: "/etc/default/piclock/pulled", fileOnly: true, desc: "Where the last good config and manifest from the config server are kept"},
+	{key: sStrictSettings, def: false, desc: "Unknown keys are errors rather than warnings"},
+	{key: sSettingsToken, def: "", fileOnly: true, desc: "File with the token every API call but a GET needs in X-Piclock-Token, empty -> the API cannot change anything"},
+	{key: sSettingsAudit, def: "/var/log/piclock-settings.log", fileOnly: true, desc: "Where changes from the settings API are logged, empty -> only the main log"},
+}
+
+// findSetting - the spec for key
+func findSetting(key string) (settingSpec, bool) {
+	for _, spec := range settingsSchema {
+		if spec.key == key {
+			return spec, true
+		}
+	}
+	return settingSpec{}, false
+}
+
+// convert reads a value from the config file as the setting's type
+func (spec settingSpec) convert(val interface{}) (interface{}, error) {
+	switch target := spec.def.(type) {
+	case bool:
+		return toBool(val)
+	case uint8:
+		return toUInt8(val)
+	case []uint8:
+		return toUInt8Array(val)
+	case int:
+		return toInt(val)
+	case string:
+		return toString(val)
+	case time.Duration:
+		return toDuration(val)
+	case buttonMap:
+		return toButtonMap(val)
+	case []carouselPageConfig:
+		return toCarouselPages(val)
+	case []animation:
+		return toAnimations(val)
+	case []tonePattern:
+		return toTonePatterns(val)
+	case []radioStation:
+		return toRadioStations(val)
+	case settingsProfiles:
+		return toProfiles(val)
+	case []profileRule:
+		return toProfileSchedule(val)
+	case []calendarAccount:
+		return toCalendarAccounts(val)
+	default:
+		return nil, fmt.Errorf("No handler for %v: %T", spec.key, target)
+	}
+}
+
+// number - ints, bytes and durations compare as one
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case time.Duration:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// check - is a converted value in range?
+func (spec settingSpec) check(value interface{}) error {
+	if n, ok := number(value); ok {
+		low, hasLow := number(spec.min)
+		high, hasHigh := number(spec.max)
+		if (hasLow && n < low) || (hasHigh && n > high) {
+			return fmt.Errorf("%s must be %s: %v", spec.key, spec.limits(), value)
+		}
+	}
+	if s, ok := value.(string); ok && len(spec.choices) > 0 {
+		for _, choice := range spec.choices {
+			if s == choice {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s must be %s: \"%s\"", spec.key, spec.limits(), s)
+	}
+	return nil
+}
+
+// parse converts and checks a value from the config file
+func (spec settingSpec) parse(val interface{}) (interface{}, error) {
+	value, err := spec.convert(val)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", spec.key, err.Error())
+	}
+	return value, spec.check(value)
+}
+
+// limits - "0 - 15", "at least 1s", or the choices
+func (spec settingSpec) limits() string {
+	if len(spec.choices) > 0 {
+		quoted := make([]string, len(spec.choices))
+		for i, choice := range spec.choices {
+			quoted[i] = fmt.Sprintf("\"%s\"", choice)
+		}
+		return "one of " + strings.Join(quoted, ", ")
+	}
+	switch {
+	case spec.min != nil && spec.max != nil:
+		return fmt.Sprintf("%v - %v", spec.min, spec.max)
+	case spec.min != nil:
+		return fmt.Sprintf("at least %v", spec.min)
+	case spec.max != nil:
+		return fmt.Sprintf("at most %v", spec.max)
+	}
+	return ""
+}
+
+// typeName - the setting's type for the reference
+func (spec settingSpec) typeName() string {
+	switch spec.def.(type) {
+	case bool:
+		return "bool"
+	case uint8:
+		return "byte"
+	case []uint8:
+		return "bytes"
+	case int:
+		return "int"
+	case string:
+		return "string"
+	case time.Duration:
+		return "duration"
+	case buttonMap:
+		return "button"
+	case []carouselPageConfig:
+		return "pages"
+	case []animation:
+		return "animations"
+	case []tonePattern:
+		return "tones"
+	case []radioStation:
+		return "stations"
+	case settingsProfiles:
+		return "profiles"
+	case []profileRule:
+		return "rules"
+	case []calendarAccount:
+		return "accounts"
+	}
+	return fmt.Sprintf("%T", spec.def)
+}
+
+// showSetting - a value the way the config file has it
+func showSetting(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return fmt.Sprintf("\"%s\"", v)
+	case time.Duration:
+		return fmt.Sprintf("\"%v\"", v)
+	case buttonMap:
+		return fmt.Sprintf(`{"pin": %d, "key": "%s", "pullup": %t}`, v.pinNum, v.key, v.pullup)
+	case []carouselPageConfig, []animation, []tonePattern, []radioStation, []profileRule, []calendarAccount, []uint8:
+		if reflect.ValueOf(v).Len() == 0 {
+			return "[]"
+		}
+		return fmt.Sprintf("%+v", v)
+	case settingsProfiles:
+		out, _ := json.Marshal(v)
+		return string(out)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// how close an unknown key has to be to a real one to suggest it
+const suggestSimilarity = 0.6
+
+// suggestSetting - "ledErr" for "ledError", "" when nothing is close
+func suggestSetting(key string) string {
+	best := ""
+	bestScore := suggestSimilarity
+	for _, spec := range settingsSchema {
+		a, b := strings.ToLower(key), strings.ToLower(spec.key)
+		score := similarity(a, b)
+		if strings.HasPrefix(a, b) || strings.HasPrefix(b, a) {
+			score = 1
+		}
+		if score >= bestScore {
+			best, bestScore = spec.key, score
+		}
+	}
+	return best
+}
+
+// unknownSettings - a warning for each key that is not in the schema
+func unknownSettings(keys []string) []string {
+	sort.Strings(keys)
+	warnings := []string{}
+	for _, key := range keys {
+		if _, ok := findSetting(key); ok {
+			continue
+		}
+		if suggestion := suggestSetting(key); suggestion != "" {
+			warnings = append(warnings, fmt.Sprintf("Unknown setting \"%s\", did you mean \"%s\"?", key, suggestion))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("Unknown setting \"%s\"", key))
+		}
+	}
+	return warnings
+}
+
+// settingsDoc writes the reference for every setting as markdown, it is
+// the -settings flag and SETTINGS.md
+func settingsDoc(w io.Writer) {
+	fmt.Fprintln(w, "# Settings")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "The config file is JSON, or YAML (`.yaml`, `.yml`) or TOML (`.toml`) by its extension, every key is optional. Live settings change on a reload (SIGHUP, or saving the file), the rest need a restart. File only settings are commands, paths and credentials that the settings API and profiles cannot change. Generated by `piclock -settings`, do not edit.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Each layer overrides the ones before it: the defaults, the config file, this host's file in `hostConfigs`, the config pulled from the `configServer`, the active profile, `PICLOCK_` and the key in any case in the environment (`PICLOCK_CONFIGSERVICE=0`), then `-set key=value` flags. Buttons and lists are JSON in the environment and flags. `piclock -effective` prints the settings in effect and where each came from.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "| Key | Type | Default | Allowed | Reload | Description |")
+	fmt.Fprintln(w, "| --- | --- | --- | --- | --- | --- |")
+	for _, spec := range settingsSchema {
+		def := showSetting(spec.def)
+		switch spec.key {
+		case sDisplay:
+			def = "true on the Pi, else false"
+		case sButtons:
+			def = fmt.Sprintf("\"%s\" on the Pi, else \"%s\"", sRPi, sKeyboard)
+		case sVolumeControl:
+			def = fmt.Sprintf("\"%s\" on the Pi, else \"%s\"", volumeAmixer, volumeSoftware)
+		}
+		reload := "live"
+		if spec.restart {
+			reload = "restart"
+		}
+		if spec.fileOnly {
+			reload += ", file only"
+		}
+		fmt.Fprintf(w, "| `%s` | %s | `%s` | %s | %s | %s |\n", spec.key, spec.typeName(), strings.Replace(def, "|", "\\|", -1), spec.limits(), reload, spec.desc)
+	}
+}
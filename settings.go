@@ -2,17 +2,25 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"runtime"
+	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
 // keep configSettings generic strings, type-convert on the fly
 type configSettings struct {
 	settings map[string]interface{}
+	warnings []string               // unknown keys in the config file
+	file     string                 // where they were read from, for reloads
+	sets     []string               // -set flags, they are reloaded too
+	sources  map[string]string      // where each came from, see loadSettings
+	raw      map[string]interface{} // as they were written, see settingsFrom
+	lock     *sync.RWMutex          // every copy shares the maps, see apply()
 }
 
 type buttonMap struct {
@@ -32,6 +40,11 @@ const sDebug string = "debugDump"
 const sLog string = "logFile"
 const sMusicURL string = "musicDownloads"
 const sMusicPath string = "musicPath"
+const sMusicParallel string = "musicParallel"
+const sMusicRetries string = "musicRetries"
+const sMusicRetryDelay string = "musicRetryDelay"
+const sMusicTimeout string = "musicTimeout"
+const sMusicPrune string = "musicPrune"
 const sBlink string = "blinkTime"
 const sStrobe string = "strobe"
 const sSkipLoader string = "skipLoader"
@@ -48,92 +61,145 @@ const sAudio string = "audio"
 const sConfigSvc string = "configService"
 const sIPTime string = "ipTimeUrl"
 const sBrightness string = "brightness"
+const sCarousel string = "carousel"
+const sTempSensor string = "tempSensor"
+const sGlyphFile string = "glyphFile"
+const sGlyphFallback string = "glyphFallback"
+const sInverted string = "inverted"
+const sAnimations string = "animations"
+const sAlarmAnimation string = "alarmAnimation"
+const sCountdownAnimation string = "countdownAnimation"
+const sAudioBackend string = "audioBackend"
+const sAudioCommand string = "audioCommand"
+const sAudioSink string = "audioSink"
+const sAudioDecoder string = "audioDecoder"
+const sTones string = "tones"
+const sTonePattern string = "tonePattern"
+const sVolume string = "volume"
+const sVolumeStart string = "volumeStart"
+const sVolumeRamp string = "volumeRamp"
+const sVolumeControl string = "volumeControl"
+const sMixerControl string = "mixerControl"
+const sPlayRepeat string = "playRepeat"
+const sPlayDuration string = "playDuration"
+const sPlayOrder string = "playOrder"
+const sRandomPlaylist string = "randomPlaylist"
+const sStations string = "stations"
+const sTTS string = "tts"
+const sTTSCommand string = "ttsCommand"
+const sAnnounceAlarm string = "announceAlarm"
+const sRadioTimeout string = "radioTimeout"
+const sRadioFallback string = "radioFallback"
+const sAudioCheck string = "audioCheck"
+const sAudioDevice string = "audioDevice"
+const sSleepTrack string = "sleepTrack"
+const sSleepVolume string = "sleepVolume"
+const sSleepFade string = "sleepFade"
+const sStrictSettings string = "strictSettings"
+const sSettingsAudit string = "settingsAudit"
+const sSettingsToken string = "settingsToken"
+const sCalendarAlarms string = "calendarAlarms"
+const sDefaultEffect string = "defaultEffect"
+const sProfiles string = "profiles"
+const sProfileSchedule string = "profileSchedule"
+const sProfileState string = "profileState"
+const sTokenPath string = "tokenPath"
+const sTokenKey string = "tokenKey"
+const sAccounts string = "accounts"
+const sConfigVersion string = "configVersion"
+const sHostConfigs string = "hostConfigs"
+const sConfigServer string = "configServer"
+const sConfigServerKey string = "configServerKey"
+const sConfigPullTime string = "configPullTime"
+const sConfigPullCache string = "configPullCache"
 
 func defaultSettings() *configSettings {
 	s := make(map[string]interface{})
+	raw := make(map[string]interface{})
 
 	// setting the type here makes the conversion "automatic" later
-	s[sCountdown], _ = time.ParseDuration("1m")
-	s[sSecrets] = "/etc/default/piclock"
-	s[sAlarms] = "/etc/default/piclock/alarms"
-	s[sAlmRefresh], _ = time.ParseDuration("1m")
-	s[sI2CBus] = byte(0)
-	s[sI2CDev] = byte(0x70)
-	s[sCalName] = "piclock"
-	s[sDebug] = false
-	s[sLog] = "/var/log/piclock.log"
-	s[sMusicURL] = "http://localhost/pimusic/music.json"
-	s[sIPTime] = "http://worldtimeapi.org/api/ip"
-	s[sMusicPath] = "/etc/default/piclock/music"
-	s[sBlink] = true
-	s[sStrobe] = true
-	s[sSkipLoader] = false
-	s[sMainBtn] = buttonMap{pinNum: 25, key: "a", pullup: true}
-	s[sLongBtn] = buttonMap{pinNum: 26, key: "b", pullup: true}
-	s[sDblBtn] = buttonMap{pinNum: 27, key: "c", pullup: true}
-	s[sLEDErr] = byte(6)
-	s[sLEDAlm] = byte(16)
-	s[sConfigSvc] = 8080 // port for the config service to run on, 0 -> no service
-	s[sBrightness] = 3
-
-	if runtime.GOARCH == "arm" {
-		s[sButtons] = sRPi
-		s[sDisplay] = true
-		s[sAudio] = true
-	} else {
-		s[sDisplay] = false
-		s[sButtons] = sKeyboard
-		s[sAudio] = true
-	}
-
-	return &configSettings{settings: s}
+	for _, spec := range settingsSchema {
+		s[spec.key] = spec.def
+		raw[spec.key] = plainSetting(spec.def)
+	}
+
+	return &configSettings{settings: s, warnings: []string{}, sources: map[string]string{}, raw: raw, lock: &sync.RWMutex{}}
 }
 
 func (s *configSettings) settingsFromJSON(data []byte) error {
-	tmp := defaultSettings()
-
 	var jsonMap map[string]interface{}
 	err := json.Unmarshal([]byte(data), &jsonMap)
 	if err != nil {
 		return err
 	}
 
-	for k, v := range tmp.settings {
-		if jsonMap[k] == nil {
+	s.warnings = []string{}
+	return s.settingsFrom(jsonMap, "file")
+}
+
+// settingsFrom parses one layer of settings (a file, the environment) on
+// top of the ones already there
+func (s *configSettings) settingsFrom(values map[string]interface{}, source string) error {
+	if problems := s.layerProblems(values, source); len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// layerProblems parses what it can of one layer and lists everything
+// wrong with the rest (see validateSettings)
+func (s *configSettings) layerProblems(values map[string]interface{}, source string) []string {
+	keys := []string{}
+	for k := range values {
+		keys = append(keys, k)
+	}
+	warnings := unknownSettings(keys)
+	s.warnings = append(s.warnings, warnings...)
+
+	problems := []string{}
+	for _, spec := range settingsSchema {
+		if values[spec.key] == nil {
 			// skip, we will use the default
 			continue
 		}
-		switch target := v.(type) {
-		case bool:
-			s.settings[k], err = toBool(jsonMap[k])
-		case uint8:
-			s.settings[k], err = toUInt8(jsonMap[k])
-		case []uint8:
-			s.settings[k], err = toUInt8Array(jsonMap[k])
-		case int:
-			s.settings[k], err = toInt(jsonMap[k])
-		case string:
-			s.settings[k], err = toString(jsonMap[k])
-		case time.Duration:
-			s.settings[k], err = toDuration(jsonMap[k])
-		case buttonMap:
-			s.settings[k], err = toButtonMap(jsonMap[k])
-		default:
-			err = fmt.Errorf("No handler for %v: %T", k, target)
-		}
-
+		value, err := spec.parse(values[spec.key])
 		if err != nil {
-			return err
+			problems = append(problems, err.Error())
+			continue
 		}
+		s.settings[spec.key] = value
+		s.sources[spec.key] = source
+		s.raw[spec.key] = values[spec.key]
 	}
 
-	return nil
+	if len(warnings) > 0 && s.GetBool(sStrictSettings) {
+		problems = append(problems, warnings...)
+	}
+	return problems
 }
 
 type cliArgs struct {
 	oauth      bool
 	version    bool
+	music      bool
+	settings   bool
+	effective  bool
 	configFile string
+	host       string // -host, which override file to use
+	sets       []string
+	command    []string // e.g. config validate, see runConfigCommand
+}
+
+// setFlags - -set key=value, as many as you like
+type setFlags []string
+
+func (sf *setFlags) String() string {
+	return strings.Join(*sf, " ")
+}
+
+func (sf *setFlags) Set(value string) error {
+	*sf = append(*sf, value)
+	return nil
 }
 
 func parseCLIArgs() cliArgs {
@@ -141,6 +207,12 @@ func parseCLIArgs() cliArgs {
 	configFile := flag.String("config", "/etc/default/piclock/piclock.conf", "config file path")
 	oauthOnly := flag.Bool("oauth", false, "connect and generate the oauth token")
 	versionOnly := flag.Bool("version", false, "show the git SHA that we built with")
+	musicOnly := flag.Bool("music", false, "list the music library and exit")
+	settingsOnly := flag.Bool("settings", false, "print the settings reference and exit")
+	effectiveOnly := flag.Bool("effective", false, "print the settings in effect, and where each came from, and exit")
+	host := flag.String("host", "", "use this host's override file, default: the hostname or machine id")
+	var sets setFlags
+	flag.Var(&sets, "set", "override a setting, key=value (repeatable)")
 
 	// parse the flags
 	flag.Parse()
@@ -152,101 +224,227 @@ func parseCLIArgs() cliArgs {
 	if versionOnly != nil && *versionOnly {
 		args.version = true
 	}
+	if musicOnly != nil && *musicOnly {
+		args.music = true
+	}
+	if settingsOnly != nil && *settingsOnly {
+		args.settings = true
+	}
+	if effectiveOnly != nil && *effectiveOnly {
+		args.effective = true
+	}
 	if configFile != nil {
 		args.configFile = *configFile
 	}
+	if host != nil {
+		args.host = *host
+	}
+	args.sets = sets
+	args.command = flag.Args()
 
 	return args
 }
 
-func initSettings(configFile string) configSettings {
+func initSettings(configFile string, sets []string) configSettings {
 	log.Println("initSettings")
 
-	// defaults
-	s := defaultSettings()
+	log.Println(fmt.Sprintf("Reading configuration from '%s'", configFile))
 
-	// try to open the config file
-	data, err := ioutil.ReadFile(configFile)
+	// defaults < file < host file < PICLOCK_ environment < -set
+	s, err := loadSettings(configFile, os.Environ(), sets)
 	if err != nil {
-		log.Fatalf("Could not load conf file '%s', terminating", configFile)
+		log.Fatal(err.Error())
+	}
+	for _, warning := range s.warnings {
+		log.Printf("Warning: %s", warning)
 	}
 
-	log.Println(fmt.Sprintf("Reading configuration from '%s'", configFile))
+	return *s
+}
 
-	// json parse it
-	if err := s.settingsFromJSON(data); err != nil {
-		// log a message about crappy JSON?
-		log.Fatal(err.Error())
+// get reads one setting, a reload can be changing them
+func (s *configSettings) get(key string) interface{} {
+	if s.lock != nil {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
 	}
+	return s.settings[key]
+}
 
-	return *s
+// apply copies keys from fresh settings in place, so every
+// runtimeConfig sees them
+func (s *configSettings) apply(fresh *configSettings, keys []string) {
+	if s.lock != nil {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+	}
+	for _, k := range keys {
+		s.settings[k] = fresh.settings[k]
+		s.raw[k] = fresh.raw[k]
+		if source, ok := fresh.sources[k]; ok {
+			s.sources[k] = source
+		} else {
+			delete(s.sources, k)
+		}
+	}
+}
+
+// rawValue - a setting the way the config file (or env, or -set) has it
+func (s *configSettings) rawValue(key string) interface{} {
+	if s.lock != nil {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+	}
+	return s.raw[key]
+}
+
+// mismatch logs a setting of the wrong type and gives the default
+// instead, the schema makes this a bug rather than a bad config file
+func (s *configSettings) mismatch(key string, v interface{}, want string) interface{} {
+	log.Printf("Error: setting %s is %T, not %s", key, v, want)
+	spec, _ := findSetting(key)
+	return spec.def
 }
 
 func (s *configSettings) GetString(key string) string {
-	switch v := s.settings[key].(type) {
+	switch v := s.get(key).(type) {
 	case string:
 		return v
 	default:
-		log.Fatalf("Could not convert %T to int", v)
-		return "noafokinstrang"
+		def, _ := s.mismatch(key, v, "string").(string)
+		return def
 	}
 }
 
 func (s *configSettings) GetBool(key string) bool {
-	switch v := s.settings[key].(type) {
+	switch v := s.get(key).(type) {
 	case bool:
 		return v
 	default:
-		log.Fatalf("Could not convert %T to bool", v)
-		return false
+		def, _ := s.mismatch(key, v, "bool").(bool)
+		return def
 	}
 }
 
 func (s *configSettings) GetDuration(key string) time.Duration {
-	switch v := s.settings[key].(type) {
+	switch v := s.get(key).(type) {
 	case time.Duration:
 		return v
 	default:
-		log.Fatalf("Could not convert %T to time.Duration", v)
-		return -1
+		def, _ := s.mismatch(key, v, "time.Duration").(time.Duration)
+		return def
 	}
 }
 
 func (s *configSettings) GetByte(key string) byte {
-	switch v := s.settings[key].(type) {
+	switch v := s.get(key).(type) {
 	case byte:
 		return v
 	case int: // cast to byte
 		return byte(v)
 	default:
-		log.Fatalf("Could not convert %T to byte", v)
-		return 0xff
+		def, _ := s.mismatch(key, v, "byte").(byte)
+		return def
 	}
 }
 
 func (s *configSettings) GetInt(key string) int {
-	switch v := s.settings[key].(type) {
+	switch v := s.get(key).(type) {
 	case int:
 		return v
 	case uint8:
 		return int(v)
 	default:
-		log.Fatalf("Could not convert %T to int", v)
-		return -1
+		def, _ := s.mismatch(key, v, "int").(int)
+		return def
 	}
 }
 
 func (s *configSettings) GetButtonMap(key string) buttonMap {
-	switch v := s.settings[key].(type) {
+	switch v := s.get(key).(type) {
 	case buttonMap:
 		return v
 	default:
-		log.Fatalf("Could not convert %T to buttonMap", v)
-		return buttonMap{}
+		def, _ := s.mismatch(key, v, "buttonMap").(buttonMap)
+		return def
+	}
+}
+
+func (s *configSettings) GetCarouselPages(key string) []carouselPageConfig {
+	switch v := s.get(key).(type) {
+	case []carouselPageConfig:
+		return v
+	default:
+		def, _ := s.mismatch(key, v, "[]carouselPageConfig").([]carouselPageConfig)
+		return def
+	}
+}
+
+func (s *configSettings) GetAnimations(key string) []animation {
+	switch v := s.get(key).(type) {
+	case []animation:
+		return v
+	default:
+		def, _ := s.mismatch(key, v, "[]animation").([]animation)
+		return def
+	}
+}
+
+func (s *configSettings) GetTonePatterns(key string) []tonePattern {
+	switch v := s.get(key).(type) {
+	case []tonePattern:
+		return v
+	default:
+		def, _ := s.mismatch(key, v, "[]tonePattern").([]tonePattern)
+		return def
+	}
+}
+
+func (s *configSettings) GetRadioStations(key string) []radioStation {
+	switch v := s.get(key).(type) {
+	case []radioStation:
+		return v
+	default:
+		def, _ := s.mismatch(key, v, "[]radioStation").([]radioStation)
+		return def
+	}
+}
+
+func (s *configSettings) GetProfiles(key string) settingsProfiles {
+	switch v := s.get(key).(type) {
+	case settingsProfiles:
+		return v
+	default:
+		def, _ := s.mismatch(key, v, "settingsProfiles").(settingsProfiles)
+		return def
+	}
+}
+
+func (s *configSettings) GetProfileSchedule(key string) []profileRule {
+	switch v := s.get(key).(type) {
+	case []profileRule:
+		return v
+	default:
+		def, _ := s.mismatch(key, v, "[]profileRule").([]profileRule)
+		return def
+	}
+}
+
+func (s *configSettings) GetCalendarAccounts(key string) []calendarAccount {
+	switch v := s.get(key).(type) {
+	case []calendarAccount:
+		return v
+	default:
+		def, _ := s.mismatch(key, v, "[]calendarAccount").([]calendarAccount)
+		return def
 	}
 }
 
 func (s *configSettings) GetAllButtonNames() []string {
+	if s.lock != nil {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+	}
 	result := make([]string, 0)
 	// try to convert every setting into a button, skip failures
 	for k, v := range s.settings {
@@ -258,9 +456,3 @@ func (s *configSettings) GetAllButtonNames() []string {
 	}
 	return result
 }
-
-func (s *configSettings) Dump() {
-	for k, v := range s.settings {
-		log.Printf("%s : %T: %v\n", k, v, v)
-	}
-}
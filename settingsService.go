@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// one PATCH at a time, they read and rewrite the config file
+var settingsWrite sync.Mutex
+
+// anything but a GET sends the settingsToken in this header
+const settingsTokenHeader string = "X-Piclock-Token"
+
+// checkSettingsToken - may r change anything?  only with the token in the
+// settingsToken file, and not at all without one
+func checkSettingsToken(settings configSettings, r *http.Request) error {
+	tokenFile := settings.GetString(sSettingsToken)
+	if tokenFile == "" {
+		return errors.New("The API cannot change anything, set settingsToken to let it")
+	}
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("The settings token %s is empty", tokenFile)
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(settingsTokenHeader)), []byte(token)) != 1 {
+		return fmt.Errorf("No %s, or the wrong one", settingsTokenHeader)
+	}
+	return nil
+}
+
+// TokenAuth - a middleware that refuses anything but a GET without the
+// settingsToken
+func (m *APIHandler) TokenAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			if err := checkSettingsToken(m.rt.settings, r); err != nil {
+				m.rt.logger.Printf("Refused %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, err.Error())
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// settingInfo - one setting for GET /api/settings
+type settingInfo struct {
+	Key         string      `json:"key"`
+	Type        string      `json:"type"`
+	Value       interface{} `json:"value"` // as the config file has it
+	Default     interface{} `json:"default"`
+	Source      string      `json:"source"`
+	Reload      string      `json:"reload"`   // live or restart
+	FileOnly    bool        `json:"fileOnly"` // PATCH cannot change it
+	Allowed     string      `json:"allowed"`
+	Description string      `json:"description"`
+}
+
+// settingsChange - what a PATCH did
+type settingsChange struct {
+	Changed    []string `json:"changed"`
+	Restart    []string `json:"restart"`    // written, but not until a restart
+	Overridden []string `json:"overridden"` // written, but a later layer wins (the host file, the config server, a profile, the env or -set)
+}
+
+func (m *APIHandler) apiSettings(w http.ResponseWriter, r *http.Request) {
+	settings := m.rt.settings
+	infos := make([]settingInfo, len(settingsSchema))
+	for i, spec := range settingsSchema {
+		reload := "live"
+		if spec.restart {
+			reload = "restart"
+		}
+		infos[i] = settingInfo{
+			Key:         spec.key,
+			Type:        spec.typeName(),
+			Value:       settings.rawValue(spec.key),
+			Default:     plainSetting(spec.def),
+			Source:      settings.source(spec.key),
+			Reload:      reload,
+			FileOnly:    spec.fileOnly,
+			Allowed:     spec.limits(),
+			Description: spec.desc,
+		}
+	}
+	output, _ := json.Marshal(infos)
+	w.Write(output)
+}
+
+// apiPatchSettings takes {"key": value, ...}, writes them to the config
+// file (the host's override file when it has one) and reloads it.
+// nothing is written unless every one is good.  TokenAuth checks the
+// settingsToken, and it cannot change the file only settings.
+func (m *APIHandler) apiPatchSettings(w http.ResponseWriter, r *http.Request) {
+	var req map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req) == 0 {
+		http.Error(w, "No settings to change", http.StatusBadRequest)
+		return
+	}
+
+	keys := []string{}
+	for k := range req {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	problems := unknownSettings(keys)
+	for _, k := range keys {
+		spec, ok := findSetting(k)
+		if !ok {
+			continue
+		}
+		if spec.fileOnly {
+			problems = append(problems, fmt.Sprintf("%s can only be changed in the config file", k))
+		} else if req[k] == nil {
+			problems = append(problems, fmt.Sprintf("%s: no value", k))
+		} else if _, err := spec.parse(req[k]); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		http.Error(w, strings.Join(problems, "; "), http.StatusBadRequest)
+		return
+	}
+
+	settingsWrite.Lock()
+	defer settingsWrite.Unlock()
+
+	before := map[string]interface{}{}
+	for _, k := range keys {
+		before[k] = m.rt.settings.rawValue(k)
+	}
+	written := settingsFile(m.rt.settings)
+	if err := updateSettingsFile(written, req); err != nil {
+		m.rt.logger.Printf("Error: could not write settings: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, k := range keys {
+		auditSetting(m.rt, r.RemoteAddr, k, before[k], req[k])
+	}
+
+	status := reloadSettings(m.rt)
+	if status.Error != "" {
+		http.Error(w, fmt.Sprintf("Reload failed: %s", status.Error), http.StatusInternalServerError)
+		return
+	}
+	change := settingsChange{Changed: status.Changed, Restart: status.Restart, Overridden: []string{}}
+	for _, k := range keys {
+		if m.rt.settings.source(k) != written {
+			change.Overridden = append(change.Overridden, k)
+		}
+	}
+	output, _ := json.Marshal(change)
+	w.Write(output)
+}
+
+// auditSetting logs a change from the API, and adds it to "settingsAudit"
+func auditSetting(rt runtimeConfig, client string, key string, from interface{}, to interface{}) {
+	old, _ := json.Marshal(from)
+	value, _ := json.Marshal(to)
+	line := fmt.Sprintf("%s %s %s %s -> %s", rt.clock.Now().Format(time.RFC3339), client, key, old, value)
+	rt.logger.Printf("Settings: %s", line)
+
+	fName := rt.settings.GetString(sSettingsAudit)
+	if fName == "" {
+		return
+	}
+	f, err := os.OpenFile(fName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		rt.logger.Printf("Error: %s", err.Error())
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
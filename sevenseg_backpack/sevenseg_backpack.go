@@ -1,10 +1,15 @@
 package sevenseg_backpack
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"dscheirer.com/piclock/i2c"
 )
@@ -46,48 +51,76 @@ const LED_BOTR = 2
 const LED_DECIMAL = 7
 const LED_DECIMAL_MASK = 0x80
 
-// translate characters to bitmasks
+// translate characters to bitmasks, a best-effort 7-segment alphabet.
+// lookups try the exact case first, then the other case.  M and W have
+// no readable single digit form, they show the fallback (a glyph file
+// can still give them one).
 var digitValues = map[byte]byte{
-	' ': 0x00,
-	'-': 0x40,
-	'_': 0x08,
-	'0': 0x3F,
-	'1': 0x06,
-	'2': 0x5B,
-	'3': 0x4F,
-	'4': 0x66,
-	'5': 0x6D,
-	'6': 0x7D,
-	'7': 0x07,
-	'8': 0x7F,
-	'9': 0x6F,
-	'A': 0x77,
-	'B': 0x7C,
-	'C': 0x39,
-	'c': 0x58,
-	'D': 0x5E,
-	'E': 0x79,
-	'F': 0x71,
-	'R': 0x50,
-	'H': 0x76,
-	'h': 0x74,
-	'l': 0x06,
-	'L': 0x38,
-	'n': 0x54,
-	'o': 0x5C,
-	'O': 0x3F,
-	'S': 0x6D,
-	'I': 0x06,
-	'P': 0x73,
-	'u': 0x1C,
-	'i': 0x04,
-	'U': 0x3E,
-	't': 0x78,
-	'Y': 0x6E,
-	'X': 0x76,
-	'?': 0x83,
+	' ':  0x00,
+	'-':  0x40,
+	'_':  0x08,
+	'=':  0x48,
+	'0':  0x3F,
+	'1':  0x06,
+	'2':  0x5B,
+	'3':  0x4F,
+	'4':  0x66,
+	'5':  0x6D,
+	'6':  0x7D,
+	'7':  0x07,
+	'8':  0x7F,
+	'9':  0x6F,
+	'A':  0x77,
+	'B':  0x7C,
+	'C':  0x39,
+	'c':  0x58,
+	'D':  0x5E,
+	'E':  0x79,
+	'F':  0x71,
+	'G':  0x3D,
+	'g':  0x6F,
+	'R':  0x50,
+	'H':  0x76,
+	'h':  0x74,
+	'J':  0x1E,
+	'K':  0x75,
+	'l':  0x06,
+	'L':  0x38,
+	'N':  0x37,
+	'n':  0x54,
+	'o':  0x5C,
+	'O':  0x3F,
+	'S':  0x6D,
+	'I':  0x06,
+	'P':  0x73,
+	'Q':  0x67,
+	'u':  0x1C,
+	'i':  0x04,
+	'U':  0x3E,
+	'V':  0x3E,
+	'v':  0x1C,
+	't':  0x78,
+	'Y':  0x6E,
+	'X':  0x76,
+	'Z':  0x5B,
+	'?':  0x83,
+	'!':  0x82,
+	'*':  0x63, // degree
+	'\'': 0x02,
+	'"':  0x22,
+	'[':  0x39,
+	']':  0x0F,
+	'(':  0x39,
+	')':  0x0F,
+	'/':  0x52,
+	'\\': 0x64,
+	'|':  0x30,
+	'^':  0x23,
 }
 
+// DefaultFallback is shown for characters that have no glyph (three bars)
+const DefaultFallback = 0x49
+
 var inverseDigitValues = createInverseMap(digitValues)
 
 func swapbits(val byte, pos1 byte, pos2 byte) byte {
@@ -98,15 +131,158 @@ func swapbits(val byte, pos1 byte, pos2 byte) byte {
 	return val ^ x
 }
 
-func createInverseMap(digits map[byte]byte) map[byte]byte {
+func invertMask(v byte) byte {
 	// map bits: 3<->0 2<->5 4<->1
+	return swapbits(swapbits(swapbits(v, 3, 0), 2, 5), 4, 1)
+}
+
+func createInverseMap(digits map[byte]byte) map[byte]byte {
 	ret := make(map[byte]byte, 0)
 	for k, v := range digits {
-		ret[k] = swapbits(swapbits(swapbits(v, 3, 0), 2, 5), 4, 1)
+		ret[k] = invertMask(v)
 	}
 	return ret
 }
 
+// ligatures are stored as single private bytes above ascii
+const ligatureBase = 0x80
+
+// Glyphs maps characters, and optional multi-character ligatures, to
+// segment masks
+type Glyphs struct {
+	chars     map[byte]byte
+	ligatures map[string]byte // ligature -> private code in chars
+	fallback  byte
+}
+
+func NewGlyphs(chars map[byte]byte, fallback byte) *Glyphs {
+	g := &Glyphs{
+		chars:     make(map[byte]byte, len(chars)),
+		ligatures: make(map[string]byte),
+		fallback:  fallback,
+	}
+	for k, v := range chars {
+		g.chars[k] = v
+	}
+	return g
+}
+
+func DefaultGlyphs() *Glyphs {
+	return NewGlyphs(digitValues, DefaultFallback)
+}
+
+func (g *Glyphs) copy() *Glyphs {
+	ret := NewGlyphs(g.chars, g.fallback)
+	for k, v := range g.ligatures {
+		ret.ligatures[k] = v
+	}
+	return ret
+}
+
+// Set adds or replaces a glyph, more than one character makes a ligature
+func (g *Glyphs) Set(key string, mask byte) error {
+	switch {
+	case len(key) == 0:
+		return errors.New("Empty glyph")
+	case len(key) == 1:
+		if key[0] >= ligatureBase {
+			return fmt.Errorf("Bad glyph character: %q", key)
+		}
+		g.chars[key[0]] = mask
+	default:
+		code, ok := g.ligatures[key]
+		if !ok {
+			if len(g.ligatures) >= 0xFF-ligatureBase {
+				return fmt.Errorf("Too many ligatures: %s", key)
+			}
+			code = byte(ligatureBase + len(g.ligatures))
+			g.ligatures[key] = code
+		}
+		g.chars[code] = mask
+	}
+	return nil
+}
+
+func (g *Glyphs) SetFallback(mask byte) {
+	g.fallback = mask
+}
+
+func (g *Glyphs) inverse() *Glyphs {
+	ret := g.copy()
+	ret.chars = createInverseMap(g.chars)
+	ret.fallback = invertMask(g.fallback)
+	return ret
+}
+
+// ligate swaps ligatures for their private codes, longest first
+func (g *Glyphs) ligate(msg string) string {
+	if len(g.ligatures) == 0 {
+		return msg
+	}
+	keys := make([]string, 0, len(g.ligatures))
+	for k := range g.ligatures {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	for _, k := range keys {
+		msg = strings.Replace(msg, k, string([]byte{g.ligatures[k]}), -1)
+	}
+	return msg
+}
+
+func (g *Glyphs) lookup(char byte) (byte, bool) {
+	val, ok := g.chars[char]
+	if !ok {
+		val, ok = g.chars[altCase(char)]
+	}
+	return val, ok
+}
+
+func toMask(val interface{}) (byte, error) {
+	switch v := val.(type) {
+	case float64:
+		if v < 0 || v > 0xFF || v != float64(byte(v)) {
+			return 0, fmt.Errorf("Bad segment mask: %v", v)
+		}
+		return byte(v), nil
+	case string:
+		ret, err := strconv.ParseUint(v, 0, 8)
+		return byte(ret), err
+	default:
+		return 0, fmt.Errorf("Bad segment mask type: %T", v)
+	}
+}
+
+// LoadGlyphs reads a JSON object of character (or ligature) -> segment
+// mask, e.g. { "M": "0x37", "deg": 99 }, on top of base
+func LoadGlyphs(path string, base *Glyphs) (*Glyphs, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var table map[string]interface{}
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	ret := base.copy()
+	for k, v := range table {
+		mask, err := toMask(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: glyph %q: %s", path, k, err.Error())
+		}
+		if err := ret.Set(k, mask); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+	}
+	return ret, nil
+}
+
 // one address byte, plus 7-seg skips bytes for each display element
 const displaySize = 1 + 5*2
 
@@ -117,8 +293,25 @@ type Sevenseg struct {
 	inverted       bool
 	dump           bool
 	blink          byte
+	brightness     byte
+	on             bool
 	sim            bool
 	currentDisplay [displaySize]uint8
+	glyphs         *Glyphs
+	inverseGlyphs  *Glyphs
+	// guards what has been sent to the device, Snapshot can be
+	// called from any goroutine
+	lock sync.Mutex
+}
+
+// Snapshot is what the display is currently showing
+type Snapshot struct {
+	Digits     [4]byte // segment masks, LED_* bit positions, left to right as wired
+	Colon      bool
+	Blink      byte
+	Brightness byte
+	On         bool
+	Inverted   bool
 }
 
 func (this *Sevenseg) simLog(v string, args ...interface{}) {
@@ -147,10 +340,13 @@ func Open(address uint8, bus int, simulated bool) (*Sevenseg, error) {
 		refresh:        true,
 		inverted:       false,
 		blink:          BLINK_OFF,
+		brightness:     i2cBRIGHTNESS_MAX & 0x0F,
+		on:             false,
 		dump:           false,
 		display:        getClearDisplay(),
 		sim:            simulated,
 		currentDisplay: getClearDisplay()}
+	this.SetGlyphs(DefaultGlyphs())
 	// turn on the oscillator, set default brightness
 	this.i2cDev.WriteByte(i2c_OSC_ON)
 	this.i2cDev.WriteByte(i2cBRIGHTNESS_MAX)
@@ -162,9 +358,17 @@ func (this *Sevenseg) DebugDump(on bool) {
 	this.dump = on
 }
 
+// SetGlyphs replaces the character table, the inverted table is derived from it
+func (this *Sevenseg) SetGlyphs(glyphs *Glyphs) {
+	this.glyphs = glyphs
+	this.inverseGlyphs = glyphs.inverse()
+}
+
 func (this *Sevenseg) SetInverted(inverted bool) {
 	this.simLog("Inverted: %t", inverted)
+	this.lock.Lock()
 	this.inverted = inverted
+	this.lock.Unlock()
 }
 
 func (this *Sevenseg) DisplayOn(on bool) error {
@@ -174,10 +378,32 @@ func (this *Sevenseg) DisplayOn(on bool) error {
 	if !on {
 		val = i2cDISPLAY_OFF
 	}
+	this.lock.Lock()
+	this.on = on
+	this.lock.Unlock()
 	_, err := this.i2cDev.WriteByte(val)
 	return err
 }
 
+func (this *Sevenseg) Snapshot() Snapshot {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	var digits [4]byte
+	var i byte
+	for i = 0; i < 4; i++ {
+		digits[i] = this.currentDisplay[getDisplayPos(i)]
+	}
+	return Snapshot{
+		Digits:     digits,
+		Colon:      this.currentDisplay[i2c_COLON_POS] != 0,
+		Blink:      this.blink,
+		Brightness: this.brightness,
+		On:         this.on,
+		Inverted:   this.inverted,
+	}
+}
+
 func (this *Sevenseg) ClearDisplay() {
 	this.simLog("ClearDisplay")
 	this.display = getClearDisplay()
@@ -295,7 +521,9 @@ func (this *Sevenseg) refresh_display() error {
 		return nil
 	}
 	// set the display buffer
+	this.lock.Lock()
 	this.currentDisplay = this.display
+	this.lock.Unlock()
 
 	// display has the address 0 embedded in it
 	// for debugging, dump out what we think we're putting on the display
@@ -358,24 +586,15 @@ func (this *Sevenseg) getMask(char uint8, decimalOn bool) (byte, error) {
 		char = ' '
 	}
 
-	// TODO: inverse support
-	var val uint8
-	var ok bool
-	if !this.inverted {
-		val, ok = digitValues[char]
-	} else {
-		val, ok = inverseDigitValues[char]
+	glyphs := this.glyphs
+	if this.inverted {
+		glyphs = this.inverseGlyphs
 	}
+	val, ok := glyphs.lookup(char)
 	if !ok {
-		// try alternate cases
-		if !this.inverted {
-			val, ok = digitValues[altCase(char)]
-		} else {
-			val, ok = inverseDigitValues[altCase(char)]
-		}
-		if !ok {
-			return 0, errors.New(fmt.Sprintf("Bad value: %s", string(char)))
-		}
+		// unknown characters get the fallback instead of failing the print
+		this.simLog("No glyph for %q", char)
+		val = glyphs.fallback
 	}
 	if decimalOn {
 		val |= (1 << LED_DECIMAL)
@@ -384,6 +603,7 @@ func (this *Sevenseg) getMask(char uint8, decimalOn bool) (byte, error) {
 }
 
 func (this *Sevenseg) PrintColon(msg string) error {
+	msg = this.glyphs.ligate(msg)
 	// find the colon, print around that as the centerline
 	parts := strings.Split(msg, ":")
 	if len(parts) > 2 {
@@ -463,6 +683,7 @@ func (this *Sevenseg) PrintColon(msg string) error {
 }
 
 func (this *Sevenseg) PrintFromPosition(msg string, position int) error {
+	msg = this.glyphs.ligate(msg)
 	if strings.Contains(msg, ":") {
 		return this.PrintColon(msg)
 	}
@@ -505,6 +726,10 @@ func (this *Sevenseg) PrintFromPosition(msg string, position int) error {
 
 // Given a string and a start point, print as much as you can (left -> right)
 func (this *Sevenseg) PrintOffset(msg string, offset int) (string, error) {
+	msg = this.glyphs.ligate(msg)
+	if offset > len(msg) {
+		offset = len(msg)
+	}
 	display := getClearDisplay()
 	var displayPos = 0
 	var inc = +1
@@ -540,6 +765,7 @@ func (this *Sevenseg) PrintOffset(msg string, offset int) (string, error) {
 }
 
 func (this *Sevenseg) Print(msg string) error {
+	msg = this.glyphs.ligate(msg)
 	if strings.Contains(msg, ":") {
 		return this.PrintColon(msg)
 	}
@@ -598,7 +824,9 @@ func (this *Sevenseg) SetBlinkRate(rate uint8) error {
 		return errors.New(fmt.Sprintf("Bad blink rate: %d", rate))
 	}
 	this.simLog("Blink rate %d", rate)
+	this.lock.Lock()
 	this.blink = rate
+	this.lock.Unlock()
 	// one assumes you want the display on now?
 	return this.DisplayOn(true)
 }
@@ -608,6 +836,9 @@ func (this *Sevenseg) SetBrightness(level uint8) error {
 		return errors.New(fmt.Sprintf("Bad brightness level: %d", level))
 	}
 	this.simLog("Brightness %d", level)
+	this.lock.Lock()
+	this.brightness = level
+	this.lock.Unlock()
 	_, err := this.i2cDev.WriteByte(i2cBRIGHTNESS_CMD | level)
 	return err
 }
@@ -2,7 +2,9 @@ package sevenseg_backpack
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
 	"runtime"
 	"sort"
 	"testing"
@@ -163,3 +165,79 @@ func TestSegments(t *testing.T) {
 	}
 	display.DisplayOn(false)
 }
+
+func TestGlyphFallback(t *testing.T) {
+	display := setup(t)
+
+	// unknown characters do not fail the print
+	assert.NilError(t, display.Print("a~c"))
+	snap := display.Snapshot()
+	assert.Equal(t, snap.Digits[1], byte(0x77))
+	assert.Equal(t, snap.Digits[2], byte(DefaultFallback))
+	assert.Equal(t, snap.Digits[3], byte(0x58))
+
+	// nor do the letters one digit cannot draw
+	assert.NilError(t, display.Print("MW"))
+	snap = display.Snapshot()
+	assert.Equal(t, snap.Digits[2], byte(DefaultFallback))
+	assert.Equal(t, snap.Digits[3], byte(DefaultFallback))
+
+	glyphs := DefaultGlyphs()
+	glyphs.SetFallback(0x00)
+	display.SetGlyphs(glyphs)
+	assert.NilError(t, display.Print("~"))
+	assert.Equal(t, display.Snapshot().Digits[3], byte(0x00))
+}
+
+func TestLoadGlyphs(t *testing.T) {
+	f, err := ioutil.TempFile("", "glyphs")
+	assert.NilError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`{ "~": "0x01", "deg": 99, "oC": "0x39" }`)
+	f.Close()
+
+	glyphs, err := LoadGlyphs(f.Name(), DefaultGlyphs())
+	assert.NilError(t, err)
+
+	display := setup(t)
+	display.SetGlyphs(glyphs)
+
+	// ligatures take one digit, longest match first
+	assert.NilError(t, display.Print("21deg"))
+	snap := display.Snapshot()
+	assert.Equal(t, snap.Digits[1], byte(0x5B))
+	assert.Equal(t, snap.Digits[2], byte(0x06))
+	assert.Equal(t, snap.Digits[3], byte(0x63))
+
+	// the inverted table is built from the loaded one
+	display.SetInverted(true)
+	assert.NilError(t, display.Print("~"))
+	assert.Equal(t, display.Snapshot().Digits[0], invertMask(0x01))
+
+	// bad masks are reported with the glyph
+	f2, err := ioutil.TempFile("", "glyphs")
+	assert.NilError(t, err)
+	defer os.Remove(f2.Name())
+	f2.WriteString(`{ "~": 300 }`)
+	f2.Close()
+	_, err = LoadGlyphs(f2.Name(), DefaultGlyphs())
+	assert.ErrorContains(t, err, `glyph "~"`)
+}
+
+func TestSnapshotInverted(t *testing.T) {
+	display := setup(t)
+
+	// another goroutine can take a snapshot while it flips (go test -race)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			display.Snapshot()
+		}
+		done <- true
+	}()
+	for i := 0; i < 100; i++ {
+		display.SetInverted(i%2 == 0)
+	}
+	<-done
+	assert.Equal(t, display.Snapshot().Inverted, false)
+}
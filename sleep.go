@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// the sleep timer choices, each hold of the double button moves to the
+// next one and after the last it is off
+var sleepTimes = []time.Duration{15 * time.Minute, 30 * time.Minute, time.Hour}
+
+// hold the double button this long to start (or change) the sleep timer,
+// a click still shows the next alarm
+const dSleepHold time.Duration = time.Second
+
+// how long the choice stays on the display
+const dSleepShow time.Duration = 2 * time.Second
+
+// the longest the API can ask for
+const dSleepMax time.Duration = 12 * time.Hour
+
+// sleepStatus - the sleep timer, for the API
+type sleepStatus struct {
+	Active  bool      `json:"active"`
+	Minutes int       `json:"minutes"`
+	Ends    time.Time `json:"ends"` // zero when off
+	Tracks  int       `json:"tracks"`
+}
+
+// sleepEffect - set the sleep timer to d, 0 turns it off
+func sleepEffect(d time.Duration) displayEffect {
+	return displayEffect{id: eSleep, val: d}
+}
+
+// sleepTracks - the "sleepTrack" playlist or directory, or the track it
+// names, and the whole library shuffled when it is not set
+func sleepTracks(rt runtimeConfig) []string {
+	name := rt.settings.GetString(sSleepTrack)
+	tracks, err := loadPlaylist(rt, name)
+	if err == nil {
+		if name == "" || rt.settings.GetString(sPlayOrder) == orderShuffle {
+			tracks = shuffleTracks(rt, tracks)
+		}
+		return tracks
+	}
+	if track, ok := findTrack(rt, name); ok {
+		return []string{track}
+	}
+	rt.logger.Printf("Error: %s", err.Error())
+	return nil
+}
+
+// sleepTimer plays something to fall asleep to and fades it out at the
+// end, run by the effects thread which calls step every loop
+type sleepTimer struct {
+	stop   chan bool // nil when off
+	done   chan bool
+	d      time.Duration
+	ends   time.Time
+	tracks int
+	fade   *volumeRamp // set once the fade starts
+}
+
+// next is the choice after the current one, 0 is off
+func (st *sleepTimer) next() time.Duration {
+	if st.stop == nil {
+		return sleepTimes[0]
+	}
+	for i, d := range sleepTimes {
+		if d == st.d && i+1 < len(sleepTimes) {
+			return sleepTimes[i+1]
+		}
+	}
+	return 0
+}
+
+// sleepShow - what the display shows for a choice, "SL15" or "oFF"
+func sleepShow(d time.Duration) string {
+	if d <= 0 {
+		return "oFF"
+	}
+	return fmt.Sprintf("SL%2d", int(d.Minutes()))
+}
+
+// set starts the timer, or changes how long is left when it is already
+// playing, 0 stops it
+func (st *sleepTimer) set(rt runtimeConfig, d time.Duration) {
+	if d <= 0 {
+		st.cancel(rt)
+		return
+	}
+	st.d = d
+	st.ends = rt.clock.Now().Add(d)
+	st.fade = nil
+	rt.logger.Printf("Sleep timer %v, until %s", d, st.ends.Format("15:04"))
+	setVolumeLevel(rt, rt.settings.GetInt(sSleepVolume))
+	if st.stop == nil {
+		tracks := sleepTracks(rt)
+		st.tracks = len(tracks)
+		st.stop = make(chan bool, 1)
+		st.done = make(chan bool, 1)
+		rt.sounds.playTracks(rt, tracks, playOptions{duration: dSleepMax}, st.stop, st.done)
+	}
+	st.report(rt)
+}
+
+// step fades the volume out over the last "sleepFade" and stops at the
+// end.  a software volume only changes when the next track starts, the
+// fade needs the amixer to be smooth.
+func (st *sleepTimer) step(rt runtimeConfig) {
+	if st.stop == nil {
+		return
+	}
+	select {
+	case <-st.done:
+		rt.logger.Println("Sleep tracks ended")
+		st.stop = nil
+		st.off(rt)
+		return
+	default:
+	}
+	now := rt.clock.Now()
+	if !now.Before(st.ends) {
+		rt.logger.Println("Sleep timer is up")
+		st.cancel(rt)
+		return
+	}
+	if left := st.ends.Sub(now); st.fade == nil && left <= rt.settings.GetDuration(sSleepFade) {
+		level := rt.status.getVolume()
+		rt.logger.Printf("Sleep fade %d -> 0 over %v", level, left)
+		st.fade = &volumeRamp{from: level, to: 0, start: now, d: left, level: level}
+	}
+	if st.fade != nil {
+		st.fade.step(rt)
+	}
+}
+
+// cancel stops the music, an alarm's countdown does this too
+func (st *sleepTimer) cancel(rt runtimeConfig) {
+	if st.stop == nil {
+		return
+	}
+	rt.logger.Println("Sleep timer off")
+	st.stop <- true
+	st.stop = nil
+	st.off(rt)
+}
+
+// off puts the volume back for the alarms
+func (st *sleepTimer) off(rt runtimeConfig) {
+	st.fade = nil
+	setVolumeLevel(rt, rt.settings.GetInt(sVolume))
+	st.report(rt)
+}
+
+func (st *sleepTimer) report(rt runtimeConfig) {
+	if st.stop == nil {
+		rt.status.setSleep(sleepStatus{})
+		return
+	}
+	rt.status.setSleep(sleepStatus{Active: true, Minutes: int(st.d.Minutes()), Ends: st.ends, Tracks: st.tracks})
+}
+
+func (m *APIHandler) apiSleep(w http.ResponseWriter, r *http.Request) {
+	output, _ := json.Marshal(m.rt.status.getSleep())
+	w.Write(output)
+}
+
+// apiSetSleep takes {"minutes": n}, 0 turns the timer off
+func (m *APIHandler) apiSetSleep(w http.ResponseWriter, r *http.Request) {
+	var req map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	minutes, err := toInt(req["minutes"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d := time.Duration(minutes) * time.Minute
+	if d < 0 || d > dSleepMax {
+		http.Error(w, fmt.Sprintf("Minutes must be 0 - %d: %d", int(dSleepMax.Minutes()), minutes), http.StatusBadRequest)
+		return
+	}
+	m.rt.comms.effects <- sleepEffect(d)
+
+	status := sleepStatus{}
+	if d > 0 {
+		status = sleepStatus{Active: true, Minutes: minutes, Ends: m.rt.clock.Now().Add(d)}
+	}
+	output, _ := json.Marshal(status)
+	w.Write(output)
+}
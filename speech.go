@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// text to speech backends, the "tts" setting
+const (
+	ttsNone    = ""
+	ttsEspeak  = "espeak-ng"
+	ttsPico    = "pico2wave"
+	ttsCommand = "command"
+)
+
+// replaced by what to say in a tts command template
+const ttsTextArg = "{text}"
+
+// the templates for the named speakers, one with {file} writes a WAV that
+// is then played like the tones
+var ttsSpeakers = map[string]string{
+	ttsEspeak: "espeak-ng {text}",
+	ttsPico:   "pico2wave -w {file} {text}",
+}
+
+// hold the main button this long (and let go before dProfileHold) to hear
+// the time and the next alarm
+const dAnnounceHold time.Duration = 2 * time.Second
+
+// noSpeaker is tts turned off
+type noSpeaker struct{}
+
+func (ns *noSpeaker) speak(rt runtimeConfig, text string) error {
+	rt.logger.Printf("Not saying '%s', %s is not set", text, sTTS)
+	return nil
+}
+
+// commandSpeaker runs an external tts, args is the template split on
+// spaces.  the text is one argument however many words it has.
+type commandSpeaker struct {
+	args []string
+}
+
+func newSpeaker(settings configSettings) (speaker, error) {
+	name := settings.GetString(sTTS)
+	template := ttsSpeakers[name]
+	switch name {
+	case ttsNone:
+		return &noSpeaker{}, nil
+	case ttsEspeak, ttsPico:
+	case ttsCommand:
+		template = settings.GetString(sTTSCommand)
+	default:
+		return nil, fmt.Errorf("Unknown tts: %s", name)
+	}
+	args := strings.Fields(template)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Empty tts command")
+	}
+	if !strings.Contains(template, ttsTextArg) {
+		args = append(args, ttsTextArg)
+	}
+	return &commandSpeaker{args: args}, nil
+}
+
+func (cs *commandSpeaker) writesFile() bool {
+	for _, arg := range cs.args {
+		if strings.Contains(arg, audioFileArg) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cs *commandSpeaker) speak(rt runtimeConfig, text string) error {
+	fName := ""
+	if cs.writesFile() {
+		fName = filepath.Join(os.TempDir(), "piclock-speech.wav")
+		defer os.Remove(fName)
+	}
+	args := (&commandBackend{args: cs.args}).command(fName, map[string]string{ttsTextArg: text})
+	rt.logger.Printf("Saying '%s'", text)
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s %s", args[0], err.Error(), strings.TrimSpace(string(out)))
+	}
+	if fName == "" {
+		return nil
+	}
+
+	backend, err := wavAudioBackend(rt.settings)
+	if err != nil {
+		return err
+	}
+	proc, err := backend.start(rt, fName)
+	if err != nil {
+		return err
+	}
+	return proc.wait()
+}
+
+// spokenTime - "7:05 AM", with the day when it is not today
+func spokenTime(now time.Time, when time.Time) string {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	day := time.Date(when.Year(), when.Month(), when.Day(), 0, 0, 0, 0, now.Location())
+	switch days := int(math.Round(day.Sub(today).Hours() / 24)); {
+	case days == 0:
+		return when.Format("3:04 PM")
+	case days == 1:
+		return when.Format("3:04 PM tomorrow")
+	case days > 1 && days < 7:
+		return when.Format("3:04 PM Monday")
+	default:
+		return when.Format("3:04 PM, January 2")
+	}
+}
+
+func timeAnnouncement(rt runtimeConfig) string {
+	return fmt.Sprintf("It's %s.", rt.clock.Now().Format("3:04 PM"))
+}
+
+func nextAlarmAnnouncement(rt runtimeConfig) string {
+	next := rt.status.getNextAlarm()
+	if next == nil {
+		return "No alarms."
+	}
+	return fmt.Sprintf("Next alarm, %s, at %s.", next.Name, spokenTime(rt.clock.Now(), next.When))
+}
+
+// alarmAnnouncement is said as the alarm goes off
+func alarmAnnouncement(rt runtimeConfig, alm *alarm) string {
+	return fmt.Sprintf("%s %s.", timeAnnouncement(rt), strings.TrimRight(alm.Name, ".!?"))
+}
+
+// announceEffect - have the effects thread say text, it queues behind
+// anything already being said
+func announceEffect(text string) displayEffect {
+	return displayEffect{id: eAnnounce, val: text}
+}
+
+// announcer says one thing at a time for the effects thread, pausing the
+// audio while it talks.  the effects thread calls step every loop.
+type announcer struct {
+	pending  []string
+	speaking chan bool // nil when quiet
+}
+
+func (an *announcer) add(text string) {
+	an.pending = append(an.pending, text)
+}
+
+func (an *announcer) step(rt runtimeConfig) {
+	if an.speaking != nil {
+		select {
+		case <-an.speaking:
+			an.speaking = nil
+		default:
+			return
+		}
+	}
+	if len(an.pending) == 0 {
+		if rt.status.isPaused() {
+			rt.status.pausePlaying(false)
+		}
+		return
+	}
+
+	text := an.pending[0]
+	an.pending = an.pending[1:]
+	rt.status.pausePlaying(true)
+	an.speaking = make(chan bool, 1)
+	go func(speaking chan bool) {
+		if err := rt.speaker.speak(rt, text); err != nil {
+			reportAudio(rt, err)
+		}
+		speaking <- true
+	}(an.speaking)
+}
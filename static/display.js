@@ -0,0 +1,89 @@
+// renders a replica of the 4 digit 7-segment display from /api/display
+
+// segment bit -> polygon points, bits match the LED_* constants in sevenseg_backpack
+var segmentShapes = [
+  "10,0 60,0 52,8 18,8",       // 0 top
+  "62,2 62,62 54,56 54,10",    // 1 top right
+  "62,68 62,128 54,120 54,74", // 2 bottom right
+  "10,130 60,130 52,122 18,122", // 3 bottom
+  "8,68 16,74 16,120 8,128",   // 4 bottom left
+  "8,2 16,10 16,56 8,62",      // 5 top left
+  "12,65 20,60 50,60 58,65 50,70 20,70", // 6 middle
+];
+
+// x offset of each digit, the colon sits between 1 and 2
+var digitOffsets = [10, 100, 230, 320];
+
+var buildDisplay = function() {
+  var svg = $("#segments")[0];
+  var ns = "http://www.w3.org/2000/svg";
+
+  for (var d = 0; d < 4; d++) {
+    var g = document.createElementNS(ns, "g");
+    g.setAttribute("transform", "translate(" + digitOffsets[d] + ",15)");
+    for (var s = 0; s < segmentShapes.length; s++) {
+      var p = document.createElementNS(ns, "polygon");
+      p.setAttribute("points", segmentShapes[s]);
+      p.setAttribute("class", "seg");
+      p.setAttribute("id", "d" + d + "s" + s);
+      g.appendChild(p);
+    }
+    // decimal point
+    var dp = document.createElementNS(ns, "circle");
+    dp.setAttribute("cx", 72);
+    dp.setAttribute("cy", 126);
+    dp.setAttribute("r", 5);
+    dp.setAttribute("class", "seg");
+    dp.setAttribute("id", "d" + d + "s7");
+    g.appendChild(dp);
+    svg.appendChild(g);
+  }
+
+  var colon = [50, 110];
+  for (var c = 0; c < colon.length; c++) {
+    var dot = document.createElementNS(ns, "circle");
+    dot.setAttribute("cx", 200);
+    dot.setAttribute("cy", colon[c]);
+    dot.setAttribute("r", 6);
+    dot.setAttribute("class", "seg colon");
+    svg.appendChild(dot);
+  }
+}
+
+var setOn = function(el, on) {
+  el.setAttribute("class", el.getAttribute("class").replace(/ on$/, "") + (on ? " on" : ""));
+}
+
+var renderDisplay = function(state) {
+  for (var d = 0; d < 4; d++) {
+    for (var s = 0; s < 8; s++) {
+      setOn($("#d" + d + "s" + s)[0], (state.digits[d] & (1 << s)) != 0);
+    }
+  }
+  $(".colon").each(function() { setOn(this, state.colon); });
+
+  var svg = $("#segments");
+  svg.css("opacity", state.on ? 0.25 + 0.75 * state.brightness / 15 : 0);
+  svg.css("transform", state.inverted ? "rotate(180deg)" : "");
+  svg.removeClass("blink1 blink2 blink3");
+  if (state.blink > 0) {
+    svg.addClass("blink" + state.blink);
+  }
+
+  $("#alarmLed").toggleClass("on", state.alarmLed);
+  $("#errorLed").toggleClass("on", state.errorLed);
+  $("#info")[0].textContent = "brightness " + state.brightness + ", blink " + state.blink;
+}
+
+var initDisplay = function() {
+  buildDisplay();
+
+  var source = new EventSource("/api/display");
+  source.onmessage = function(e) {
+    renderDisplay(JSON.parse(e.data));
+  };
+  source.onerror = function(e) {
+    console.log(e);
+    $("#info")[0].textContent = "disconnected, retrying...";
+  };
+}
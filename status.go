@@ -0,0 +1,299 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// clockStatus is state that one thread owns and other threads
+// (effects, config service) only read.  runtimeConfig is copied
+// by value into each thread, so it is carried around as a pointer.
+type clockStatus struct {
+	mutex     sync.Mutex
+	nextAlarm *alarm
+	leds      map[int]bool
+	audioErr  string // last audio backend failure, "" when it is working
+	health    audioHealth
+	sleep     sleepStatus
+	reload    reloadStatus
+	profile   profileStatus
+	pull      pullStatus
+	volume    int // level in effect, changes during a ramp
+	volTarget int // where the volume is headed
+	downloads downloadStatus
+	playing   map[audioProcess]bool // what is making noise right now
+	paused    bool                  // hold anything that starts
+	accounts  map[string]string     // calendar accounts that failed the last fetch
+}
+
+func newClockStatus() *clockStatus {
+	return &clockStatus{leds: make(map[int]bool), downloads: newDownloadStatus(), playing: make(map[audioProcess]bool)}
+}
+
+func (cs *clockStatus) setNextAlarm(alm *alarm) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if alm == nil {
+		cs.nextAlarm = nil
+		return
+	}
+	// keep a copy, the caller's alarm list changes underneath us
+	next := *alm
+	cs.nextAlarm = &next
+}
+
+func (cs *clockStatus) getNextAlarm() *alarm {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if cs.nextAlarm == nil {
+		return nil
+	}
+	next := *cs.nextAlarm
+	return &next
+}
+
+func (cs *clockStatus) setLED(pin int, on bool) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.leds[pin] = on
+}
+
+func (cs *clockStatus) getLED(pin int) bool {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	return cs.leds[pin]
+}
+
+func (cs *clockStatus) setAudioError(err string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.audioErr = err
+}
+
+func (cs *clockStatus) getAudioError() string {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	return cs.audioErr
+}
+
+func (cs *clockStatus) setAudioHealth(health audioHealth) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.health = health
+}
+
+func (cs *clockStatus) getAudioHealth() audioHealth {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	health := cs.health
+	health.Problems = append([]string{}, health.Problems...)
+	return health
+}
+
+func (cs *clockStatus) setSleep(sleep sleepStatus) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.sleep = sleep
+}
+
+func (cs *clockStatus) getSleep() sleepStatus {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	return cs.sleep
+}
+
+func (cs *clockStatus) setReload(reload reloadStatus) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.reload = reload
+}
+
+func (cs *clockStatus) getReload() reloadStatus {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	return cs.reload
+}
+
+func (cs *clockStatus) setPull(pull pullStatus) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.pull = pull
+}
+
+func (cs *clockStatus) getPull() pullStatus {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	pull := cs.pull
+	pull.ETags = map[string]string{}
+	for k, v := range cs.pull.ETags {
+		pull.ETags[k] = v
+	}
+	pull.Versions = map[string]int64{}
+	for k, v := range cs.pull.Versions {
+		pull.Versions[k] = v
+	}
+	return pull
+}
+
+func (cs *clockStatus) setProfile(profile profileStatus) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.profile = profile
+}
+
+func (cs *clockStatus) getProfile() profileStatus {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	profile := cs.profile
+	profile.Profiles = append([]string{}, profile.Profiles...)
+	return profile
+}
+
+func (cs *clockStatus) setAccountErrors(failed map[string]string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.accounts = failed
+}
+
+func (cs *clockStatus) getAccountErrors() map[string]string {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	failed := map[string]string{}
+	for name, err := range cs.accounts {
+		failed[name] = err
+	}
+	return failed
+}
+
+func (cs *clockStatus) setVolume(level int) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.volume = level
+}
+
+func (cs *clockStatus) getVolume() int {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	return cs.volume
+}
+
+func (cs *clockStatus) setVolumeTarget(level int) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.volTarget = level
+}
+
+func (cs *clockStatus) getVolumeTarget() int {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	return cs.volTarget
+}
+
+// beginDownloads resets the download status for a new run, false if
+// one is already running
+func (cs *clockStatus) beginDownloads(now time.Time) bool {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if cs.downloads.State == downloadRunning {
+		return false
+	}
+	cs.downloads = newDownloadStatus()
+	cs.downloads.State = downloadRunning
+	cs.downloads.Started = now
+	return true
+}
+
+func (cs *clockStatus) updateDownloads(update func(ds *downloadStatus)) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	update(&cs.downloads)
+}
+
+func (cs *clockStatus) getDownloads() downloadStatus {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	ds := cs.downloads
+	ds.Failed = append([]string{}, ds.Failed...)
+	ds.Pruned = append([]string{}, ds.Pruned...)
+	return ds
+}
+
+// startPlaying registers proc so an announcement can pause it, it starts
+// out paused when one is going on
+func (cs *clockStatus) startPlaying(proc audioProcess) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.playing[proc] = true
+	if cs.paused {
+		proc.pause()
+	}
+}
+
+func (cs *clockStatus) stopPlaying(proc audioProcess) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	delete(cs.playing, proc)
+}
+
+// pausePlaying holds (or releases) everything playing and anything that
+// starts until it is released
+func (cs *clockStatus) pausePlaying(pause bool) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if cs.paused == pause {
+		return
+	}
+	cs.paused = pause
+	for proc := range cs.playing {
+		if pause {
+			proc.pause()
+		} else {
+			proc.resume()
+		}
+	}
+}
+
+// gainPlaying passes a software volume change to everything playing
+func (cs *clockStatus) gainPlaying(gain float64) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	for proc := range cs.playing {
+		proc.setGain(gain)
+	}
+}
+
+func (cs *clockStatus) isPaused() bool {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	return cs.paused
+}
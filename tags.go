@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// trackTags - what we care about from ID3 and Vorbis comments
+type trackTags struct {
+	title    string
+	artist   string
+	album    string
+	duration time.Duration
+}
+
+// tags live at the ends of the file, we only read this much of each
+const tagHeadSize = 256 * 1024
+const tagTailSize = 64 * 1024
+
+// readTags reads the tags of an mp3, ogg (vorbis and opus), flac or wav
+// file, anything else has no tags and that is not an error
+func readTags(fName string) (trackTags, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return trackTags{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return trackTags{}, err
+	}
+	size := info.Size()
+
+	head := make([]byte, tagHeadSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return trackTags{}, err
+	}
+	head = head[:n]
+
+	tail := head
+	if size > int64(len(head)) {
+		tailSize := int64(tagTailSize)
+		if size < tailSize {
+			tailSize = size
+		}
+		tail = make([]byte, tailSize)
+		if _, err := f.ReadAt(tail, size-tailSize); err != nil && err != io.EOF {
+			return trackTags{}, err
+		}
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("ID3")) || isMPEGFrame(head):
+		return mp3Tags(head, tail, size), nil
+	case bytes.HasPrefix(head, []byte("OggS")):
+		return oggTags(head, tail)
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return flacTags(head)
+	case bytes.HasPrefix(head, []byte("RIFF")):
+		wav, err := readWav(fName)
+		if err != nil {
+			return trackTags{}, err
+		}
+		return trackTags{duration: wav.format.duration(len(wav.pcm))}, nil
+	}
+	return trackTags{}, nil
+}
+
+// ID3v2 sizes are 7 bits a byte
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// sizeWithin - a 32 bit size from a tag as an int, false when it is more
+// than the room left.  an int is 32 bits on the Pi, a size of 2GB or more
+// would turn negative if it was converted first.
+func sizeWithin(size uint32, room int) (int, bool) {
+	if room < 0 || uint64(size) > uint64(room) {
+		return 0, false
+	}
+	return int(size), true
+}
+
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+func trimTag(s string) string {
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+// id3Text decodes a text frame, the first byte is the encoding
+func id3Text(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	enc, text := b[0], b[1:]
+	switch enc {
+	case 1, 2:
+		var order binary.ByteOrder = binary.BigEndian
+		if enc == 1 && len(text) >= 2 {
+			if text[0] == 0xff && text[1] == 0xfe {
+				order = binary.LittleEndian
+			}
+			text = text[2:]
+		}
+		units := make([]uint16, 0, len(text)/2)
+		for i := 0; i+1 < len(text); i += 2 {
+			units = append(units, order.Uint16(text[i:]))
+		}
+		return trimTag(string(utf16.Decode(units)))
+	case 3:
+		return trimTag(string(text))
+	default:
+		return trimTag(latin1(text))
+	}
+}
+
+// id3v2 reads an ID3v2.2/3/4 tag, returning the tags and where the audio
+// starts
+func id3v2(head []byte) (trackTags, int) {
+	tags := trackTags{}
+	if len(head) < 10 || !bytes.HasPrefix(head, []byte("ID3")) {
+		return tags, 0
+	}
+	version := head[3]
+	end := 10 + syncsafe(head[6:10])
+	if end > len(head) {
+		end = len(head)
+	}
+	pos := 10
+	if head[5]&0x40 != 0 && version >= 3 && pos+4 <= end {
+		// skip the extended header
+		if version == 3 {
+			skip, ok := sizeWithin(binary.BigEndian.Uint32(head[pos:]), end-pos-4)
+			if !ok {
+				return tags, 10 + syncsafe(head[6:10])
+			}
+			pos += 4 + skip
+		} else {
+			pos += syncsafe(head[pos:])
+		}
+	}
+
+	idSize, headerSize := 4, 10
+	if version == 2 {
+		idSize, headerSize = 3, 6
+	}
+	for pos+headerSize <= end {
+		id := string(head[pos : pos+idSize])
+		if id[0] == 0 {
+			// padding
+			break
+		}
+		var frameSize uint32
+		switch version {
+		case 2:
+			frameSize = uint32(head[pos+3])<<16 | uint32(head[pos+4])<<8 | uint32(head[pos+5])
+		case 3:
+			frameSize = binary.BigEndian.Uint32(head[pos+4:])
+		default:
+			frameSize = uint32(syncsafe(head[pos+4:]))
+		}
+		body := pos + headerSize
+		size, ok := sizeWithin(frameSize, end-body)
+		if !ok {
+			break
+		}
+		text := head[body : body+size]
+		switch id {
+		case "TIT2", "TT2":
+			tags.title = id3Text(text)
+		case "TPE1", "TP1":
+			tags.artist = id3Text(text)
+		case "TALB", "TAL":
+			tags.album = id3Text(text)
+		case "TLEN", "TLE":
+			if ms, err := strconv.Atoi(id3Text(text)); err == nil {
+				tags.duration = time.Duration(ms) * time.Millisecond
+			}
+		}
+		pos = body + size
+	}
+	return tags, 10 + syncsafe(head[6:10])
+}
+
+// id3v1 is the last 128 bytes of the file
+func id3v1(tail []byte) (trackTags, bool) {
+	if len(tail) < 128 {
+		return trackTags{}, false
+	}
+	tag := tail[len(tail)-128:]
+	if !bytes.HasPrefix(tag, []byte("TAG")) {
+		return trackTags{}, false
+	}
+	return trackTags{
+		title:  trimTag(latin1(tag[3:33])),
+		artist: trimTag(latin1(tag[33:63])),
+		album:  trimTag(latin1(tag[63:93])),
+	}, true
+}
+
+// kbps by [MPEG 1 or 2][bitrate index], layer III
+var mpegBitrates = [2][16]int{
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+}
+
+func isMPEGFrame(b []byte) bool {
+	return len(b) >= 4 && b[0] == 0xff && b[1]&0xe0 == 0xe0 && mpegBitrate(b) > 0
+}
+
+// mpegBitrate of a layer III frame header in bits per second, 0 if it
+// is not one
+func mpegBitrate(b []byte) int {
+	version := (b[1] >> 3) & 0x03
+	layer := (b[1] >> 1) & 0x03
+	if version == 1 || layer != 1 {
+		return 0
+	}
+	table := 1
+	if version == 3 {
+		table = 0
+	}
+	return mpegBitrates[table][b[2]>>4] * 1000
+}
+
+// mp3Tags prefers ID3v2 to ID3v1, without a TLEN the duration is
+// estimated from the first frame's bitrate
+func mp3Tags(head []byte, tail []byte, size int64) trackTags {
+	tags, start := id3v2(head)
+	v1, hasV1 := id3v1(tail)
+	if tags.title == "" {
+		tags.title = v1.title
+	}
+	if tags.artist == "" {
+		tags.artist = v1.artist
+	}
+	if tags.album == "" {
+		tags.album = v1.album
+	}
+	if tags.duration > 0 {
+		return tags
+	}
+	audio := size - int64(start)
+	if hasV1 {
+		audio -= 128
+	}
+	for pos := start; pos+4 <= len(head); pos++ {
+		if !isMPEGFrame(head[pos:]) {
+			continue
+		}
+		bitrate := int64(mpegBitrate(head[pos:]))
+		tags.duration = time.Duration(audio * 8 * int64(time.Second) / bitrate)
+		break
+	}
+	return tags
+}
+
+// vorbisComments reads a comment block (the Vorbis, Opus and FLAC one):
+// a vendor string then KEY=value pairs, lengths are little endian
+func vorbisComments(b []byte, tags *trackTags) error {
+	if len(b) < 4 {
+		return fmt.Errorf("Short comment header")
+	}
+	vendor, ok := sizeWithin(binary.LittleEndian.Uint32(b), len(b)-8)
+	if !ok {
+		return fmt.Errorf("Short comment header")
+	}
+	pos := 4 + vendor
+	count := binary.LittleEndian.Uint32(b[pos:])
+	pos += 4
+	for i := uint32(0); i < count && pos+4 <= len(b); i++ {
+		size, ok := sizeWithin(binary.LittleEndian.Uint32(b[pos:]), len(b)-pos-4)
+		pos += 4
+		if !ok {
+			return fmt.Errorf("Short comment")
+		}
+		kv := strings.SplitN(string(b[pos:pos+size]), "=", 2)
+		pos += size
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.ToUpper(kv[0]) {
+		case "TITLE":
+			tags.title = strings.TrimSpace(kv[1])
+		case "ARTIST":
+			tags.artist = strings.TrimSpace(kv[1])
+		case "ALBUM":
+			tags.album = strings.TrimSpace(kv[1])
+		}
+	}
+	return nil
+}
+
+// oggPackets joins the pages in b into packets, stopping after max
+func oggPackets(b []byte, max int) [][]byte {
+	packets := make([][]byte, 0)
+	var packet []byte
+	pos := 0
+	for pos+27 <= len(b) && len(packets) < max && bytes.Equal(b[pos:pos+4], []byte("OggS")) {
+		segments := int(b[pos+26])
+		if pos+27+segments > len(b) {
+			break
+		}
+		table := b[pos+27 : pos+27+segments]
+		body := pos + 27 + segments
+		for _, lacing := range table {
+			if body+int(lacing) > len(b) {
+				return packets
+			}
+			packet = append(packet, b[body:body+int(lacing)]...)
+			body += int(lacing)
+			// a lacing value under 255 ends the packet
+			if lacing < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+		pos = body
+	}
+	return packets
+}
+
+// oggGranule is the granule position of the last page in tail
+func oggGranule(tail []byte) int64 {
+	last := bytes.LastIndex(tail, []byte("OggS"))
+	if last < 0 || last+14 > len(tail) {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(tail[last+6:]))
+}
+
+func oggTags(head []byte, tail []byte) (trackTags, error) {
+	tags := trackTags{}
+	packets := oggPackets(head, 2)
+	if len(packets) < 2 {
+		return tags, fmt.Errorf("Short ogg stream")
+	}
+	var rate int64
+	var err error
+	id, comments := packets[0], packets[1]
+	switch {
+	case bytes.HasPrefix(id, []byte("\x01vorbis")) && len(id) >= 16 && bytes.HasPrefix(comments, []byte("\x03vorbis")):
+		rate = int64(binary.LittleEndian.Uint32(id[12:]))
+		err = vorbisComments(comments[7:], &tags)
+	case bytes.HasPrefix(id, []byte("OpusHead")) && bytes.HasPrefix(comments, []byte("OpusTags")):
+		// opus granules are always 48kHz
+		rate = 48000
+		err = vorbisComments(comments[8:], &tags)
+	default:
+		return tags, fmt.Errorf("Unknown ogg stream")
+	}
+	if rate > 0 {
+		tags.duration = time.Duration(oggGranule(tail) * int64(time.Second) / rate)
+	}
+	return tags, err
+}
+
+// flacTags reads the STREAMINFO and VORBIS_COMMENT metadata blocks
+func flacTags(head []byte) (trackTags, error) {
+	tags := trackTags{}
+	pos := 4
+	for pos+4 <= len(head) {
+		last := head[pos]&0x80 != 0
+		kind := head[pos] & 0x7f
+		size := int(head[pos+1])<<16 | int(head[pos+2])<<8 | int(head[pos+3])
+		body := pos + 4
+		if body+size > len(head) {
+			break
+		}
+		block := head[body : body+size]
+		switch kind {
+		case 0:
+			if len(block) >= 18 {
+				rate := int64(block[10])<<12 | int64(block[11])<<4 | int64(block[12])>>4
+				samples := int64(block[13]&0x0f)<<32 | int64(binary.BigEndian.Uint32(block[14:]))
+				if rate > 0 {
+					tags.duration = time.Duration(samples * int64(time.Second) / rate)
+				}
+			}
+		case 4:
+			if err := vorbisComments(block, &tags); err != nil {
+				return tags, err
+			}
+		}
+		if last {
+			break
+		}
+		pos = body + size
+	}
+	return tags, nil
+}
@@ -0,0 +1,3 @@
+#!/bin/sh
+# stands in for ffmpeg: whatever the file, it decodes to the beep
+cat "$(dirname "$0")/beep.wav"
@@ -0,0 +1,3 @@
+#!/bin/sh
+# a stand-in for pico2wave: say.sh <wav> <text>
+cp "$(dirname "$0")/../audio/beep.wav" "$1"
@@ -78,7 +78,7 @@ func (te *testEvents) fetch(rt runtimeConfig) (*calendar.Events, error) {
 	return &events, nil
 }
 
-func (te *testEvents) getCalendarService(rt runtimeConfig, prompt bool) (*calendar.Service, error) {
+func (te *testEvents) getCalendarService(rt runtimeConfig, account calendarAccount, prompt bool) (*calendar.Service, error) {
 	return nil, nil
 }
 
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -19,7 +20,7 @@ var testlog *os.File
 var cfgFile string = "./test/config.conf"
 
 func piTestMain(m *testing.M) {
-	testSettings = initSettings(cfgFile)
+	testSettings = initSettings(cfgFile, nil)
 	setupLogging(testSettings, false)
 
 	// run the tests
@@ -59,6 +60,29 @@ func testRuntime() (runtimeConfig, clockwork.FakeClock, commChannels) {
 	return rt, rt.clock.(clockwork.FakeClock), rt.comms
 }
 
+// testRuntimeWith - testRuntime with some settings overridden, the
+// shared testSettings are left alone
+func testRuntimeWith(overrides map[string]interface{}) (runtimeConfig, clockwork.FakeClock, commChannels) {
+	settings := configSettings{settings: make(map[string]interface{}), file: testSettings.file, sources: make(map[string]string), raw: make(map[string]interface{}), lock: &sync.RWMutex{}}
+	for k, v := range testSettings.settings {
+		settings.settings[k] = v
+	}
+	for k, v := range testSettings.sources {
+		settings.sources[k] = v
+	}
+	for k, v := range testSettings.raw {
+		settings.raw[k] = v
+	}
+	for k, v := range overrides {
+		settings.settings[k] = v
+	}
+
+	wg.Add(1)
+	logCaller("Starting ", 1)
+	rt := initTestRuntime(settings)
+	return rt, rt.clock.(clockwork.FakeClock), rt.comms
+}
+
 func almStateRead(t *testing.T, c chan almStateMsg) (almStateMsg, error) {
 	select {
 	case e := <-c:
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"time"
+)
+
+// waveforms for a toneStep
+const (
+	waveSquare = "square"
+	waveSine   = "sine"
+)
+
+// one note (or a gap when freq is 0) in a tone pattern
+type toneStep struct {
+	freq     float64 // Hz, 0 is silence
+	toFreq   float64 // glide to this by the end of the step, 0 -> no glide
+	duration time.Duration
+	wave     string
+	volume   float64       // 0 - 1
+	attack   time.Duration // ramp up at the start
+	release  time.Duration // ramp down at the end
+}
+
+type tonePattern struct {
+	name   string
+	steps  []toneStep
+	repeat int // times through the steps for one rendering
+}
+
+const sSteps string = "steps"
+const sRepeat string = "repeat"
+const sFreq string = "freq"
+const sToFreq string = "to"
+const sWave string = "wave"
+const sAttack string = "attack"
+const sRelease string = "release"
+
+// per-alarm option (see parseAlarmOptions) that picks a tone pattern
+const optTone string = "tone"
+
+// mono, 16 bit, plenty for beeps and small enough for the pi
+const toneSampleRate uint32 = 22050
+
+// a rendered pattern is repeated out to this so the replays last a while
+const dToneLoop time.Duration = 20 * time.Second
+
+const toneVolume float64 = 0.5
+
+// the built-ins, in the same format as the "tones" setting
+const builtinTones string = `[
+	{"name": "beep-beep", "steps": [
+		{"freq": 1000, "duration": "100ms", "wave": "square", "attack": "5ms", "release": "5ms"},
+		{"duration": "100ms"},
+		{"freq": 1000, "duration": "100ms", "wave": "square", "attack": "5ms", "release": "5ms"},
+		{"duration": "700ms"}
+	]},
+	{"name": "rising", "steps": [
+		{"freq": 440, "duration": "250ms", "attack": "10ms", "release": "20ms"},
+		{"freq": 554, "duration": "250ms", "attack": "10ms", "release": "20ms"},
+		{"freq": 659, "duration": "250ms", "attack": "10ms", "release": "20ms"},
+		{"freq": 880, "duration": "500ms", "attack": "10ms", "release": "100ms"},
+		{"duration": "500ms"}
+	]},
+	{"name": "siren", "steps": [
+		{"freq": 600, "to": 1200, "duration": "500ms"},
+		{"freq": 1200, "to": 600, "duration": "500ms"}
+	]}
+]`
+
+var tonePatterns = map[string]tonePattern{}
+
+func init() {
+	var data interface{}
+	if err := json.Unmarshal([]byte(builtinTones), &data); err != nil {
+		panic(err)
+	}
+	builtins, err := toTonePatterns(data)
+	if err != nil {
+		panic(err)
+	}
+	for _, pattern := range builtins {
+		tonePatterns[pattern.name] = pattern
+	}
+}
+
+func toFloat(val interface{}) (float64, error) {
+	switch v := val.(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	default:
+		return 0, fmt.Errorf("Bad type: %T", v)
+	}
+}
+
+func toToneStep(result interface{}) (toneStep, error) {
+	rt, ok := result.(map[string]interface{})
+	if !ok {
+		return toneStep{}, fmt.Errorf("Could not convert type %T (%v)", result, result)
+	}
+	step := toneStep{wave: waveSine, volume: toneVolume}
+	var err error
+	if step.duration, err = toDuration(rt[sDuration]); err != nil {
+		return step, fmt.Errorf("Tone step needs a duration: %v", rt)
+	}
+	if step.duration <= 0 {
+		return step, fmt.Errorf("Tone step duration must be positive: %v", step.duration)
+	}
+	for key, target := range map[string]*float64{sFreq: &step.freq, sToFreq: &step.toFreq, sVolume: &step.volume} {
+		if rt[key] == nil {
+			continue
+		}
+		if *target, err = toFloat(rt[key]); err != nil {
+			return step, err
+		}
+		if *target < 0 {
+			return step, fmt.Errorf("Tone step %s can not be negative: %v", key, *target)
+		}
+	}
+	if step.volume > 1 {
+		return step, fmt.Errorf("Tone step volume is 0 - 1: %v", step.volume)
+	}
+	for key, target := range map[string]*time.Duration{sAttack: &step.attack, sRelease: &step.release} {
+		if rt[key] == nil {
+			continue
+		}
+		if *target, err = toDuration(rt[key]); err != nil {
+			return step, err
+		}
+	}
+	if rt[sWave] != nil {
+		if step.wave, err = toString(rt[sWave]); err != nil {
+			return step, err
+		}
+		if step.wave != waveSine && step.wave != waveSquare {
+			return step, fmt.Errorf("Unknown wave: %s", step.wave)
+		}
+	}
+	return step, nil
+}
+
+func toTonePattern(result interface{}) (tonePattern, error) {
+	rt, ok := result.(map[string]interface{})
+	if !ok {
+		return tonePattern{}, fmt.Errorf("Could not convert type %T (%v)", result, result)
+	}
+	name, err := toString(rt[sName])
+	if err != nil {
+		return tonePattern{}, err
+	}
+	ret := tonePattern{name: name, repeat: 1}
+	if rt[sRepeat] != nil {
+		if ret.repeat, err = toInt(rt[sRepeat]); err != nil {
+			return ret, err
+		}
+		if ret.repeat < 1 {
+			return ret, fmt.Errorf("Tone pattern %s repeat must be at least 1", name)
+		}
+	}
+	steps, ok := rt[sSteps].([]interface{})
+	if !ok || len(steps) == 0 {
+		return ret, fmt.Errorf("Tone pattern %s has no steps", name)
+	}
+	ret.steps = make([]toneStep, len(steps))
+	for i := range steps {
+		if ret.steps[i], err = toToneStep(steps[i]); err != nil {
+			return ret, err
+		}
+	}
+	return ret, nil
+}
+
+func toTonePatterns(result interface{}) ([]tonePattern, error) {
+	switch rt := result.(type) {
+	case []tonePattern:
+		return rt, nil
+	case []interface{}:
+		patterns := make([]tonePattern, len(rt))
+		for i := range rt {
+			var err error
+			patterns[i], err = toTonePattern(rt[i])
+			if err != nil {
+				return patterns, err
+			}
+		}
+		return patterns, nil
+	default:
+		return nil, fmt.Errorf("Could not convert type %T (%v)", rt, rt)
+	}
+}
+
+// findTonePattern looks in the "tones" setting, then the built-ins
+func findTonePattern(rt runtimeConfig, name string) (tonePattern, bool) {
+	for _, pattern := range rt.settings.GetTonePatterns(sTones) {
+		if pattern.name == name {
+			return pattern, true
+		}
+	}
+	pattern, ok := tonePatterns[name]
+	return pattern, ok
+}
+
+// alarmTonePattern picks the tones for an alarm: the #tone option, then
+// "tone <name>", then the setting
+func alarmTonePattern(rt runtimeConfig, alm *alarm) tonePattern {
+	name := alm.option(optTone)
+	if name == "" && alm.Effect == almTones {
+		name = alm.Extra
+	}
+	if name == "" {
+		name = rt.settings.GetString(sTonePattern)
+	}
+	pattern, ok := findTonePattern(rt, name)
+	if !ok {
+		rt.logger.Printf("Unknown tone pattern: %s", name)
+		pattern = tonePatterns["beep-beep"]
+	}
+	return pattern
+}
+
+// the envelope is linear in and out
+func envelope(step toneStep, t time.Duration) float64 {
+	gain := 1.0
+	if step.attack > 0 && t < step.attack {
+		gain = float64(t) / float64(step.attack)
+	}
+	if left := step.duration - t; step.release > 0 && left < step.release {
+		gain = math.Min(gain, float64(left)/float64(step.release))
+	}
+	return gain
+}
+
+// renderTones turns the pattern into 16 bit mono PCM
+func renderTones(pattern tonePattern) *wavData {
+	format := wavFormat{channels: 1, sampleRate: toneSampleRate, bitsPerSample: 16}
+	pcm := make([]byte, 0)
+	sample := make([]byte, 2)
+	for r := 0; r < pattern.repeat; r++ {
+		for _, step := range pattern.steps {
+			count := format.bytesIn(step.duration) / format.frameSize()
+			phase := 0.0
+			for i := 0; i < count; i++ {
+				value := 0.0
+				if step.freq > 0 {
+					t := time.Duration(i) * time.Second / time.Duration(format.sampleRate)
+					freq := step.freq
+					if step.toFreq > 0 {
+						freq += (step.toFreq - step.freq) * float64(i) / float64(count)
+					}
+					phase += 2 * math.Pi * freq / float64(format.sampleRate)
+					value = math.Sin(phase)
+					if step.wave == waveSquare {
+						value = math.Copysign(1, value)
+					}
+					value *= step.volume * envelope(step, t)
+				}
+				binary.LittleEndian.PutUint16(sample, uint16(int16(value*math.MaxInt16)))
+				pcm = append(pcm, sample...)
+			}
+		}
+	}
+	return &wavData{format: format, pcm: pcm}
+}
+
+// renderToneLoop repeats the rendered pattern out to at least d
+func renderToneLoop(pattern tonePattern, d time.Duration) *wavData {
+	wav := renderTones(pattern)
+	once := wav.pcm
+	if len(once) == 0 {
+		return wav
+	}
+	for wav.format.duration(len(wav.pcm)) < d {
+		wav.pcm = append(wav.pcm, once...)
+	}
+	return wav
+}
+
+// playTonePattern renders the pattern to a WAV file and plays it like
+// any other file
+func playTonePattern(rt runtimeConfig, backend audioBackend, pattern tonePattern, stop chan bool, done chan bool) {
+	// the name comes from the settings, it stays out of the file name
+	f, err := ioutil.TempFile("", "piclock-tones-*.wav")
+	if err != nil {
+		reportAudio(rt, err)
+		done <- true
+		return
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(renderToneLoop(pattern, dToneLoop).encode())
+	f.Close()
+	if err != nil {
+		reportAudio(rt, err)
+		done <- true
+		return
+	}
+	rt.logger.Printf("Playing tones %s", pattern.name)
+	playAudio(rt, backend, f.Name(), true, stop, done)
+}
@@ -4,10 +4,15 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
+	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 
+	"dscheirer.com/piclock/sevenseg_backpack"
 	"github.com/jonboulle/clockwork"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
@@ -20,6 +25,7 @@ type commChannels struct {
 	leds      chan ledEffect
 	configSvc chan configSvcMsg
 	ntpVerify chan bool
+	profiles  chan profileMsg
 }
 
 type runtimeConfig struct {
@@ -27,6 +33,8 @@ type runtimeConfig struct {
 	comms         commChannels
 	clock         clockwork.Clock
 	sounds        sounds
+	speaker       speaker
+	mixer         mixer
 	buttons       buttons
 	display       display
 	led           led
@@ -34,6 +42,7 @@ type runtimeConfig struct {
 	configService configService
 	logger        flogger
 	ntpCheck      ntpcheck
+	status        *clockStatus
 	badTime       bool
 }
 
@@ -44,6 +53,7 @@ const dLEDSleep time.Duration = 10 * time.Millisecond
 const dRollingPrint time.Duration = 250 * time.Millisecond
 const dPrintDuration time.Duration = 3 * time.Second
 const dPrintBriefDuration time.Duration = 1 * time.Second
+const dPrintExpiry time.Duration = 1 * time.Minute
 const dCancelTimeout time.Duration = 5 * time.Second
 const dNTPCheckBadSleep time.Duration = 15 * time.Second
 const dNTPCheckSleep time.Duration = 5 * time.Minute
@@ -113,11 +123,17 @@ func toUInt8(val interface{}) (uint8, error) {
 	case uint8:
 		return v, nil
 	case float64:
+		if v < 0 || v > math.MaxUint8 || v != math.Trunc(v) {
+			return 0, fmt.Errorf("%v is not a byte", v)
+		}
 		return uint8(v), nil
 	case int:
+		if v < 0 || v > math.MaxUint8 {
+			return 0, fmt.Errorf("%v is not a byte", v)
+		}
 		return uint8(v), nil
 	case string:
-		ret, err := strconv.ParseInt(v, 0, 8)
+		ret, err := strconv.ParseUint(v, 0, 8)
 		return uint8(ret), err
 	default:
 		return 0, errors.New("failed to convert")
@@ -168,6 +184,81 @@ func toButtonMap(result interface{}) (buttonMap, error) {
 	}
 }
 
+func toTimeOfDay(val interface{}) (time.Duration, error) {
+	str, err := toString(val)
+	if err != nil {
+		return 0, err
+	}
+	t, err := time.Parse("15:04", str)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func toCarouselPage(result interface{}) (carouselPageConfig, error) {
+	rt, ok := result.(map[string]interface{})
+	if !ok {
+		return carouselPageConfig{}, fmt.Errorf("Could not convert type %T (%v)", result, result)
+	}
+	page, err := toString(rt[sPage])
+	if err != nil {
+		return carouselPageConfig{}, err
+	}
+	if _, ok := carouselPages[page]; !ok {
+		return carouselPageConfig{}, fmt.Errorf("Unknown carousel page: %s", page)
+	}
+	ret := carouselPageConfig{page: page, duration: dCarouselDuration, interval: dCarouselInterval}
+	// everything else is optional
+	if rt[sDuration] != nil {
+		if ret.duration, err = toDuration(rt[sDuration]); err != nil {
+			return ret, err
+		}
+	}
+	if rt[sInterval] != nil {
+		if ret.interval, err = toDuration(rt[sInterval]); err != nil {
+			return ret, err
+		}
+	}
+	if ret.duration <= 0 {
+		return ret, fmt.Errorf("Carousel duration must be positive: %v", ret.duration)
+	}
+	// the clock would never get a turn
+	if ret.interval <= ret.duration {
+		return ret, fmt.Errorf("Carousel interval must be longer than the duration: %v <= %v", ret.interval, ret.duration)
+	}
+	if rt[sFrom] != nil {
+		if ret.from, err = toTimeOfDay(rt[sFrom]); err != nil {
+			return ret, err
+		}
+	}
+	if rt[sUntil] != nil {
+		if ret.until, err = toTimeOfDay(rt[sUntil]); err != nil {
+			return ret, err
+		}
+	}
+	return ret, nil
+}
+
+func toCarouselPages(result interface{}) ([]carouselPageConfig, error) {
+	switch rt := result.(type) {
+	case []carouselPageConfig:
+		return rt, nil
+	case []interface{}:
+		pages := make([]carouselPageConfig, len(rt))
+		for i := range rt {
+			var err error
+			pages[i], err = toCarouselPage(rt[i])
+			if err != nil {
+				return pages, err
+			}
+		}
+		return pages, nil
+	default:
+		return nil, fmt.Errorf("Could not convert type %T (%v)", rt, rt)
+	}
+}
+
 func initCommChannels() commChannels {
 	quit := make(chan struct{}, 1)
 	alarmChannel := make(chan almStateMsg, 10)
@@ -176,6 +267,7 @@ func initCommChannels() commChannels {
 	leds := make(chan ledEffect, 100)
 	configSvc := make(chan configSvcMsg, 10)
 	ntp := make(chan bool, 10)
+	profiles := make(chan profileMsg, 10)
 
 	return commChannels{
 		quit:      quit,
@@ -185,6 +277,7 @@ func initCommChannels() commChannels {
 		leds:      leds,
 		configSvc: configSvc,
 		ntpVerify: ntp,
+		profiles:  profiles,
 	}
 }
 
@@ -221,11 +314,19 @@ func initRuntimeConfig(settings configSettings) runtimeConfig {
 		sounds = &noSounds{}
 	}
 
+	speaker, err := newSpeaker(settings)
+	if err != nil {
+		log.Printf("No speech: %s", err.Error())
+		speaker = &noSpeaker{}
+	}
+
 	return runtimeConfig{
 		settings:      settings,
 		comms:         initCommChannels(),
 		clock:         clockwork.NewRealClock(),
 		sounds:        sounds,
+		speaker:       speaker,
+		mixer:         newMixer(settings),
 		buttons:       buttons,
 		display:       display,
 		led:           led,
@@ -233,6 +334,7 @@ func initRuntimeConfig(settings configSettings) runtimeConfig {
 		configService: &httpConfigService{},
 		logger:        &ThreadLogger{name: "main"},
 		ntpCheck:      &ntpChecker{},
+		status:        newClockStatus(),
 		badTime:       false,
 	}
 }
@@ -244,6 +346,8 @@ func initTestRuntime(settings configSettings) runtimeConfig {
 		comms:         initCommChannels(),
 		clock:         clockwork.NewFakeClockAt(time.Date(2020, 01, 26, 0, 0, 0, 0, time.UTC)),
 		sounds:        &noSounds{},
+		speaker:       &logSpeaker{},
+		mixer:         &logMixer{},
 		buttons:       &noButtons{},
 		display:       &logDisplay{},
 		led:           &logLed{},
@@ -251,6 +355,7 @@ func initTestRuntime(settings configSettings) runtimeConfig {
 		configService: &testConfigService{},
 		logger:        &ThreadLogger{name: "test"},
 		ntpCheck:      &testNtpChecker{},
+		status:        newClockStatus(),
 		badTime:       false,
 	}
 }
@@ -270,6 +375,16 @@ func setupLogging(settings configSettings, append bool) {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds) // | log.Lshortfile)
 }
 
+// displayGlyphs builds the character table for the display from the settings
+func displayGlyphs(settings configSettings) (*sevenseg_backpack.Glyphs, error) {
+	glyphs := sevenseg_backpack.DefaultGlyphs()
+	glyphs.SetFallback(settings.GetByte(sGlyphFallback))
+	if settings.GetString(sGlyphFile) == "" {
+		return glyphs, nil
+	}
+	return sevenseg_backpack.LoadGlyphs(settings.GetString(sGlyphFile), glyphs)
+}
+
 func calcRolling(s string) time.Duration {
 	// the rolling effect pre and post pends 4 spaces, but
 	// it really just adds a total of 4 extra cycles
@@ -295,3 +410,29 @@ func (l *ThreadLogger) Print(v ...interface{}) {
 func (l *ThreadLogger) Println(v ...interface{}) {
 	log.Println(fmt.Sprintf("%-20s: %s", l.name, fmt.Sprint(v...)))
 }
+
+// writeFileAtomic writes to a temp file next to fName and renames it over
+// fName, so readers see the old file or the new one and never half of it
+func writeFileAtomic(fName string, data []byte) error {
+	return writeFileMode(fName, data, 0644)
+}
+
+// writeFileMode is writeFileAtomic for a file only some can read
+func writeFileMode(fName string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fName), "."+filepath.Base(fName)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fName)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// how the volume is set, the "volumeControl" setting
+const (
+	volumeAmixer   = "amixer"
+	volumeSoftware = "software"
+)
+
+// per-alarm options (see parseAlarmOptions) for the volume
+const optVolume string = "volume"
+const optRamp string = "ramp"
+
+const volumeMax = 100
+
+// amixerMixer sets an ALSA mixer control
+type amixerMixer struct{}
+
+func (am *amixerMixer) setVolume(rt runtimeConfig, level int) error {
+	control := rt.settings.GetString(sMixerControl)
+	out, err := exec.Command("amixer", "-q", "sset", control, fmt.Sprintf("%d%%", level)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("amixer %s: %s %s", control, err.Error(), string(out))
+	}
+	return nil
+}
+
+// softwareMixer leaves the device alone, the players scale their output
+// by the level in rt.status.  the wav backend follows a change as it
+// plays, a command player only gets it when it starts (see liveGain).
+type softwareMixer struct{}
+
+func (sm *softwareMixer) setVolume(rt runtimeConfig, level int) error {
+	rt.status.gainPlaying(float64(level) / volumeMax)
+	return nil
+}
+
+func newMixer(settings configSettings) mixer {
+	switch settings.GetString(sVolumeControl) {
+	case volumeAmixer:
+		return &amixerMixer{}
+	default:
+		return &softwareMixer{}
+	}
+}
+
+// softwareGain is the scale players apply, 1 when the mixer does the work
+func softwareGain(rt runtimeConfig) float64 {
+	if rt.settings.GetString(sVolumeControl) != volumeSoftware {
+		return 1
+	}
+	return float64(rt.status.getVolume()) / volumeMax
+}
+
+// liveGain - a volume change is heard while a track plays.  the software
+// volume of a command player is on its command line, it stays as it was
+// until the next track.
+func liveGain(settings configSettings) bool {
+	return settings.GetString(sVolumeControl) != volumeSoftware || settings.GetString(sAudioBackend) == audioWav
+}
+
+// volumeProblems - a ramp needs a volume that can change as it plays
+func volumeProblems(s *configSettings) []string {
+	problems := []string{}
+	if s.GetDuration(sVolumeRamp) > 0 && !liveGain(*s) {
+		problems = append(problems, fmt.Sprintf("%s: %s needs %s %s (or the %s backend), the %s player's volume is set when a track starts",
+			s.source(sVolumeRamp), sVolumeRamp, sVolumeControl, volumeAmixer, audioWav, s.GetString(sAudioBackend)))
+	}
+	return problems
+}
+
+func toVolume(val interface{}) (int, error) {
+	level, err := toInt(val)
+	if err != nil {
+		return -1, err
+	}
+	if level < 0 || level > volumeMax {
+		return -1, fmt.Errorf("Volume must be 0 - %d: %d", volumeMax, level)
+	}
+	return level, nil
+}
+
+// volumeEffect - change the volume, the effects thread owns it
+func volumeEffect(level int) displayEffect {
+	return displayEffect{id: eVolume, val: level}
+}
+
+// volumeRamp moves the volume from one level to another over time, it
+// is stepped by the effects loop
+type volumeRamp struct {
+	from   int
+	to     int
+	start  time.Time
+	d      time.Duration
+	level  int  // last level set
+	failed bool // the mixer failed, stop trying
+}
+
+// newVolumeRamp starts the volume for an alarm, the alarm's options win
+// over the settings
+func newVolumeRamp(rt runtimeConfig, alm *alarm) *volumeRamp {
+	to := rt.settings.GetInt(sVolume)
+	if opt := alm.option(optVolume); opt != "" {
+		if level, err := toVolume(opt); err == nil {
+			to = level
+		} else {
+			rt.logger.Printf("Bad alarm volume: %s", err.Error())
+		}
+	}
+	d := rt.settings.GetDuration(sVolumeRamp)
+	if opt := alm.option(optRamp); opt != "" {
+		if ramp, err := time.ParseDuration(opt); err == nil {
+			d = ramp
+		} else {
+			rt.logger.Printf("Bad alarm ramp: %s", err.Error())
+		}
+	}
+	if d > 0 && !liveGain(rt.settings) {
+		rt.logger.Printf("No ramp, the %s player's software volume is set when a track starts", rt.settings.GetString(sAudioBackend))
+		d = 0
+	}
+	from := to
+	if d > 0 {
+		from = rt.settings.GetInt(sVolumeStart)
+	}
+	rt.logger.Printf("Volume %d -> %d over %v", from, to, d)
+	v := &volumeRamp{from: from, to: to, start: rt.clock.Now(), d: d, level: -1}
+	rt.status.setVolumeTarget(to)
+	v.step(rt)
+	return v
+}
+
+// set jumps straight to level, ending any ramp
+func (v *volumeRamp) set(rt runtimeConfig, level int) {
+	v.from = level
+	v.to = level
+	v.d = 0
+	v.failed = false
+	rt.status.setVolumeTarget(level)
+	v.step(rt)
+}
+
+func (v *volumeRamp) step(rt runtimeConfig) {
+	level := v.to
+	if elapsed := rt.clock.Now().Sub(v.start); v.d > 0 && elapsed < v.d {
+		level = v.from + int(float64(v.to-v.from)*float64(elapsed)/float64(v.d))
+	}
+	if level == v.level || v.failed {
+		return
+	}
+	v.level = level
+	if err := applyVolume(rt, level); err != nil {
+		v.failed = true
+	}
+}
+
+// setVolumeLevel heads straight to level, no ramp
+func setVolumeLevel(rt runtimeConfig, level int) {
+	rt.status.setVolumeTarget(level)
+	applyVolume(rt, level)
+}
+
+// applyVolume sets the mixer and records the level, failures are
+// reported like any other audio failure
+func applyVolume(rt runtimeConfig, level int) error {
+	rt.status.setVolume(level)
+	err := rt.mixer.setVolume(rt, level)
+	if err != nil {
+		reportAudio(rt, err)
+	}
+	return err
+}
+
+// volume tokens for command templates
+func volumeArgs(rt runtimeConfig) map[string]string {
+	gain := softwareGain(rt)
+	return map[string]string{
+		"{volume}": strconv.Itoa(int(gain * volumeMax)),
+		// mpg123 -f, 32768 is full scale
+		"{scale}": strconv.Itoa(int(gain * 32768)),
+	}
+}
+
+type volumeStatus struct {
+	Level   int    `json:"level"`
+	Target  int    `json:"target"`
+	Control string `json:"control"`
+}
+
+func (m *APIHandler) getVolumeStatus() volumeStatus {
+	return volumeStatus{
+		Level:   m.rt.status.getVolume(),
+		Target:  m.rt.status.getVolumeTarget(),
+		Control: m.rt.settings.GetString(sVolumeControl),
+	}
+}
+
+func (m *APIHandler) apiVolume(w http.ResponseWriter, r *http.Request) {
+	output, _ := json.Marshal(m.getVolumeStatus())
+	w.Write(output)
+}
+
+// apiSetVolume takes {"level": 0-100}, it also ends a ramp
+func (m *APIHandler) apiSetVolume(w http.ResponseWriter, r *http.Request) {
+	var req map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	level, err := toVolume(req["level"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.rt.comms.effects <- volumeEffect(level)
+
+	status := m.getVolumeStatus()
+	status.Target = level
+	output, _ := json.Marshal(status)
+	w.Write(output)
+}
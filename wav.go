@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// just enough WAV (RIFF, PCM) to read what we play and write what we
+// would have played
+type wavFormat struct {
+	channels      uint16
+	sampleRate    uint32
+	bitsPerSample uint16
+}
+
+type wavData struct {
+	format wavFormat
+	pcm    []byte
+}
+
+func (f wavFormat) frameSize() int {
+	return int(f.channels) * int(f.bitsPerSample) / 8
+}
+
+// duration of n bytes of pcm
+func (f wavFormat) duration(n int) time.Duration {
+	frames := n / f.frameSize()
+	return time.Duration(frames) * time.Second / time.Duration(f.sampleRate)
+}
+
+// bytes of pcm played in d, whole frames only
+func (f wavFormat) bytesIn(d time.Duration) int {
+	frames := int64(d) * int64(f.sampleRate) / int64(time.Second)
+	return int(frames) * f.frameSize()
+}
+
+// parseWavFormat reads the body of the "fmt " chunk
+func parseWavFormat(body []byte) (wavFormat, error) {
+	if len(body) < 16 {
+		return wavFormat{}, fmt.Errorf("Bad WAV format chunk")
+	}
+	if binary.LittleEndian.Uint16(body) != 1 {
+		return wavFormat{}, fmt.Errorf("Only PCM WAV files are supported")
+	}
+	format := wavFormat{
+		channels:      binary.LittleEndian.Uint16(body[2:]),
+		sampleRate:    binary.LittleEndian.Uint32(body[4:]),
+		bitsPerSample: binary.LittleEndian.Uint16(body[14:]),
+	}
+	if format.frameSize() == 0 || format.sampleRate == 0 {
+		return format, fmt.Errorf("Bad WAV format: %+v", format)
+	}
+	return format, nil
+}
+
+func parseWav(data []byte) (*wavData, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, fmt.Errorf("Not a WAV file")
+	}
+	wav := &wavData{}
+	haveFormat := false
+	pos := 12
+	for pos+8 <= len(data) {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		body := pos + 8
+		if body+size > len(data) {
+			// truncated, take what is there
+			size = len(data) - body
+		}
+		switch id {
+		case "fmt ":
+			format, err := parseWavFormat(data[body : body+size])
+			if err != nil {
+				return nil, err
+			}
+			wav.format = format
+			haveFormat = true
+		case "data":
+			if !haveFormat {
+				return nil, fmt.Errorf("WAV data before format")
+			}
+			wav.pcm = data[body : body+size]
+			return wav, nil
+		}
+		// chunks are word aligned
+		pos = body + size + size%2
+	}
+	return nil, fmt.Errorf("No WAV data")
+}
+
+func readWav(fName string) (*wavData, error) {
+	data, err := ioutil.ReadFile(fName)
+	if err != nil {
+		return nil, err
+	}
+	wav, err := parseWav(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fName, err.Error())
+	}
+	return wav, nil
+}
+
+func isWav(fName string) bool {
+	f, err := os.Open(fName)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+	return string(header[0:4]) == "RIFF" && string(header[8:12]) == "WAVE"
+}
+
+// decodeWav runs the decoder command template on fName, it writes the
+// audio to stdout as a WAV
+func decodeWav(decoder string, fName string) (*wavData, error) {
+	cb, err := newCommandBackend(decoder)
+	if err != nil {
+		return nil, err
+	}
+	args := cb.command(fName, nil)
+	var stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s %s", args[0], err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	wav, err := parseWav(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s from %s: %s", fName, args[0], err.Error())
+	}
+	return wav, nil
+}
+
+func writeWavHeader(w io.Writer, format wavFormat, dataSize int) error {
+	frameSize := uint16(format.frameSize())
+	header := []interface{}{
+		[]byte("RIFF"), uint32(36 + dataSize), []byte("WAVE"),
+		[]byte("fmt "), uint32(16), uint16(1), format.channels, format.sampleRate,
+		format.sampleRate * uint32(frameSize), frameSize, format.bitsPerSample,
+		[]byte("data"), uint32(dataSize),
+	}
+	for _, v := range header {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encode returns the whole file
+func (wav *wavData) encode() []byte {
+	var buf bytes.Buffer
+	writeWavHeader(&buf, wav.format, len(wav.pcm))
+	buf.Write(wav.pcm)
+	return buf.Bytes()
+}
+
+// appendWav adds pcm to the end of fName, creating it if needed
+func appendWav(fName string, format wavFormat, pcm []byte) error {
+	existing, err := ioutil.ReadFile(fName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	wav := &wavData{format: format}
+	if len(existing) > 0 {
+		if wav, err = parseWav(existing); err != nil {
+			return fmt.Errorf("%s: %s", fName, err.Error())
+		}
+		if wav.format != format {
+			return fmt.Errorf("%s: format %+v does not match %+v", fName, wav.format, format)
+		}
+	}
+	wav.pcm = append(wav.pcm, pcm...)
+	return ioutil.WriteFile(fName, wav.encode(), 0644)
+}
+
+// scaled - a copy of the 16 bit pcm at gain
+func (wav *wavData) scaled(gain float64) *wavData {
+	if gain == 1 || wav.format.bitsPerSample != 16 {
+		return wav
+	}
+	pcm := make([]byte, len(wav.pcm))
+	for i := 0; i+1 < len(pcm); i += 2 {
+		sample := float64(int16(binary.LittleEndian.Uint16(wav.pcm[i:])))
+		binary.LittleEndian.PutUint16(pcm[i:], uint16(int16(sample*gain)))
+	}
+	return &wavData{format: wav.format, pcm: pcm}
+}
+
+// wavGain - the software volume from a point in the file on
+type wavGain struct {
+	at   time.Duration
+	gain float64
+}
+
+// wavBackend "plays" WAV files in rt.clock time by appending what was
+// heard to the sink file, a stop part way through is a partial write.
+// the software volume is applied to each part at the level it was
+// played at, a ramp is heard as it goes.  any other file is turned into a
+// WAV by the decoder first.
+type wavBackend struct {
+	sink    string
+	decoder string // command template, "" -> only WAV files play
+}
+
+func (wb *wavBackend) start(rt runtimeConfig, fName string) (audioProcess, error) {
+	var wav *wavData
+	var err error
+	switch {
+	case isWav(fName):
+		wav, err = readWav(fName)
+	case wb.decoder == "":
+		_, err = readWav(fName)
+	default:
+		wav, err = decodeWav(wb.decoder, fName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rt.logger.Printf("Playing %s into %s (%v)", fName, wb.sink, wav.format.duration(len(wav.pcm)))
+	return &wavProcess{
+		rt:      rt,
+		sink:    wb.sink,
+		wav:     wav,
+		gains:   []wavGain{{gain: softwareGain(rt)}},
+		start:   rt.clock.Now(),
+		killed:  make(chan bool, 1),
+		pauses:  make(chan bool, 1),
+		timeout: rt.clock.After(wav.format.duration(len(wav.pcm))),
+	}, nil
+}
+
+// wavProcess plays in rt.clock time, a pause stops the clock on it.  the
+// time played is counted as pause and resume are called so it does not
+// matter when wait gets to them.
+type wavProcess struct {
+	rt      runtimeConfig
+	sink    string
+	wav     *wavData
+	gains   []wavGain // in the order they were set
+	killed  chan bool
+	pauses  chan bool // something changed paused
+	timeout <-chan time.Time
+	once    sync.Once
+	lock    sync.Mutex
+	start   time.Time     // of the current run, between pauses
+	played  time.Duration // before the current run
+	paused  bool
+	runs    int // resumes so far, a timeout from an earlier run is stale
+}
+
+// heard - how much has played so far
+func (wp *wavProcess) heard() time.Duration {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+	return wp.heardLocked()
+}
+
+func (wp *wavProcess) heardLocked() time.Duration {
+	if wp.paused {
+		return wp.played
+	}
+	return wp.played + wp.rt.clock.Now().Sub(wp.start)
+}
+
+// mixed - the pcm with each part at the gain it was played at
+func (wp *wavProcess) mixed(pcm []byte) []byte {
+	wp.lock.Lock()
+	gains := append([]wavGain{}, wp.gains...)
+	wp.lock.Unlock()
+
+	out := make([]byte, 0, len(pcm))
+	for i, g := range gains {
+		from := wp.wav.format.bytesIn(g.at)
+		to := len(pcm)
+		if i+1 < len(gains) {
+			to = wp.wav.format.bytesIn(gains[i+1].at)
+		}
+		if from > len(pcm) {
+			break
+		}
+		if to > len(pcm) {
+			to = len(pcm)
+		}
+		part := &wavData{format: wp.wav.format, pcm: pcm[from:to]}
+		out = append(out, part.scaled(g.gain).pcm...)
+	}
+	return out
+}
+
+func (wp *wavProcess) wait() error {
+	pcm := wp.wav.pcm
+	total := wp.wav.format.duration(len(pcm))
+	timeout := wp.timeout
+	run := 0
+	for {
+		select {
+		case <-timeout:
+			wp.lock.Lock()
+			finished := !wp.paused && wp.runs == run
+			wp.lock.Unlock()
+			if finished {
+				return appendWav(wp.sink, wp.wav.format, wp.mixed(pcm))
+			}
+			timeout = nil
+		case <-wp.killed:
+			if n := wp.wav.format.bytesIn(wp.heard()); n < len(pcm) {
+				pcm = pcm[:n]
+			}
+			return appendWav(wp.sink, wp.wav.format, wp.mixed(pcm))
+		case <-wp.pauses:
+		}
+
+		wp.lock.Lock()
+		if wp.paused {
+			timeout = nil
+		} else if timeout == nil || wp.runs != run {
+			run = wp.runs
+			timeout = wp.rt.clock.After(total - wp.played)
+		}
+		wp.lock.Unlock()
+	}
+}
+
+func (wp *wavProcess) kill() {
+	wp.once.Do(func() {
+		wp.killed <- true
+	})
+}
+
+func (wp *wavProcess) setPaused(paused bool) {
+	wp.lock.Lock()
+	if paused == wp.paused {
+		wp.lock.Unlock()
+		return
+	}
+	now := wp.rt.clock.Now()
+	if paused {
+		wp.played += now.Sub(wp.start)
+	} else {
+		wp.start = now
+		wp.runs++
+	}
+	wp.paused = paused
+	wp.lock.Unlock()
+	select {
+	case wp.pauses <- true:
+	default:
+		// wait has not seen the last one yet, it will see this too
+	}
+}
+
+func (wp *wavProcess) pause() {
+	wp.setPaused(true)
+}
+
+func (wp *wavProcess) resume() {
+	wp.setPaused(false)
+}
+
+// setGain - the rest of the file plays at gain
+func (wp *wavProcess) setGain(gain float64) {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+	at := wp.heardLocked()
+	// a change at the same point replaces the one before
+	if last := len(wp.gains) - 1; wp.gains[last].at == at {
+		wp.gains[last].gain = gain
+		return
+	}
+	wp.gains = append(wp.gains, wavGain{at: at, gain: gain})
+}
+
+// readWavHeader reads up to the start of the pcm, for streams where the
+// data size is unknown
+func readWavHeader(r *bufio.Reader) (wavFormat, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return wavFormat{}, err
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return wavFormat{}, fmt.Errorf("Not a WAV stream")
+	}
+	var format wavFormat
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return format, err
+		}
+		size := int(binary.LittleEndian.Uint32(chunk[4:]))
+		switch string(chunk[0:4]) {
+		case "data":
+			if format.frameSize() == 0 || format.sampleRate == 0 {
+				return format, fmt.Errorf("WAV data before format")
+			}
+			return format, nil
+		case "fmt ":
+			body := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return format, err
+			}
+			var err error
+			if format, err = parseWavFormat(body[:size]); err != nil {
+				return format, err
+			}
+		default:
+			if _, err := io.CopyN(ioutil.Discard, r, int64(size+size%2)); err != nil {
+				return format, err
+			}
+		}
+	}
+}
+
+// stream appends a WAV stream to the sink as it arrives, it plays at the
+// pace of the stream not rt.clock
+func (wb *wavBackend) stream(rt runtimeConfig, body io.ReadCloser) (audioProcess, error) {
+	r := bufio.NewReader(body)
+	format, err := readWavHeader(r)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	rt.logger.Printf("Streaming into %s", wb.sink)
+	wp := &wavStreamProcess{sink: wb.sink, format: format, gain: softwareGain(rt), r: r, body: body}
+	wp.held = sync.NewCond(&wp.lock)
+	return wp, nil
+}
+
+type wavStreamProcess struct {
+	sink   string
+	format wavFormat
+	gain   float64
+	r      io.Reader
+	body   io.Closer
+	lock   sync.Mutex
+	held   *sync.Cond // signalled when paused or killed change
+	paused bool
+	killed bool
+}
+
+func (wp *wavStreamProcess) wait() error {
+	defer wp.body.Close()
+	buf := make([]byte, 4096)
+	var partial []byte
+	for {
+		// a paused stream is not read, it backs up in the network
+		wp.lock.Lock()
+		for wp.paused && !wp.killed {
+			wp.held.Wait()
+		}
+		wp.lock.Unlock()
+
+		n, err := wp.r.Read(buf)
+		// whole frames only, a short read keeps the rest for later
+		pending := append(partial, buf[:n]...)
+		whole := len(pending) - len(pending)%wp.format.frameSize()
+		if whole > 0 {
+			wp.lock.Lock()
+			gain := wp.gain
+			wp.lock.Unlock()
+			pcm := (&wavData{format: wp.format, pcm: pending[:whole]}).scaled(gain).pcm
+			if werr := appendWav(wp.sink, wp.format, pcm); werr != nil {
+				return werr
+			}
+		}
+		partial = append([]byte{}, pending[whole:]...)
+		if err != nil {
+			wp.lock.Lock()
+			defer wp.lock.Unlock()
+			if wp.killed || err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (wp *wavStreamProcess) kill() {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+	wp.killed = true
+	wp.body.Close()
+	wp.held.Broadcast()
+}
+
+func (wp *wavStreamProcess) pause() {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+	wp.paused = true
+}
+
+func (wp *wavStreamProcess) resume() {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+	wp.paused = false
+	wp.held.Broadcast()
+}
+
+// setGain - what is read from now on plays at gain
+func (wp *wavStreamProcess) setGain(gain float64) {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+	wp.gain = gain
+}